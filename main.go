@@ -1,244 +1,11980 @@
-
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"image"
+	"image/color"
+	_ "image/gif" // Registers GIF decoding for image downscaling
+	"image/jpeg"
+	"image/png"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 )
 
 // This directive tells Go to embed the "static" folder into the binary
 //go:embed static
 var staticFiles embed.FS
 
-// Base URL for the Ollama API
+// Default base URL for the Ollama API (used when no route matches)
 const ollamaBaseURL = "http://localhost:11434"
-const ollamaGenerateAPI = ollamaBaseURL + "/api/generate"
-const ollamaChatAPI = ollamaBaseURL + "/api/chat"
-const ollamaTagsAPI = ollamaBaseURL + "/api/tags"
-const ollamaPullAPI = ollamaBaseURL + "/api/pull"
-const ollamaDeleteAPI = ollamaBaseURL + "/api/delete"
+
+// Ollama API paths, appended to whichever backend a request is routed to
+const ollamaGenerateAPI = "/api/generate"
+const ollamaChatAPI = "/api/chat"
+const ollamaTagsAPI = "/api/tags"
+const ollamaPullAPI = "/api/pull"
+const ollamaDeleteAPI = "/api/delete"
+const ollamaShowAPI = "/api/show"
+const ollamaCreateAPI = "/api/create"
+const ollamaCopyAPI = "/api/copy"
+const ollamaPushAPI = "/api/push"
+const ollamaPsAPI = "/api/ps"
+const ollamaEmbedAPI = "/api/embed"
 
 // --- API Request/Response Structures ---
 
 type OllamaGenerateRequestPayload struct {
-	Model   string                 `json:"model"`
-	Prompt  string                 `json:"prompt"`
-	Stream  bool                   `json:"stream"`
-	Options map[string]interface{} `json:"options,omitempty"`
+	Model     string                 `json:"model"`
+	Prompt    string                 `json:"prompt"`
+	System    string                 `json:"system,omitempty"`
+	Images    []string               `json:"images,omitempty"`
+	Format    json.RawMessage        `json:"format,omitempty"`
+	Stream    bool                   `json:"stream"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive json.RawMessage        `json:"keep_alive,omitempty"`
 }
 
 type OllamaChatRequestPayload struct {
-	Model    string                 `json:"model"`
-	Messages []Message              `json:"messages"`
-	Stream   bool                   `json:"stream"`
-	Options  map[string]interface{} `json:"options,omitempty"`
+	Model     string                 `json:"model"`
+	Messages  []Message              `json:"messages"`
+	Tools     []Tool                 `json:"tools,omitempty"`
+	Format    json.RawMessage        `json:"format,omitempty"`
+	Stream    bool                   `json:"stream"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive json.RawMessage        `json:"keep_alive,omitempty"`
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Images    []string   `json:"images,omitempty"`     // User messages: attached images, base64-encoded
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"` // Assistant messages requesting tool calls
+	ToolName  string     `json:"tool_name,omitempty"`  // Tool messages: which tool produced the content
+	Name      string     `json:"name,omitempty"`       // Round-table assistant messages: which participant wrote it
+}
+
+// Tool is a function definition offered to the model (Ollama's "tools" field).
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"` // JSON schema of the arguments
+}
+
+type ToolCall struct {
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string                 `json:"name"`
+	Arguments map[string]interface{} `json:"arguments"`
 }
 
 type OllamaModelActionPayload struct {
 	Name string `json:"name"`
 }
 
+// OllamaCreatePayload derives a new model from an existing one (Ollama's structured create API).
+type OllamaCreatePayload struct {
+	Model      string                 `json:"model"`
+	From       string                 `json:"from"`
+	System     string                 `json:"system,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Stream     bool                   `json:"stream"`
+}
+
+type OllamaCopyPayload struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+type OllamaPushPayload struct {
+	Model  string `json:"model"`
+	Stream bool   `json:"stream"`
+}
+
+// OllamaUnloadPayload is an empty generate request; keep_alive 0 makes Ollama evict the model.
+type OllamaUnloadPayload struct {
+	Model     string `json:"model"`
+	KeepAlive int    `json:"keep_alive"`
+	Stream    bool   `json:"stream"`
+}
+
 type OllamaResponseChunk struct {
 	Model    string   `json:"model"`
-	Response string   `json:"response"` // For generate API
-	Message  *Message `json:"message"`  // For chat API
+	Response string   `json:"response"`          // For generate API
+	Message  *Message `json:"message,omitempty"` // For chat API
 	Done     bool     `json:"done"`
+
+	DoneReason string `json:"done_reason,omitempty"` // "stop", or "length" when num_predict was reached
+
+	// Statistics, only present on the final chunk (durations in nanoseconds)
+	TotalDuration      int64 `json:"total_duration,omitempty"`
+	LoadDuration       int64 `json:"load_duration,omitempty"`
+	PromptEvalCount    int   `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int   `json:"eval_count,omitempty"`
+	EvalDuration       int64 `json:"eval_duration,omitempty"`
 }
 
+// ClientRequest is the only shape accepted on /api/ollama-action. Unknown fields are rejected
+// and every field is validated, so the proxy can't be used as an arbitrary Ollama relay.
 type ClientRequest struct {
-	ActionType string                 `json:"actionType"` // "generate", "chat", "pull", "delete"
+	ActionType string                 `json:"actionType"` // "generate", "chat", "longform", "roundtable", "pull", "delete", "unload", "create", "copy", "push"
 	Model      string                 `json:"model"`
-	Prompt     string                 `json:"prompt"`   // For generate API
-	Messages   []Message              `json:"messages"` // For chat API
+	Prompt     string                 `json:"prompt"`           // For generate API
+	Images     []string               `json:"images,omitempty"` // For generate API, base64-encoded
+	Format     json.RawMessage        `json:"format,omitempty"` // For generate and chat: "json" or a JSON schema
+	Messages   []Message              `json:"messages"`         // For chat API
+	Tools      []Tool                 `json:"tools,omitempty"`  // For chat API; see the Tool Calling section
 	Options    map[string]interface{} `json:"options,omitempty"`
+	KeepAlive  json.RawMessage        `json:"keep_alive,omitempty"` // How long the model stays loaded afterwards: "10m", seconds, 0 or -1
+
+	Schedule        []ScheduleStep `json:"schedule,omitempty"`         // For chat: options that change as the answer grows
+	AutoTemperature bool           `json:"auto_temperature,omitempty"` // For generate and chat: pick the temperature by task type
+	Candidates      int            `json:"candidates,omitempty"`       // For generate and chat: write this many answers at once (best-of-N)
+	Pick            string         `json:"pick,omitempty"`             // With candidates: "first" (default) or "judge" to let the model choose
+
+	Participants []RoundTableParticipant `json:"participants,omitempty"` // For roundtable: the models taking turns
+	Rounds       int                     `json:"rounds,omitempty"`       // For roundtable: turns each participant takes (default 1)
+
+	PromptID  string            `json:"promptId,omitempty"`  // Persona or template from the prompt library
+	Variables map[string]string `json:"variables,omitempty"` // Values for the template's {{variables}}
+
+	EnableWebSearch bool `json:"enable_web_search,omitempty"` // For chat API: ground the answer in web search results
+
+	Files []ContextFile `json:"files,omitempty"` // For chat API: text files and archives the model should read
+
+	// For generate, chat, longform and roundtable: keep the conversation out of everything LAIM
+	// derives from traffic (quality samples, debug captures)
+	Private bool `json:"private,omitempty"`
+
+	From        string `json:"from,omitempty"`        // For create: the base model
+	System      string `json:"system,omitempty"`      // For create: system prompt baked into the new model
+	Destination string `json:"destination,omitempty"` // For copy: name of the copy
 }
 
 type OllamaModel struct {
-	Name string `json:"name"`
+	Name    string             `json:"name"`
+	Size    int64              `json:"size,omitempty"` // Bytes on disk, which is about what the weights take in memory
+	Details OllamaModelDetails `json:"details"`
+}
+
+// OllamaModelDetails is the details object of a /api/tags entry.
+type OllamaModelDetails struct {
+	Family            string `json:"family,omitempty"`
+	ParameterSize     string `json:"parameter_size,omitempty"`     // e.g. "7.2B" or "137M"
+	QuantizationLevel string `json:"quantization_level,omitempty"` // e.g. "Q4_K_M", "Q8_0", "F16"
 }
 
 type OllamaTagsResponse struct {
 	Models []OllamaModel `json:"models"`
 }
 
-// --- Main Server Logic ---
-
-func main() {
-	// serveRoot handles the index.html
-	http.HandleFunc("/", serveRoot)
+// --- Request Validation ---
 
-	// This serves the static CSS and JS files
-	// It automatically looks inside the embedded 'static' folder
-	http.Handle("/static/", http.FileServer(http.FS(staticFiles)))
+const maxRequestBytes = 32 << 20 // Room for a few base64-encoded images
+const maxImageBytes = 10 << 20
+const maxSystemPromptBytes = 64 << 10
 
-	http.HandleFunc("/api/ollama-action", handleOllamaAction)
-	http.HandleFunc("/api/models", handleListModels)
+var modelNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._\-/]*(:[A-Za-z0-9._\-]+)?$`)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+var validRoles = map[string]bool{"system": true, "user": true, "assistant": true, "tool": true}
 
-	log.Printf("Server starting on http://localhost:%s", port)
-	log.Printf("Make sure Ollama is running on %s", ollamaBaseURL)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
-}
+var toolNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,63}$`)
 
-func serveRoot(w http.ResponseWriter, r *http.Request) {
-	// If the path isn't root (and hasn't been caught by /static/), return 404
-	if r.URL.Path != "/" && r.URL.Path != "/index.html" {
-		http.NotFound(w, r)
-		return
-	}
+// optionKind is the JSON type accepted for an Ollama generation option.
+type optionKind int
 
-	// Read the index.html from the embedded file system
-	content, err := staticFiles.ReadFile("static/index.html")
-	if err != nil {
-		http.Error(w, "Could not load UI", http.StatusInternalServerError)
-		log.Printf("Error reading index.html: %v", err)
-		return
-	}
+const (
+	numberOption optionKind = iota
+	intOption
+	boolOption
+	stringListOption
+)
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write(content)
+// allowedOptions whitelists the Ollama model options clients may set.
+var allowedOptions = map[string]optionKind{
+	"num_keep":          intOption,
+	"seed":              intOption,
+	"num_predict":       intOption,
+	"top_k":             intOption,
+	"top_p":             numberOption,
+	"min_p":             numberOption,
+	"typical_p":         numberOption,
+	"repeat_last_n":     intOption,
+	"temperature":       numberOption,
+	"repeat_penalty":    numberOption,
+	"presence_penalty":  numberOption,
+	"frequency_penalty": numberOption,
+	"penalize_newline":  boolOption,
+	"stop":              stringListOption,
+	"num_ctx":           intOption,
+	"num_batch":         intOption,
+	"num_gpu":           intOption,
+	"main_gpu":          intOption,
+	"num_thread":        intOption,
+	"mirostat":          intOption,
+	"mirostat_tau":      numberOption,
+	"mirostat_eta":      numberOption,
+	"tfs_z":             numberOption,
 }
 
-// handleOllamaAction is a unified handler for all Ollama API interactions.
-func handleOllamaAction(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// decodeClientRequest strictly decodes and validates a ClientRequest.
+func decodeClientRequest(w http.ResponseWriter, r *http.Request) (ClientRequest, error) {
+	var clientReq ClientRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&clientReq); err != nil {
+		return clientReq, err
 	}
+	return clientReq, validateClientRequest(clientReq)
+}
 
-	var clientReq ClientRequest
-	if err := json.NewDecoder(r.Body).Decode(&clientReq); err != nil {
-		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
-		return
+func validateClientRequest(req ClientRequest) error {
+	if !modelNamePattern.MatchString(req.Model) || len(req.Model) > 200 {
+		return fmt.Errorf("invalid model name %q", req.Model)
 	}
 
-	client := &http.Client{Timeout: 300 * time.Second}
+	if req.Model == autoModel && req.ActionType != "generate" && req.ActionType != "chat" {
+		return fmt.Errorf("model %q is only supported for generate and chat", autoModel)
+	}
+	if len(req.Files) > 0 && req.ActionType != "chat" {
+		return errors.New("files are only supported for chat")
+	}
+	if req.Private && req.ActionType != "generate" && req.ActionType != "chat" && req.ActionType != "longform" && req.ActionType != "roundtable" {
+		return errors.New("private is only supported for generate, chat, longform and roundtable")
+	}
+	if err := validateContextFiles(req.Files); err != nil {
+		return err
+	}
 
-	switch clientReq.ActionType {
+	switch req.ActionType {
 	case "generate":
-		callGenerateAPI(w, r, clientReq, client)
+		if strings.TrimSpace(req.Prompt) == "" && len(req.Images) == 0 {
+			return errors.New("prompt is required")
+		}
+		if len(req.Messages) > 0 {
+			return errors.New("messages are not allowed for generate")
+		}
+		if err := validateImages(req.Images); err != nil {
+			return err
+		}
+		if err := validateFormat(req.Format); err != nil {
+			return err
+		}
+	case "longform":
+		if strings.TrimSpace(req.Prompt) == "" {
+			return errors.New("prompt is required")
+		}
+		if len(req.Messages) > 0 || len(req.Images) > 0 || len(req.Format) > 0 || req.PromptID != "" || len(req.Variables) > 0 {
+			return errors.New("messages, images, format, promptId and variables are not allowed for longform")
+		}
 	case "chat":
-		callChatAPI(w, r, clientReq, client)
-	case "pull":
-		callModelPullAPI(w, r, clientReq, client)
-	case "delete":
-		callModelDeleteAPI(w, r, clientReq, client)
+		if len(req.Messages) == 0 {
+			return errors.New("messages are required")
+		}
+		for i, m := range req.Messages {
+			if !validRoles[m.Role] {
+				return fmt.Errorf("message %d: invalid role %q", i, m.Role)
+			}
+			if err := validateImages(m.Images); err != nil {
+				return fmt.Errorf("message %d: %v", i, err)
+			}
+		}
+		for i, t := range req.Tools {
+			if t.Type != "function" || !toolNamePattern.MatchString(t.Function.Name) {
+				return fmt.Errorf("tool %d: must be a function with a valid name", i)
+			}
+		}
+		if req.Prompt != "" || len(req.Images) > 0 {
+			return errors.New("prompt and images are not allowed for chat")
+		}
+		if err := validateFormat(req.Format); err != nil {
+			return err
+		}
+		if len(req.Format) > 0 && len(req.Tools) > 0 {
+			return errors.New("format cannot be combined with tools")
+		}
+	case "roundtable":
+		if len(req.Messages) == 0 {
+			return errors.New("messages are required")
+		}
+		for i, m := range req.Messages {
+			if !validRoles[m.Role] || m.Role == "tool" {
+				return fmt.Errorf("message %d: invalid role %q", i, m.Role)
+			}
+			if len(m.Images) > 0 {
+				return fmt.Errorf("message %d: images are not allowed for roundtable", i)
+			}
+		}
+		if req.Prompt != "" || len(req.Images) > 0 || len(req.Format) > 0 || req.PromptID != "" {
+			return errors.New("prompt, images, format and promptId are not allowed for roundtable (participants have their own persona)")
+		}
+		if err := validateRoundTable(req.Participants, req.Rounds); err != nil {
+			return err
+		}
+	case "pull", "delete", "unload":
+		if req.PromptID != "" || len(req.Variables) > 0 {
+			return fmt.Errorf("%s does not use prompts", req.ActionType)
+		}
+		if req.Prompt != "" || len(req.Messages) > 0 || len(req.Images) > 0 || len(req.Format) > 0 || len(req.Options) > 0 {
+			return fmt.Errorf("%s only accepts a model name", req.ActionType)
+		}
+	case "create":
+		if !modelNamePattern.MatchString(req.From) || len(req.From) > 200 {
+			return errors.New("from must name the base model")
+		}
+		if len(req.System) > maxSystemPromptBytes {
+			return fmt.Errorf("system prompt exceeds %d bytes", maxSystemPromptBytes)
+		}
+		if req.Prompt != "" || len(req.Messages) > 0 || len(req.Images) > 0 || len(req.Format) > 0 || req.PromptID != "" || len(req.Variables) > 0 {
+			return errors.New("create only accepts model, from, system and options")
+		}
+	case "copy":
+		if !modelNamePattern.MatchString(req.Destination) || len(req.Destination) > 200 {
+			return errors.New("destination must be a valid model name")
+		}
+		if req.Prompt != "" || len(req.Messages) > 0 || len(req.Images) > 0 || len(req.Format) > 0 || len(req.Options) > 0 || req.PromptID != "" || len(req.Variables) > 0 {
+			return errors.New("copy only accepts model and destination")
+		}
+	case "push":
+		if !strings.Contains(req.Model, "/") {
+			return errors.New("push needs a namespaced model name, e.g. username/model")
+		}
+		if req.Prompt != "" || len(req.Messages) > 0 || len(req.Images) > 0 || len(req.Format) > 0 || len(req.Options) > 0 || req.PromptID != "" || len(req.Variables) > 0 {
+			return errors.New("push only accepts a model name")
+		}
 	default:
-		http.Error(w, "Unknown action type: "+clientReq.ActionType, http.StatusBadRequest)
+		return fmt.Errorf("unknown action type: %q", req.ActionType)
 	}
-}
 
-func callGenerateAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
-	ollamaReq := OllamaGenerateRequestPayload{
-		Model:   clientReq.Model,
-		Prompt:  clientReq.Prompt,
-		Stream:  true,
-		Options: clientReq.Options,
+	if req.ActionType != "create" && (req.From != "" || req.System != "") {
+		return errors.New("from and system are only supported for create")
+	}
+	if req.ActionType != "copy" && req.Destination != "" {
+		return errors.New("destination is only supported for copy")
+	}
+	if req.PromptID == "" && len(req.Variables) > 0 {
+		return errors.New("variables require a promptId")
+	}
+	if req.ActionType != "roundtable" && (len(req.Participants) > 0 || req.Rounds != 0) {
+		return errors.New("participants and rounds are only supported for roundtable")
+	}
+	if req.ActionType != "chat" && len(req.Tools) > 0 {
+		return errors.New("tools are only supported for chat")
+	}
+	if req.ActionType != "chat" && req.EnableWebSearch {
+		return errors.New("enable_web_search is only supported for chat")
+	}
+	if len(req.Schedule) > 0 {
+		if req.ActionType != "chat" {
+			return errors.New("schedule is only supported for chat")
+		}
+		if len(req.Tools) > 0 || len(req.Format) > 0 {
+			return errors.New("schedule cannot be combined with tools or format")
+		}
+		if err := validateSchedule(req.Schedule); err != nil {
+			return err
+		}
+	}
+	if req.AutoTemperature && req.ActionType != "generate" && req.ActionType != "chat" {
+		return errors.New("auto_temperature is only supported for generate and chat")
+	}
+	if req.Candidates != 0 {
+		if req.ActionType != "generate" && req.ActionType != "chat" {
+			return errors.New("candidates is only supported for generate and chat")
+		}
+		if req.Candidates < 2 || req.Candidates > maxCandidates {
+			return fmt.Errorf("candidates must be between 2 and %d", maxCandidates)
+		}
+		if len(req.Tools) > 0 || len(req.Format) > 0 || len(req.Schedule) > 0 {
+			return errors.New("candidates cannot be combined with tools, format or schedule")
+		}
 	}
-	proxyStreamRequest(w, r, ollamaGenerateAPI, ollamaReq, client)
+	if req.Pick != "" {
+		if req.Candidates == 0 {
+			return errors.New("pick requires candidates")
+		}
+		if req.Pick != "first" && req.Pick != "judge" {
+			return fmt.Errorf("invalid pick %q (want \"first\" or \"judge\")", req.Pick)
+		}
+	}
+	if len(req.KeepAlive) > 0 {
+		if req.ActionType != "generate" && req.ActionType != "chat" && req.ActionType != "longform" && req.ActionType != "roundtable" {
+			return errors.New("keep_alive is only supported for generate, chat, longform and roundtable")
+		}
+		if err := validateKeepAlive(req.KeepAlive); err != nil {
+			return err
+		}
+	}
+	return validateOptions(req.Options)
 }
 
-func callChatAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
-	ollamaReq := OllamaChatRequestPayload{
-		Model:    clientReq.Model,
-		Messages: clientReq.Messages,
-		Stream:   true,
-		Options:  clientReq.Options,
+// validateKeepAlive accepts what Ollama does: a number of seconds or a Go duration string,
+// where 0 unloads the model right after the request and a negative value keeps it loaded.
+func validateKeepAlive(keepAlive json.RawMessage) error {
+	var seconds float64
+	if json.Unmarshal(keepAlive, &seconds) == nil {
+		return nil
 	}
-	proxyStreamRequest(w, r, ollamaChatAPI, ollamaReq, client)
+	var duration string
+	if json.Unmarshal(keepAlive, &duration) == nil {
+		if _, err := time.ParseDuration(duration); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("keep_alive must be a number of seconds or a duration like \"10m\", got %s", keepAlive)
 }
 
-// Generic helper to handle streaming requests (Generate and Chat)
-func proxyStreamRequest(w http.ResponseWriter, r *http.Request, apiUrl string, payload interface{}, client *http.Client) {
-	payloadBytes, _ := json.Marshal(payload)
-	req, _ := http.NewRequest(http.MethodPost, apiUrl, bytes.NewBuffer(payloadBytes))
-	req.Header.Set("Content-Type", "application/json")
+// imageTypes are the image formats vision models accept, as detected from the content.
+var imageTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "Ollama Connection Error: "+err.Error(), http.StatusBadGateway)
-		return
+func validateImages(images []string) error {
+	for i, img := range images {
+		if base64.StdEncoding.DecodedLen(len(img)) > maxImageBytes {
+			return fmt.Errorf("image %d exceeds %d MB", i, maxImageBytes>>20)
+		}
+		data, err := base64.StdEncoding.DecodeString(img)
+		if err != nil {
+			return fmt.Errorf("image %d is not valid base64", i)
+		}
+		// Go by the bytes, not by what the client says the file is
+		if detected := http.DetectContentType(data); !imageTypes[detected] {
+			return fmt.Errorf("image %d is %s, not a PNG, JPEG, GIF or WebP image", i, strings.SplitN(detected, ";", 2)[0])
+		}
 	}
-	defer resp.Body.Close()
+	return nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		http.Error(w, "Ollama API Error: "+string(body), resp.StatusCode)
-		return
+func validateFormat(format json.RawMessage) error {
+	if len(format) == 0 {
+		return nil
 	}
+	var asString string
+	if err := json.Unmarshal(format, &asString); err == nil {
+		if asString != "json" {
+			return fmt.Errorf("format must be \"json\" or a JSON schema object")
+		}
+		return nil
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(format, &schema); err != nil {
+		return fmt.Errorf("format must be \"json\" or a JSON schema object")
+	}
+	return nil
+}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	if f, ok := w.(http.Flusher); ok {
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			fmt.Fprintf(w, "data: %s\n\n", scanner.Text())
-			f.Flush()
+func validateOptions(options map[string]interface{}) error {
+	for key, value := range options {
+		kind, ok := allowedOptions[key]
+		if !ok {
+			return fmt.Errorf("option %q is not allowed", key)
+		}
+		valid := false
+		switch kind {
+		case numberOption:
+			_, valid = value.(float64)
+		case intOption:
+			f, isNumber := value.(float64)
+			valid = isNumber && f == float64(int64(f))
+		case boolOption:
+			_, valid = value.(bool)
+		case stringListOption:
+			list, isList := value.([]interface{})
+			valid = isList
+			for _, item := range list {
+				if _, isString := item.(string); !isString {
+					valid = false
+				}
+			}
+		}
+		if !valid {
+			return fmt.Errorf("option %q has an invalid value", key)
 		}
 	}
+	return nil
 }
 
-func callModelPullAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
-	// Pull Logic
-	proxyStandardRequest(w, ollamaPullAPI, OllamaModelActionPayload{Name: clientReq.Model}, client)
+// --- Configuration ---
+
+// Config is loaded from the JSON file named by the CONFIG_FILE environment variable.
+// Every field is optional; an absent file means "single local Ollama instance".
+type Config struct {
+	DefaultBackend string       `json:"default_backend"` // Base URL used when no route matches
+	Routes         []ModelRoute `json:"routes"`          // Model-aware routing table, first match wins
+	DefaultModel   string       `json:"default_model"`   // Selected in the UI when it loads; empty: the first installed model
+
+	MaxConcurrentGenerations int `json:"max_concurrent_generations"` // Parallel generations per backend
+	MaxQueuedGenerations     int `json:"max_queued_generations"`     // Waiting generations per backend before rejecting
+
+	LongformMaxSections int `json:"longform_max_sections"` // Upper bound on sections planned in long document mode
+
+	DefaultNumCtx int `json:"default_num_ctx"` // Context window assumed when a chat request doesn't set num_ctx
+
+	// Chats longer than SummarizeAfterMessages get their older turns condensed into a summary
+	// in the background; the newest SummaryKeepRecent messages are always sent verbatim. 0 disables.
+	SummarizeAfterMessages int    `json:"summarize_after_messages"`
+	SummaryKeepRecent      int    `json:"summary_keep_recent"`
+	SummaryModel           string `json:"summary_model"` // Model that writes summaries; defaults to the chat's model
+
+	// Model and prompt deletions wait this many seconds, during which they can be undone. 0 deletes immediately.
+	UndoWindowSeconds int `json:"undo_window_seconds"`
+
+	// A single write of a streamed response may take at most this long before the client is
+	// considered gone and the connection is closed. 0 waits forever.
+	StreamWriteTimeoutSeconds int `json:"stream_write_timeout_seconds"`
+
+	// A client may fall at most this many bytes behind a generation before it is dropped
+	// and the generation stopped. 0 buffers without limit.
+	StreamBufferBytes int `json:"stream_buffer_bytes"`
+
+	// A generation whose client disconnected keeps running this many seconds, with its last
+	// ResumeBufferBytes of output kept, so the client can reconnect and resume. 0 stops it at once.
+	ResumeGraceSeconds int `json:"resume_grace_seconds"`
+	ResumeBufferBytes  int `json:"resume_buffer_bytes"`
+
+	// Embeddings served by /api/embeddings are cached by model and content, up to this many;
+	// the oldest are dropped first. 0 turns the cache off.
+	EmbeddingCacheEntries int `json:"embedding_cache_entries"`
+
+	// Images larger than this many pixels on their longest side are scaled down before they are
+	// sent to a model, which saves memory and time. 0 sends them as uploaded.
+	MaxImageDimension int `json:"max_image_dimension"`
+
+	// TokenQuota limits the tokens (prompt plus answer) each client may use per UTC day.
+	TokenQuota TokenQuotaConfig `json:"token_quota"`
+
+	// KeepAlive sets how long models stay loaded after a generation, by model pattern; the
+	// first match wins and requests may override it. Unmatched models use Ollama's default (5m).
+	KeepAlive []ModelKeepAlive `json:"keep_alive"`
+
+	// Guardrail is a system preamble put ahead of every generate, chat and longform request,
+	// e.g. company policy. Users can't remove it. Admins can also change it at runtime; every
+	// change is a new version, and the version each request used is audited.
+	Guardrail string `json:"guardrail"`
+
+	// With model "auto", each generate or chat request goes to the installed model best suited
+	// to it. AutoModelClassifier names a small model that decides between code, reasoning and
+	// chat; without one, keyword rules decide.
+	AutoModelClassifier string `json:"auto_model_classifier"`
+
+	// The recommender re-reads the installed models every RecommenderRefreshMinutes (0: only at
+	// startup and on request). Hugging Face metadata is looked up again after
+	// RecommenderMetadataTTLHours. Computed recommendations are reused for
+	// RecommendationCacheSeconds (0: never), until the models or benchmarks change.
+	RecommenderRefreshMinutes   int `json:"recommender_refresh_minutes"`
+	RecommenderMetadataTTLHours int `json:"recommender_metadata_ttl_hours"`
+	RecommendationCacheSeconds  int `json:"recommendation_cache_seconds"`
+	// The recommender's list of models that can be pulled comes from this Ollama library page
+	// (or a JSON mirror of it), fetched daily. Empty: use the saved or built-in list.
+	ModelCatalogURL string `json:"model_catalog_url"`
+
+	// DataDir holds LAIM's own state (prompt library, ...). Empty keeps everything in memory.
+	DataDir string `json:"data_dir"`
+
+	WebSearch WebSearchConfig `json:"web_search"`
+
+	// MCPServers are Model Context Protocol servers whose tools are offered to chats.
+	MCPServers []MCPServerConfig `json:"mcp_servers"`
+
+	DebugCapture DebugCaptureConfig `json:"debug_capture"`
+	Chaos        ChaosConfig        `json:"chaos"`
+
+	SentryDSN string `json:"sentry_dsn"` // Optional Sentry-compatible endpoint for panic reports
+
+	// Listen overrides the public address: "host:port" or "unix:/run/laim/laim.sock"; $LISTEN
+	// sets it too. When empty, LAIM listens on all interfaces on $PORT (default 8080).
+	// SocketMode is the octal file mode of Unix sockets LAIM creates (default "0660").
+	Listen     string `json:"listen"`
+	SocketMode string `json:"socket_mode"`
+
+	// AdminListen moves the admin/debug endpoints to their own listener, e.g. "127.0.0.1:9090"
+	// or "unix:/run/laim/admin.sock". When empty they are served on the public port.
+	AdminListen string `json:"admin_listen"`
+
+	// AdminToken, when set, must be sent as "Authorization: Bearer <token>" to use the admin
+	// endpoints and to pull, delete, create, copy or push models. $ADMIN_TOKEN sets it too.
+	// Without it, only requests from this machine may do those things.
+	AdminToken string `json:"admin_token"`
+
+	// Quality has a judge model score a sample of conversations, for per-model quality trends.
+	Quality QualityConfig `json:"quality"`
+
+	// Whisper transcribes audio files attached to chats, so recordings can be asked about.
+	Whisper WhisperConfig `json:"whisper"`
+
+	// Kiosk turns the public listener into a showcase for events: example chats and a prompt
+	// box for one fixed model. All other endpoints are switched off.
+	Kiosk KioskConfig `json:"kiosk"`
+
+	// CORS lets web apps on other origins call the API, per origin; the first matching rule
+	// wins. Without rules, browsers only allow same-origin requests.
+	CORS []CORSRule `json:"cors"`
+
+	// BasePath serves LAIM under a URL prefix such as "/laim", for reverse proxies that
+	// don't strip it. TrustedProxies are the proxies (IP addresses, CIDR ranges, or "unix"
+	// for Unix socket connections) whose X-Forwarded-For and X-Forwarded-Proto are believed.
+	BasePath       string   `json:"base_path"`
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// UIDir serves the UI from a directory (a checkout's static/) instead of the copy built
+	// into the binary, so edits show up on reload. For development; $UI_DIR sets it too.
+	UIDir string `json:"ui_dir"`
+
+	// Hooks are inbound webhooks for automation tools: POST /api/hooks/{id} turns the JSON
+	// posted into a prompt and answers with the model's reply, or forwards it.
+	Hooks []HookConfig `json:"hooks"`
 }
 
-func callModelDeleteAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
-	// Delete Logic - Note: Ollama expects DELETE method usually, but here we proxy via POST or DELETE based on API needs.
-	// We will stick to the standard logic used previously.
-	payloadBytes, _ := json.Marshal(OllamaModelActionPayload{Name: clientReq.Model})
-	req, _ := http.NewRequest(http.MethodDelete, ollamaDeleteAPI, bytes.NewBuffer(payloadBytes))
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := client.Do(req)
-	handleStandardResponse(w, resp, err)
+// TokenQuotaConfig sets daily token budgets per client (IP address, or "local" over a Unix socket).
+type TokenQuotaConfig struct {
+	DailyTokens int            `json:"daily_tokens"` // Budget of every client; 0: no budget
+	Clients     map[string]int `json:"clients"`      // Budgets of particular clients, overriding daily_tokens; 0: none
+	WarnPercent int            `json:"warn_percent"` // Warn clients once they have used this share of their budget
+	HardCap     bool           `json:"hard_cap"`     // Refuse generations once the budget is used up, instead of only warning
 }
 
-func handleListModels(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// QualityConfig sets up conversation quality scoring.
+type QualityConfig struct {
+	Enabled         bool    `json:"enabled"`
+	JudgeModel      string  `json:"judge_model"`
+	SampleRate      float64 `json:"sample_rate"`      // Share of generate and chat answers scored, 0 to 1
+	IntervalMinutes int     `json:"interval_minutes"` // How often the sampled answers are judged
+}
+
+// WhisperConfig points at a speech-to-text server: whisper.cpp's server (".../inference") or
+// an OpenAI-compatible one such as faster-whisper-server (".../v1/audio/transcriptions").
+type WhisperConfig struct {
+	URL            string `json:"url"`   // Empty: audio files are refused
+	Model          string `json:"model"` // Sent as the model field, which OpenAI-compatible servers need
+	TimeoutSeconds int    `json:"timeout_seconds"`
+}
+
+// KioskConfig sets up kiosk mode.
+type KioskConfig struct {
+	Enabled  bool        `json:"enabled"`
+	Title    string      `json:"title"`
+	Model    string      `json:"model"`
+	System   string      `json:"system"`   // Fixed system prompt
+	Showcase []KioskChat `json:"showcase"` // Curated example conversations shown on the page
+
+	RequestsPerMinute int `json:"requests_per_minute"` // Per visitor (client address)
+	MaxPromptChars    int `json:"max_prompt_chars"`    // Longest message a visitor may send
+	MaxTokens         int `json:"max_tokens"`          // Longest reply
+	MaxHistory        int `json:"max_history"`         // Earlier messages sent along with a new one
+}
+
+// KioskChat is an example conversation shown in kiosk mode.
+type KioskChat struct {
+	Title    string    `json:"title"`
+	Messages []Message `json:"messages"`
+}
+
+// DebugCaptureConfig controls recording of the exact payloads exchanged with Ollama.
+type DebugCaptureConfig struct {
+	Enabled      bool `json:"enabled"`
+	MaxEntries   int  `json:"max_entries"`    // Oldest captures are evicted beyond this
+	MaxBodyBytes int  `json:"max_body_bytes"` // Request and response bodies are truncated to this size
+}
+
+// WebSearchConfig selects the search API behind enable_web_search and the web_search tool.
+type WebSearchConfig struct {
+	Provider   string `json:"provider"`    // "duckduckgo" (default) or "searxng"
+	URL        string `json:"url"`         // Base URL of the SearxNG instance
+	MaxResults int    `json:"max_results"` // Results fetched and injected into the chat
+}
+
+// MCPServerConfig describes how to reach one MCP server: either a command speaking MCP
+// over stdin/stdout, or the URL of a streamable HTTP endpoint.
+type MCPServerConfig struct {
+	Name    string            `json:"name"` // Prefix of the server's tool names, e.g. "github"
+	Command []string          `json:"command,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"` // Sent with every HTTP request, e.g. Authorization
+}
+
+// ModelKeepAlive is the keep_alive default for models matching Pattern (same syntax as routes).
+type ModelKeepAlive struct {
+	Pattern   string          `json:"pattern"`
+	KeepAlive json.RawMessage `json:"keep_alive"`
+}
+
+// keepAliveFor returns the keep_alive to send for a request: its own, the configured default
+// for its model, or nothing to leave it to Ollama.
+func keepAliveFor(clientReq ClientRequest) json.RawMessage {
+	if len(clientReq.KeepAlive) > 0 {
+		return clientReq.KeepAlive
 	}
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(ollamaTagsAPI)
-	handleStandardResponse(w, resp, err)
+	for _, rule := range config.KeepAlive {
+		if modelMatches(rule.Pattern, clientReq.Model) {
+			return rule.KeepAlive
+		}
+	}
+	return nil
 }
 
-// Helper for non-streaming requests
-func proxyStandardRequest(w http.ResponseWriter, url string, payload interface{}, client *http.Client) {
-	payloadBytes, _ := json.Marshal(payload)
-	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(payloadBytes))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	handleStandardResponse(w, resp, err)
+func validateKeepAliveRules(rules []ModelKeepAlive) error {
+	for i, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return fmt.Errorf("keep_alive %d: bad pattern %q", i, rule.Pattern)
+		}
+		if err := validateKeepAlive(rule.KeepAlive); err != nil {
+			return fmt.Errorf("keep_alive %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// ModelRoute maps a model name pattern to an Ollama backend.
+// Patterns use shell glob syntax ("llama3:70b", "qwen*"); a pattern without a tag
+// also matches every tag of that model ("tinyllama" matches "tinyllama:latest").
+type ModelRoute struct {
+	Pattern string `json:"pattern"`
+	Backend string `json:"backend"`
 }
 
-func handleStandardResponse(w http.ResponseWriter, resp *http.Response, err error) {
+var config Config
+
+func loadConfig() Config {
+	cfg := Config{
+		DefaultBackend:              ollamaBaseURL,
+		MaxConcurrentGenerations:    2,
+		MaxQueuedGenerations:        32,
+		LongformMaxSections:         8,
+		DefaultNumCtx:               4096,
+		SummarizeAfterMessages:      40,
+		SummaryKeepRecent:           10,
+		UndoWindowSeconds:           10,
+		StreamWriteTimeoutSeconds:   30,
+		StreamBufferBytes:           256 * 1024,
+		ResumeGraceSeconds:          30,
+		ResumeBufferBytes:           64 * 1024,
+		EmbeddingCacheEntries:       20000,
+		MaxImageDimension:           1536,
+		RecommenderRefreshMinutes:   60,
+		RecommenderMetadataTTLHours: 7 * 24,
+		RecommendationCacheSeconds:  300,
+		ModelCatalogURL:             "https://ollama.com/library?sort=popular",
+		WebSearch: WebSearchConfig{
+			Provider:   "duckduckgo",
+			MaxResults: 3,
+		},
+		DebugCapture: DebugCaptureConfig{
+			MaxEntries:   100,
+			MaxBodyBytes: 64 * 1024,
+		},
+		TokenQuota: TokenQuotaConfig{
+			WarnPercent: 80,
+		},
+		Quality: QualityConfig{
+			SampleRate:      0.1,
+			IntervalMinutes: 60,
+		},
+		Whisper: WhisperConfig{
+			TimeoutSeconds: 300,
+		},
+		Kiosk: KioskConfig{
+			Title:             "Ask a local model",
+			RequestsPerMinute: 3,
+			MaxPromptChars:    500,
+			MaxTokens:         300,
+			MaxHistory:        6,
+		},
+		SocketMode: "0660",
+	}
+
+	if url := os.Getenv("OLLAMA_URL"); url != "" {
+		cfg.DefaultBackend = url
+	}
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.Listen = os.Getenv("LISTEN")
+	cfg.UIDir = os.Getenv("UI_DIR")
+
+	if dir, err := os.UserConfigDir(); err == nil {
+		cfg.DataDir = filepath.Join(dir, "laim")
+	}
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return cfg
+	}
+
+	data, err := os.ReadFile(path)
 	if err != nil {
-		http.Error(w, "Error: "+err.Error(), http.StatusBadGateway)
-		return
+		log.Fatalf("Could not read config file %s: %v", path, err)
 	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
-}
\ No newline at end of file
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Fatalf("Invalid config file %s: %v", path, err)
+	}
+	if cfg.DefaultBackend == "" {
+		cfg.DefaultBackend = ollamaBaseURL
+	}
+	cfg.DefaultBackend = strings.TrimSuffix(cfg.DefaultBackend, "/")
+
+	if err := validateRoutes(cfg.Routes); err != nil {
+		log.Fatalf("Invalid routes in config file %s: %v", path, err)
+	}
+	if err := validateMCPServers(cfg.MCPServers); err != nil {
+		log.Fatalf("Invalid mcp_servers in config file %s: %v", path, err)
+	}
+	if err := validateKeepAliveRules(cfg.KeepAlive); err != nil {
+		log.Fatalf("Invalid keep_alive in config file %s: %v", path, err)
+	}
+	if err := validateCORSRules(cfg.CORS); err != nil {
+		log.Fatalf("Invalid cors in config file %s: %v", path, err)
+	}
+	if err := validateHooks(cfg.Hooks); err != nil {
+		log.Fatalf("Invalid hooks in config file %s: %v", path, err)
+	}
+	cfg.BasePath = strings.TrimSuffix(cfg.BasePath, "/")
+	if cfg.BasePath != "" && (!strings.HasPrefix(cfg.BasePath, "/") || strings.ContainsAny(cfg.BasePath, "?#%\"") ||
+		strings.Contains(cfg.BasePath+"/", "//") || strings.Contains(cfg.BasePath+"/", "/./") || strings.Contains(cfg.BasePath+"/", "/../")) {
+		log.Fatalf("Invalid base_path in config file %s: must be a clean path such as /laim", path)
+	}
+	if mode, err := strconv.ParseUint(cfg.SocketMode, 8, 32); err != nil || mode > 0777 {
+		log.Fatalf("Invalid socket_mode in config file %s: must be an octal file mode such as \"0660\"", path)
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted_proxies in config file %s: %v", path, err)
+	}
+	if cfg.MaxConcurrentGenerations < 1 {
+		cfg.MaxConcurrentGenerations = 1
+	}
+	if cfg.MaxImageDimension < 0 {
+		log.Fatalf("Invalid max_image_dimension in config file %s: must not be negative", path)
+	}
+	if cfg.MaxQueuedGenerations < 0 {
+		cfg.MaxQueuedGenerations = 0
+	}
+	if cfg.SummaryKeepRecent < 1 {
+		cfg.SummaryKeepRecent = 1
+	}
+	if cfg.DefaultModel != "" && !modelNamePattern.MatchString(cfg.DefaultModel) {
+		log.Fatalf("Invalid default_model in config file %s: %q is not a model name", path, cfg.DefaultModel)
+	}
+	if cfg.TokenQuota.DailyTokens < 0 || cfg.TokenQuota.WarnPercent < 1 || cfg.TokenQuota.WarnPercent > 100 {
+		log.Fatalf("Invalid token_quota in config file %s: daily_tokens must not be negative and warn_percent must be between 1 and 100", path)
+	}
+	for client, limit := range cfg.TokenQuota.Clients {
+		if limit < 0 {
+			log.Fatalf("Invalid token_quota in config file %s: the budget of %s must not be negative", path, client)
+		}
+	}
+	if cfg.Quality.Enabled && (!modelNamePattern.MatchString(cfg.Quality.JudgeModel) || cfg.Quality.SampleRate <= 0 || cfg.Quality.SampleRate > 1 || cfg.Quality.IntervalMinutes < 1) {
+		log.Fatalf("Invalid quality in config file %s: needs a judge_model, a sample_rate between 0 and 1 and an interval_minutes of at least 1", path)
+	}
+	if cfg.Whisper.URL != "" {
+		if u, err := url.Parse(cfg.Whisper.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || cfg.Whisper.TimeoutSeconds < 1 {
+			log.Fatalf("Invalid whisper in config file %s: needs an http(s) url and a timeout_seconds of at least 1", path)
+		}
+	}
+	if cfg.Kiosk.Enabled && (!modelNamePattern.MatchString(cfg.Kiosk.Model) || cfg.Kiosk.RequestsPerMinute < 1 || cfg.Kiosk.MaxPromptChars < 1 || cfg.Kiosk.MaxTokens < 1) {
+		log.Fatalf("Invalid kiosk in config file %s: needs a model, and requests_per_minute, max_prompt_chars and max_tokens of at least 1", path)
+	}
+	return cfg
+}
+
+// --- Model Routing ---
+
+// RouteTable decides which Ollama backend serves a given model.
+// It is read on every proxied request and may be replaced at runtime via the admin API.
+type RouteTable struct {
+	mu             sync.RWMutex
+	defaultBackend string
+	routes         []ModelRoute
+}
+
+var routes *RouteTable
+
+func NewRouteTable(defaultBackend string, initial []ModelRoute) *RouteTable {
+	return &RouteTable{defaultBackend: defaultBackend, routes: normalizeRoutes(initial)}
+}
+
+// Resolve returns the backend base URL for a model name.
+func (rt *RouteTable) Resolve(model string) string {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	for _, route := range rt.routes {
+		if modelMatches(route.Pattern, model) {
+			return route.Backend
+		}
+	}
+	return rt.defaultBackend
+}
+
+// modelMatches reports whether a model name matches a shell glob pattern. A pattern
+// without a tag also matches every tag of the model.
+func modelMatches(pattern, model string) bool {
+	if ok, _ := path.Match(pattern, model); ok {
+		return true
+	}
+	if !strings.Contains(pattern, ":") {
+		baseName := strings.SplitN(model, ":", 2)[0]
+		ok, _ := path.Match(pattern, baseName)
+		return ok
+	}
+	return false
+}
+
+// Backends returns the default backend followed by every distinct routed backend.
+func (rt *RouteTable) Backends() []string {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	backends := []string{rt.defaultBackend}
+	seen := map[string]bool{rt.defaultBackend: true}
+	for _, route := range rt.routes {
+		if !seen[route.Backend] {
+			seen[route.Backend] = true
+			backends = append(backends, route.Backend)
+		}
+	}
+	return backends
+}
+
+func (rt *RouteTable) Routes() []ModelRoute {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return append([]ModelRoute(nil), rt.routes...)
+}
+
+func (rt *RouteTable) Replace(newRoutes []ModelRoute) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes = normalizeRoutes(newRoutes)
+}
+
+func validateRoutes(rs []ModelRoute) error {
+	for i, route := range rs {
+		if route.Pattern == "" || route.Backend == "" {
+			return fmt.Errorf("route %d: pattern and backend are required", i)
+		}
+		if _, err := path.Match(route.Pattern, ""); err != nil {
+			return fmt.Errorf("route %d: bad pattern %q: %v", i, route.Pattern, err)
+		}
+		if !strings.HasPrefix(route.Backend, "http://") && !strings.HasPrefix(route.Backend, "https://") {
+			return fmt.Errorf("route %d: backend %q must be an http(s) URL", i, route.Backend)
+		}
+	}
+	return nil
+}
+
+func normalizeRoutes(rs []ModelRoute) []ModelRoute {
+	out := make([]ModelRoute, len(rs))
+	for i, route := range rs {
+		out[i] = ModelRoute{Pattern: route.Pattern, Backend: strings.TrimSuffix(route.Backend, "/")}
+	}
+	return out
+}
+
+// --- Generation Queue ---
+
+var errQueueFull = errors.New("generation queue is full")
+
+// GenerationQueue limits how many generations run in parallel on each backend,
+// so simultaneous chats wait their turn instead of thrashing the GPU.
+type GenerationQueue struct {
+	mu       sync.Mutex
+	limit    int
+	maxQueue int
+	backends map[string]*backendQueue
+}
+
+type backendQueue struct {
+	active     int
+	waiting    []*queueTicket
+	background []*queueTicket // Served only when nobody is in waiting
+}
+
+type queueTicket struct {
+	ready chan struct{} // Closed when the ticket is granted a slot
+	moved chan struct{} // Signalled whenever the ticket's position changes
+}
+
+var generationQueue *GenerationQueue
+
+func NewGenerationQueue(limit, maxQueue int) *GenerationQueue {
+	return &GenerationQueue{limit: limit, maxQueue: maxQueue, backends: make(map[string]*backendQueue)}
+}
+
+// Acquire blocks until a generation slot is free on the backend or ctx is cancelled.
+// While waiting, onPosition is called with the 1-based queue position each time it changes.
+// The returned release function must be called once the generation has finished.
+func (q *GenerationQueue) Acquire(ctx context.Context, backend string, onPosition func(int)) (func(), error) {
+	q.mu.Lock()
+	bq := q.queueFor(backend)
+	if bq.active < q.limit && len(bq.waiting) == 0 {
+		bq.active++
+		q.mu.Unlock()
+		return q.releaseFunc(backend), nil
+	}
+	if len(bq.waiting) >= q.maxQueue {
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	ticket := &queueTicket{ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	bq.waiting = append(bq.waiting, ticket)
+	position := len(bq.waiting)
+	q.mu.Unlock()
+
+	onPosition(position)
+	for {
+		select {
+		case <-ticket.ready:
+			return q.releaseFunc(backend), nil
+		case <-ticket.moved:
+			if newPosition := q.position(backend, ticket); newPosition > 0 && newPosition != position {
+				position = newPosition
+				onPosition(position)
+			}
+		case <-ctx.Done():
+			q.abandon(backend, ticket)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// AcquireBackground is Acquire for work nobody is watching, such as batch jobs. It waits in a
+// line of its own that gets a free slot only when no interactive request is waiting, so it
+// never takes a place in the queue and is never refused with errQueueFull.
+func (q *GenerationQueue) AcquireBackground(ctx context.Context, backend string) (func(), error) {
+	q.mu.Lock()
+	bq := q.queueFor(backend)
+	if bq.active < q.limit && len(bq.waiting) == 0 && len(bq.background) == 0 {
+		bq.active++
+		q.mu.Unlock()
+		return q.releaseFunc(backend), nil
+	}
+	ticket := &queueTicket{ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	bq.background = append(bq.background, ticket)
+	q.mu.Unlock()
+
+	select {
+	case <-ticket.ready:
+		return q.releaseFunc(backend), nil
+	case <-ctx.Done():
+		q.abandon(backend, ticket)
+		return nil, ctx.Err()
+	}
+}
+
+// queueFor returns the backend's queue, creating it on first use; the caller holds q.mu.
+func (q *GenerationQueue) queueFor(backend string) *backendQueue {
+	bq, ok := q.backends[backend]
+	if !ok {
+		bq = &backendQueue{}
+		q.backends[backend] = bq
+	}
+	return bq
+}
+
+func (q *GenerationQueue) releaseFunc(backend string) func() {
+	var once sync.Once
+	return func() { once.Do(func() { q.release(backend) }) }
+}
+
+// release hands the slot to the next waiter, interactive ones first, or frees it when nobody
+// is waiting.
+func (q *GenerationQueue) release(backend string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	bq := q.backends[backend]
+	switch {
+	case len(bq.waiting) > 0:
+		next := bq.waiting[0]
+		bq.waiting = bq.waiting[1:]
+		close(next.ready)
+		notifyMoved(bq.waiting)
+	case len(bq.background) > 0:
+		next := bq.background[0]
+		bq.background = bq.background[1:]
+		close(next.ready)
+	default:
+		bq.active--
+	}
+}
+
+// abandon removes a cancelled ticket. If the slot was granted concurrently with the
+// cancellation, the slot is passed on so it is not leaked.
+func (q *GenerationQueue) abandon(backend string, ticket *queueTicket) {
+	q.mu.Lock()
+	bq := q.backends[backend]
+	for i, t := range bq.waiting {
+		if t == ticket {
+			bq.waiting = append(bq.waiting[:i], bq.waiting[i+1:]...)
+			notifyMoved(bq.waiting[i:])
+			q.mu.Unlock()
+			return
+		}
+	}
+	for i, t := range bq.background {
+		if t == ticket {
+			bq.background = append(bq.background[:i], bq.background[i+1:]...)
+			q.mu.Unlock()
+			return
+		}
+	}
+	q.mu.Unlock()
+	q.release(backend)
+}
+
+func (q *GenerationQueue) position(backend string, ticket *queueTicket) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, t := range q.backends[backend].waiting {
+		if t == ticket {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func notifyMoved(tickets []*queueTicket) {
+	for _, t := range tickets {
+		select {
+		case t.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ChaosConfig enables fault injection on upstream calls. Development only: it exists to
+// exercise retry and reconnect handling and must never be turned on in production.
+type ChaosConfig struct {
+	Enabled     bool    `json:"enabled"`
+	LatencyRate float64 `json:"latency_rate"` // Fraction of upstream calls delayed by up to LatencyMS
+	LatencyMS   int     `json:"latency_ms"`
+	ErrorRate   float64 `json:"error_rate"` // Fraction of upstream calls answered with a synthetic 5xx
+	DropRate    float64 `json:"drop_rate"`  // Fraction of upstream responses cut off mid-stream
+}
+
+// --- Request IDs ---
+
+type contextKey string
+
+const requestIDKey contextKey = "request-id"
+const clientKey contextKey = "client"
+const connKey contextKey = "conn"
+const guardrailKey contextKey = "guardrail"
+const autoRouteKey contextKey = "auto-route"
+const tokenQuotaKey contextKey = "token-quota"
+const privateKey contextKey = "private"
+const noCommandsKey contextKey = "no-commands" // Messages are sent as typed, even if they start with a command
+
+// requestIDPattern is what a client's X-Request-ID must look like to be reused; it ends up in
+// log lines, SSE ids and URLs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware tags every request with an ID (reusing the client's X-Request-ID when given)
+// and echoes it back, so a response can be matched with its log lines and debug capture. An ID
+// that a resumable generation already has isn't reused, so one client can't take over another's.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if _, taken := resumables.Get(id); taken || !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, clientKey, clientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP identifies the caller for accounting purposes. Behind a trusted proxy, that's the
+// address the proxy forwarded the request for.
+func clientIP(r *http.Request) string {
+	host := remoteHost(r)
+	if !isTrustedProxy(host) {
+		return host
+	}
+	// Each proxy appends the address it got the request from, so the nearest address that
+	// isn't a trusted proxy is the client; anything further left could be made up by it
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !isTrustedProxy(host) {
+			break
+		}
+	}
+	return host
+}
+
+// remoteHost is the address of the connection's peer, or "local" for Unix socket connections.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || host == "" {
+		// Unix socket connections have no remote address
+		return "local"
+	}
+	return host
+}
+
+// isPrivate reports whether a request asked to be kept out of samples and captures.
+func isPrivate(ctx context.Context) bool {
+	private, _ := ctx.Value(privateKey).(bool)
+	return private
+}
+
+// clientFrom returns the client a request was made by; background work is attributed to "laim".
+func clientFrom(ctx context.Context) string {
+	if client, ok := ctx.Value(clientKey).(string); ok {
+		return client
+	}
+	return "laim"
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// --- Panic Recovery ---
+
+// recoveryMiddleware turns a handler panic into a 500 carrying the request ID, logs the
+// stack trace and reports it to the configured Sentry-compatible endpoint.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				// Deliberate abort of a response; let net/http handle it silently
+				panic(rec)
+			}
+
+			id := requestIDFrom(r.Context())
+			stack := debug.Stack()
+			log.Printf("PANIC in %s %s (request %s): %v\n%s", r.Method, r.URL.Path, id, rec, stack)
+			if config.SentryDSN != "" {
+				go reportPanic(config.SentryDSN, r, id, rec, stack)
+			}
+
+			http.Error(w, "Internal Server Error (request ID: "+id+")", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reportPanic sends the panic to a Sentry-compatible store endpoint (Sentry, GlitchTip, ...).
+func reportPanic(dsn string, r *http.Request, requestID string, rec interface{}, stack []byte) {
+	endpoint, key, err := parseSentryDSN(dsn)
+	if err != nil {
+		log.Printf("Invalid sentry_dsn: %v", err)
+		return
+	}
+
+	event := map[string]interface{}{
+		"event_id":  newRequestID() + newRequestID(), // 32 hex characters
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"level":     "error",
+		"platform":  "go",
+		"logger":    "laim",
+		"message":   fmt.Sprintf("panic: %v", rec),
+		"tags":      map[string]string{"request_id": requestID},
+		"request":   map[string]string{"method": r.Method, "url": r.URL.String()},
+		"extra":     map[string]string{"stack": string(stack)},
+	}
+	payload, _ := json.Marshal(event)
+
+	req, _ := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=laim/1.0, sentry_key=%s", key))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Could not report panic to Sentry: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Sentry rejected panic report: %s", resp.Status)
+	}
+}
+
+// parseSentryDSN turns "https://<key>@<host>/<project>" into the project's store URL and public key.
+func parseSentryDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", "", errors.New("missing public key")
+	}
+	projectPath := strings.Trim(u.Path, "/")
+	idx := strings.LastIndex(projectPath, "/")
+	prefix, project := "", projectPath
+	if idx >= 0 {
+		prefix, project = "/"+projectPath[:idx], projectPath[idx+1:]
+	}
+	if project == "" {
+		return "", "", errors.New("missing project ID")
+	}
+	return fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project), u.User.Username(), nil
+}
+
+// --- Debug Capture ---
+
+// Capture is the recorded upstream exchange for one client request.
+type Capture struct {
+	RequestID      string    `json:"request_id"`
+	Time           time.Time `json:"time"`
+	Method         string    `json:"method"`
+	URL            string    `json:"url"`
+	RequestBody    string    `json:"request_body,omitempty"`
+	ResponseStatus int       `json:"response_status"`
+	ResponseBody   string    `json:"response_body,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Truncated      bool      `json:"truncated"`
+	Private        bool      `json:"private,omitempty"` // The request was private, so its bodies weren't kept
+}
+
+// CaptureStore keeps the most recent captures in memory, keyed by request ID.
+type CaptureStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int
+	order      []string
+	captures   map[string]*Capture
+}
+
+var captures *CaptureStore
+
+func NewCaptureStore(maxEntries, maxBytes int) *CaptureStore {
+	return &CaptureStore{maxEntries: maxEntries, maxBytes: maxBytes, captures: make(map[string]*Capture)}
+}
+
+func (cs *CaptureStore) add(c *Capture) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	// A request may talk to Ollama more than once; keep each exchange addressable
+	key := c.RequestID
+	for n := 2; cs.captures[key] != nil; n++ {
+		key = fmt.Sprintf("%s.%d", c.RequestID, n)
+	}
+	c.RequestID = key
+
+	cs.captures[key] = c
+	cs.order = append(cs.order, key)
+	for len(cs.order) > cs.maxEntries {
+		delete(cs.captures, cs.order[0])
+		cs.order = cs.order[1:]
+	}
+}
+
+// Get returns a copy of the capture, which may still be receiving its response stream.
+func (cs *CaptureStore) Get(id string) (Capture, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.captures[id]
+	if !ok {
+		return Capture{}, false
+	}
+	return *c, true
+}
+
+// List returns summaries (without bodies) of the stored captures, newest first.
+func (cs *CaptureStore) List() []Capture {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	list := make([]Capture, 0, len(cs.order))
+	for i := len(cs.order) - 1; i >= 0; i-- {
+		c := *cs.captures[cs.order[i]]
+		c.RequestBody, c.ResponseBody = "", ""
+		list = append(list, c)
+	}
+	return list
+}
+
+func (cs *CaptureStore) appendResponse(c *Capture, p []byte) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	room := cs.maxBytes - len(c.ResponseBody)
+	if room <= 0 {
+		c.Truncated = true
+		return
+	}
+	if len(p) > room {
+		p = p[:room]
+		c.Truncated = true
+	}
+	c.ResponseBody += string(p)
+}
+
+// captureTransport records every upstream exchange when debug capture is enabled.
+type captureTransport struct {
+	base http.RoundTripper
+}
+
+func (t captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := &Capture{
+		RequestID: requestIDFrom(req.Context()),
+		Time:      time.Now(),
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Private:   isPrivate(req.Context()),
+	}
+	if req.Body != nil && !c.Private {
+		body, _ := io.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		c.RequestBody = string(redactJSON(body))
+		if len(c.RequestBody) > captures.maxBytes {
+			c.RequestBody = c.RequestBody[:captures.maxBytes]
+			c.Truncated = true
+		}
+	}
+	captures.add(c)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		captures.mu.Lock()
+		c.Error = err.Error()
+		captures.mu.Unlock()
+		return nil, err
+	}
+	captures.mu.Lock()
+	c.ResponseStatus = resp.StatusCode
+	captures.mu.Unlock()
+	if !c.Private {
+		resp.Body = &captureBody{ReadCloser: resp.Body, capture: c}
+	}
+	return resp, nil
+}
+
+// captureBody tees the upstream response into the capture as it is streamed to the client.
+type captureBody struct {
+	io.ReadCloser
+	capture *Capture
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		captures.appendResponse(b.capture, p[:n])
+	}
+	return n, err
+}
+
+// secretKeys are JSON keys whose values never end up in a capture.
+var secretKeys = []string{"api_key", "apikey", "authorization", "password", "secret", "token"}
+
+// redactJSON masks secret-looking fields in a JSON document; non-JSON input is returned as is.
+func redactJSON(body []byte) []byte {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return body
+	}
+	redacted, _ := json.Marshal(redactValue(doc))
+	return redacted
+}
+
+func redactValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range val {
+			if isSecretKey(k) {
+				val[k] = "[REDACTED]"
+			} else {
+				val[k] = redactValue(inner)
+			}
+		}
+	case []interface{}:
+		for i, inner := range val {
+			val[i] = redactValue(inner)
+		}
+	}
+	return v
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// --- Chaos / Fault Injection ---
+
+// chaosTransport injects latency, 5xx responses and dropped streams into upstream calls.
+type chaosTransport struct {
+	base http.RoundTripper
+	cfg  ChaosConfig
+}
+
+var chaosStatuses = []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}
+
+func (t chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.cfg.LatencyMS > 0 && rand.Float64() < t.cfg.LatencyRate {
+		delay := time.Duration(rand.Intn(t.cfg.LatencyMS)+1) * time.Millisecond
+		log.Printf("chaos: delaying %s %s by %v", req.Method, req.URL.Path, delay)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if rand.Float64() < t.cfg.ErrorRate {
+		status := chaosStatuses[rand.Intn(len(chaosStatuses))]
+		log.Printf("chaos: answering %s %s with %d", req.Method, req.URL.Path, status)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return &http.Response{
+			StatusCode: status,
+			Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"error":"chaos: injected upstream failure"}`)),
+			Request:    req,
+		}, nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || rand.Float64() >= t.cfg.DropRate {
+		return resp, err
+	}
+	log.Printf("chaos: dropping response stream of %s %s", req.Method, req.URL.Path)
+	resp.Body = &droppingBody{ReadCloser: resp.Body, remaining: rand.Intn(2048)}
+	return resp, nil
+}
+
+// droppingBody simulates a connection that dies after a few bytes of the stream.
+// Short responses never see their clean end either.
+type droppingBody struct {
+	io.ReadCloser
+	remaining int
+}
+
+func (b *droppingBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ollamaTransport skips transparent gzip, so streamed chunks are never held back in a decompressor.
+var ollamaTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DisableCompression = true
+	return t
+}()
+
+// newOllamaClient builds the HTTP client used for upstream calls, adding fault injection
+// and debug capture when enabled. Capture wraps chaos so recordings show what the proxy saw.
+func newOllamaClient(timeout time.Duration) *http.Client {
+	var transport http.RoundTripper = ollamaTransport
+	if config.Chaos.Enabled {
+		transport = chaosTransport{base: transport, cfg: config.Chaos}
+	}
+	if config.DebugCapture.Enabled {
+		transport = captureTransport{base: transport}
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// --- Server-Sent Events ---
+
+// Stream envelopes a client can ask for with ?stream= or the Accept header
+const (
+	streamSSE    = "sse"    // Server-sent events (default, used by the web UI)
+	streamNDJSON = "ndjson" // One JSON object per line, like Ollama itself
+	streamText   = "text"   // Just the generated text, for curl
+)
+
+// eventStream writes a streamed response to the client, by default as Server-Sent Events.
+// Headers are sent lazily so that errors raised before the first event can still be
+// reported with a proper HTTP status.
+type eventStream struct {
+	w       http.ResponseWriter
+	conn    net.Conn // For write deadlines; nil when not served by newHTTPServer
+	format  string
+	started bool
+	id      string // Sent as the SSE id of the next event, for Last-Event-ID resumption
+
+	mu      sync.Mutex // Guards the write deadline against Abort from another goroutine
+	aborted bool
+}
+
+// newEventStream picks the envelope from ?stream=sse|ndjson|text, then from the Accept header.
+func newEventStream(w http.ResponseWriter, r *http.Request) *eventStream {
+	conn, _ := r.Context().Value(connKey).(net.Conn)
+	return &eventStream{w: w, conn: conn, format: streamFormat(r)}
+}
+
+func streamFormat(r *http.Request) string {
+	switch r.URL.Query().Get("stream") {
+	case streamNDJSON:
+		return streamNDJSON
+	case streamText:
+		return streamText
+	case streamSSE:
+		return streamSSE
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/event-stream"):
+		return streamSSE
+	case strings.Contains(accept, "application/x-ndjson"), strings.Contains(accept, "application/jsonl"):
+		return streamNDJSON
+	case strings.HasPrefix(accept, "text/plain"):
+		return streamText
+	}
+	return streamSSE
+}
+
+func (s *eventStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	switch s.format {
+	case streamNDJSON:
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+	case streamText:
+		s.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Connection", "keep-alive")
+	}
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("X-Accel-Buffering", "no") // Keep nginx and similar proxies from buffering the stream
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// Data forwards a raw JSON line as an unnamed event.
+func (s *eventStream) Data(line string) {
+	s.start()
+	switch s.format {
+	case streamNDJSON:
+		fmt.Fprintf(s.w, "%s\n", line)
+	case streamText:
+		io.WriteString(s.w, plainText(line))
+	default:
+		s.writeID()
+		fmt.Fprintf(s.w, "data: %s\n\n", line)
+	}
+	s.flush()
+}
+
+// SetID makes the next event carry id, so a client can resume after it.
+func (s *eventStream) SetID(id string) {
+	s.id = id
+}
+
+func (s *eventStream) writeID() {
+	if s.id != "" {
+		fmt.Fprintf(s.w, "id: %s\n", s.id)
+		s.id = ""
+	}
+}
+
+// plainText extracts what a person reading the text stream wants from a chunk: generated
+// text, or the status line of a model operation.
+func plainText(line string) string {
+	var chunk struct {
+		Response string   `json:"response"`
+		Message  *Message `json:"message"`
+		Status   string   `json:"status"`
+		Done     bool     `json:"done"`
+	}
+	if json.Unmarshal([]byte(line), &chunk) != nil {
+		return ""
+	}
+	text := chunk.Response
+	if chunk.Message != nil {
+		text += chunk.Message.Content
+	}
+	if chunk.Status != "" {
+		text += chunk.Status + "\n"
+	}
+	if chunk.Done {
+		text += "\n"
+	}
+	return text
+}
+
+// JSON sends v encoded as JSON as an unnamed event.
+func (s *eventStream) JSON(v interface{}) {
+	payload, _ := json.Marshal(v)
+	s.Data(string(payload))
+}
+
+// Event sends a named event whose data is v encoded as JSON. NDJSON streams wrap it as
+// {"event": name, "data": v}; text streams only show errors.
+func (s *eventStream) Event(name string, v interface{}) {
+	s.start()
+	payload, _ := json.Marshal(v)
+	switch s.format {
+	case streamNDJSON:
+		fmt.Fprintf(s.w, "{\"event\":%q,\"data\":%s}\n", name, payload)
+	case streamText:
+		if name == "error" {
+			var e struct{ Error string }
+			json.Unmarshal(payload, &e)
+			fmt.Fprintf(s.w, "\nError: %s\n", e.Error)
+		}
+	default:
+		s.writeID()
+		fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, payload)
+	}
+	s.flush()
+}
+
+// Fail reports an error as an HTTP status if nothing was streamed yet, or as an error event otherwise.
+func (s *eventStream) Fail(message string, status int) {
+	if !s.started {
+		http.Error(s.w, message, status)
+		return
+	}
+	s.Event("error", map[string]string{"error": message})
+}
+
+// FailUpstream reports a classified Ollama failure like Fail, keeping its code and hint.
+func (s *eventStream) FailUpstream(e *UpstreamError) {
+	if !s.started {
+		writeUpstreamError(s.w, e)
+		return
+	}
+	s.Event("error", e)
+}
+
+// flush pushes every event to the client as soon as it is written. With a stream write
+// timeout configured, a client that stops reading fails the flush and the connection is
+// closed instead of stalling the handler. The deadline is cleared afterwards so it can't
+// leak into the next request on a kept-alive connection.
+func (s *eventStream) flush() {
+	f, ok := s.w.(http.Flusher)
+	if !ok {
+		return
+	}
+	timeout := time.Duration(config.StreamWriteTimeoutSeconds) * time.Second
+	if s.conn == nil || timeout <= 0 {
+		f.Flush()
+		return
+	}
+	s.setWriteDeadline(time.Now().Add(timeout))
+	f.Flush()
+	s.setWriteDeadline(time.Time{})
+}
+
+func (s *eventStream) setWriteDeadline(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.aborted {
+		s.conn.SetWriteDeadline(t)
+	}
+}
+
+// Abort gives up on a client that stopped reading: the write in progress and every later
+// one fail at once, and the connection is closed. It may be called from any goroutine.
+func (s *eventStream) Abort() {
+	if s.conn == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = true
+	s.conn.SetWriteDeadline(time.Now())
+}
+
+// streamBuffer sits between the reader of an Ollama stream and the goroutine writing it to
+// the client, so a client reading slower than the model generates doesn't slow the
+// generation down. Once more than limit bytes are waiting the client is considered stalled.
+type streamBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	pending int // Bytes in lines
+	limit   int // 0 means unbounded
+	closed  bool
+	wake    chan struct{}
+}
+
+func newStreamBuffer(limit int) *streamBuffer {
+	return &streamBuffer{limit: limit, wake: make(chan struct{}, 1)}
+}
+
+// Push queues a line for the client, or returns false if the client is too far behind.
+// A single line is always accepted when nothing else is waiting.
+func (b *streamBuffer) Push(line string) bool {
+	b.mu.Lock()
+	if b.limit > 0 && b.pending > 0 && b.pending+len(line) > b.limit {
+		b.mu.Unlock()
+		return false
+	}
+	b.lines = append(b.lines, line)
+	b.pending += len(line)
+	b.mu.Unlock()
+	b.signal()
+	return true
+}
+
+// Close marks the end of the stream; lines already queued are still delivered.
+func (b *streamBuffer) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *streamBuffer) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Next waits for queued lines and takes all of them. closed reports that no more will follow.
+func (b *streamBuffer) Next() (lines []string, closed bool) {
+	for {
+		b.mu.Lock()
+		lines, closed = b.lines, b.closed
+		b.lines, b.pending = nil, 0
+		b.mu.Unlock()
+		if len(lines) > 0 || closed {
+			return lines, closed
+		}
+		<-b.wake
+	}
+}
+
+// relay writes everything pushed to the buffer to the client until it is closed. With an
+// idPrefix, the lines are numbered from 1 as SSE ids "<idPrefix>:<n>".
+func (b *streamBuffer) relay(stream *eventStream, idPrefix string) {
+	n := 0
+	for {
+		lines, closed := b.Next()
+		for _, line := range lines {
+			n++
+			if idPrefix != "" {
+				stream.SetID(fmt.Sprintf("%s:%d", idPrefix, n))
+			}
+			stream.Data(line)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// --- Main Server Logic ---
+
+// serve runs the web UI and API server; it's what "laim" and "laim serve" do.
+func serve() {
+	config = loadConfig()
+	routes = NewRouteTable(config.DefaultBackend, config.Routes)
+	generationQueue = NewGenerationQueue(config.MaxConcurrentGenerations, config.MaxQueuedGenerations)
+	captures = NewCaptureStore(config.DebugCapture.MaxEntries, config.DebugCapture.MaxBodyBytes)
+	prompts = NewPromptStore()
+	summaries = NewSummaryCache(1000)
+	usage = NewUsageStore()
+	customCommands = NewCommandStore()
+	pendingDeletions = NewUndoStore(time.Duration(config.UndoWindowSeconds) * time.Second)
+	pulls = NewPullTracker()
+	resumables = NewResumeStore()
+	guardrails = NewGuardrailStore(config.Guardrail)
+	embeddingCache = NewEmbeddingCache(config.EmbeddingCacheEntries)
+	kioskLimiter = NewRateLimiter(config.Kiosk.RequestsPerMinute, time.Minute)
+	quality = NewQualityStore()
+	transcripts = NewTranscriptStore()
+	batches = NewBatchStore()
+	preferences = NewPreferenceStore()
+	trustedProxies, _ = parseTrustedProxies(config.TrustedProxies)
+	if config.AdminToken == "" {
+		log.Printf("⚠️ WARNING: ADMIN_TOKEN is not set; model management and admin endpoints only answer requests from this machine")
+	}
+	go runUsageFlusher()
+	if config.Quality.Enabled {
+		go runQualityJob(time.Duration(config.Quality.IntervalMinutes) * time.Minute)
+	}
+	connectMCPServers(config.MCPServers)
+	startRecommender()
+
+	// Sockets handed over by systemd take precedence over configured addresses
+	activated, err := systemdListeners()
+	if err != nil {
+		log.Fatalf("Socket activation failed: %v", err)
+	}
+	adminListener := activated["admin"]
+
+	if config.UIDir != "" {
+		if _, err := os.Stat(filepath.Join(config.UIDir, "index.html")); err != nil {
+			log.Fatalf("Invalid UI directory %s: %v", config.UIDir, err)
+		}
+		log.Printf("Serving the UI from %s instead of the embedded copy", config.UIDir)
+	}
+
+	// serveRoot handles the index.html
+	http.HandleFunc("/", serveRoot)
+
+	// This serves the static CSS and JS files from the embedded 'static' folder, under
+	// content-hashed names as well as their own
+	http.HandleFunc("/static/", handleStatic)
+
+	http.HandleFunc("/api/ollama-action", handleOllamaAction)
+	http.HandleFunc("/api/models", handleListModels)
+	http.HandleFunc("/api/models/", handleModelDetails)
+	http.HandleFunc("/api/embeddings", handleEmbeddings)
+	http.HandleFunc("/api/kiosk", handleKiosk)
+	http.HandleFunc("/api/kiosk/chat", handleKioskChat)
+	http.HandleFunc("/api/prompts", handlePrompts)
+	http.HandleFunc("/api/preferences", handlePreferences)
+	http.HandleFunc("/basic", handleBasic)
+	http.HandleFunc("/api/prompts/", handlePrompts)
+	http.HandleFunc("/api/usage", handleUsage)
+	http.HandleFunc("/api/usage/quality", handleQuality)
+	http.HandleFunc("/api/tools", handleListTools)
+	http.HandleFunc("/api/undo", requireAdmin(handleUndo))
+	http.HandleFunc("/api/commands", handleCommands)
+	http.HandleFunc("/api/commands/", handleCommands)
+	http.HandleFunc("/api/mcp", handleListMCPServers)
+	http.HandleFunc("/api/variables", handleListVariables)
+	http.HandleFunc("/api/pull/status", handlePullStatus)
+	http.HandleFunc("/api/ps", handleRunningModels)
+	http.HandleFunc("/api/streams/", handleStreamResume)
+	http.HandleFunc("/api/undo/", requireAdmin(handleUndo))
+	http.HandleFunc("/api/recommendations", handleRecommendations)
+	http.HandleFunc("/api/recommendations/hardware", handleHardware)
+	http.HandleFunc("/api/recommendations/benchmark", handleBenchmark)
+	http.HandleFunc("/api/recommendations/pull", handleRecommendationPull)
+	http.HandleFunc("/api/recommendations/refresh", handleRecommendationRefresh)
+	http.HandleFunc("/api/recommendations/catalog", handleCatalog)
+	http.HandleFunc("/api/hooks/", handleHook)
+	http.HandleFunc("/api/batch", handleBatch)
+	http.HandleFunc("/api/batch/", handleBatch)
+
+	// Operational endpoints stay off the public listener when a separate admin listener is configured
+	separateAdmin := config.AdminListen != "" || adminListener != nil
+	adminMux := http.DefaultServeMux
+	if separateAdmin {
+		adminMux = http.NewServeMux()
+	}
+	adminMux.HandleFunc("/api/admin/routes", requireAdmin(handleAdminRoutes))
+	adminMux.HandleFunc("/api/admin/defaults", requireAdmin(handleAdminDefaults))
+	adminMux.HandleFunc("/api/admin/debug/captures", requireAdmin(handleAdminCaptures))
+	adminMux.HandleFunc("/api/admin/debug/captures/", requireAdmin(handleAdminCaptures))
+	adminMux.HandleFunc("/api/admin/guardrail", requireAdmin(handleAdminGuardrail))
+	adminMux.HandleFunc("/api/admin/guardrail/audit", requireAdmin(handleAdminGuardrailAudit))
+	adminMux.HandleFunc("/api/admin/auto-routes", requireAdmin(handleAdminAutoRoutes))
+	adminMux.HandleFunc("/api/admin/stats", requireAdmin(handleAdminStats))
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	publicAddr := config.Listen
+	if publicAddr == "" {
+		publicAddr = ":" + port
+	}
+
+	publicListener := activated["public"]
+	if publicListener == nil {
+		publicListener, err = listen(publicAddr)
+		if err != nil {
+			log.Fatalf("Could not listen on %s: %v", publicAddr, err)
+		}
+		if config.Listen == "" {
+			log.Printf("Server starting on http://localhost:%s", port)
+		} else {
+			log.Printf("Server starting on %s", publicAddr)
+		}
+	} else {
+		log.Printf("Server starting on systemd-activated socket %s", publicListener.Addr())
+	}
+	log.Printf("Make sure Ollama is running on %s", config.DefaultBackend)
+	for _, route := range routes.Routes() {
+		log.Printf("Routing models matching %q to %s", route.Pattern, route.Backend)
+	}
+	if config.Chaos.Enabled {
+		log.Printf("⚠️ CHAOS MODE ENABLED: injecting latency (%.0f%%), 5xx errors (%.0f%%) and dropped streams (%.0f%%) into Ollama calls",
+			config.Chaos.LatencyRate*100, config.Chaos.ErrorRate*100, config.Chaos.DropRate*100)
+	}
+	if config.DebugCapture.Enabled {
+		log.Printf("Debug capture enabled: upstream payloads are recorded (last %d requests)", config.DebugCapture.MaxEntries)
+	}
+
+	if separateAdmin {
+		if adminListener == nil {
+			adminListener, err = listen(config.AdminListen)
+			if err != nil {
+				log.Fatalf("Could not open admin listener %s: %v", config.AdminListen, err)
+			}
+		}
+		log.Printf("Admin endpoints available on %s", adminListener.Addr())
+		go func() {
+			log.Fatal(newHTTPServer(forwardedMiddleware(requestIDMiddleware(recoveryMiddleware(crossSiteMiddleware(config.CORS, adminMux))))).Serve(adminListener))
+		}()
+	}
+
+	var public http.Handler = http.DefaultServeMux
+	if config.Kiosk.Enabled {
+		log.Printf("Kiosk mode: only the showcase for %s is served on %s", config.Kiosk.Model, publicListener.Addr())
+		public = kioskMiddleware(http.DefaultServeMux)
+	}
+	if len(config.CORS) > 0 {
+		public = corsMiddleware(config.CORS, public)
+	}
+	public = crossSiteMiddleware(config.CORS, public)
+	if config.BasePath != "" {
+		log.Printf("Serving under %s/", config.BasePath)
+		public = basePathMiddleware(config.BasePath, public)
+	}
+	log.Fatal(newHTTPServer(forwardedMiddleware(requestIDMiddleware(recoveryMiddleware(public)))).Serve(publicListener))
+}
+
+// newHTTPServer configures the server for long-lived streams: no overall write timeout (a
+// generation can take minutes) but per-write deadlines in eventStream, which needs the
+// connection in the request context.
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey, c)
+		},
+	}
+}
+
+// systemdListeners returns the sockets passed in by systemd socket activation (see sd_listen_fds(3)).
+// A socket whose FileDescriptorName is "admin" serves the admin endpoints; the first other socket
+// serves the public UI and API.
+func systemdListeners() (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return listeners, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return listeners, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	const firstFD = 3
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(firstFD+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("fd %d (%s): %v", firstFD+i, name, err)
+		}
+
+		role := "public"
+		if name == "admin" {
+			role = "admin"
+		}
+		if listeners[role] != nil {
+			ln.Close()
+			continue
+		}
+		listeners[role] = ln
+	}
+	return listeners, nil
+}
+
+// listen opens a TCP listener for "host:port", or a Unix domain socket for "unix:/path".
+func listen(addr string) (net.Listener, error) {
+	socketPath := strings.TrimPrefix(addr, "unix:")
+	if socketPath == addr {
+		return net.Listen("tcp", addr)
+	}
+	// A stale socket left behind by a previous run is replaced, but nothing else is: not a
+	// file, and not a socket that something still answers on
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use; is LAIM already running?", socketPath)
+		}
+	}
+	// By default only the owning user (and group) may talk to the socket
+	mode, err := strconv.ParseUint(config.SocketMode, 8, 32)
+	if err != nil {
+		mode = 0660
+	}
+
+	// The socket is created in a directory only LAIM may enter and gets its mode there, then
+	// moves into place, so nobody can connect while it still has the umask's mode.
+	dir, err := os.MkdirTemp(filepath.Dir(socketPath), ".laim")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	created := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", created)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(created, os.FileMode(mode)); err == nil {
+		err = os.Rename(created, socketPath)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &socketListener{Listener: ln, path: socketPath}, nil
+}
+
+// socketListener is a Unix socket that was moved into place after it was created. It reports
+// and, once closed, removes the path it was moved to.
+type socketListener struct {
+	net.Listener
+	path string
+}
+
+func (l *socketListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *socketListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+func serveRoot(w http.ResponseWriter, r *http.Request) {
+	// If the path isn't root (and hasn't been caught by /static/), return 404
+	if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+		http.NotFound(w, r)
+		return
+	}
+
+	servePage(w, "index.html")
+}
+
+// handleOllamaAction is a unified handler for all Ollama API interactions.
+func handleOllamaAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientReq, err := decodeClientRequest(w, r)
+	if err != nil {
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := downscaleRequestImages(&clientReq); err != nil {
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if clientReq.Private {
+		r = r.WithContext(context.WithValue(r.Context(), privateKey, true))
+	}
+	client := newOllamaClient(300 * time.Second)
+
+	if clientReq.Model == autoModel {
+		route, err := routeAutoModel(r.Context(), client, clientReq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		clientReq.Model = route.Model
+		r = withAutoRoute(w, r, route)
+	}
+
+	switch clientReq.ActionType {
+	case "generate", "chat", "longform", "roundtable":
+		var ok bool
+		if r, ok = withTokenQuota(w, r); !ok {
+			return
+		}
+		r = withGuardrail(w, r, clientReq)
+	case "pull", "delete", "unload", "create", "copy", "push":
+		if !isAdmin(r) {
+			http.Error(w, "Only admins may "+clientReq.ActionType+" models on this server; send the admin token", http.StatusForbidden)
+			return
+		}
+	}
+
+	switch clientReq.ActionType {
+	case "generate":
+		callGenerateAPI(w, r, clientReq, client)
+	case "chat":
+		callChatAPI(w, r, clientReq, client)
+	case "longform":
+		callLongformAPI(w, r, clientReq, client)
+	case "roundtable":
+		callRoundTableAPI(w, r, clientReq, client)
+	case "pull":
+		callModelPullAPI(w, r, clientReq, client)
+	case "delete":
+		callModelDeleteAPI(w, r, clientReq, client)
+	case "create":
+		callModelCreateAPI(w, r, clientReq, client)
+	case "copy":
+		callModelCopyAPI(w, r, clientReq, client)
+	case "push":
+		callModelPushAPI(w, r, clientReq, client)
+	case "unload":
+		callModelUnloadAPI(w, r, clientReq, client)
+	default:
+		http.Error(w, "Unknown action type: "+clientReq.ActionType, http.StatusBadRequest)
+	}
+}
+
+func callGenerateAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	ollamaReq := OllamaGenerateRequestPayload{
+		Model:     clientReq.Model,
+		Prompt:    clientReq.Prompt,
+		Images:    clientReq.Images,
+		Format:    clientReq.Format,
+		Stream:    true,
+		Options:   clientReq.Options,
+		KeepAlive: keepAliveFor(clientReq),
+	}
+	if clientReq.PromptID != "" {
+		if err := applyPromptToGenerate(&ollamaReq, clientReq.PromptID, clientReq.Variables); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ollamaReq.Prompt = expandBuiltinVariables(ollamaReq.Prompt, ollamaReq.Model)
+	ollamaReq.System = guardrailSystem(r.Context(), expandBuiltinVariables(ollamaReq.System, ollamaReq.Model))
+
+	preamble := requestEvents(r.Context())
+	if _, auto := generationTuning(clientReq); auto {
+		var event streamEvent
+		ollamaReq.Options, event = autoTemperature(ollamaReq.Options, clientReq.Prompt)
+		preamble = append(preamble, event)
+	}
+
+	if clientReq.Candidates > 1 {
+		runCandidates(w, r, routes.Resolve(clientReq.Model), ollamaGenerateAPI, client, clientReq.Candidates, clientReq.Pick == "judge", ollamaReq.Prompt, func(i int) interface{} {
+			candidate := ollamaReq
+			candidate.Options = candidateOptions(ollamaReq.Options, i)
+			return candidate
+		}, preamble...)
+		return
+	}
+
+	if len(ollamaReq.Format) > 0 {
+		prompt := ollamaReq.Prompt
+		runStructured(w, r, routes.Resolve(clientReq.Model), ollamaGenerateAPI, client, ollamaReq.Format, func(previous string, invalid error) interface{} {
+			if invalid != nil {
+				ollamaReq.Prompt = prompt + "\n\n" + structuredRetryPrompt(previous, invalid)
+			}
+			return ollamaReq
+		}, preamble...)
+		return
+	}
+	proxyStreamRequest(w, r, routes.Resolve(clientReq.Model), ollamaGenerateAPI, ollamaReq, client, preamble...)
+}
+
+func callChatAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	preamble := requestEvents(r.Context())
+	noCommands, _ := r.Context().Value(noCommandsKey).(bool)
+	if cmd, args, ok := parseSlashCommand(clientReq.Messages); ok && !noCommands {
+		result, err := cmd.Run(&clientReq, args)
+		if err != nil {
+			http.Error(w, "/"+cmd.Name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Slash command /%s on %s (request %s)", cmd.Name, clientReq.Model, requestIDFrom(r.Context()))
+		if !result.Generate {
+			stream := newEventStream(w, r)
+			stream.Event("command", result)
+			return
+		}
+		preamble = append(preamble, streamEvent{"command", result})
+	}
+
+	ollamaReq := OllamaChatRequestPayload{
+		Model:     clientReq.Model,
+		Messages:  clientReq.Messages,
+		Stream:    true,
+		Options:   clientReq.Options,
+		KeepAlive: keepAliveFor(clientReq),
+	}
+	if clientReq.PromptID != "" {
+		messages, err := applyPromptToChat(clientReq.Messages, clientReq.PromptID, clientReq.Variables)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ollamaReq.Messages = messages
+	}
+
+	ollamaReq.Messages = guardrailMessages(r.Context(), expandMessageVariables(ollamaReq.Messages, ollamaReq.Model))
+
+	if clientReq.EnableWebSearch {
+		if event, ok := addWebSearchContext(r.Context(), &ollamaReq); ok {
+			preamble = append(preamble, event)
+		}
+	}
+	if len(clientReq.Files) > 0 {
+		files, texts, err := transcribeAudioFiles(r.Context(), clientReq.Files)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		event, err := addContextFiles(&ollamaReq, files)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		preamble = append(preamble, event)
+		if len(texts) > 0 {
+			preamble = append(preamble, streamEvent{"transcripts", map[string]interface{}{"transcripts": texts}})
+		}
+	}
+
+	schedule, auto := generationTuning(clientReq)
+	if auto {
+		var event streamEvent
+		ollamaReq.Options, event = autoTemperature(ollamaReq.Options, lastUserMessage(clientReq.Messages))
+		preamble = append(preamble, event)
+	}
+
+	summarized := compactHistory(r.Context(), &ollamaReq)
+	usage := fitToContext(&ollamaReq)
+	usage.SummarizedMessages = summarized
+	preamble = append([]streamEvent{{"context", usage}}, preamble...)
+
+	if len(schedule) > 0 && len(clientReq.Tools) == 0 && len(clientReq.Format) == 0 {
+		runScheduledChat(w, r, ollamaReq, client, schedule, preamble...)
+		return
+	}
+
+	if clientReq.Candidates > 1 {
+		runCandidates(w, r, routes.Resolve(clientReq.Model), ollamaChatAPI, client, clientReq.Candidates, clientReq.Pick == "judge", lastUserMessage(ollamaReq.Messages), func(i int) interface{} {
+			candidate := ollamaReq
+			candidate.Options = candidateOptions(ollamaReq.Options, i)
+			return candidate
+		}, preamble...)
+		return
+	}
+
+	if len(clientReq.Tools) > 0 {
+		ollamaReq.Tools = resolveTools(clientReq.Tools)
+		runToolLoop(w, r, ollamaReq, client, preamble...)
+		return
+	}
+	if len(clientReq.Format) > 0 {
+		ollamaReq.Format = clientReq.Format
+		messages := ollamaReq.Messages
+		runStructured(w, r, routes.Resolve(clientReq.Model), ollamaChatAPI, client, ollamaReq.Format, func(previous string, invalid error) interface{} {
+			if invalid != nil {
+				ollamaReq.Messages = append(append([]Message(nil), messages...),
+					Message{Role: "assistant", Content: previous},
+					Message{Role: "user", Content: structuredRetryPrompt("", invalid)})
+			}
+			return ollamaReq
+		}, preamble...)
+		return
+	}
+	proxyStreamRequest(w, r, routes.Resolve(clientReq.Model), ollamaChatAPI, ollamaReq, client, preamble...)
+}
+
+// streamEvent is a named SSE event sent to the client ahead of the upstream response.
+type streamEvent struct {
+	Name string
+	Data interface{}
+}
+
+// Generic helper to handle streaming requests (Generate and Chat).
+// The request waits in the backend's generation queue first, streaming its position to the client;
+// once it is its turn, the preamble events are sent before Ollama's chunks.
+func proxyStreamRequest(w http.ResponseWriter, r *http.Request, backend, apiPath string, payload interface{}, client *http.Client, preamble ...streamEvent) {
+	stream := newEventStream(w, r)
+
+	release, ok := acquireGenerationSlot(r, stream, backend)
+	if !ok {
+		return
+	}
+	defer release()
+
+	for _, event := range preamble {
+		stream.Event(event.Name, event.Data)
+	}
+
+	// A resumable generation outlives its connection for the grace period, so a client that
+	// reconnects with Last-Event-ID can pick it up
+	ctx := r.Context()
+	var resumable *resumableStream
+	idPrefix := ""
+	if config.ResumeGraceSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(detachedContext{r.Context()})
+		defer cancel()
+		resumable = resumables.Start(requestIDFrom(r.Context()), clientFrom(r.Context()), cancel)
+		idPrefix = resumable.id
+		go func() {
+			<-r.Context().Done()
+			resumable.Detach()
+		}()
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, backend+apiPath, bytes.NewBuffer(payloadBytes))
+	req.Header.Set("Content-Type", "application/json")
+	var target struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(payloadBytes, &target)
+	model := target.Model
+
+	resp, err := client.Do(req)
+	if err != nil {
+		failure := classifyUpstream(model, 0, "", err)
+		resumable.Finish(failure.Message)
+		stream.FailUpstream(failure)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		failure := upstreamFailure(model, resp)
+		resumable.Finish(failure.Message)
+		stream.FailUpstream(failure)
+		return
+	}
+
+	// Ollama is read here and the client written by relay, so only the buffer limit, not the
+	// client's pace, decides how long the generation keeps its slot
+	buffer := newStreamBuffer(config.StreamBufferBytes)
+	relayed := make(chan struct{})
+	go func() {
+		buffer.relay(stream, idPrefix)
+		close(relayed)
+	}()
+
+	sample := quality.Sample(r.Context(), payload)
+	live := true
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		recordUsageLine(r.Context(), line)
+		sample.Add(line)
+		resumable.Append(line)
+		if live && !buffer.Push(line) {
+			log.Printf("Dropping stalled client %s: more than %d bytes of %s waiting (request %s)",
+				r.RemoteAddr, config.StreamBufferBytes, apiPath, requestIDFrom(r.Context()))
+			stream.Abort()
+			buffer.Close()
+			live = false
+			if resumable == nil {
+				resp.Body.Close() // Stops the generation on Ollama
+				<-relayed
+				return
+			}
+		}
+	}
+	if live {
+		buffer.Close()
+	}
+	<-relayed
+
+	failure := ""
+	if err := scanner.Err(); err != nil {
+		failure = "Ollama stream interrupted: " + err.Error()
+	}
+	if ctx.Err() != nil {
+		failure = "Generation stopped"
+	}
+	resumable.Finish(failure)
+	if failure != "" && ctx.Err() == nil {
+		stream.Fail(failure, http.StatusBadGateway)
+		return
+	}
+	if failure == "" {
+		quality.Keep(sample)
+	}
+	stream.start()
+}
+
+// acquireGenerationSlot waits for a free generation slot on the backend, streaming the queue
+// position to the client meanwhile. It returns false if the request was rejected or abandoned.
+func acquireGenerationSlot(r *http.Request, stream *eventStream, backend string) (func(), bool) {
+	release, err := generationQueue.Acquire(r.Context(), backend, func(position int) {
+		stream.Event("queue", map[string]int{"queue_position": position})
+	})
+	if errors.Is(err, errQueueFull) {
+		stream.Fail("Server busy: "+err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err != nil {
+		// The client went away while queued; nothing left to answer
+		return nil, false
+	}
+	return release, true
+}
+
+// callModelPullAPI starts a pull (or joins the one already running for the model) and streams
+// its progress. The pull itself runs in the background, so it survives the client going away.
+func callModelPullAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	job := pulls.Start(clientReq.Model, routes.Resolve(clientReq.Model))
+	followPull(w, r, job)
+}
+
+func callModelDeleteAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	if pendingDeletions.Enabled() {
+		scheduleModelDelete(w, r, clientReq.Model, client)
+		return
+	}
+
+	// Delete Logic - Note: Ollama expects DELETE method usually, but here we proxy via POST or DELETE based on API needs.
+	// We will stick to the standard logic used previously.
+	payloadBytes, _ := json.Marshal(OllamaModelActionPayload{Name: clientReq.Model})
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodDelete, routes.Resolve(clientReq.Model)+ollamaDeleteAPI, bytes.NewBuffer(payloadBytes))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	handleStandardResponse(w, resp, err, clientReq.Model)
+}
+
+// callModelCreateAPI derives a model from clientReq.From with its own system prompt and default
+// options. It is created on the backend the new name routes to.
+func callModelCreateAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	payload := OllamaCreatePayload{
+		Model:      clientReq.Model,
+		From:       clientReq.From,
+		System:     clientReq.System,
+		Parameters: clientReq.Options,
+		Stream:     true,
+	}
+	proxyProgressStream(w, r, routes.Resolve(clientReq.Model)+ollamaCreateAPI, clientReq.Model, payload, client)
+}
+
+func callModelCopyAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	payload := OllamaCopyPayload{Source: clientReq.Model, Destination: clientReq.Destination}
+	proxyStandardRequest(w, r, routes.Resolve(clientReq.Model)+ollamaCopyAPI, clientReq.Model, payload, client)
+}
+
+func callModelPushAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	payload := OllamaPushPayload{Model: clientReq.Model, Stream: true}
+	proxyProgressStream(w, r, routes.Resolve(clientReq.Model)+ollamaPushAPI, clientReq.Model, payload, client)
+}
+
+// callModelUnloadAPI frees the memory a loaded model holds without waiting for its keep-alive to expire.
+func callModelUnloadAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	payload := OllamaUnloadPayload{Model: clientReq.Model, KeepAlive: 0}
+	proxyStandardRequest(w, r, routes.Resolve(clientReq.Model)+ollamaGenerateAPI, clientReq.Model, payload, client)
+}
+
+// proxyProgressStream relays the NDJSON status lines of a long-running model operation
+// ({"status", "digest", "total", "completed"}) as server-sent events.
+func proxyProgressStream(w http.ResponseWriter, r *http.Request, url, model string, payload interface{}, client *http.Client) {
+	payloadBytes, _ := json.Marshal(payload)
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, url, bytes.NewBuffer(payloadBytes))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		writeUpstreamError(w, classifyUpstream(model, 0, "", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		writeUpstreamError(w, upstreamFailure(model, resp))
+		return
+	}
+
+	stream := newEventStream(w, r)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var status struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal([]byte(line), &status) == nil && status.Error != "" {
+			stream.FailUpstream(classifyUpstream(model, 0, status.Error, nil))
+			return
+		}
+		stream.Data(line)
+	}
+	if err := scanner.Err(); err != nil && r.Context().Err() == nil {
+		stream.Fail("Ollama stream interrupted: "+err.Error(), http.StatusBadGateway)
+	}
+}
+
+// fetchInstalledModels returns the models installed on one backend.
+func fetchInstalledModels(ctx context.Context, client *http.Client, backend string) ([]OllamaModel, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, backend+ollamaTagsAPI, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama answered %s", resp.Status)
+	}
+	var tags OllamaTagsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("could not decode model list: %v", err)
+	}
+	return tags.Models, nil
+}
+
+func handleListModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := newOllamaClient(10 * time.Second)
+	if model := defaultModel(); model != "" {
+		w.Header().Set("X-Default-Model", model)
+	}
+
+	backends := routes.Backends()
+	if len(backends) == 1 {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, backends[0]+ollamaTagsAPI, nil)
+		resp, err := client.Do(req)
+		handleStandardResponse(w, resp, err, "")
+		return
+	}
+
+	// With several backends, merge their model lists so routed models show up in the UI
+	merged := OllamaTagsResponse{Models: []OllamaModel{}}
+	seen := make(map[string]bool)
+	for _, backend := range backends {
+		models, err := fetchInstalledModels(r.Context(), client, backend)
+		if err != nil {
+			log.Printf("Could not list models on %s: %v", backend, err)
+			continue
+		}
+		for _, m := range models {
+			if !seen[m.Name] {
+				seen[m.Name] = true
+				merged.Models = append(merged.Models, m)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merged)
+}
+
+// handleAdminRoutes lists (GET) or replaces (PUT) the model routing table.
+func handleAdminRoutes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"default_backend": config.DefaultBackend,
+			"routes":          routes.Routes(),
+		})
+	case http.MethodPut:
+		var newRoutes []ModelRoute
+		if err := json.NewDecoder(r.Body).Decode(&newRoutes); err != nil {
+			http.Error(w, "Invalid routes payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateRoutes(newRoutes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		routes.Replace(newRoutes)
+		log.Printf("Routing table replaced via admin API (%d routes)", len(newRoutes))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GlobalDefaults are the server-wide settings PUT /api/admin/defaults changes while LAIM runs.
+// They start from the config file and, like the routing table, go back to it on a restart.
+type GlobalDefaults struct {
+	DefaultModel           string `json:"default_model"`             // Selected in the UI when it loads
+	DailyTokens            int    `json:"daily_tokens"`              // As in token_quota
+	WarnPercent            int    `json:"warn_percent"`              // As in token_quota
+	HardCap                bool   `json:"hard_cap"`                  // As in token_quota
+	KioskRequestsPerMinute int    `json:"kiosk_requests_per_minute"` // kiosk.requests_per_minute
+}
+
+// defaultsMu guards the fields of config that GlobalDefaults changes.
+var defaultsMu sync.RWMutex
+
+func currentDefaults() GlobalDefaults {
+	defaultsMu.RLock()
+	defer defaultsMu.RUnlock()
+	return GlobalDefaults{
+		DefaultModel:           config.DefaultModel,
+		DailyTokens:            config.TokenQuota.DailyTokens,
+		WarnPercent:            config.TokenQuota.WarnPercent,
+		HardCap:                config.TokenQuota.HardCap,
+		KioskRequestsPerMinute: kioskLimiter.Limit(),
+	}
+}
+
+func (d GlobalDefaults) Validate() error {
+	switch {
+	case d.DefaultModel != "" && !modelNamePattern.MatchString(d.DefaultModel):
+		return fmt.Errorf("%q is not a model name", d.DefaultModel)
+	case d.DailyTokens < 0:
+		return errors.New("daily_tokens must not be negative")
+	case d.WarnPercent < 1 || d.WarnPercent > 100:
+		return errors.New("warn_percent must be between 1 and 100")
+	case d.KioskRequestsPerMinute < 1:
+		return errors.New("kiosk_requests_per_minute must be at least 1")
+	}
+	return nil
+}
+
+// defaultModel returns the model the UI selects when it loads, if one is set.
+func defaultModel() string {
+	defaultsMu.RLock()
+	defer defaultsMu.RUnlock()
+	return config.DefaultModel
+}
+
+// handleAdminDefaults returns (GET) or replaces (PUT) the global defaults. Fields left out of a
+// PUT keep their current values.
+func handleAdminDefaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		d := currentDefaults()
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&d); err != nil {
+			http.Error(w, "Invalid defaults: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := d.Validate(); err != nil {
+			http.Error(w, "Invalid defaults: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defaultsMu.Lock()
+		config.DefaultModel = d.DefaultModel
+		config.TokenQuota.DailyTokens = d.DailyTokens
+		config.TokenQuota.WarnPercent = d.WarnPercent
+		config.TokenQuota.HardCap = d.HardCap
+		defaultsMu.Unlock()
+		kioskLimiter.SetLimit(d.KioskRequestsPerMinute)
+		log.Printf("Global defaults changed via admin API: %+v", d)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentDefaults())
+}
+
+// handleAdminCaptures lists debug captures, or returns a single one at /api/admin/debug/captures/{request_id}.
+func handleAdminCaptures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !config.DebugCapture.Enabled {
+		http.Error(w, "Debug capture is disabled (set debug_capture.enabled in the config file)", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/debug/captures"), "/")
+	if id == "" {
+		json.NewEncoder(w).Encode(captures.List())
+		return
+	}
+
+	capture, ok := captures.Get(id)
+	if !ok {
+		http.Error(w, "No capture for request ID "+id, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(capture)
+}
+
+// Helper for non-streaming requests
+func proxyStandardRequest(w http.ResponseWriter, r *http.Request, url, model string, payload interface{}, client *http.Client) {
+	payloadBytes, _ := json.Marshal(payload)
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, url, bytes.NewBuffer(payloadBytes))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	handleStandardResponse(w, resp, err, model)
+}
+
+// handleStandardResponse relays an Ollama answer as is, and its failures as classified UpstreamErrors.
+func handleStandardResponse(w http.ResponseWriter, resp *http.Response, err error, model string) {
+	if err != nil {
+		writeUpstreamError(w, classifyUpstream(model, 0, "", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		writeUpstreamError(w, upstreamFailure(model, resp))
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
+
+// --- Ollama Client Helpers ---
+
+// ollamaGenerateOnce runs a non-streaming generation and returns the complete response.
+func ollamaGenerateOnce(ctx context.Context, client *http.Client, backend string, payload OllamaGenerateRequestPayload) (OllamaResponseChunk, error) {
+	payload.Stream = false
+	var result OllamaResponseChunk
+	err := ollamaStream(ctx, client, backend+ollamaGenerateAPI, payload, func(chunk OllamaResponseChunk) {
+		result = chunk
+	})
+	return result, err
+}
+
+// ollamaStream posts payload to an Ollama endpoint and calls onChunk for every NDJSON line of the response.
+func ollamaStream(ctx context.Context, client *http.Client, url string, payload interface{}, onChunk func(OllamaResponseChunk)) error {
+	payloadBytes, _ := json.Marshal(payload)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(payloadBytes))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return classifyUpstream("", 0, "", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return upstreamFailure("", resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var chunk OllamaResponseChunk
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return fmt.Errorf("invalid Ollama response: %v", err)
+		}
+		if chunk.Done {
+			usage.Record(clientFrom(ctx), chunk)
+		}
+		onChunk(chunk)
+	}
+	return scanner.Err()
+}
+
+// --- Long-Form Generation ---
+
+// How much of the already written text is fed back to the model as rolling context
+const longformContextChars = 6000
+
+// LongformPlan is the outline the model produces before writing a long document.
+type LongformPlan struct {
+	Title    string   `json:"title"`
+	Sections []string `json:"sections"`
+}
+
+// callLongformAPI writes documents longer than a single response allows: the model first plans
+// an outline, then writes each section in turn with the tail of the text so far as context.
+// Sections stream to the client as ordinary generate chunks, so the output reads as one document.
+func callLongformAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	backend := routes.Resolve(clientReq.Model)
+	stream := newEventStream(w, r)
+
+	release, ok := acquireGenerationSlot(r, stream, backend)
+	if !ok {
+		return
+	}
+	defer release()
+
+	plan, err := planLongform(r.Context(), client, backend, clientReq)
+	if err != nil {
+		stream.Fail("Could not plan the document: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	stream.Event("plan", plan)
+
+	var document strings.Builder
+	emit := func(text string) {
+		document.WriteString(text)
+		stream.JSON(OllamaResponseChunk{Model: clientReq.Model, Response: text})
+	}
+
+	if plan.Title != "" {
+		emit("# " + plan.Title + "\n\n")
+	}
+	for i, title := range plan.Sections {
+		stream.Event("section", map[string]interface{}{"index": i + 1, "total": len(plan.Sections), "title": title})
+		emit("## " + title + "\n\n")
+
+		payload := OllamaGenerateRequestPayload{
+			Model:     clientReq.Model,
+			Prompt:    longformSectionPrompt(clientReq.Prompt, plan, i, document.String()),
+			System:    guardrailSystem(r.Context(), ""),
+			Stream:    true,
+			Options:   clientReq.Options,
+			KeepAlive: keepAliveFor(clientReq),
+		}
+		err := ollamaStream(r.Context(), client, backend+ollamaGenerateAPI, payload, func(chunk OllamaResponseChunk) {
+			if chunk.Response != "" {
+				emit(chunk.Response)
+			}
+		})
+		if err != nil {
+			if r.Context().Err() == nil {
+				stream.Fail(fmt.Sprintf("Section %d failed: %v", i+1, err), http.StatusBadGateway)
+			}
+			return
+		}
+		emit("\n\n")
+	}
+
+	stream.JSON(OllamaResponseChunk{Model: clientReq.Model, Done: true})
+}
+
+func planLongform(ctx context.Context, client *http.Client, backend string, clientReq ClientRequest) (LongformPlan, error) {
+	prompt := fmt.Sprintf(`You are planning a long document that will be written one section at a time.
+
+Request: %s
+
+Reply with JSON only, in the form {"title": "...", "sections": ["...", "..."]}, listing between 3 and %d section headings in reading order.`,
+		clientReq.Prompt, config.LongformMaxSections)
+
+	resp, err := ollamaGenerateOnce(ctx, client, backend, OllamaGenerateRequestPayload{
+		Model:     clientReq.Model,
+		Prompt:    prompt,
+		System:    guardrailSystem(ctx, ""),
+		Format:    json.RawMessage(`"json"`),
+		Options:   clientReq.Options,
+		KeepAlive: keepAliveFor(clientReq),
+	})
+	if err != nil {
+		return LongformPlan{}, err
+	}
+
+	var plan LongformPlan
+	if err := json.Unmarshal([]byte(resp.Response), &plan); err != nil {
+		return LongformPlan{}, fmt.Errorf("model returned an invalid outline: %v", err)
+	}
+	var sections []string
+	for _, title := range plan.Sections {
+		if title = strings.TrimSpace(title); title != "" {
+			sections = append(sections, title)
+		}
+	}
+	if len(sections) == 0 {
+		return LongformPlan{}, errors.New("model returned an empty outline")
+	}
+	if len(sections) > config.LongformMaxSections {
+		sections = sections[:config.LongformMaxSections]
+	}
+	plan.Sections = sections
+	return plan, nil
+}
+
+func longformSectionPrompt(request string, plan LongformPlan, index int, written string) string {
+	var sb strings.Builder
+	sb.WriteString("You are writing a long document one section at a time.\n\n")
+	fmt.Fprintf(&sb, "Request: %s\n\n", request)
+	if plan.Title != "" {
+		fmt.Fprintf(&sb, "Title: %s\n\n", plan.Title)
+	}
+	sb.WriteString("Outline:\n")
+	for i, title := range plan.Sections {
+		fmt.Fprintf(&sb, "%d. %s\n", i+1, title)
+	}
+
+	if index > 0 {
+		if len(written) > longformContextChars {
+			start := len(written) - longformContextChars
+			for start < len(written) && !utf8.RuneStart(written[start]) {
+				start++
+			}
+			written = "..." + written[start:]
+		}
+		fmt.Fprintf(&sb, "\nThe document so far ends with:\n\"\"\"\n%s\n\"\"\"\n", written)
+	}
+
+	fmt.Fprintf(&sb, "\nWrite section %d, \"%s\". Write only the body of this section, without its heading, "+
+		"continuing naturally from what came before and leaving later sections' topics for later.", index+1, plan.Sections[index])
+	return sb.String()
+}
+
+// --- Data Directory ---
+
+// loadJSONFile reads name from the data directory into v. A missing file (or no data
+// directory) leaves v untouched.
+func loadJSONFile(name string, v interface{}) error {
+	if config.DataDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(config.DataDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// appendJSONLine appends v as one line of JSON to name in the data directory.
+func appendJSONLine(name string, v interface{}) error {
+	if config.DataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(config.DataDir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// saveJSONFile atomically replaces name in the data directory with v encoded as JSON.
+func saveJSONFile(name string, v interface{}) error {
+	if config.DataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(config.DataDir, name)
+	tmp := target + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// --- Prompt Library ---
+
+// Prompt is a reusable persona (kind "system") or prompt template (kind "template").
+// Both may contain {{variables}}; in a template, {{input}} stands for the user's own text.
+type Prompt struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Kind        string   `json:"kind"`
+	Content     string   `json:"content"`
+	Variables   []string `json:"variables"`
+	Builtin     bool     `json:"builtin"`
+
+	// Generation tuning used with this persona; a request's own settings take precedence
+	Schedule        []ScheduleStep `json:"schedule,omitempty"`
+	AutoTemperature bool           `json:"auto_temperature,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Version goes up with every change. An update or delete that names the version it read
+	// (in the body or as If-Match) fails if someone else changed the prompt in the meantime.
+	Version int `json:"version"`
+}
+
+const promptsFile = "prompts.json"
+
+var templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+var builtinPrompts = []Prompt{
+	{
+		ID:          "assistant",
+		Name:        "Helpful Assistant",
+		Description: "Concise, friendly general-purpose assistant.",
+		Kind:        "system",
+		Content:     "You are a helpful assistant. Answer clearly and concisely, and say so when you are unsure.",
+	},
+	{
+		ID:          "code-reviewer",
+		Name:        "Code Reviewer",
+		Description: "Senior engineer reviewing code for bugs, security and readability.",
+		Kind:        "system",
+		Content:     "You are a senior {{language}} engineer doing a code review. Point out bugs, security issues and unclear code, most important first, and suggest concrete fixes.",
+	},
+	{
+		ID:          "security-analyst",
+		Name:        "Security Analyst",
+		Description: "Threat-focused analysis of systems and configurations.",
+		Kind:        "system",
+		Content:     "You are a senior security analyst. Assess risks realistically, explain the attack scenario behind each finding and prioritise mitigations.",
+	},
+	{
+		ID:          "translate",
+		Name:        "Translate",
+		Description: "Translate the input into another language.",
+		Kind:        "template",
+		Content:     "Translate the following text into {{language}}. Reply with the translation only.\n\n{{input}}",
+	},
+	{
+		ID:          "summarize",
+		Name:        "Summarize",
+		Description: "Summarize the input as bullet points.",
+		Kind:        "template",
+		Content:     "Summarize the following text in at most {{bullets}} bullet points.\n\n{{input}}",
+	},
+}
+
+// PromptStore holds the built-in prompts plus user-defined ones persisted in the data directory.
+type PromptStore struct {
+	mu      sync.RWMutex
+	prompts map[string]Prompt
+}
+
+var prompts *PromptStore
+
+func NewPromptStore() *PromptStore {
+	ps := &PromptStore{prompts: make(map[string]Prompt)}
+
+	var saved []Prompt
+	if err := loadJSONFile(promptsFile, &saved); err != nil {
+		log.Printf("⚠️ WARNING: Could not load prompt library: %v", err)
+	}
+	for _, p := range saved {
+		p.Variables = templateVariables(p.Content)
+		if p.Version == 0 { // Saved before prompts had versions
+			p.Version = 1
+		}
+		ps.prompts[p.ID] = p
+	}
+	for _, p := range builtinPrompts {
+		p.Builtin = true
+		p.Version = 1
+		p.Variables = templateVariables(p.Content)
+		ps.prompts[p.ID] = p
+	}
+	return ps
+}
+
+func (ps *PromptStore) List() []Prompt {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	list := make([]Prompt, 0, len(ps.prompts))
+	for _, p := range ps.prompts {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Builtin != list[j].Builtin {
+			return list[i].Builtin
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (ps *PromptStore) Get(id string) (Prompt, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	p, ok := ps.prompts[id]
+	return p, ok
+}
+
+// Save creates or updates a user-defined prompt. Built-in prompts are read-only. An update
+// with a Version only succeeds if that is still the stored version.
+func (ps *PromptStore) Save(p Prompt) (Prompt, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := time.Now().UTC()
+	if existing, ok := ps.prompts[p.ID]; ok {
+		if existing.Builtin {
+			return Prompt{}, errBuiltinPrompt
+		}
+		if p.Version != 0 && p.Version != existing.Version {
+			return existing, errPromptVersion
+		}
+		p.CreatedAt = existing.CreatedAt
+		p.Version = existing.Version + 1
+	} else {
+		p.CreatedAt = now
+		p.Version = 1
+	}
+	p.UpdatedAt = now
+	p.Builtin = false
+	p.Variables = templateVariables(p.Content)
+	ps.prompts[p.ID] = p
+	return p, ps.persist()
+}
+
+// Delete removes a user-defined prompt; a version other than 0 must be the stored one.
+func (ps *PromptStore) Delete(id string, version int) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	existing, ok := ps.prompts[id]
+	if !ok {
+		return errPromptNotFound
+	}
+	if existing.Builtin {
+		return errBuiltinPrompt
+	}
+	if version != 0 && version != existing.Version {
+		return errPromptVersion
+	}
+	delete(ps.prompts, id)
+	return ps.persist()
+}
+
+// persist writes the user-defined prompts; callers hold the lock.
+func (ps *PromptStore) persist() error {
+	var custom []Prompt
+	for _, p := range ps.prompts {
+		if !p.Builtin {
+			custom = append(custom, p)
+		}
+	}
+	return saveJSONFile(promptsFile, custom)
+}
+
+var errPromptNotFound = errors.New("prompt not found")
+var errBuiltinPrompt = errors.New("built-in prompts cannot be modified")
+var errPromptVersion = errors.New("prompt was changed since it was read; fetch it again and reapply your change")
+
+// templateVariables lists the distinct {{variables}} used in content, in order of appearance.
+// Built-in variables such as {{date}} are filled in by LAIM and not listed.
+func templateVariables(content string) []string {
+	vars := []string{}
+	seen := make(map[string]bool)
+	for _, m := range templateVariablePattern.FindAllStringSubmatch(content, -1) {
+		if _, builtin := findBuiltinVariable(m[1]); builtin {
+			continue
+		}
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			vars = append(vars, m[1])
+		}
+	}
+	return vars
+}
+
+// renderTemplate substitutes {{variables}} and fails if any of them has no value.
+// Built-in variables without a value are left for expandBuiltinVariables.
+func renderTemplate(content string, vars map[string]string) (string, error) {
+	var missing []string
+	for _, name := range templateVariables(content) {
+		if _, ok := vars[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing template variables: %s", strings.Join(missing, ", "))
+	}
+	return templateVariablePattern.ReplaceAllStringFunc(content, func(m string) string {
+		if v, ok := vars[templateVariablePattern.FindStringSubmatch(m)[1]]; ok {
+			return v
+		}
+		return m
+	}), nil
+}
+
+// renderPrompt renders a library prompt; input fills {{input}} unless the caller set it explicitly.
+func renderPrompt(id string, vars map[string]string, input string) (Prompt, string, error) {
+	p, ok := prompts.Get(id)
+	if !ok {
+		return Prompt{}, "", fmt.Errorf("unknown promptId %q", id)
+	}
+	all := map[string]string{"input": input}
+	for k, v := range vars {
+		all[k] = v
+	}
+	rendered, err := renderTemplate(p.Content, all)
+	return p, rendered, err
+}
+
+// applyPromptToGenerate sets a persona as the system prompt, or wraps the prompt in a template.
+func applyPromptToGenerate(req *OllamaGenerateRequestPayload, id string, vars map[string]string) error {
+	p, rendered, err := renderPrompt(id, vars, req.Prompt)
+	if err != nil {
+		return err
+	}
+	if p.Kind == "system" {
+		req.System = rendered
+	} else {
+		req.Prompt = rendered
+	}
+	return nil
+}
+
+// applyPromptToChat puts a persona in front of the conversation, or wraps the latest user message in a template.
+func applyPromptToChat(messages []Message, id string, vars map[string]string) ([]Message, error) {
+	last := -1
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			last = i
+			break
+		}
+	}
+	input := ""
+	if last >= 0 {
+		input = messages[last].Content
+	}
+
+	p, rendered, err := renderPrompt(id, vars, input)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]Message(nil), messages...)
+	if p.Kind == "system" {
+		return append([]Message{{Role: "system", Content: rendered}}, out...), nil
+	}
+	if last < 0 {
+		return nil, errors.New("template prompts need a user message")
+	}
+	out[last].Content = rendered
+	return out, nil
+}
+
+var promptIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// handlePrompts serves the prompt library: GET/POST /api/prompts and GET/PUT/DELETE /api/prompts/{id}.
+func handlePrompts(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/prompts"), "/")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(prompts.List())
+		case http.MethodPost:
+			savePromptFromRequest(w, r, "")
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p, ok := prompts.Get(id)
+		if !ok {
+			http.Error(w, errPromptNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", promptETag(p))
+		json.NewEncoder(w).Encode(p)
+	case http.MethodPut:
+		if _, ok := prompts.Get(id); !ok {
+			http.Error(w, errPromptNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		savePromptFromRequest(w, r, id)
+	case http.MethodDelete:
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if pendingDeletions.Enabled() {
+			schedulePromptDelete(w, id, version)
+			return
+		}
+		err = prompts.Delete(id, version)
+		switch {
+		case errors.Is(err, errPromptNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errBuiltinPrompt):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, errPromptVersion):
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		case err != nil:
+			http.Error(w, "Could not save prompt library: "+err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// savePromptFromRequest creates (id == "") or replaces a prompt from the request body.
+func savePromptFromRequest(w http.ResponseWriter, r *http.Request, id string) {
+	var p Prompt
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		http.Error(w, "Invalid prompt payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if id != "" {
+		p.ID = id
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if version != 0 {
+			p.Version = version
+		}
+	} else if p.ID == "" {
+		p.ID = slugify(p.Name)
+	}
+	if _, exists := prompts.Get(p.ID); exists && id == "" {
+		http.Error(w, "A prompt with ID "+p.ID+" already exists", http.StatusConflict)
+		return
+	}
+	if !promptIDPattern.MatchString(p.ID) {
+		http.Error(w, "Prompt ID must be lowercase letters, digits and dashes", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(p.Name) == "" || strings.TrimSpace(p.Content) == "" {
+		http.Error(w, "name and content are required", http.StatusBadRequest)
+		return
+	}
+	if p.Kind == "" {
+		p.Kind = "system"
+	}
+	if p.Kind != "system" && p.Kind != "template" {
+		http.Error(w, `kind must be "system" or "template"`, http.StatusBadRequest)
+		return
+	}
+	if err := validateSchedule(p.Schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	saved, err := prompts.Save(p)
+	if errors.Is(err, errBuiltinPrompt) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errPromptVersion) {
+		w.Header().Set("ETag", promptETag(saved))
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not save prompt library: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", promptETag(saved))
+	if id == "" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(saved)
+}
+
+// promptETag is a prompt's version as an HTTP entity tag.
+func promptETag(p Prompt) string {
+	return strconv.Quote(strconv.Itoa(p.Version))
+}
+
+// ifMatchVersion reads the prompt version from an If-Match header; 0 when there is none.
+func ifMatchVersion(r *http.Request) (int, error) {
+	tag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if tag == "" || tag == "*" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(tag, "W/"), `"`))
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("If-Match must be a prompt's ETag, got %s", tag)
+	}
+	return version, nil
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slugify(name string) string {
+	slug := strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(slug) > 64 {
+		slug = strings.TrimRight(slug[:64], "-")
+	}
+	return slug
+}
+
+// --- Context Window Management ---
+
+// Per-message overhead of the chat template (role markers, separators)
+const messageTokenOverhead = 4
+
+// ContextUsage is reported to the client in an "context" event before a chat response streams.
+type ContextUsage struct {
+	PromptTokens    int `json:"prompt_tokens"` // Estimated tokens of the messages actually sent
+	NumCtx          int `json:"num_ctx"`
+	Budget          int `json:"budget"` // Tokens available to the prompt after reserving room for the reply
+	TrimmedMessages int `json:"trimmed_messages"`
+
+	SummarizedMessages int `json:"summarized_messages"` // Older messages replaced by a summary
+}
+
+// estimateTokens approximates the token count of text. Ollama has no tokenize endpoint, and
+// ~4 characters per token holds well enough for English text and code across common tokenizers.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+func estimateMessageTokens(messages []Message) int {
+	total := 0
+	for _, m := range messages {
+		total += estimateTokens(m.Content) + messageTokenOverhead
+	}
+	return total
+}
+
+// fitToContext drops the oldest non-system messages until the history fits the model's context
+// window, leaving room for the reply. System messages and the latest message are always kept.
+func fitToContext(req *OllamaChatRequestPayload) ContextUsage {
+	numCtx := optionInt(req.Options, "num_ctx", config.DefaultNumCtx)
+
+	reserve := optionInt(req.Options, "num_predict", 512)
+	if reserve < 0 || reserve > numCtx/2 {
+		reserve = numCtx / 2
+	}
+	usage := ContextUsage{NumCtx: numCtx, Budget: numCtx - reserve}
+
+	messages := req.Messages
+	tokens := estimateMessageTokens(messages)
+	for tokens > usage.Budget {
+		drop := -1
+		for i, m := range messages[:len(messages)-1] {
+			if m.Role != "system" {
+				drop = i
+				break
+			}
+		}
+		if drop < 0 {
+			break
+		}
+		tokens -= estimateTokens(messages[drop].Content) + messageTokenOverhead
+		messages = append(append([]Message(nil), messages[:drop]...), messages[drop+1:]...)
+		usage.TrimmedMessages++
+	}
+
+	if usage.TrimmedMessages > 0 {
+		log.Printf("Trimmed %d old messages to fit %s's context window (%d tokens)", usage.TrimmedMessages, req.Model, numCtx)
+	}
+	req.Messages = messages
+	usage.PromptTokens = tokens
+	return usage
+}
+
+// optionInt reads an integer generation option, falling back to def when it is not set.
+func optionInt(options map[string]interface{}, key string, def int) int {
+	if v, ok := options[key].(float64); ok && v > 0 {
+		return int(v)
+	}
+	if v, ok := options[key].(int); ok && v > 0 {
+		return v
+	}
+	return def
+}
+
+// --- Conversation Summarization ---
+
+// SummaryCache remembers summaries of conversation prefixes. The browser resends the whole
+// history on every turn, so a prefix is identified by a hash chained over its messages.
+type SummaryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      []string
+	summaries  map[string]string
+	pending    map[string]bool
+}
+
+var summaries *SummaryCache
+
+func NewSummaryCache(maxEntries int) *SummaryCache {
+	return &SummaryCache{maxEntries: maxEntries, summaries: make(map[string]string), pending: make(map[string]bool)}
+}
+
+func (sc *SummaryCache) Get(key string) (string, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	summary, ok := sc.summaries[key]
+	return summary, ok
+}
+
+func (sc *SummaryCache) Put(key, summary string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, exists := sc.summaries[key]; !exists {
+		sc.order = append(sc.order, key)
+	}
+	sc.summaries[key] = summary
+	for len(sc.order) > sc.maxEntries {
+		delete(sc.summaries, sc.order[0])
+		sc.order = sc.order[1:]
+	}
+}
+
+// claim marks a summarization as in progress; it returns false if one is already running.
+func (sc *SummaryCache) claim(key string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.pending[key] {
+		return false
+	}
+	sc.pending[key] = true
+	return true
+}
+
+func (sc *SummaryCache) done(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.pending, key)
+}
+
+// prefixHashes returns hashes[i] identifying messages[:i+1].
+func prefixHashes(model string, messages []Message) []string {
+	hashes := make([]string, len(messages))
+	prev := sha256.Sum256([]byte(model))
+	for i, m := range messages {
+		h := sha256.New()
+		h.Write(prev[:])
+		h.Write([]byte(m.Role + "\x00" + m.Content + "\x00"))
+		copy(prev[:], h.Sum(nil))
+		hashes[i] = hex.EncodeToString(prev[:])
+	}
+	return hashes
+}
+
+// compactHistory replaces the older part of a long chat with the most recent cached summary of
+// it, and schedules a background summarization when the summary doesn't cover enough history.
+// Leading system messages (personas) are kept as they are. Returns the number of messages replaced.
+func compactHistory(ctx context.Context, req *OllamaChatRequestPayload) int {
+	if config.SummarizeAfterMessages <= 0 || len(req.Messages) <= config.SummarizeAfterMessages {
+		return 0
+	}
+
+	head := 0
+	for head < len(req.Messages) && req.Messages[head].Role == "system" {
+		head++
+	}
+	body := req.Messages[head:]
+	cut := len(body) - config.SummaryKeepRecent
+	if cut <= 0 {
+		return 0
+	}
+	hashes := prefixHashes(req.Model, body[:cut])
+
+	covered, summary := 0, ""
+	for n := cut; n > 0; n-- {
+		if s, ok := summaries.Get(hashes[n-1]); ok {
+			covered, summary = n, s
+			break
+		}
+	}
+
+	// Refresh the summary in the background once enough new turns piled up behind it
+	if cut-covered >= config.SummaryKeepRecent && summaries.claim(hashes[cut-1]) {
+		// The summary is LAIM's own work, but a private chat keeps it out of debug captures
+		background := context.Background()
+		if isPrivate(ctx) {
+			background = context.WithValue(background, privateKey, true)
+		}
+		go summarizeHistory(background, req.Model, hashes[cut-1], summary, append([]Message(nil), body[covered:cut]...))
+	}
+
+	if covered == 0 {
+		return 0
+	}
+	messages := append([]Message(nil), req.Messages[:head]...)
+	messages = append(messages, Message{Role: "system", Content: "Summary of the earlier conversation:\n" + summary})
+	messages = append(messages, body[covered:]...)
+	req.Messages = messages
+	return covered
+}
+
+// summarizeHistory condenses turns (continuing an earlier summary, if any) and caches the result under key.
+func summarizeHistory(ctx context.Context, chatModel, key, previous string, turns []Message) {
+	defer summaries.done(key)
+
+	model := config.SummaryModel
+	if model == "" {
+		model = chatModel
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Summarize the conversation below between a user and an assistant so that it can be continued without the original. " +
+		"Keep facts, decisions, names, numbers, code identifiers and open questions. Write in the third person, as compact notes.\n\n")
+	if previous != "" {
+		fmt.Fprintf(&sb, "Summary of what came before:\n%s\n\n", previous)
+	}
+	sb.WriteString("Conversation:\n")
+	for _, m := range turns {
+		fmt.Fprintf(&sb, "%s: %s\n\n", strings.ToUpper(m.Role), m.Content)
+	}
+
+	backend := routes.Resolve(model)
+	release, err := generationQueue.Acquire(ctx, backend, func(int) {})
+	if err != nil {
+		log.Printf("Skipping conversation summary: %v", err)
+		return
+	}
+	defer release()
+
+	resp, err := ollamaGenerateOnce(ctx, newOllamaClient(300*time.Second), backend, OllamaGenerateRequestPayload{
+		Model:  model,
+		Prompt: sb.String(),
+	})
+	if err != nil {
+		log.Printf("Conversation summary failed: %v", err)
+		return
+	}
+	summaries.Put(key, strings.TrimSpace(resp.Response))
+	log.Printf("Summarized %d older chat messages with %s", len(turns), model)
+}
+
+// --- Usage Accounting ---
+
+// UsageTotals aggregates the statistics Ollama reports on the final chunk of each generation.
+type UsageTotals struct {
+	Requests        int   `json:"requests"`
+	PromptTokens    int   `json:"prompt_tokens"`
+	EvalTokens      int   `json:"eval_tokens"`
+	TotalDurationMS int64 `json:"total_duration_ms"`
+	EvalDurationMS  int64 `json:"eval_duration_ms"`
+}
+
+func (t *UsageTotals) add(o UsageTotals) {
+	t.Requests += o.Requests
+	t.PromptTokens += o.PromptTokens
+	t.EvalTokens += o.EvalTokens
+	t.TotalDurationMS += o.TotalDurationMS
+	t.EvalDurationMS += o.EvalDurationMS
+}
+
+// UsageRecord is the total for one model, used by one client, on one (UTC) day.
+type UsageRecord struct {
+	Day    string `json:"day"`
+	Model  string `json:"model"`
+	Client string `json:"client"`
+	UsageTotals
+}
+
+// UsageGroup is one row of GET /api/usage.
+type UsageGroup struct {
+	Key string `json:"key"`
+	UsageTotals
+}
+
+const (
+	usageFile          = "usage.json"
+	usageFlushInterval = time.Minute // How often new statistics are written to usageFile
+	usageRetentionDays = 400         // Older days are dropped
+)
+
+// UsageStore keeps daily per-model, per-client totals, persisted in the data directory.
+type UsageStore struct {
+	mu      sync.Mutex
+	records map[string]*UsageRecord
+	dirty   bool       // Records changed since the last Flush
+	flushMu sync.Mutex // Keeps writes of usageFile in order
+}
+
+var usage *UsageStore
+
+func NewUsageStore() *UsageStore {
+	us := &UsageStore{records: make(map[string]*UsageRecord)}
+	var saved []*UsageRecord
+	if err := loadJSONFile(usageFile, &saved); err != nil {
+		log.Printf("⚠️ WARNING: Could not load usage statistics: %v", err)
+	}
+	for _, rec := range saved {
+		us.records[rec.Day+"|"+rec.Model+"|"+rec.Client] = rec
+	}
+	return us
+}
+
+// Record adds the statistics of a finished generation.
+func (us *UsageStore) Record(client string, final OllamaResponseChunk) {
+	if final.Model == "" {
+		return
+	}
+	day := time.Now().UTC().Format("2006-01-02")
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	key := day + "|" + final.Model + "|" + client
+	rec, ok := us.records[key]
+	if !ok {
+		rec = &UsageRecord{Day: day, Model: final.Model, Client: client}
+		us.records[key] = rec
+	}
+	rec.add(UsageTotals{
+		Requests:        1,
+		PromptTokens:    final.PromptEvalCount,
+		EvalTokens:      final.EvalCount,
+		TotalDurationMS: final.TotalDuration / int64(time.Millisecond),
+		EvalDurationMS:  final.EvalDuration / int64(time.Millisecond),
+	})
+	us.dirty = true
+}
+
+// Flush drops the days past usageRetentionDays and writes the statistics, if they changed
+// since the last time.
+func (us *UsageStore) Flush() {
+	us.flushMu.Lock()
+	defer us.flushMu.Unlock()
+
+	us.mu.Lock()
+	if !us.dirty {
+		us.mu.Unlock()
+		return
+	}
+	us.dirty = false
+	oldest := time.Now().UTC().AddDate(0, 0, -usageRetentionDays+1).Format("2006-01-02")
+	list := make([]UsageRecord, 0, len(us.records))
+	for key, r := range us.records {
+		if r.Day < oldest {
+			delete(us.records, key)
+			continue
+		}
+		list = append(list, *r)
+	}
+	us.mu.Unlock()
+
+	if err := saveJSONFile(usageFile, list); err != nil {
+		log.Printf("Could not save usage statistics: %v", err)
+	}
+}
+
+// runUsageFlusher writes the usage statistics every usageFlushInterval.
+func runUsageFlusher() {
+	for range time.Tick(usageFlushInterval) {
+		usage.Flush()
+	}
+}
+
+// Summary groups the records of the last `days` days by "model", "day" or "client".
+func (us *UsageStore) Summary(groupBy string, days int) []UsageGroup {
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format("2006-01-02")
+
+	us.mu.Lock()
+	groups := make(map[string]*UsageGroup)
+	for _, rec := range us.records {
+		if rec.Day < since {
+			continue
+		}
+		key := rec.Model
+		switch groupBy {
+		case "day":
+			key = rec.Day
+		case "client":
+			key = rec.Client
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &UsageGroup{Key: key}
+			groups[key] = g
+		}
+		g.add(rec.UsageTotals)
+	}
+	us.mu.Unlock()
+
+	list := make([]UsageGroup, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, *g)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if groupBy == "day" {
+			return list[i].Key < list[j].Key
+		}
+		return list[i].PromptTokens+list[i].EvalTokens > list[j].PromptTokens+list[j].EvalTokens
+	})
+	return list
+}
+
+// TokensToday returns the prompt and answer tokens each client used today (UTC).
+func (us *UsageStore) TokensToday() map[string]int {
+	day := time.Now().UTC().Format("2006-01-02")
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	tokens := make(map[string]int)
+	for _, rec := range us.records {
+		if rec.Day == day {
+			tokens[rec.Client] += rec.PromptTokens + rec.EvalTokens
+		}
+	}
+	return tokens
+}
+
+// recordUsageLine records usage from a raw NDJSON line of a proxied stream if it is the final chunk.
+func recordUsageLine(ctx context.Context, line string) {
+	if !strings.Contains(line, `"done":true`) {
+		return
+	}
+	var chunk OllamaResponseChunk
+	if err := json.Unmarshal([]byte(line), &chunk); err == nil && chunk.Done {
+		usage.Record(clientFrom(ctx), chunk)
+	}
+}
+
+// handleUsage reports token and compute usage: GET /api/usage?group_by=model|day|client&days=30
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy == "" {
+		groupBy = "model"
+	}
+	if groupBy != "model" && groupBy != "day" && groupBy != "client" {
+		http.Error(w, "group_by must be model, day or client", http.StatusBadRequest)
+		return
+	}
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days < 1 {
+		days = 30
+	}
+
+	resp := map[string]interface{}{
+		"group_by": groupBy,
+		"days":     days,
+		"usage":    usage.Summary(groupBy, days),
+	}
+	if quotas := tokenQuotaReport(); quotas != nil {
+		resp["token_quotas"] = quotas
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// --- Token Quotas ---
+
+// TokenQuotaStatus is how much of its daily token budget a client has used.
+type TokenQuotaStatus struct {
+	Client   string    `json:"client"`
+	Used     int       `json:"used"`
+	Limit    int       `json:"limit"`
+	Percent  int       `json:"percent"`
+	Warning  bool      `json:"warning"` // At least warn_percent is used
+	Exceeded bool      `json:"exceeded"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// tokenQuota returns the token_quota settings, which PUT /api/admin/defaults may change.
+func tokenQuota() TokenQuotaConfig {
+	defaultsMu.RLock()
+	defer defaultsMu.RUnlock()
+	return config.TokenQuota
+}
+
+// tokenLimit returns a client's daily budget, if it has one.
+func tokenLimit(client string) (int, bool) {
+	quota := tokenQuota()
+	if limit, ok := quota.Clients[client]; ok {
+		return limit, limit > 0
+	}
+	return quota.DailyTokens, quota.DailyTokens > 0
+}
+
+func newTokenQuotaStatus(client string, used, limit int) TokenQuotaStatus {
+	percent := used * 100 / limit
+	return TokenQuotaStatus{
+		Client:   client,
+		Used:     used,
+		Limit:    limit,
+		Percent:  percent,
+		Warning:  percent >= tokenQuota().WarnPercent,
+		Exceeded: used >= limit,
+		ResetsAt: time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour),
+	}
+}
+
+// tokenQuotaReport lists the budgets of the clients that have one and used tokens today, or
+// of the clients configured by name; nil when no budgets are set.
+func tokenQuotaReport() []TokenQuotaStatus {
+	quota := tokenQuota()
+	if quota.DailyTokens == 0 && len(quota.Clients) == 0 {
+		return nil
+	}
+	tokens := usage.TokensToday()
+	for client := range quota.Clients {
+		if _, ok := tokens[client]; !ok {
+			tokens[client] = 0
+		}
+	}
+	list := []TokenQuotaStatus{}
+	for client, used := range tokens {
+		if limit, ok := tokenLimit(client); ok && client != "laim" {
+			list = append(list, newTokenQuotaStatus(client, used, limit))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+// withTokenQuota checks the client's daily budget before a generation and reports it in the
+// X-Token-Quota header. A used-up budget refuses the request when hard_cap is set; otherwise,
+// like a budget past warn_percent, it only adds a "quota" event to the stream. The budget is
+// soft either way: a generation that starts within it may end past it.
+func withTokenQuota(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	client := clientFrom(r.Context())
+	limit, ok := tokenLimit(client)
+	if !ok {
+		return r, true
+	}
+	status := newTokenQuotaStatus(client, usage.TokensToday()[client], limit)
+	w.Header().Set("X-Token-Quota", fmt.Sprintf("%d/%d", status.Used, status.Limit))
+	if status.Exceeded && tokenQuota().HardCap {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(status.ResetsAt).Seconds()))))
+		http.Error(w, fmt.Sprintf("Daily token quota of %d tokens used up; it resets at %s", status.Limit, status.ResetsAt.Format(time.RFC3339)), http.StatusTooManyRequests)
+		return r, false
+	}
+	if status.Warning {
+		return r.WithContext(context.WithValue(r.Context(), tokenQuotaKey, status)), true
+	}
+	return r, true
+}
+
+// tokenQuotaUsedUp reports whether hard_cap refuses the client any more generations today, for
+// work that runs after its request has been answered and for pages that show the refusal.
+func tokenQuotaUsedUp(client string) (TokenQuotaStatus, bool) {
+	limit, ok := tokenLimit(client)
+	if !ok {
+		return TokenQuotaStatus{}, false
+	}
+	status := newTokenQuotaStatus(client, usage.TokensToday()[client], limit)
+	return status, status.Exceeded && tokenQuota().HardCap
+}
+
+// requestEvents starts a stream's preamble with what was decided about the request before
+// generating: the auto-route and a token quota warning.
+func requestEvents(ctx context.Context) []streamEvent {
+	events := autoRouteEvents(ctx)
+	if status, ok := ctx.Value(tokenQuotaKey).(TokenQuotaStatus); ok {
+		events = append(events, streamEvent{"quota", status})
+	}
+	return events
+}
+
+// --- Tool Calling ---
+
+// Upper bound on model → tool → model round trips for a single chat request
+const maxToolRounds = 8
+
+// Tool results are truncated to this many characters before going back to the model
+const maxToolResultChars = 8000
+
+// ServerTool is a tool LAIM executes itself when the model calls it.
+type ServerTool struct {
+	Definition Tool
+	Run        func(ctx context.Context, args map[string]interface{}) (string, error)
+}
+
+var serverTools = map[string]ServerTool{}
+
+func registerServerTool(tool ServerTool) {
+	serverTools[tool.Definition.Function.Name] = tool
+}
+
+func init() {
+	registerServerTool(ServerTool{
+		Definition: Tool{Type: "function", Function: ToolFunction{
+			Name:        "calculator",
+			Description: "Evaluate an arithmetic expression with + - * / % ^ and parentheses, e.g. (3 + 4) * 2.5",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"expression":{"type":"string","description":"The expression to evaluate"}},"required":["expression"]}`),
+		}},
+		Run: runCalculatorTool,
+	})
+	registerServerTool(ServerTool{
+		Definition: Tool{Type: "function", Function: ToolFunction{
+			Name:        "web_search",
+			Description: "Search the web and return the top results with their titles, URLs and snippets",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"query":{"type":"string","description":"The search query"}},"required":["query"]}`),
+		}},
+		Run: runWebSearchTool,
+	})
+	registerServerTool(ServerTool{
+		Definition: Tool{Type: "function", Function: ToolFunction{
+			Name:        "web_fetch",
+			Description: "Fetch a public web page and return its text content",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"url":{"type":"string","description":"An http or https URL"}},"required":["url"]}`),
+		}},
+		Run: runWebFetchTool,
+	})
+}
+
+// resolveTools fills in the definitions of server tools referenced by name only; other
+// definitions are passed to the model unchanged and their calls are left to the client.
+func resolveTools(tools []Tool) []Tool {
+	resolved := make([]Tool, len(tools))
+	for i, t := range tools {
+		if st, ok := serverTools[t.Function.Name]; ok && len(t.Function.Parameters) == 0 {
+			t = st.Definition
+		}
+		resolved[i] = t
+	}
+	return resolved
+}
+
+// runToolLoop streams a chat that may call tools. Calls to server tools are executed and their
+// results fed back to the model until it answers; a call to any other tool ends the stream with
+// the tool_calls chunk so the client can run it and continue the conversation itself.
+func runToolLoop(w http.ResponseWriter, r *http.Request, req OllamaChatRequestPayload, client *http.Client, preamble ...streamEvent) {
+	backend := routes.Resolve(req.Model)
+	stream := newEventStream(w, r)
+
+	release, ok := acquireGenerationSlot(r, stream, backend)
+	if !ok {
+		return
+	}
+	defer release()
+
+	for _, event := range preamble {
+		stream.Event(event.Name, event.Data)
+	}
+
+	for round := 0; round < maxToolRounds; round++ {
+		var calls []ToolCall
+		var content strings.Builder
+		var final OllamaResponseChunk
+
+		err := ollamaStream(r.Context(), client, backend+ollamaChatAPI, req, func(chunk OllamaResponseChunk) {
+			if chunk.Message != nil {
+				calls = append(calls, chunk.Message.ToolCalls...)
+				content.WriteString(chunk.Message.Content)
+			}
+			if chunk.Done {
+				final = chunk
+				return
+			}
+			stream.JSON(chunk)
+		})
+		if err != nil {
+			if r.Context().Err() == nil {
+				stream.Fail(err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+
+		if len(calls) == 0 || !allServerTools(calls) {
+			stream.JSON(final)
+			return
+		}
+
+		req.Messages = append(req.Messages, Message{Role: "assistant", Content: content.String(), ToolCalls: calls})
+		for _, call := range calls {
+			result := executeServerTool(r.Context(), call)
+			stream.Event("tool", map[string]interface{}{
+				"name":      call.Function.Name,
+				"arguments": call.Function.Arguments,
+				"result":    result,
+			})
+			req.Messages = append(req.Messages, Message{Role: "tool", Content: result, ToolName: call.Function.Name})
+		}
+	}
+
+	stream.Fail(fmt.Sprintf("Stopped after %d tool call rounds without a final answer", maxToolRounds), http.StatusBadGateway)
+}
+
+func allServerTools(calls []ToolCall) bool {
+	for _, call := range calls {
+		if _, ok := serverTools[call.Function.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// executeServerTool runs a tool call; failures are reported to the model as the tool's result.
+func executeServerTool(ctx context.Context, call ToolCall) string {
+	tool := serverTools[call.Function.Name]
+	log.Printf("Running tool %s %v (request %s)", call.Function.Name, call.Function.Arguments, requestIDFrom(ctx))
+
+	result, err := tool.Run(ctx, call.Function.Arguments)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	if utf8.RuneCountInString(result) > maxToolResultChars {
+		result = truncateRunes(result, maxToolResultChars) + "\n[truncated]"
+	}
+	return result
+}
+
+func stringArg(args map[string]interface{}, name string) (string, error) {
+	v, ok := args[name].(string)
+	if !ok || strings.TrimSpace(v) == "" {
+		return "", fmt.Errorf("missing string argument %q", name)
+	}
+	return v, nil
+}
+
+// --- Tool: calculator ---
+
+func runCalculatorTool(ctx context.Context, args map[string]interface{}) (string, error) {
+	expr, err := stringArg(args, "expression")
+	if err != nil {
+		return "", err
+	}
+	value, err := evalExpression(expr)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(value, 'g', 15, 64), nil
+}
+
+// evalExpression evaluates arithmetic with + - * / % ^, unary minus and parentheses.
+func evalExpression(expr string) (float64, error) {
+	p := &exprParser{input: strings.ReplaceAll(expr, " ", "")}
+	value, err := p.parseSum()
+	if err != nil {
+		return 0, err
+	}
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, errors.New("result is not a finite number")
+	}
+	return value, nil
+}
+
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func (p *exprParser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseSum() (float64, error) {
+	left, err := p.parseProduct()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.input[p.pos]
+		p.pos++
+		var right float64
+		if right, err = p.parseProduct(); err == nil {
+			if op == '+' {
+				left += right
+			} else {
+				left -= right
+			}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseProduct() (float64, error) {
+	left, err := p.parsePower()
+	for err == nil && (p.peek() == '*' || p.peek() == '/' || p.peek() == '%') {
+		op := p.input[p.pos]
+		p.pos++
+		var right float64
+		if right, err = p.parsePower(); err == nil {
+			switch op {
+			case '*':
+				left *= right
+			case '/':
+				left /= right
+			case '%':
+				left = math.Mod(left, right)
+			}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parsePower() (float64, error) {
+	base, err := p.parseUnary()
+	if err != nil || p.peek() != '^' {
+		return base, err
+	}
+	p.pos++
+	exp, err := p.parsePower() // Right-associative
+	return math.Pow(base, exp), err
+}
+
+func (p *exprParser) parseUnary() (float64, error) {
+	if p.peek() == '-' {
+		p.pos++
+		v, err := p.parseUnary()
+		return -v, err
+	}
+	if p.peek() == '+' {
+		p.pos++
+		return p.parseUnary()
+	}
+	if p.peek() == '(' {
+		p.pos++
+		v, err := p.parseSum()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return v, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos >= len(p.input) {
+			return 0, errors.New("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	return strconv.ParseFloat(p.input[start:p.pos], 64)
+}
+
+// --- Tool: web_fetch ---
+
+const maxFetchBytes = 2 << 20
+
+func runWebFetchTool(ctx context.Context, args map[string]interface{}) (string, error) {
+	rawURL, err := stringArg(args, "url")
+	if err != nil {
+		return "", err
+	}
+	text, err := fetchPageText(ctx, rawURL)
+	if err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// fetchPageText downloads a public web page and reduces it to readable text.
+// Requests to loopback, private and other non-public addresses are refused so a model can't probe the local network.
+func fetchPageText(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid URL %q", rawURL)
+	}
+
+	client := &http.Client{
+		Timeout:   15 * time.Second,
+		Transport: &http.Transport{DialContext: publicOnlyDialer},
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	req.Header.Set("User-Agent", "LAIM/1.0 (+https://github.com/newlatveria/LAIM)")
+	req.Header.Set("Accept", "text/html,text/plain;q=0.9,*/*;q=0.5")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", u.Host, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes))
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return htmlToText(string(body)), nil
+	}
+	return string(body), nil
+}
+
+// publicOnlyDialer refuses connections to addresses that aren't public.
+func publicOnlyDialer(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip.IP) {
+			return nil, fmt.Errorf("refusing to fetch from non-public address %s", ip.IP)
+		}
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+}
+
+// nonPublicNets are the special-purpose ranges of the IANA registries: besides loopback,
+// private and link-local addresses, "this network", shared (carrier-grade NAT), benchmarking,
+// documentation, multicast and reserved addresses, and NAT64, which embeds IPv4 addresses.
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16", "198.18.0.0/15",
+		"198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+		"::/127", "64:ff9b::/96", "64:ff9b:1::/48", "100::/64", "2001:db8::/32", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		nets = append(nets, ipNet)
+	}
+	return nets
+}()
+
+func isPublicIP(ip net.IP) bool {
+	for _, ipNet := range nonPublicNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// isPublicHost reports whether a URL's host may be public: not localhost and not an address
+// in nonPublicNets. Names that resolve to such addresses are refused later, by
+// publicOnlyDialer.
+func isPublicHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return isPublicIP(ip)
+	}
+	return true
+}
+
+var (
+	htmlDropBlocks = regexp.MustCompile(`(?is)<(script|style|noscript|svg|head)[^>]*>.*?</(script|style|noscript|svg|head)>`)
+	htmlBreaks     = regexp.MustCompile(`(?i)<(br|/p|/div|/h[1-6]|/li|/tr)[^>]*>`)
+	htmlTags       = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankRuns      = regexp.MustCompile(`[ \t\r\f\v]+`)
+	blankLines     = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// htmlToText strips markup from an HTML page, keeping paragraph breaks.
+func htmlToText(page string) string {
+	text := htmlDropBlocks.ReplaceAllString(page, " ")
+	text = htmlBreaks.ReplaceAllString(text, "\n")
+	text = htmlTags.ReplaceAllString(text, " ")
+	text = html.UnescapeString(text)
+	text = blankRuns.ReplaceAllString(text, " ")
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// handleListTools lists the tools LAIM can execute itself: GET /api/tools
+func handleListTools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := make([]Tool, 0, len(serverTools))
+	for _, t := range serverTools {
+		list = append(list, t.Definition)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Function.Name < list[j].Function.Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// --- Web Search ---
+
+// Characters of each fetched page injected into the chat
+const maxSearchResultChars = 2000
+
+type SearchResult struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// searchClient talks to the configured search API, which may be a SearxNG instance on the local network.
+var searchClient = &http.Client{Timeout: 10 * time.Second}
+
+// searchWeb queries the configured provider and returns at most MaxResults results.
+func searchWeb(ctx context.Context, query string) ([]SearchResult, error) {
+	var results []SearchResult
+	var err error
+	switch config.WebSearch.Provider {
+	case "searxng":
+		results, err = searchSearxNG(ctx, query)
+	case "", "duckduckgo":
+		results, err = searchDuckDuckGo(ctx, query)
+	default:
+		return nil, fmt.Errorf("unknown web search provider %q", config.WebSearch.Provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if max := config.WebSearch.MaxResults; max > 0 && len(results) > max {
+		results = results[:max]
+	}
+	return results, nil
+}
+
+func searchSearxNG(ctx context.Context, query string) ([]SearchResult, error) {
+	if config.WebSearch.URL == "" {
+		return nil, errors.New("web_search.url must point to a SearxNG instance")
+	}
+	endpoint := strings.TrimSuffix(config.WebSearch.URL, "/") + "/search?format=json&q=" + url.QueryEscape(query)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+
+	resp, err := searchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SearxNG returned %s", resp.Status)
+	}
+
+	var body struct {
+		Results []struct {
+			Title   string `json:"title"`
+			URL     string `json:"url"`
+			Content string `json:"content"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid SearxNG response: %w", err)
+	}
+	results := make([]SearchResult, 0, len(body.Results))
+	for _, r := range body.Results {
+		results = append(results, SearchResult{Title: r.Title, URL: r.URL, Snippet: r.Content})
+	}
+	return results, nil
+}
+
+var (
+	ddgResultLink    = regexp.MustCompile(`(?s)<a[^>]+class="result__a"[^>]+href="([^"]+)"[^>]*>(.*?)</a>`)
+	ddgResultSnippet = regexp.MustCompile(`(?s)class="result__snippet"[^>]*>(.*?)</a>`)
+)
+
+// searchDuckDuckGo scrapes DuckDuckGo's HTML endpoint, which needs no API key.
+func searchDuckDuckGo(ctx context.Context, query string) ([]SearchResult, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://html.duckduckgo.com/html/?q="+url.QueryEscape(query), nil)
+	req.Header.Set("User-Agent", "LAIM/1.0 (+https://github.com/newlatveria/LAIM)")
+
+	resp, err := searchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DuckDuckGo returned %s", resp.Status)
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	links := ddgResultLink.FindAllStringSubmatch(string(page), -1)
+	snippets := ddgResultSnippet.FindAllStringSubmatch(string(page), -1)
+	var results []SearchResult
+	for i, link := range links {
+		target := html.UnescapeString(link[1])
+		// Result links go through a redirect that carries the real URL in "uddg"
+		if u, err := url.Parse(target); err == nil && u.Query().Get("uddg") != "" {
+			target = u.Query().Get("uddg")
+		}
+		result := SearchResult{Title: htmlToText(link[2]), URL: target}
+		if i < len(snippets) {
+			result.Snippet = htmlToText(snippets[i][1])
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// addWebSearchContext searches for the latest user message, fetches the top results and inserts
+// them as a system message right before that message. Search failures are logged and the chat
+// goes ahead without results.
+func addWebSearchContext(ctx context.Context, req *OllamaChatRequestPayload) (streamEvent, bool) {
+	last := len(req.Messages) - 1
+	if last < 0 || req.Messages[last].Role != "user" {
+		return streamEvent{}, false
+	}
+	query := req.Messages[last].Content
+	if len(query) > 300 {
+		query = strings.ToValidUTF8(query[:300], "")
+	}
+
+	results, err := searchWeb(ctx, query)
+	if err != nil || len(results) == 0 {
+		log.Printf("Web search failed for request %s: %v", requestIDFrom(ctx), err)
+		return streamEvent{}, false
+	}
+
+	// Fetch result pages in parallel; a page that can't be fetched falls back to its snippet
+	texts := make([]string, len(results))
+	var wg sync.WaitGroup
+	for i, result := range results {
+		wg.Add(1)
+		go func(i int, result SearchResult) {
+			defer wg.Done()
+			texts[i] = result.Snippet
+			if text, err := fetchPageText(ctx, result.URL); err == nil && text != "" {
+				texts[i] = truncateRunes(text, maxSearchResultChars)
+			}
+		}(i, result)
+	}
+	wg.Wait()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Web search results for %q, retrieved %s. Use them to answer the next message and cite sources by number, like [1].\n", query, time.Now().Format("2006-01-02"))
+	for i, result := range results {
+		fmt.Fprintf(&sb, "\n[%d] %s (%s)\n%s\n", i+1, result.Title, result.URL, texts[i])
+	}
+
+	messages := make([]Message, 0, len(req.Messages)+1)
+	messages = append(messages, req.Messages[:last]...)
+	messages = append(messages, Message{Role: "system", Content: sb.String()}, req.Messages[last])
+	req.Messages = messages
+
+	return streamEvent{"sources", map[string]interface{}{"query": query, "sources": results}}, true
+}
+
+func runWebSearchTool(ctx context.Context, args map[string]interface{}) (string, error) {
+	query, err := stringArg(args, "query")
+	if err != nil {
+		return "", err
+	}
+	results, err := searchWeb(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "No results.", nil
+	}
+	var sb strings.Builder
+	for i, result := range results {
+		fmt.Fprintf(&sb, "[%d] %s\n%s\n%s\n\n", i+1, result.Title, result.URL, result.Snippet)
+	}
+	return sb.String(), nil
+}
+
+// truncateRunes cuts s to at most n runes.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
+
+// --- Undo Window ---
+
+// PendingOperation is a destructive operation waiting out the undo window.
+type PendingOperation struct {
+	Token       string    `json:"undo_token"`
+	Description string    `json:"description"`
+	ExpiresAt   time.Time `json:"expires_at"`
+
+	timer *time.Timer
+}
+
+// UndoStore delays destructive operations so they can be cancelled for a short while.
+type UndoStore struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending map[string]*PendingOperation
+}
+
+var pendingDeletions *UndoStore
+
+func NewUndoStore(window time.Duration) *UndoStore {
+	return &UndoStore{window: window, pending: make(map[string]*PendingOperation)}
+}
+
+// Enabled reports whether operations are delayed at all.
+func (s *UndoStore) Enabled() bool {
+	return s.window > 0
+}
+
+// Stage schedules run to execute once the undo window has passed.
+func (s *UndoStore) Stage(description string, run func()) PendingOperation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op := &PendingOperation{Token: newRequestID(), Description: description, ExpiresAt: time.Now().Add(s.window)}
+	op.timer = time.AfterFunc(s.window, func() {
+		s.mu.Lock()
+		_, ok := s.pending[op.Token]
+		delete(s.pending, op.Token)
+		s.mu.Unlock()
+		if ok {
+			run()
+		}
+	})
+	s.pending[op.Token] = op
+	return *op
+}
+
+// Undo cancels a pending operation. It returns false if the token is unknown or the operation already ran.
+func (s *UndoStore) Undo(token string) (PendingOperation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, ok := s.pending[token]
+	if !ok {
+		return PendingOperation{}, false
+	}
+	op.timer.Stop()
+	delete(s.pending, token)
+	return *op, true
+}
+
+// List returns the pending operations, soonest first.
+func (s *UndoStore) List() []PendingOperation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]PendingOperation, 0, len(s.pending))
+	for _, op := range s.pending {
+		list = append(list, *op)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ExpiresAt.Before(list[j].ExpiresAt) })
+	return list
+}
+
+// scheduleModelDelete answers 202 with an undo token and deletes the model when the window ends.
+func scheduleModelDelete(w http.ResponseWriter, r *http.Request, model string, client *http.Client) {
+	backend := routes.Resolve(model)
+	requestID := requestIDFrom(r.Context())
+
+	op := pendingDeletions.Stage("delete model "+model, func() {
+		payloadBytes, _ := json.Marshal(OllamaModelActionPayload{Name: model})
+		req, _ := http.NewRequest(http.MethodDelete, backend+ollamaDeleteAPI, bytes.NewBuffer(payloadBytes))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Deleting model %s failed (request %s): %v", model, requestID, err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			log.Printf("Deleting model %s failed (request %s): %s %s", model, requestID, resp.Status, body)
+			return
+		}
+		log.Printf("Deleted model %s (request %s)", model, requestID)
+	})
+	writePendingOperation(w, op)
+}
+
+// schedulePromptDelete checks the prompt can be deleted now, then deletes it when the window ends.
+func schedulePromptDelete(w http.ResponseWriter, id string, version int) {
+	p, ok := prompts.Get(id)
+	if !ok {
+		http.Error(w, errPromptNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if p.Builtin {
+		http.Error(w, errBuiltinPrompt.Error(), http.StatusForbidden)
+		return
+	}
+	if version != 0 && version != p.Version {
+		http.Error(w, errPromptVersion.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	op := pendingDeletions.Stage("delete prompt "+id, func() {
+		if err := prompts.Delete(id, version); err != nil && !errors.Is(err, errPromptNotFound) {
+			log.Printf("Deleting prompt %s failed: %v", id, err)
+		}
+	})
+	writePendingOperation(w, op)
+}
+
+func writePendingOperation(w http.ResponseWriter, op PendingOperation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		PendingOperation
+	}{"scheduled", op})
+}
+
+// handleUndo lists pending operations (GET /api/undo) and cancels one (POST /api/undo/{token}).
+// Both are admin only, since the list shows every client's pending deletions and their tokens.
+func handleUndo(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/undo"), "/")
+
+	switch {
+	case token == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pendingDeletions.List())
+	case token != "" && r.Method == http.MethodPost:
+		op, ok := pendingDeletions.Undo(token)
+		if !ok {
+			http.Error(w, "Nothing to undo: the token is unknown or the operation already ran", http.StatusNotFound)
+			return
+		}
+		log.Printf("Undid %s", op.Description)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Status string `json:"status"`
+			PendingOperation
+		}{"undone", op})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// --- Slash Commands ---
+
+// SlashCommand is a command typed at the start of a chat message, e.g. "/model llama3".
+// Run rewrites the chat request; when the result doesn't ask for a generation, only the
+// command event is sent back.
+type SlashCommand struct {
+	Name        string         `json:"name"`
+	Usage       string         `json:"usage"`
+	Description string         `json:"description"`
+	Builtin     bool           `json:"builtin"`
+	Definition  *CustomCommand `json:"definition,omitempty"` // Set for user-defined commands
+
+	Run func(req *ClientRequest, args string) (CommandResult, error) `json:"-"`
+}
+
+// CommandResult is streamed to the client as "event: command" so the UI can follow along.
+type CommandResult struct {
+	Command      string `json:"command"`
+	Message      string `json:"message,omitempty"`
+	Model        string `json:"model,omitempty"`         // The chat's model changed
+	ClearContext bool   `json:"clear_context,omitempty"` // Earlier messages were dropped
+
+	Generate bool `json:"-"` // Continue with a model reply
+}
+
+var slashCommands = map[string]SlashCommand{}
+
+func registerSlashCommand(cmd SlashCommand) {
+	cmd.Builtin = true
+	slashCommands[cmd.Name] = cmd
+}
+
+func init() {
+	registerSlashCommand(SlashCommand{
+		Name:        "model",
+		Usage:       "/model <name> [message]",
+		Description: "Switch the chat to another model, optionally sending a message to it",
+		Run:         runModelCommand,
+	})
+	registerSlashCommand(SlashCommand{
+		Name:        "clear-context",
+		Usage:       "/clear-context [message]",
+		Description: "Forget the earlier messages of this chat (system prompts are kept)",
+		Run:         runClearContextCommand,
+	})
+	registerSlashCommand(SlashCommand{
+		Name:        "translate",
+		Usage:       "/translate <language> [text]",
+		Description: "Translate the text, or the last reply, into another language",
+		Run:         runTranslateCommand,
+	})
+	registerSlashCommand(SlashCommand{
+		Name:        "summarize",
+		Usage:       "/summarize [text]",
+		Description: "Summarize the text, or the conversation so far, as bullet points",
+		Run:         runSummarizeCommand,
+	})
+}
+
+// parseSlashCommand recognises a registered command at the start of the latest message.
+// Unknown commands are left alone so messages like "/etc/hosts is..." still reach the model.
+func parseSlashCommand(messages []Message) (SlashCommand, string, bool) {
+	if len(messages) == 0 || messages[len(messages)-1].Role != "user" {
+		return SlashCommand{}, "", false
+	}
+	text := strings.TrimSpace(messages[len(messages)-1].Content)
+	if !strings.HasPrefix(text, "/") {
+		return SlashCommand{}, "", false
+	}
+	name, args := splitFirstWord(text[1:])
+	if cmd, ok := slashCommands[name]; ok {
+		return cmd, args, true
+	}
+	if custom, ok := customCommands.Get(name); ok {
+		return custom.SlashCommand(), args, true
+	}
+	return SlashCommand{}, "", false
+}
+
+// splitFirstWord splits s into its first word and the trimmed rest.
+func splitFirstWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t\n"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i:])
+	}
+	return s, ""
+}
+
+// setLastMessage replaces the command message with the text the model should see.
+func setLastMessage(req *ClientRequest, text string) {
+	req.Messages = append([]Message(nil), req.Messages...)
+	req.Messages[len(req.Messages)-1].Content = text
+}
+
+func runModelCommand(req *ClientRequest, args string) (CommandResult, error) {
+	model, text := splitFirstWord(args)
+	if !modelNamePattern.MatchString(model) || len(model) > 200 {
+		return CommandResult{}, errors.New("usage: /model <name> [message]")
+	}
+	req.Model = model
+	result := CommandResult{Command: "model", Model: model, Message: "Switched to " + model}
+	if text == "" {
+		return result, nil
+	}
+	setLastMessage(req, text)
+	result.Generate = true
+	return result, nil
+}
+
+func runClearContextCommand(req *ClientRequest, args string) (CommandResult, error) {
+	kept := []Message{}
+	for _, m := range req.Messages[:len(req.Messages)-1] {
+		if m.Role == "system" {
+			kept = append(kept, m)
+		}
+	}
+	result := CommandResult{
+		Command:      "clear-context",
+		ClearContext: true,
+		Message:      fmt.Sprintf("Cleared %d earlier messages", len(req.Messages)-1-len(kept)),
+	}
+	if args == "" {
+		return result, nil
+	}
+	req.Messages = append(kept, Message{Role: "user", Content: args})
+	result.Generate = true
+	return result, nil
+}
+
+func runTranslateCommand(req *ClientRequest, args string) (CommandResult, error) {
+	language, text := splitFirstWord(args)
+	if language == "" {
+		return CommandResult{}, errors.New("usage: /translate <language> [text]")
+	}
+	if text == "" {
+		text = lastReply(req.Messages)
+		if text == "" {
+			return CommandResult{}, errors.New("nothing to translate")
+		}
+	}
+	setLastMessage(req, text)
+	req.PromptID = "translate"
+	req.Variables = map[string]string{"language": language}
+	return CommandResult{Command: "translate", Generate: true}, nil
+}
+
+func runSummarizeCommand(req *ClientRequest, args string) (CommandResult, error) {
+	text := args
+	if text == "" {
+		// Summarize the conversation itself; the history is replaced by its transcript
+		var sb strings.Builder
+		for _, m := range req.Messages[:len(req.Messages)-1] {
+			if m.Role == "user" || m.Role == "assistant" {
+				fmt.Fprintf(&sb, "%s: %s\n\n", m.Role, m.Content)
+			}
+		}
+		if sb.Len() == 0 {
+			return CommandResult{}, errors.New("nothing to summarize")
+		}
+		text = sb.String()
+		req.Messages = []Message{{Role: "user"}}
+	}
+	setLastMessage(req, text)
+	req.PromptID = "summarize"
+	req.Variables = map[string]string{"bullets": "5"}
+	return CommandResult{Command: "summarize", Generate: true}, nil
+}
+
+// lastReply returns the content of the latest assistant message.
+func lastReply(messages []Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "assistant" {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+// --- MCP (Model Context Protocol) Client ---
+
+const mcpProtocolVersion = "2025-03-26"
+
+// Time allowed for connecting to an MCP server at startup, and for each tool call
+const (
+	mcpConnectTimeout = 15 * time.Second
+	mcpCallTimeout    = 60 * time.Second
+)
+
+var mcpNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,31}$`)
+
+func validateMCPServers(servers []MCPServerConfig) error {
+	seen := make(map[string]bool)
+	for i, srv := range servers {
+		if !mcpNamePattern.MatchString(srv.Name) {
+			return fmt.Errorf("server %d: invalid name %q", i, srv.Name)
+		}
+		if seen[srv.Name] {
+			return fmt.Errorf("server %d: duplicate name %q", i, srv.Name)
+		}
+		seen[srv.Name] = true
+		if (len(srv.Command) == 0) == (srv.URL == "") {
+			return fmt.Errorf("server %q: set exactly one of command and url", srv.Name)
+		}
+		if srv.URL != "" {
+			if u, err := url.Parse(srv.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("server %q: invalid url %q", srv.Name, srv.URL)
+			}
+		}
+	}
+	return nil
+}
+
+// mcpTransport carries JSON-RPC messages to one MCP server.
+type mcpTransport interface {
+	Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error)
+	Notify(ctx context.Context, method string, params interface{}) error
+	Close() error
+}
+
+type jsonRPCRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      *int64      `json:"id,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type jsonRPCResponse struct {
+	ID     *int64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (r jsonRPCResponse) err() error {
+	if r.Error != nil {
+		return fmt.Errorf("MCP error %d: %s", r.Error.Code, r.Error.Message)
+	}
+	return nil
+}
+
+// mcpStdioTransport runs the server as a child process and speaks newline-delimited JSON-RPC.
+type mcpStdioTransport struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan jsonRPCResponse
+	closed  error
+}
+
+func startMCPStdio(srv MCPServerConfig) (*mcpStdioTransport, error) {
+	cmd := exec.Command(srv.Command[0], srv.Command[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range srv.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	t := &mcpStdioTransport{cmd: cmd, stdin: stdin, pending: make(map[int64]chan jsonRPCResponse)}
+	go t.readLoop(stdout)
+	return t, nil
+}
+
+// readLoop delivers responses to their callers; server-initiated requests and notifications are ignored.
+func (t *mcpStdioTransport) readLoop(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var resp jsonRPCResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil || resp.ID == nil {
+			continue
+		}
+		t.mu.Lock()
+		ch, ok := t.pending[*resp.ID]
+		delete(t.pending, *resp.ID)
+		t.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+
+	t.mu.Lock()
+	t.closed = errors.New("MCP server exited")
+	for id, ch := range t.pending {
+		close(ch)
+		delete(t.pending, id)
+	}
+	t.mu.Unlock()
+}
+
+func (t *mcpStdioTransport) send(msg jsonRPCRequest) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err = t.stdin.Write(append(data, '\n'))
+	return err
+}
+
+func (t *mcpStdioTransport) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	t.mu.Lock()
+	if t.closed != nil {
+		t.mu.Unlock()
+		return nil, t.closed
+	}
+	t.nextID++
+	id := t.nextID
+	ch := make(chan jsonRPCResponse, 1)
+	t.pending[id] = ch
+	t.mu.Unlock()
+
+	if err := t.send(jsonRPCRequest{JSONRPC: "2.0", ID: &id, Method: method, Params: params}); err != nil {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, errors.New("MCP server exited")
+		}
+		return resp.Result, resp.err()
+	case <-ctx.Done():
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (t *mcpStdioTransport) Notify(ctx context.Context, method string, params interface{}) error {
+	return t.send(jsonRPCRequest{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (t *mcpStdioTransport) Close() error {
+	t.stdin.Close()
+	return t.cmd.Wait()
+}
+
+// mcpHTTPTransport speaks MCP's streamable HTTP transport: each message is POSTed and the
+// response comes back either as JSON or as a short event stream.
+type mcpHTTPTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu        sync.Mutex
+	nextID    int64
+	sessionID string
+}
+
+func (t *mcpHTTPTransport) post(ctx context.Context, msg jsonRPCRequest) (*http.Response, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	t.mu.Lock()
+	if t.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", t.sessionID)
+	}
+	t.mu.Unlock()
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if id := resp.Header.Get("Mcp-Session-Id"); id != "" {
+		t.mu.Lock()
+		t.sessionID = id
+		t.mu.Unlock()
+	}
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("MCP server returned %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return resp, nil
+}
+
+func (t *mcpHTTPTransport) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	t.mu.Lock()
+	t.nextID++
+	id := t.nextID
+	t.mu.Unlock()
+
+	resp, err := t.post(ctx, jsonRPCRequest{JSONRPC: "2.0", ID: &id, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		var rpc jsonRPCResponse
+		if err := json.NewDecoder(resp.Body).Decode(&rpc); err != nil {
+			return nil, fmt.Errorf("invalid MCP response: %w", err)
+		}
+		return rpc.Result, rpc.err()
+	}
+
+	// Event stream: wait for the message answering our request
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var rpc jsonRPCResponse
+		if json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &rpc) == nil && rpc.ID != nil && *rpc.ID == id {
+			return rpc.Result, rpc.err()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("MCP server closed the stream without a response")
+}
+
+func (t *mcpHTTPTransport) Notify(ctx context.Context, method string, params interface{}) error {
+	resp, err := t.post(ctx, jsonRPCRequest{JSONRPC: "2.0", Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *mcpHTTPTransport) Close() error {
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID == "" {
+		return nil
+	}
+	req, _ := http.NewRequest(http.MethodDelete, t.url, nil)
+	req.Header.Set("Mcp-Session-Id", sessionID)
+	resp, err := t.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// MCPTool and MCPResource are what a server advertises in tools/list and resources/list.
+type MCPTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"inputSchema,omitempty"`
+}
+
+type MCPResource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+// MCPServer is a connected MCP server and what it offers.
+type MCPServer struct {
+	Name      string        `json:"name"`
+	Tools     []MCPTool     `json:"tools"`
+	Resources []MCPResource `json:"resources"`
+	Error     string        `json:"error,omitempty"` // Why connecting failed
+
+	transport mcpTransport
+}
+
+var mcpServers []*MCPServer
+
+// connectMCPServers connects to every configured server and registers its tools as server
+// tools named "<server>__<tool>". It runs before the HTTP server starts, so the tool registry
+// is complete (and no longer written to) once requests arrive. Failures are logged and skipped.
+func connectMCPServers(configs []MCPServerConfig) {
+	mcpServers = nil
+	for _, cfg := range configs {
+		srv, err := connectMCPServer(cfg)
+		if err != nil {
+			log.Printf("MCP server %s unavailable: %v", cfg.Name, err)
+			mcpServers = append(mcpServers, &MCPServer{Name: cfg.Name, Tools: []MCPTool{}, Resources: []MCPResource{}, Error: err.Error()})
+			continue
+		}
+		mcpServers = append(mcpServers, srv)
+		registerMCPTools(srv)
+		log.Printf("MCP server %s: %d tools, %d resources", srv.Name, len(srv.Tools), len(srv.Resources))
+	}
+}
+
+func connectMCPServer(cfg MCPServerConfig) (*MCPServer, error) {
+	var transport mcpTransport
+	if cfg.URL != "" {
+		transport = &mcpHTTPTransport{url: cfg.URL, headers: cfg.Headers, client: &http.Client{Timeout: mcpCallTimeout}}
+	} else {
+		t, err := startMCPStdio(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mcpConnectTimeout)
+	defer cancel()
+
+	result, err := transport.Call(ctx, "initialize", map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]string{"name": "laim", "version": "1.0"},
+	})
+	if err != nil {
+		transport.Close()
+		return nil, fmt.Errorf("initialize: %w", err)
+	}
+	var initResult struct {
+		Capabilities struct {
+			Tools     *json.RawMessage `json:"tools"`
+			Resources *json.RawMessage `json:"resources"`
+		} `json:"capabilities"`
+	}
+	json.Unmarshal(result, &initResult)
+	if err := transport.Notify(ctx, "notifications/initialized", nil); err != nil {
+		transport.Close()
+		return nil, fmt.Errorf("initialized: %w", err)
+	}
+
+	srv := &MCPServer{Name: cfg.Name, Tools: []MCPTool{}, Resources: []MCPResource{}, transport: transport}
+	if initResult.Capabilities.Tools != nil {
+		var list struct {
+			Tools []MCPTool `json:"tools"`
+		}
+		if err := mcpCallInto(ctx, transport, "tools/list", nil, &list); err != nil {
+			transport.Close()
+			return nil, fmt.Errorf("tools/list: %w", err)
+		}
+		srv.Tools = list.Tools
+	}
+	if initResult.Capabilities.Resources != nil {
+		var list struct {
+			Resources []MCPResource `json:"resources"`
+		}
+		if err := mcpCallInto(ctx, transport, "resources/list", nil, &list); err != nil {
+			log.Printf("MCP server %s: resources/list failed: %v", cfg.Name, err)
+		} else {
+			srv.Resources = list.Resources
+		}
+	}
+	return srv, nil
+}
+
+func mcpCallInto(ctx context.Context, t mcpTransport, method string, params, v interface{}) error {
+	result, err := t.Call(ctx, method, params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(result, v)
+}
+
+// registerMCPTools exposes a server's tools, plus a reader for its resources, as server tools.
+func registerMCPTools(srv *MCPServer) {
+	for _, tool := range srv.Tools {
+		tool := tool
+		params := tool.InputSchema
+		if len(params) == 0 {
+			params = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		name := srv.Name + "__" + tool.Name
+		if !toolNamePattern.MatchString(name) {
+			log.Printf("MCP server %s: skipping tool with unsupported name %q", srv.Name, tool.Name)
+			continue
+		}
+		registerServerTool(ServerTool{
+			Definition: Tool{Type: "function", Function: ToolFunction{Name: name, Description: tool.Description, Parameters: params}},
+			Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+				return srv.CallTool(ctx, tool.Name, args)
+			},
+		})
+	}
+
+	if len(srv.Resources) > 0 {
+		registerServerTool(ServerTool{
+			Definition: Tool{Type: "function", Function: ToolFunction{
+				Name:        srv.Name + "__read_resource",
+				Description: "Read a resource from " + srv.Name + ". Available: " + describeMCPResources(srv.Resources),
+				Parameters:  json.RawMessage(`{"type":"object","properties":{"uri":{"type":"string","description":"URI of the resource"}},"required":["uri"]}`),
+			}},
+			Run: func(ctx context.Context, args map[string]interface{}) (string, error) {
+				uri, err := stringArg(args, "uri")
+				if err != nil {
+					return "", err
+				}
+				return srv.ReadResource(ctx, uri)
+			},
+		})
+	}
+}
+
+func describeMCPResources(resources []MCPResource) string {
+	var parts []string
+	for i, res := range resources {
+		if i == 20 {
+			parts = append(parts, fmt.Sprintf("and %d more", len(resources)-i))
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", res.URI, res.Name))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// mcpContent is an item of a tool result or resource; only text is passed on to the model.
+type mcpContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	MimeType string `json:"mimeType"`
+}
+
+func joinMCPContent(items []mcpContent) string {
+	var parts []string
+	for _, item := range items {
+		if item.Text != "" {
+			parts = append(parts, item.Text)
+		} else if item.Type != "" && item.Type != "text" {
+			parts = append(parts, fmt.Sprintf("[%s content omitted]", item.Type))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// CallTool proxies a tool invocation to the server.
+func (s *MCPServer) CallTool(ctx context.Context, name string, args map[string]interface{}) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, mcpCallTimeout)
+	defer cancel()
+
+	var result struct {
+		Content []mcpContent `json:"content"`
+		IsError bool         `json:"isError"`
+	}
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	if err := mcpCallInto(ctx, s.transport, "tools/call", map[string]interface{}{"name": name, "arguments": args}, &result); err != nil {
+		return "", err
+	}
+	text := joinMCPContent(result.Content)
+	if result.IsError {
+		return "", errors.New(text)
+	}
+	return text, nil
+}
+
+// ReadResource fetches a resource's text.
+func (s *MCPServer) ReadResource(ctx context.Context, uri string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, mcpCallTimeout)
+	defer cancel()
+
+	var result struct {
+		Contents []mcpContent `json:"contents"`
+	}
+	if err := mcpCallInto(ctx, s.transport, "resources/read", map[string]string{"uri": uri}, &result); err != nil {
+		return "", err
+	}
+	return joinMCPContent(result.Contents), nil
+}
+
+// handleListMCPServers shows the configured MCP servers and what they offer: GET /api/mcp
+func handleListMCPServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := mcpServers
+	if list == nil {
+		list = []*MCPServer{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// --- Custom Slash Commands ---
+
+const commandsFile = "commands.json"
+
+// CustomCommand is a user-defined slash command. The text after the command (or the last reply
+// when there is none) becomes {{input}} of the inline template and/or of the library prompt.
+type CustomCommand struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Template    string            `json:"template,omitempty"`  // Rewrites the message, e.g. "Explain like I'm five: {{input}}"
+	PromptID    string            `json:"promptId,omitempty"`  // Persona or template from the prompt library
+	Variables   map[string]string `json:"variables,omitempty"` // Values for the template's and prompt's {{variables}}
+	Model       string            `json:"model,omitempty"`     // Model the command runs on
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// SlashCommand adapts a custom command to the command registry.
+func (c CustomCommand) SlashCommand() SlashCommand {
+	def := c
+	return SlashCommand{
+		Name:        c.Name,
+		Usage:       "/" + c.Name + " [text]",
+		Description: c.Description,
+		Definition:  &def,
+		Run:         c.run,
+	}
+}
+
+func (c CustomCommand) run(req *ClientRequest, args string) (CommandResult, error) {
+	input := args
+	if input == "" {
+		input = lastReply(req.Messages)
+	}
+	if input == "" && (c.Template != "" || c.PromptID != "") {
+		return CommandResult{}, errors.New("no text given and no reply to use")
+	}
+
+	text := input
+	if c.Template != "" {
+		vars := map[string]string{"input": input}
+		for k, v := range c.Variables {
+			vars[k] = v
+		}
+		rendered, err := renderTemplate(c.Template, vars)
+		if err != nil {
+			return CommandResult{}, err
+		}
+		text = rendered
+	}
+
+	result := CommandResult{Command: c.Name, Generate: true}
+	if c.Model != "" {
+		req.Model = c.Model
+		result.Model = c.Model
+	}
+	setLastMessage(req, text)
+	if c.PromptID != "" {
+		req.PromptID = c.PromptID
+		req.Variables = c.Variables
+	}
+	return result, nil
+}
+
+// CommandStore holds the user-defined slash commands, persisted in the data directory.
+type CommandStore struct {
+	mu       sync.RWMutex
+	commands map[string]CustomCommand
+}
+
+var customCommands *CommandStore
+
+func NewCommandStore() *CommandStore {
+	cs := &CommandStore{commands: make(map[string]CustomCommand)}
+
+	var saved []CustomCommand
+	if err := loadJSONFile(commandsFile, &saved); err != nil {
+		log.Printf("⚠️ WARNING: Could not load custom commands: %v", err)
+	}
+	for _, c := range saved {
+		cs.commands[c.Name] = c
+	}
+	return cs
+}
+
+func (cs *CommandStore) List() []CustomCommand {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	list := make([]CustomCommand, 0, len(cs.commands))
+	for _, c := range cs.commands {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (cs *CommandStore) Get(name string) (CustomCommand, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	c, ok := cs.commands[name]
+	return c, ok
+}
+
+// Save creates or updates a custom command.
+func (cs *CommandStore) Save(c CustomCommand) (CustomCommand, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now().UTC()
+	if existing, ok := cs.commands[c.Name]; ok {
+		c.CreatedAt = existing.CreatedAt
+	} else {
+		c.CreatedAt = now
+	}
+	c.UpdatedAt = now
+	cs.commands[c.Name] = c
+	return c, cs.persist()
+}
+
+func (cs *CommandStore) Delete(name string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.commands[name]; !ok {
+		return errCommandNotFound
+	}
+	delete(cs.commands, name)
+	return cs.persist()
+}
+
+// persist writes all custom commands; callers hold the lock.
+func (cs *CommandStore) persist() error {
+	list := make([]CustomCommand, 0, len(cs.commands))
+	for _, c := range cs.commands {
+		list = append(list, c)
+	}
+	return saveJSONFile(commandsFile, list)
+}
+
+var errCommandNotFound = errors.New("command not found")
+
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// validateCustomCommand checks a command before it is saved.
+func validateCustomCommand(c CustomCommand) error {
+	if !commandNamePattern.MatchString(c.Name) {
+		return errors.New("name must be lowercase letters, digits and dashes")
+	}
+	if _, ok := slashCommands[c.Name]; ok {
+		return fmt.Errorf("/%s is a built-in command", c.Name)
+	}
+	if c.Template == "" && c.PromptID == "" && c.Model == "" {
+		return errors.New("set at least one of template, promptId and model")
+	}
+	if c.PromptID != "" {
+		if _, ok := prompts.Get(c.PromptID); !ok {
+			return fmt.Errorf("unknown promptId %q", c.PromptID)
+		}
+	}
+	if c.Model != "" && (!modelNamePattern.MatchString(c.Model) || len(c.Model) > 200) {
+		return fmt.Errorf("invalid model name %q", c.Model)
+	}
+	return nil
+}
+
+// handleCommands serves the slash commands: GET /api/commands lists built-in and custom commands,
+// POST /api/commands creates a custom one, and GET/PUT/DELETE /api/commands/{name} manage it.
+func handleCommands(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/commands"), "/")
+
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list := make([]SlashCommand, 0, len(slashCommands))
+			for _, cmd := range slashCommands {
+				list = append(list, cmd)
+			}
+			for _, c := range customCommands.List() {
+				list = append(list, c.SlashCommand())
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+		case http.MethodPost:
+			saveCommandFromRequest(w, r, "")
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if _, ok := slashCommands[name]; ok && r.Method != http.MethodGet {
+		http.Error(w, "built-in commands cannot be modified", http.StatusForbidden)
+		return
+	}
+	c, ok := customCommands.Get(name)
+
+	switch r.Method {
+	case http.MethodGet:
+		cmd, builtin := slashCommands[name]
+		if !builtin && !ok {
+			http.Error(w, errCommandNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		if !builtin {
+			cmd = c.SlashCommand()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cmd)
+	case http.MethodPut:
+		if !ok {
+			http.Error(w, errCommandNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		saveCommandFromRequest(w, r, name)
+	case http.MethodDelete:
+		if !ok {
+			http.Error(w, errCommandNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		if pendingDeletions.Enabled() {
+			writePendingOperation(w, pendingDeletions.Stage("delete command /"+name, func() {
+				if err := customCommands.Delete(name); err != nil && !errors.Is(err, errCommandNotFound) {
+					log.Printf("Deleting command /%s failed: %v", name, err)
+				}
+			}))
+			return
+		}
+		if err := customCommands.Delete(name); err != nil {
+			http.Error(w, "Could not save commands: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveCommandFromRequest creates (name == "") or replaces a custom command from the request body.
+func saveCommandFromRequest(w http.ResponseWriter, r *http.Request, name string) {
+	var c CustomCommand
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		http.Error(w, "Invalid command payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.Name = strings.TrimPrefix(c.Name, "/")
+	if name != "" {
+		c.Name = name
+	} else if _, exists := customCommands.Get(c.Name); exists {
+		http.Error(w, "A command named /"+c.Name+" already exists", http.StatusConflict)
+		return
+	}
+	if err := validateCustomCommand(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	saved, err := customCommands.Save(c)
+	if err != nil {
+		http.Error(w, "Could not save commands: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if name == "" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(saved)
+}
+
+// --- Structured Output ---
+
+// runStructured generates a response constrained by format ("json" or a JSON schema) and checks
+// it before anything reaches the client: output that doesn't parse or doesn't match the schema
+// is retried once, with the problem explained to the model. The response is then sent as one
+// chunk, followed by an "event: validation" and Ollama's final chunk. attempt builds the payload,
+// given the previous output and why it was rejected (nil on the first attempt).
+func runStructured(w http.ResponseWriter, r *http.Request, backend, apiPath string, client *http.Client, format json.RawMessage, attempt func(previous string, invalid error) interface{}, preamble ...streamEvent) {
+	stream := newEventStream(w, r)
+
+	release, ok := acquireGenerationSlot(r, stream, backend)
+	if !ok {
+		return
+	}
+	defer release()
+
+	for _, event := range preamble {
+		stream.Event(event.Name, event.Data)
+	}
+
+	var output string
+	var final OllamaResponseChunk
+	var invalid error
+	attempts := 0
+	for attempts < 2 {
+		attempts++
+		var sb strings.Builder
+		err := ollamaStream(r.Context(), client, backend+apiPath, attempt(output, invalid), func(chunk OllamaResponseChunk) {
+			sb.WriteString(chunk.Response)
+			if chunk.Message != nil {
+				sb.WriteString(chunk.Message.Content)
+			}
+			if chunk.Done {
+				final = chunk
+			}
+		})
+		if err != nil {
+			if r.Context().Err() == nil {
+				stream.Fail(err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		output = sb.String()
+		if invalid = validateStructuredOutput(output, format); invalid == nil {
+			break
+		}
+		log.Printf("Structured output from %s rejected (attempt %d, request %s): %v", final.Model, attempts, requestIDFrom(r.Context()), invalid)
+	}
+
+	result := OllamaResponseChunk{Model: final.Model}
+	if apiPath == ollamaChatAPI {
+		result.Message = &Message{Role: "assistant", Content: output}
+	} else {
+		result.Response = output
+	}
+	stream.JSON(result)
+
+	validation := map[string]interface{}{"valid": invalid == nil, "attempts": attempts}
+	if invalid != nil {
+		validation["error"] = invalid.Error()
+	}
+	stream.Event("validation", validation)
+
+	final.Response = ""
+	if final.Message != nil {
+		final.Message = &Message{Role: final.Message.Role}
+	}
+	stream.JSON(final)
+}
+
+func structuredRetryPrompt(previous string, invalid error) string {
+	var sb strings.Builder
+	if previous != "" {
+		fmt.Fprintf(&sb, "Your previous answer was:\n%s\n\n", previous)
+	}
+	fmt.Fprintf(&sb, "That answer was rejected: %v. Reply again with only valid JSON that fixes this.", invalid)
+	return sb.String()
+}
+
+// validateStructuredOutput checks that output is JSON and, when format is a schema, that it matches.
+func validateStructuredOutput(output string, format json.RawMessage) error {
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(output))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	if decoder.More() {
+		return errors.New("invalid JSON: unexpected data after the value")
+	}
+
+	var schema map[string]interface{}
+	if json.Unmarshal(format, &schema) != nil {
+		return nil // "json": any valid JSON will do
+	}
+	return matchSchema(schema, value, "$")
+}
+
+// matchSchema validates value against the commonly used subset of JSON Schema: type, enum,
+// const, properties, required, additionalProperties, items, numeric bounds, string length,
+// pattern and array size. Unsupported keywords are ignored.
+func matchSchema(schema map[string]interface{}, value interface{}, path string) error {
+	if types, ok := schema["type"]; ok && !matchesSchemaType(types, value) {
+		return fmt.Errorf("%s: expected %v", path, types)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, candidate := range enum {
+			if jsonValuesEqual(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: must be one of %v", path, enum)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonValuesEqual(c, value) {
+		return fmt.Errorf("%s: must be %v", path, c)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, _ := name.(string); key != "" {
+					if _, present := v[key]; !present {
+						return fmt.Errorf("%s: missing required property %q", path, key)
+					}
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if sub, ok := properties[key].(map[string]interface{}); ok {
+				if err := matchSchema(sub, v[key], path+"."+key); err != nil {
+					return err
+				}
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra && properties != nil {
+					return fmt.Errorf("%s: unexpected property %q", path, key)
+				}
+			case map[string]interface{}:
+				if err := matchSchema(extra, v[key], path+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < min {
+			return fmt.Errorf("%s: needs at least %v items", path, min)
+		}
+		if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > max {
+			return fmt.Errorf("%s: allows at most %v items", path, max)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := matchSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := schemaNumber(schema, "minLength"); ok && length < min {
+			return fmt.Errorf("%s: shorter than %v characters", path, min)
+		}
+		if max, ok := schemaNumber(schema, "maxLength"); ok && length > max {
+			return fmt.Errorf("%s: longer than %v characters", path, max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				return fmt.Errorf("%s: does not match %s", path, pattern)
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if min, ok := schemaNumber(schema, "minimum"); ok && n < min {
+			return fmt.Errorf("%s: below the minimum of %v", path, min)
+		}
+		if max, ok := schemaNumber(schema, "maximum"); ok && n > max {
+			return fmt.Errorf("%s: above the maximum of %v", path, max)
+		}
+	}
+	return nil
+}
+
+// matchesSchemaType checks a "type" keyword, which may be a single type or a list of them.
+func matchesSchemaType(types interface{}, value interface{}) bool {
+	list, ok := types.([]interface{})
+	if !ok {
+		list = []interface{}{types}
+	}
+	for _, t := range list {
+		switch t {
+		case "object":
+			_, ok = value.(map[string]interface{})
+		case "array":
+			_, ok = value.([]interface{})
+		case "string":
+			_, ok = value.(string)
+		case "boolean":
+			_, ok = value.(bool)
+		case "null":
+			ok = value == nil
+		case "number":
+			_, ok = value.(json.Number)
+		case "integer":
+			var n json.Number
+			if n, ok = value.(json.Number); ok {
+				_, err := n.Int64()
+				ok = err == nil
+			}
+		default:
+			ok = true // Unknown types are not enforced
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func schemaNumber(schema map[string]interface{}, key string) (float64, bool) {
+	n, ok := schema[key].(float64)
+	return n, ok
+}
+
+// jsonValuesEqual compares a schema value (decoded with float64 numbers) with output (json.Number).
+func jsonValuesEqual(a, b interface{}) bool {
+	if n, ok := b.(json.Number); ok {
+		f, err := n.Float64()
+		return err == nil && a == f
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// --- Built-in Variables ---
+
+// BuiltinVariable is a {{variable}} LAIM resolves itself in prompts and messages.
+type BuiltinVariable struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	value func(model string, now time.Time) string
+}
+
+var builtinVariables = []BuiltinVariable{
+	{Name: "date", Description: "Today's date, e.g. 2025-03-14", value: func(_ string, now time.Time) string { return now.Format("2006-01-02") }},
+	{Name: "time", Description: "Current time, e.g. 15:04", value: func(_ string, now time.Time) string { return now.Format("15:04") }},
+	{Name: "datetime", Description: "Date, time and time zone, e.g. Friday, 14 March 2025 15:04 CET", value: func(_ string, now time.Time) string { return now.Format("Monday, 2 January 2006 15:04 MST") }},
+	{Name: "weekday", Description: "Day of the week, e.g. Friday", value: func(_ string, now time.Time) string { return now.Weekday().String() }},
+	{Name: "timezone", Description: "The server's time zone, e.g. CET", value: func(_ string, now time.Time) string { return now.Format("MST") }},
+	{Name: "model", Description: "Name of the model answering", value: func(model string, _ time.Time) string { return model }},
+}
+
+func findBuiltinVariable(name string) (BuiltinVariable, bool) {
+	for _, v := range builtinVariables {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return BuiltinVariable{}, false
+}
+
+// expandBuiltinVariables replaces built-in {{variables}} in text; anything else is left untouched.
+func expandBuiltinVariables(text, model string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	now := time.Now()
+	return templateVariablePattern.ReplaceAllStringFunc(text, func(m string) string {
+		if v, ok := findBuiltinVariable(templateVariablePattern.FindStringSubmatch(m)[1]); ok {
+			return v.value(model, now)
+		}
+		return m
+	})
+}
+
+// expandMessageVariables resolves built-in variables in system messages and the latest user
+// message. Earlier turns are left as they were sent, so the history stays stable.
+func expandMessageVariables(messages []Message, model string) []Message {
+	out := append([]Message(nil), messages...)
+	lastUser := true
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i].Role == "system" || (out[i].Role == "user" && lastUser) {
+			out[i].Content = expandBuiltinVariables(out[i].Content, model)
+		}
+		if out[i].Role == "user" {
+			lastUser = false
+		}
+	}
+	return out
+}
+
+// handleListVariables lists the built-in variables with their current values: GET /api/variables
+func handleListVariables(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	model := r.URL.Query().Get("model")
+	now := time.Now()
+
+	type variable struct {
+		BuiltinVariable
+		Example string `json:"example"`
+	}
+	list := make([]variable, 0, len(builtinVariables))
+	for _, v := range builtinVariables {
+		list = append(list, variable{v, v.value(model, now)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// --- Model Details ---
+
+// ModelDetails is the useful part of Ollama's /api/show, flattened for the UI and recommender.
+type ModelDetails struct {
+	Name              string `json:"name"`
+	Family            string `json:"family"`
+	Format            string `json:"format"`
+	ParameterSize     string `json:"parameter_size"`  // As reported by Ollama, e.g. "8.0B"
+	ParameterCount    int64  `json:"parameter_count"` // Exact count from the model file, 0 if unknown
+	QuantizationLevel string `json:"quantization_level"`
+	ContextLength     int    `json:"context_length"` // Trained context window, 0 if unknown
+	// Memory each token of context takes in the KV cache at f16, 0 if unknown
+	KVCacheBytesPerToken int64    `json:"kv_cache_bytes_per_token,omitempty"`
+	Capabilities         []string `json:"capabilities,omitempty"`
+	Parameters           string   `json:"parameters"` // Modelfile PARAMETER lines
+	Template             string   `json:"template"`
+	System               string   `json:"system,omitempty"`
+	Modelfile            string   `json:"modelfile"`
+}
+
+type ollamaShowResponse struct {
+	Modelfile  string `json:"modelfile"`
+	Parameters string `json:"parameters"`
+	Template   string `json:"template"`
+	System     string `json:"system"`
+	Details    struct {
+		Format            string `json:"format"`
+		Family            string `json:"family"`
+		ParameterSize     string `json:"parameter_size"`
+		QuantizationLevel string `json:"quantization_level"`
+	} `json:"details"`
+	ModelInfo    map[string]interface{} `json:"model_info"`
+	Capabilities []string               `json:"capabilities"`
+}
+
+// errModelNotFound is returned by fetchModelDetails when the backend doesn't have the model.
+var errModelNotFound = errors.New("model not found")
+
+// fetchModelDetails asks the model's backend for its metadata.
+func fetchModelDetails(ctx context.Context, client *http.Client, name string) (ModelDetails, error) {
+	payload, _ := json.Marshal(map[string]string{"model": name})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, routes.Resolve(name)+ollamaShowAPI, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return ModelDetails{}, fmt.Errorf("Ollama Connection Error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ModelDetails{}, errModelNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return ModelDetails{}, fmt.Errorf("Ollama API Error: %s", body)
+	}
+
+	var show ollamaShowResponse
+	if err := json.NewDecoder(resp.Body).Decode(&show); err != nil {
+		return ModelDetails{}, fmt.Errorf("invalid /api/show response: %w", err)
+	}
+
+	details := ModelDetails{
+		Name:              name,
+		Family:            show.Details.Family,
+		Format:            show.Details.Format,
+		ParameterSize:     show.Details.ParameterSize,
+		QuantizationLevel: show.Details.QuantizationLevel,
+		Capabilities:      show.Capabilities,
+		Parameters:        show.Parameters,
+		Template:          show.Template,
+		System:            show.System,
+		Modelfile:         show.Modelfile,
+	}
+	if n, ok := show.ModelInfo["general.parameter_count"].(float64); ok {
+		details.ParameterCount = int64(n)
+	}
+	// The context length key is prefixed with the architecture, e.g. "llama.context_length"
+	if arch, ok := show.ModelInfo["general.architecture"].(string); ok {
+		if n, ok := show.ModelInfo[arch+".context_length"].(float64); ok {
+			details.ContextLength = int(n)
+		}
+		details.KVCacheBytesPerToken = kvCacheBytesPerToken(show.ModelInfo, arch)
+	}
+	return details, nil
+}
+
+// kvCacheBytesPerToken works out the KV cache's size per token from the model's shape: a key
+// and a value for every KV head in every layer, at 2 bytes per number.
+func kvCacheBytesPerToken(info map[string]interface{}, arch string) int64 {
+	number := func(key string) int64 {
+		n, _ := info[arch+"."+key].(float64)
+		return int64(n)
+	}
+	layers, heads := number("block_count"), number("attention.head_count")
+	kvHeads := number("attention.head_count_kv")
+	if kvHeads == 0 {
+		kvHeads = heads
+	}
+	keyLen := number("attention.key_length")
+	if keyLen == 0 && heads > 0 {
+		keyLen = number("embedding_length") / heads
+	}
+	valueLen := number("attention.value_length")
+	if valueLen == 0 {
+		valueLen = keyLen
+	}
+	return layers * kvHeads * (keyLen + valueLen) * 2
+}
+
+// handleModelDetails returns a model's metadata: GET /api/models/{name}
+func handleModelDetails(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/models/")
+	if !modelNamePattern.MatchString(name) || len(name) > 200 {
+		http.Error(w, "Invalid model name", http.StatusBadRequest)
+		return
+	}
+
+	details, err := fetchModelDetails(r.Context(), newOllamaClient(10*time.Second), name)
+	if errors.Is(err, errModelNotFound) {
+		http.Error(w, "Model "+name+" is not installed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+}
+
+// --- Model Pulls ---
+
+// Finished pulls stay visible in /api/pull/status for this long
+const pullRetention = 10 * time.Minute
+
+// PullProgress is the state of a pull, updated from Ollama's progress lines.
+type PullProgress struct {
+	Model     string    `json:"model"`
+	Status    string    `json:"status"`
+	Digest    string    `json:"digest,omitempty"`
+	Total     int64     `json:"total,omitempty"`     // Bytes of the layer being downloaded
+	Completed int64     `json:"completed,omitempty"` // Bytes of it downloaded so far
+	Error     string    `json:"error,omitempty"`
+	Code      string    `json:"code,omitempty"` // UpstreamError code of a failed pull
+	Hint      string    `json:"hint,omitempty"`
+	Done      bool      `json:"done"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// pullJob is one running or finished pull and the clients following it.
+type pullJob struct {
+	mu          sync.Mutex
+	progress    PullProgress
+	subscribers map[chan PullProgress]bool
+	cancel      context.CancelFunc
+}
+
+// PullTracker runs pulls in the background, one per model.
+type PullTracker struct {
+	mu   sync.Mutex
+	jobs map[string]*pullJob
+}
+
+var pulls *PullTracker
+
+func NewPullTracker() *PullTracker {
+	return &PullTracker{jobs: make(map[string]*pullJob)}
+}
+
+// Start begins pulling model from backend, or returns the pull already running for it.
+func (t *PullTracker) Start(model, backend string) *pullJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if job, ok := t.jobs[model]; ok && !job.Snapshot().Done {
+		return job
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now().UTC()
+	job := &pullJob{
+		progress:    PullProgress{Model: model, Status: "starting", StartedAt: now, UpdatedAt: now},
+		subscribers: make(map[chan PullProgress]bool),
+		cancel:      cancel,
+	}
+	t.jobs[model] = job
+	go job.run(ctx, backend)
+	return job
+}
+
+// Get returns the pull for model, if there is one.
+func (t *PullTracker) Get(model string) (*pullJob, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job, ok := t.jobs[model]
+	return job, ok
+}
+
+// List returns running pulls and recently finished ones, oldest first.
+func (t *PullTracker) List() []PullProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := []PullProgress{}
+	for model, job := range t.jobs {
+		p := job.Snapshot()
+		if p.Done && time.Since(p.UpdatedAt) > pullRetention {
+			delete(t.jobs, model)
+			continue
+		}
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+func (j *pullJob) run(ctx context.Context, backend string) {
+	defer j.cancel()
+	model := j.Snapshot().Model
+
+	// No client timeout: a large model can take hours on a slow link
+	err := ollamaProgress(ctx, newOllamaClient(0), backend+ollamaPullAPI, OllamaModelActionPayload{Name: model}, func(line PullProgress) {
+		j.update(func(p *PullProgress) {
+			p.Status, p.Digest, p.Total, p.Completed = line.Status, line.Digest, line.Total, line.Completed
+		})
+	})
+
+	j.update(func(p *PullProgress) {
+		p.Done = true
+		if err != nil {
+			failure := asUpstreamError(model, err)
+			if failure.Code == codeModelNotFound {
+				failure.Hint = "Check the name and tag on ollama.com/library."
+			}
+			p.Error, p.Code, p.Hint = failure.Message, failure.Code, failure.Hint
+		}
+	})
+	if err != nil {
+		log.Printf("Pulling %s failed: %v", model, err)
+	} else {
+		log.Printf("Pulled %s", model)
+	}
+}
+
+// ollamaProgress posts payload and calls onLine for each progress line until Ollama reports success.
+func ollamaProgress(ctx context.Context, client *http.Client, url string, payload interface{}, onLine func(PullProgress)) error {
+	payloadBytes, _ := json.Marshal(payload)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(payloadBytes))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return classifyUpstream("", 0, "", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	success := false
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var line PullProgress
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("invalid progress line from Ollama: %s", scanner.Bytes())
+		}
+		if line.Error != "" {
+			return errors.New(line.Error)
+		}
+		success = line.Status == "success"
+		onLine(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Ollama stream interrupted: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return classifyUpstream("", resp.StatusCode, "", nil)
+	}
+	if !success {
+		return errors.New("Ollama ended the pull without reporting success")
+	}
+	return nil
+}
+
+// Snapshot returns the current progress.
+func (j *pullJob) Snapshot() PullProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.progress
+}
+
+// update changes the progress and tells every subscriber. Subscribers only ever need the
+// latest state, so a slow one gets its pending update replaced rather than holding up the pull.
+func (j *pullJob) update(change func(*PullProgress)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	change(&j.progress)
+	j.progress.UpdatedAt = time.Now().UTC()
+	for ch := range j.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- j.progress
+	}
+}
+
+// Subscribe returns a channel that receives the current progress and then every update.
+func (j *pullJob) Subscribe() (<-chan PullProgress, func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ch := make(chan PullProgress, 1)
+	ch <- j.progress
+	j.subscribers[ch] = true
+	return ch, func() {
+		j.mu.Lock()
+		delete(j.subscribers, ch)
+		j.mu.Unlock()
+	}
+}
+
+// followPull streams a pull's progress until it finishes or the client leaves.
+func followPull(w http.ResponseWriter, r *http.Request, job *pullJob) {
+	stream := newEventStream(w, r)
+	updates, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case p := <-updates:
+			if p.Error != "" {
+				stream.FailUpstream(&UpstreamError{Message: "Pull failed: " + p.Error, Code: p.Code, Hint: p.Hint, Status: http.StatusBadGateway})
+				return
+			}
+			stream.JSON(p)
+			if p.Done {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handlePullStatus reports pulls: GET /api/pull/status lists them, GET /api/pull/status?model=x
+// re-attaches to that pull's progress stream, and DELETE /api/pull/status?model=x cancels it.
+// Only admins may cancel a pull, as only they may start one.
+func handlePullStatus(w http.ResponseWriter, r *http.Request) {
+	model := r.URL.Query().Get("model")
+
+	switch {
+	case r.Method == http.MethodGet && model == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pulls.List())
+	case r.Method == http.MethodGet:
+		job, ok := pulls.Get(model)
+		if !ok {
+			http.Error(w, "No pull for "+model, http.StatusNotFound)
+			return
+		}
+		followPull(w, r, job)
+	case r.Method == http.MethodDelete && model != "":
+		if !isAdmin(r) {
+			http.Error(w, "Only admins may cancel pulls on this server; send the admin token", http.StatusForbidden)
+			return
+		}
+		job, ok := pulls.Get(model)
+		if !ok || job.Snapshot().Done {
+			http.Error(w, "No running pull for "+model, http.StatusNotFound)
+			return
+		}
+		job.cancel()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// --- Running Models ---
+
+// RunningModel is a model Ollama currently holds in memory, as reported by /api/ps.
+type RunningModel struct {
+	Name      string          `json:"name"`
+	Model     string          `json:"model"`
+	Digest    string          `json:"digest"`
+	Size      int64           `json:"size"`      // Bytes in memory, VRAM included
+	SizeVRAM  int64           `json:"size_vram"` // Bytes of Size held on GPUs
+	ExpiresAt time.Time       `json:"expires_at"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	Backend   string          `json:"backend"` // Added by LAIM
+}
+
+// HostMemory describes the memory of the machine LAIM runs on, normally the same one as Ollama.
+type HostMemory struct {
+	TotalBytes     uint64      `json:"total_bytes"`
+	AvailableBytes uint64      `json:"available_bytes"`
+	GPUs           []GPUMemory `json:"gpus,omitempty"`
+}
+
+type GPUMemory struct {
+	Name       string `json:"name"`
+	TotalBytes uint64 `json:"total_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+}
+
+// handleRunningModels serves GET /api/ps: the loaded models of every backend plus host memory.
+func handleRunningModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := newOllamaClient(10 * time.Second)
+
+	running := []RunningModel{}
+	for _, backend := range routes.Backends() {
+		models, err := fetchRunningModels(r.Context(), client, backend)
+		if err != nil {
+			log.Printf("Could not list running models on %s: %v", backend, err)
+			continue
+		}
+		running = append(running, models...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"models": running,
+		"host":   readHostMemory(r.Context()),
+	})
+}
+
+func fetchRunningModels(ctx context.Context, client *http.Client, backend string) ([]RunningModel, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, backend+ollamaPsAPI, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama answered %s", resp.Status)
+	}
+
+	var ps struct {
+		Models []RunningModel `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
+		return nil, err
+	}
+	for i := range ps.Models {
+		ps.Models[i].Backend = backend
+	}
+	return ps.Models, nil
+}
+
+// readHostMemory reports system memory from /proc/meminfo and, when nvidia-smi is installed,
+// GPU memory. Whatever can't be read is left zero or empty.
+func readHostMemory(ctx context.Context) HostMemory {
+	var mem HostMemory
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		mem.TotalBytes, mem.AvailableBytes = parseMeminfo(string(data))
+	}
+	if _, err := exec.LookPath("nvidia-smi"); err == nil {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "nvidia-smi", "--query-gpu=name,memory.total,memory.used", "--format=csv,noheader,nounits").Output()
+		if err == nil {
+			mem.GPUs = parseNvidiaSMI(string(out))
+		}
+	}
+	return mem
+}
+
+// parseMeminfo returns MemTotal and MemAvailable in bytes.
+func parseMeminfo(meminfo string) (total, available uint64) {
+	for _, line := range strings.Split(meminfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	return total, available
+}
+
+// parseNvidiaSMI reads "name, total MiB, used MiB" lines.
+func parseNvidiaSMI(out string) []GPUMemory {
+	var gpus []GPUMemory
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			continue
+		}
+		total, err1 := strconv.ParseUint(strings.TrimSpace(fields[1]), 10, 64)
+		used, err2 := strconv.ParseUint(strings.TrimSpace(fields[2]), 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		gpus = append(gpus, GPUMemory{Name: strings.TrimSpace(fields[0]), TotalBytes: total << 20, UsedBytes: used << 20})
+	}
+	return gpus
+}
+
+// --- Stream Resume ---
+
+// detachedContext keeps a request's values (request ID, client) but not its cancellation,
+// for work that may outlive the connection.
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// resumableStream keeps the tail of a generation's output so a client whose connection
+// dropped can reconnect with Last-Event-ID and receive the lines it missed. Lines are
+// numbered from 1, matching the SSE ids of the original stream. All methods accept a nil
+// receiver, which is what proxyStreamRequest holds when resumption is disabled.
+type resumableStream struct {
+	id     string
+	client string
+	cancel context.CancelFunc
+	forget func()
+
+	mu       sync.Mutex
+	lines    []string
+	first    int // Number of lines[0]
+	size     int
+	done     bool
+	failure  string
+	attached int           // Connected clients; the generation is stopped when none returns in time
+	changed  chan struct{} // Closed and replaced whenever a line is added or the stream ends
+}
+
+// ResumeStore indexes resumable generations by request ID.
+type ResumeStore struct {
+	mu      sync.Mutex
+	streams map[string]*resumableStream
+}
+
+var resumables *ResumeStore
+
+func NewResumeStore() *ResumeStore {
+	return &ResumeStore{streams: make(map[string]*resumableStream)}
+}
+
+// Start registers a generation requested by client, with its original connection attached.
+// If a generation was registered under id since requestIDMiddleware checked, the new one gets
+// a fresh ID instead; its id field is the one to use.
+func (s *ResumeStore) Start(id, client string, cancel context.CancelFunc) *resumableStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, taken := s.streams[id]; taken {
+		id = newRequestID()
+	}
+	rs := &resumableStream{id: id, client: client, cancel: cancel, first: 1, attached: 1, changed: make(chan struct{})}
+	rs.forget = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.streams[id] == rs {
+			delete(s.streams, id)
+		}
+	}
+	s.streams[id] = rs
+	return rs
+}
+
+func (s *ResumeStore) Get(id string) (*resumableStream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs, ok := s.streams[id]
+	return rs, ok
+}
+
+func resumeGrace() time.Duration {
+	return time.Duration(config.ResumeGraceSeconds) * time.Second
+}
+
+// Append records a line, dropping the oldest ones beyond ResumeBufferBytes.
+func (rs *resumableStream) Append(line string) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.lines = append(rs.lines, line)
+	rs.size += len(line)
+	for rs.size > config.ResumeBufferBytes && len(rs.lines) > 1 {
+		rs.size -= len(rs.lines[0])
+		rs.lines = rs.lines[1:]
+		rs.first++
+	}
+	rs.notify()
+}
+
+// Finish marks the end of the generation; failure is empty if it completed. The buffered
+// output stays available for the grace period.
+func (rs *resumableStream) Finish(failure string) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.done = true
+	rs.failure = failure
+	rs.notify()
+	time.AfterFunc(resumeGrace(), rs.forget)
+}
+
+func (rs *resumableStream) notify() {
+	close(rs.changed)
+	rs.changed = make(chan struct{})
+}
+
+func (rs *resumableStream) Attach() {
+	rs.mu.Lock()
+	rs.attached++
+	rs.mu.Unlock()
+}
+
+// Detach is called when a client disconnects. If no client is attached by the end of the
+// grace period, the generation is stopped.
+func (rs *resumableStream) Detach() {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.attached--
+	if rs.attached > 0 || rs.done {
+		return
+	}
+	time.AfterFunc(resumeGrace(), func() {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		if rs.attached == 0 && !rs.done {
+			log.Printf("Stopping generation %s: no client resumed it", rs.id)
+			rs.cancel()
+		}
+	})
+}
+
+// Since returns the lines after number after, whether the stream has ended (and how), and a
+// channel closed on the next change. ok is false if some of those lines were already dropped.
+func (rs *resumableStream) Since(after int) (lines []string, ended bool, failure string, changed <-chan struct{}, ok bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if after+1 < rs.first {
+		return nil, false, "", nil, false
+	}
+	if start := after + 1 - rs.first; start < len(rs.lines) {
+		lines = append(lines, rs.lines[start:]...)
+	}
+	return lines, rs.done, rs.failure, rs.changed, true
+}
+
+// handleStreamResume serves /api/streams/{request_id}. GET replays the generation from the line
+// after the Last-Event-ID header (from the start without one) and follows it to its end;
+// DELETE stops it. Only the client that started a generation can reach it.
+func handleStreamResume(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/streams/")
+	rs, ok := resumables.Get(id)
+	if !ok || rs.client != clientFrom(r.Context()) {
+		http.Error(w, "No resumable stream "+id, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		after := 0
+		if last := r.Header.Get("Last-Event-ID"); last != "" {
+			n, err := strconv.Atoi(last[strings.LastIndex(last, ":")+1:])
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid Last-Event-ID "+last, http.StatusBadRequest)
+				return
+			}
+			after = n
+		}
+		followResumable(w, r, rs, after)
+	case http.MethodDelete:
+		rs.cancel()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func followResumable(w http.ResponseWriter, r *http.Request, rs *resumableStream, after int) {
+	rs.Attach()
+	defer rs.Detach()
+
+	stream := newEventStream(w, r)
+	for {
+		lines, ended, failure, changed, ok := rs.Since(after)
+		if !ok {
+			stream.Fail("The missed part of the stream is no longer buffered", http.StatusGone)
+			return
+		}
+		for _, line := range lines {
+			after++
+			stream.SetID(fmt.Sprintf("%s:%d", rs.id, after))
+			stream.Data(line)
+		}
+		if ended {
+			if failure != "" {
+				stream.Fail(failure, http.StatusBadGateway)
+				return
+			}
+			stream.start()
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// --- Generation Tuning ---
+
+// Most phases a schedule may have
+const maxScheduleSteps = 8
+
+// ScheduleStep applies Options to the next Tokens tokens of an answer. A final step with
+// Tokens 0 runs until the answer ends.
+type ScheduleStep struct {
+	Tokens  int                    `json:"tokens"`
+	Options map[string]interface{} `json:"options"`
+}
+
+func validateSchedule(steps []ScheduleStep) error {
+	if len(steps) > maxScheduleSteps {
+		return fmt.Errorf("schedule has more than %d steps", maxScheduleSteps)
+	}
+	for i, step := range steps {
+		if step.Tokens < 0 || (step.Tokens == 0 && i < len(steps)-1) {
+			return fmt.Errorf("schedule step %d: tokens must be positive (only the last step may be 0)", i+1)
+		}
+		if _, ok := step.Options["num_predict"]; ok {
+			return fmt.Errorf("schedule step %d: use tokens instead of num_predict", i+1)
+		}
+		if err := validateOptions(step.Options); err != nil {
+			return fmt.Errorf("schedule step %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// generationTuning returns the schedule and auto_temperature setting for a request: its own,
+// or those of its persona.
+func generationTuning(clientReq ClientRequest) ([]ScheduleStep, bool) {
+	schedule, auto := clientReq.Schedule, clientReq.AutoTemperature
+	if clientReq.PromptID != "" {
+		if p, ok := prompts.Get(clientReq.PromptID); ok {
+			if len(schedule) == 0 {
+				schedule = p.Schedule
+			}
+			auto = auto || p.AutoTemperature
+		}
+	}
+	return schedule, auto
+}
+
+// taskTemperatures are the temperatures auto_temperature uses for each detected task type.
+var taskTemperatures = map[string]float64{
+	"code":     0.2,
+	"factual":  0.3,
+	"chat":     0.7,
+	"creative": 1.0,
+}
+
+var (
+	codeTaskPattern     = regexp.MustCompile("(?i)```|\\b(code|function|bug|error|exception|stack ?trace|compile|regex|sql|python|javascript|typescript|golang|rust|java|refactor|unit test)\\b")
+	creativeTaskPattern = regexp.MustCompile(`(?i)\b(story|poem|poetry|song|lyrics|haiku|fiction|novel|brainstorm|imagine|creative|slogan)\b`)
+	factualTaskPattern  = regexp.MustCompile(`(?i)^\s*(what|when|where|who|which|how (many|much|does|do|is)|why|define|explain|is|are|does)\b`)
+)
+
+// detectTaskType guesses from a message whether it asks for code, creative writing, a
+// factual answer or just conversation.
+func detectTaskType(text string) string {
+	switch {
+	case codeTaskPattern.MatchString(text):
+		return "code"
+	case creativeTaskPattern.MatchString(text):
+		return "creative"
+	case factualTaskPattern.MatchString(text):
+		return "factual"
+	}
+	return "chat"
+}
+
+// autoTemperature sets the temperature for the task the text asks for, and returns the
+// "temperature" event telling the client what was picked.
+func autoTemperature(options map[string]interface{}, text string) (map[string]interface{}, streamEvent) {
+	task := detectTaskType(text)
+	out := make(map[string]interface{}, len(options)+1)
+	for k, v := range options {
+		out[k] = v
+	}
+	out["temperature"] = taskTemperatures[task]
+	return out, streamEvent{"temperature", map[string]interface{}{"task": task, "temperature": taskTemperatures[task]}}
+}
+
+func lastUserMessage(messages []Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+// runScheduledChat writes the answer in phases, one per schedule step, each with its own
+// options. Ollama can't change options during a generation, so each phase after the first
+// continues the partial answer, passed back as a prefilled assistant message. Phases stream
+// as one answer; an "event: schedule" marks where each one starts.
+func runScheduledChat(w http.ResponseWriter, r *http.Request, req OllamaChatRequestPayload, client *http.Client, schedule []ScheduleStep, preamble ...streamEvent) {
+	backend := routes.Resolve(req.Model)
+	stream := newEventStream(w, r)
+
+	release, ok := acquireGenerationSlot(r, stream, backend)
+	if !ok {
+		return
+	}
+	defer release()
+
+	for _, event := range preamble {
+		stream.Event(event.Name, event.Data)
+	}
+
+	messages := req.Messages
+	var answer strings.Builder
+	for i, step := range schedule {
+		phase := req
+		phase.Options = make(map[string]interface{}, len(req.Options)+len(step.Options)+1)
+		for k, v := range req.Options {
+			phase.Options[k] = v
+		}
+		for k, v := range step.Options {
+			phase.Options[k] = v
+		}
+		if step.Tokens > 0 {
+			phase.Options["num_predict"] = step.Tokens
+		}
+		if answer.Len() > 0 {
+			phase.Messages = append(append([]Message(nil), messages...), Message{Role: "assistant", Content: answer.String()})
+		}
+		stream.Event("schedule", map[string]interface{}{"step": i + 1, "tokens": step.Tokens, "options": step.Options})
+
+		var final OllamaResponseChunk
+		err := ollamaStream(r.Context(), client, backend+ollamaChatAPI, phase, func(chunk OllamaResponseChunk) {
+			if chunk.Message != nil {
+				answer.WriteString(chunk.Message.Content)
+			}
+			if chunk.Done {
+				final = chunk
+				return
+			}
+			stream.JSON(chunk)
+		})
+		if err != nil {
+			if r.Context().Err() == nil {
+				stream.Fail(err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+
+		// The answer is complete unless this phase stopped at its token budget
+		if final.DoneReason != "length" || i == len(schedule)-1 {
+			stream.JSON(final)
+			return
+		}
+	}
+}
+
+// --- Best of N ---
+
+// Most candidates a single request may ask for
+const maxCandidates = 5
+
+// Candidate is one of the answers a best-of-N request generated, sent as an "event: candidate"
+// as soon as it is complete.
+type Candidate struct {
+	Candidate int    `json:"candidate"` // 1-based
+	Content   string `json:"content"`
+	EvalCount int    `json:"eval_count,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// candidateOptions gives each candidate its own seed when the request fixed one, so they
+// don't all come out the same.
+func candidateOptions(options map[string]interface{}, i int) map[string]interface{} {
+	seed, ok := options["seed"].(float64)
+	if !ok || i == 0 {
+		return options
+	}
+	out := make(map[string]interface{}, len(options))
+	for k, v := range options {
+		out[k] = v
+	}
+	out["seed"] = seed + float64(i)
+	return out
+}
+
+// runCandidates generates n answers at once and streams each as an "event: candidate". The
+// answer sent as the response is the first candidate, or with judge the one the model itself
+// rates best, announced first in an "event: judgement". All candidates share one generation
+// slot; whether they really run in parallel is up to OLLAMA_NUM_PARALLEL.
+func runCandidates(w http.ResponseWriter, r *http.Request, backend, apiPath string, client *http.Client, n int, judge bool, question string, payload func(i int) interface{}, preamble ...streamEvent) {
+	stream := newEventStream(w, r)
+
+	release, ok := acquireGenerationSlot(r, stream, backend)
+	if !ok {
+		return
+	}
+	defer release()
+
+	for _, event := range preamble {
+		stream.Event(event.Name, event.Data)
+	}
+
+	candidates := make([]Candidate, n)
+	finals := make([]OllamaResponseChunk, n)
+	completed := make(chan int)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			var sb strings.Builder
+			err := ollamaStream(r.Context(), client, backend+apiPath, payload(i), func(chunk OllamaResponseChunk) {
+				sb.WriteString(chunk.Response)
+				if chunk.Message != nil {
+					sb.WriteString(chunk.Message.Content)
+				}
+				if chunk.Done {
+					finals[i] = chunk
+				}
+			})
+			candidates[i] = Candidate{Candidate: i + 1, Content: sb.String(), EvalCount: finals[i].EvalCount}
+			if err != nil {
+				candidates[i].Error = err.Error()
+			}
+			completed <- i
+		}(i)
+	}
+
+	best := -1
+	for range candidates {
+		i := <-completed
+		stream.Event("candidate", candidates[i])
+		if candidates[i].Error == "" && (best < 0 || i < best) {
+			best = i
+		}
+	}
+	if r.Context().Err() != nil {
+		return
+	}
+	if best < 0 {
+		stream.Fail(candidates[0].Error, http.StatusBadGateway)
+		return
+	}
+
+	if judge {
+		choice, reason, err := judgeCandidates(r.Context(), client, backend, finals[best].Model, question, candidates)
+		if err != nil {
+			log.Printf("Judging %d candidates failed (request %s): %v", n, requestIDFrom(r.Context()), err)
+			stream.Event("judgement", map[string]interface{}{"best": best + 1, "error": err.Error()})
+		} else {
+			best = choice
+			stream.Event("judgement", map[string]interface{}{"best": best + 1, "reason": reason})
+		}
+	}
+
+	final := finals[best]
+	result := OllamaResponseChunk{Model: final.Model}
+	if apiPath == ollamaChatAPI {
+		result.Message = &Message{Role: "assistant", Content: candidates[best].Content}
+	} else {
+		result.Response = candidates[best].Content
+	}
+	stream.JSON(result)
+
+	final.Response = ""
+	if final.Message != nil {
+		final.Message = &Message{Role: final.Message.Role}
+	}
+	stream.JSON(final)
+}
+
+// judgeCandidates asks the model which candidate answers the question best and why. It only
+// picks among candidates that didn't fail.
+func judgeCandidates(ctx context.Context, client *http.Client, backend, model, question string, candidates []Candidate) (int, string, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Several answers were written to the same request. Pick the one that is most correct, complete and clear.\n\nRequest:\n%s\n", question)
+	for _, c := range candidates {
+		if c.Error == "" {
+			fmt.Fprintf(&sb, "\nAnswer %d:\n%s\n", c.Candidate, c.Content)
+		}
+	}
+	sb.WriteString("\nReply with only JSON: {\"best\": <number of the best answer>, \"reason\": \"<one sentence>\"}")
+
+	chunk, err := ollamaGenerateOnce(ctx, client, backend, OllamaGenerateRequestPayload{
+		Model:   model,
+		Prompt:  sb.String(),
+		Format:  json.RawMessage(`"json"`),
+		Options: map[string]interface{}{"temperature": 0},
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	var verdict struct {
+		Best   int    `json:"best"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(chunk.Response), &verdict); err != nil {
+		return 0, "", fmt.Errorf("unreadable verdict %q: %v", chunk.Response, err)
+	}
+	if verdict.Best < 1 || verdict.Best > len(candidates) || candidates[verdict.Best-1].Error != "" {
+		return 0, "", fmt.Errorf("verdict picked answer %d, which doesn't exist", verdict.Best)
+	}
+	return verdict.Best - 1, verdict.Reason, nil
+}
+
+// --- Guardrail Preamble ---
+
+// GuardrailVersion is one revision of the deployment's mandatory system preamble. A version
+// with empty Text turns the guardrail off.
+type GuardrailVersion struct {
+	Version   int       `json:"version"`
+	Text      string    `json:"text"`
+	Source    string    `json:"source"` // "config" or "admin"
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GuardrailAudit records which preamble version a request was answered under.
+type GuardrailAudit struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Client    string    `json:"client"`
+	Action    string    `json:"action"`
+	Model     string    `json:"model"`
+	Version   int       `json:"version"`
+}
+
+const (
+	guardrailFile      = "guardrails.json"
+	guardrailAuditFile = "guardrail-audit.jsonl"
+	// Audit entries kept in memory for the admin API; the file in the data directory keeps all
+	maxGuardrailAudit = 10000
+)
+
+// GuardrailStore holds every version of the preamble and the recent audit trail.
+type GuardrailStore struct {
+	mu       sync.Mutex
+	versions []GuardrailVersion
+	audit    []GuardrailAudit
+}
+
+var guardrails *GuardrailStore
+
+// NewGuardrailStore loads the saved versions and audit trail. When the configured preamble
+// differs from the one the config file last set, it becomes a new version; a preamble set
+// through the admin API since then stays in force until the config file changes.
+func NewGuardrailStore(configured string) *GuardrailStore {
+	gs := &GuardrailStore{}
+	if err := loadJSONFile(guardrailFile, &gs.versions); err != nil {
+		log.Printf("⚠️ WARNING: Could not load guardrail versions: %v", err)
+	}
+	gs.loadAudit()
+
+	lastConfigured := ""
+	for _, v := range gs.versions {
+		if v.Source == "config" {
+			lastConfigured = v.Text
+		}
+	}
+	if configured != lastConfigured {
+		v := gs.Set(configured, "config")
+		log.Printf("Guardrail preamble version %d set from the config file", v.Version)
+	}
+	return gs
+}
+
+func (gs *GuardrailStore) loadAudit() {
+	if config.DataDir == "" {
+		return
+	}
+	f, err := os.Open(filepath.Join(config.DataDir, guardrailAuditFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("⚠️ WARNING: Could not load guardrail audit: %v", err)
+		}
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry GuardrailAudit
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			gs.audit = append(gs.audit, entry)
+		}
+	}
+	if len(gs.audit) > maxGuardrailAudit {
+		gs.audit = gs.audit[len(gs.audit)-maxGuardrailAudit:]
+	}
+}
+
+// Current returns the preamble in force; version 0 means none was ever set.
+func (gs *GuardrailStore) Current() GuardrailVersion {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if len(gs.versions) == 0 {
+		return GuardrailVersion{}
+	}
+	return gs.versions[len(gs.versions)-1]
+}
+
+func (gs *GuardrailStore) Versions() []GuardrailVersion {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return append([]GuardrailVersion(nil), gs.versions...)
+}
+
+// Set makes text the preamble from now on, as a new version.
+func (gs *GuardrailStore) Set(text, source string) GuardrailVersion {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	v := GuardrailVersion{Version: len(gs.versions) + 1, Text: text, Source: source, CreatedAt: time.Now().UTC()}
+	gs.versions = append(gs.versions, v)
+	if err := saveJSONFile(guardrailFile, gs.versions); err != nil {
+		log.Printf("Could not save guardrail versions: %v", err)
+	}
+	return v
+}
+
+func (gs *GuardrailStore) Record(entry GuardrailAudit) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.audit = append(gs.audit, entry)
+	if len(gs.audit) > maxGuardrailAudit {
+		gs.audit = gs.audit[len(gs.audit)-maxGuardrailAudit:]
+	}
+	if err := appendJSONLine(guardrailAuditFile, entry); err != nil {
+		log.Printf("Could not write guardrail audit: %v", err)
+	}
+}
+
+// Audit returns recorded entries, newest first, optionally only those of one request or version.
+func (gs *GuardrailStore) Audit(requestID string, version int) []GuardrailAudit {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	list := []GuardrailAudit{}
+	for i := len(gs.audit) - 1; i >= 0; i-- {
+		entry := gs.audit[i]
+		if (requestID == "" || entry.RequestID == requestID) && (version == 0 || entry.Version == version) {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// withGuardrail pins the preamble in force for the rest of the request, audits it and tells the
+// client its version in X-Guardrail-Version.
+func withGuardrail(w http.ResponseWriter, r *http.Request, clientReq ClientRequest) *http.Request {
+	current := guardrails.Current()
+	if current.Text == "" {
+		return r
+	}
+	guardrails.Record(GuardrailAudit{
+		Time:      time.Now().UTC(),
+		RequestID: requestIDFrom(r.Context()),
+		Client:    clientFrom(r.Context()),
+		Action:    clientReq.ActionType,
+		Model:     clientReq.Model,
+		Version:   current.Version,
+	})
+	w.Header().Set("X-Guardrail-Version", strconv.Itoa(current.Version))
+	return r.WithContext(context.WithValue(r.Context(), guardrailKey, current.Text))
+}
+
+// guardrailSystem puts the request's preamble ahead of a generate system prompt.
+func guardrailSystem(ctx context.Context, system string) string {
+	text, _ := ctx.Value(guardrailKey).(string)
+	if text == "" {
+		return system
+	}
+	if system == "" {
+		return text
+	}
+	return text + "\n\n" + system
+}
+
+// guardrailMessages puts the request's preamble ahead of a chat as its first system message.
+func guardrailMessages(ctx context.Context, messages []Message) []Message {
+	text, _ := ctx.Value(guardrailKey).(string)
+	if text == "" {
+		return messages
+	}
+	return append([]Message{{Role: "system", Content: text}}, messages...)
+}
+
+// handleAdminGuardrail shows the preamble and its history (GET) or sets a new version (PUT
+// {"text": "..."}; an empty text turns it off).
+func handleAdminGuardrail(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"current":  guardrails.Current(),
+			"versions": guardrails.Versions(),
+		})
+	case http.MethodPut:
+		var body struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid guardrail payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		v := guardrails.Set(strings.TrimSpace(body.Text), "admin")
+		log.Printf("Guardrail preamble version %d set via admin API", v.Version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminGuardrailAudit lists which preamble version requests used:
+// GET /api/admin/guardrail/audit?request_id=...&version=...
+func handleAdminGuardrailAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			http.Error(w, "version must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(guardrails.Audit(r.URL.Query().Get("request_id"), version))
+}
+
+// --- Round Table ---
+
+// Limits on a round-table discussion
+const (
+	maxRoundTableParticipants = 6
+	maxRoundTableRounds       = 5
+)
+
+// RoundTableParticipant is one model taking turns in a round-table chat.
+type RoundTableParticipant struct {
+	Name     string `json:"name,omitempty"`     // How the others address it; defaults to its model
+	Model    string `json:"model,omitempty"`    // Defaults to the request's model
+	Persona  string `json:"persona,omitempty"`  // System prompt giving it its role
+	PromptID string `json:"promptId,omitempty"` // Or a persona from the prompt library
+}
+
+func validateRoundTable(participants []RoundTableParticipant, rounds int) error {
+	if len(participants) < 2 || len(participants) > maxRoundTableParticipants {
+		return fmt.Errorf("roundtable needs between 2 and %d participants", maxRoundTableParticipants)
+	}
+	if rounds < 0 || rounds > maxRoundTableRounds {
+		return fmt.Errorf("rounds must be between 1 and %d", maxRoundTableRounds)
+	}
+	names := make(map[string]bool)
+	for i, p := range participants {
+		if p.Model != "" && (!modelNamePattern.MatchString(p.Model) || len(p.Model) > 200) {
+			return fmt.Errorf("participant %d: invalid model name %q", i+1, p.Model)
+		}
+		if len(p.Name) > 64 || strings.ContainsAny(p.Name, "\n:") {
+			return fmt.Errorf("participant %d: names must be a single line of at most 64 characters without colons", i+1)
+		}
+		if p.Persona != "" && p.PromptID != "" {
+			return fmt.Errorf("participant %d: use either persona or promptId", i+1)
+		}
+		if len(p.Persona) > maxSystemPromptBytes {
+			return fmt.Errorf("participant %d: persona exceeds %d bytes", i+1, maxSystemPromptBytes)
+		}
+		if p.PromptID != "" && !promptIDPattern.MatchString(p.PromptID) {
+			return fmt.Errorf("participant %d: invalid promptId %q", i+1, p.PromptID)
+		}
+		if name := p.Name; name != "" {
+			if names[name] {
+				return fmt.Errorf("participant %d: name %q is used twice", i+1, name)
+			}
+			names[name] = true
+		}
+	}
+	return nil
+}
+
+// roundTableSeats fills in each participant's defaults and resolves library personas.
+func roundTableSeats(clientReq ClientRequest) ([]RoundTableParticipant, error) {
+	seats := make([]RoundTableParticipant, len(clientReq.Participants))
+	taken := make(map[string]bool)
+	for _, p := range clientReq.Participants {
+		if p.Name != "" {
+			taken[p.Name] = true
+		}
+	}
+	for i, p := range clientReq.Participants {
+		if p.Model == "" {
+			p.Model = clientReq.Model
+		}
+		if p.PromptID != "" {
+			prompt, rendered, err := renderPrompt(p.PromptID, nil, "")
+			if err != nil {
+				return nil, fmt.Errorf("participant %d: %v", i+1, err)
+			}
+			if prompt.Kind != "system" {
+				return nil, fmt.Errorf("participant %d: %q is a template, not a persona", i+1, p.PromptID)
+			}
+			p.Persona = rendered
+		}
+		if p.Name == "" {
+			// Two unnamed participants on the same model become "mistral" and "mistral 2", skipping
+			// names that other participants were given
+			p.Name = p.Model
+			for n := 2; taken[p.Name]; n++ {
+				p.Name = fmt.Sprintf("%s %d", p.Model, n)
+			}
+			taken[p.Name] = true
+		}
+		seats[i] = p
+	}
+	return seats, nil
+}
+
+// roundTableMessages is the conversation as one participant sees it: its own turns as the
+// assistant's, everyone else's as user messages prefixed with the speaker's name.
+func roundTableMessages(seat RoundTableParticipant, seats []RoundTableParticipant, history []Message) []Message {
+	var others []string
+	for _, s := range seats {
+		if s.Name != seat.Name {
+			others = append(others, s.Name)
+		}
+	}
+	system := fmt.Sprintf("You are %s, taking part in a round-table discussion with %s and the user. "+
+		"Messages from the other participants start with their name. Reply only as %s, without a name prefix: "+
+		"build on, question or challenge what the others said, and keep it to a few paragraphs.",
+		seat.Name, strings.Join(others, ", "), seat.Name)
+	if seat.Persona != "" {
+		system = seat.Persona + "\n\n" + system
+	}
+
+	messages := []Message{{Role: "system", Content: system}}
+	for _, m := range history {
+		switch {
+		case m.Role == "assistant" && m.Name == seat.Name:
+			messages = append(messages, Message{Role: "assistant", Content: m.Content})
+		case m.Role == "assistant":
+			speaker := m.Name
+			if speaker == "" {
+				speaker = "Assistant"
+			}
+			messages = append(messages, Message{Role: "user", Content: speaker + ": " + m.Content})
+		default:
+			messages = append(messages, Message{Role: m.Role, Content: m.Content})
+		}
+	}
+	return messages
+}
+
+// callRoundTableAPI lets the participants answer in turn, for the given number of rounds, each
+// seeing what the others said before it. An "event: turn" announces who speaks next; their
+// reply streams as ordinary chat chunks. Each turn waits for its own generation slot.
+func callRoundTableAPI(w http.ResponseWriter, r *http.Request, clientReq ClientRequest, client *http.Client) {
+	seats, err := roundTableSeats(clientReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rounds := clientReq.Rounds
+	if rounds == 0 {
+		rounds = 1
+	}
+
+	stream := newEventStream(w, r)
+	history := expandMessageVariables(clientReq.Messages, clientReq.Model)
+	for round := 1; round <= rounds; round++ {
+		for _, seat := range seats {
+			backend := routes.Resolve(seat.Model)
+			release, ok := acquireGenerationSlot(r, stream, backend)
+			if !ok {
+				return
+			}
+			stream.Event("turn", map[string]interface{}{"round": round, "participant": seat.Name, "model": seat.Model})
+
+			seatReq := clientReq
+			seatReq.Model = seat.Model
+			req := OllamaChatRequestPayload{
+				Model:     seat.Model,
+				Messages:  guardrailMessages(r.Context(), roundTableMessages(seat, seats, history)),
+				Stream:    true,
+				Options:   clientReq.Options,
+				KeepAlive: keepAliveFor(seatReq),
+			}
+			fitToContext(&req)
+
+			var answer strings.Builder
+			err := ollamaStream(r.Context(), client, backend+ollamaChatAPI, req, func(chunk OllamaResponseChunk) {
+				if chunk.Done {
+					return
+				}
+				if chunk.Message != nil {
+					answer.WriteString(chunk.Message.Content)
+				}
+				stream.JSON(chunk)
+			})
+			release()
+			if err != nil {
+				if r.Context().Err() == nil {
+					stream.Fail(fmt.Sprintf("%s's turn failed: %v", seat.Name, err), http.StatusBadGateway)
+				}
+				return
+			}
+			history = append(history, Message{Role: "assistant", Name: seat.Name, Content: answer.String()})
+		}
+	}
+	stream.JSON(OllamaResponseChunk{Model: clientReq.Model, Done: true})
+}
+
+// --- Auto Model Selection ---
+
+// autoModel is the model name that has LAIM pick an installed model for each request.
+const autoModel = "auto"
+
+const (
+	// Requests estimated to be longer than this go to a long-context model
+	autoLongContextTokens = 6000
+	// Routing decisions kept in memory for the admin API; the file in the data directory keeps all
+	maxAutoRoutes  = 10000
+	autoRoutesFile = "auto-routes.jsonl"
+)
+
+// AutoRoute records which model a request with model "auto" was sent to, and why.
+type AutoRoute struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Model      string    `json:"model"`
+	Category   string    `json:"category"` // "vision", "long-context", "code", "reasoning" or "chat"
+	Reason     string    `json:"reason"`
+	Classifier string    `json:"classifier"` // "rules", or the model that classified the request
+}
+
+var reasoningTaskPattern = regexp.MustCompile(`(?i)\b(prove|proof|step by step|calculate|solve|equation|math|logic|puzzle|riddle|reason)\b`)
+
+// autoCategories are the categories a classifier model may answer with.
+var autoCategories = map[string]bool{"code": true, "reasoning": true, "chat": true}
+
+// classifyRequest decides what kind of model a request needs. Images and length are decided
+// by rules; the rest by the classifier model, if configured, or keyword rules.
+func classifyRequest(ctx context.Context, client *http.Client, clientReq ClientRequest) (category, reason, classifier string) {
+	text, tokens := clientReq.Prompt, estimateTokens(clientReq.Prompt)
+	if clientReq.ActionType == "chat" {
+		text, tokens = lastUserMessage(clientReq.Messages), estimateMessageTokens(clientReq.Messages)
+	}
+
+	switch {
+	case hasImages(clientReq):
+		return "vision", "the request has images", "rules"
+	case tokens > autoLongContextTokens:
+		return "long-context", fmt.Sprintf("the request is about %d tokens long", tokens), "rules"
+	}
+
+	if config.AutoModelClassifier != "" {
+		category, reason, err := classifyWithModel(ctx, client, config.AutoModelClassifier, text)
+		if err == nil {
+			return category, reason, config.AutoModelClassifier
+		}
+		log.Printf("Auto model classifier %s failed, using rules: %v", config.AutoModelClassifier, err)
+	}
+
+	switch {
+	case detectTaskType(text) == "code":
+		return "code", "the message is about code", "rules"
+	case reasoningTaskPattern.MatchString(text):
+		return "reasoning", "the message asks for reasoning or math", "rules"
+	}
+	return "chat", "general conversation", "rules"
+}
+
+// classifyWithModel asks a small model which category a message belongs to.
+func classifyWithModel(ctx context.Context, client *http.Client, model, text string) (string, string, error) {
+	prompt := "Classify the request below as \"code\" (writing, reviewing or debugging code), \"reasoning\" (math, logic or multi-step problems) or \"chat\" (anything else).\n\n" +
+		"Request:\n" + text + "\n\nReply with only JSON: {\"category\": \"...\", \"reason\": \"<a few words>\"}"
+	chunk, err := ollamaGenerateOnce(ctx, client, routes.Resolve(model), OllamaGenerateRequestPayload{
+		Model:   model,
+		Prompt:  prompt,
+		Format:  json.RawMessage(`"json"`),
+		Options: map[string]interface{}{"temperature": 0},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	var verdict struct {
+		Category string `json:"category"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(chunk.Response), &verdict); err != nil {
+		return "", "", fmt.Errorf("unreadable classification %q: %v", chunk.Response, err)
+	}
+	if !autoCategories[verdict.Category] {
+		return "", "", fmt.Errorf("unknown category %q", verdict.Category)
+	}
+	return verdict.Category, verdict.Reason, nil
+}
+
+// pickInstalledModel returns the best installed model for a task: one that fits the detected
+// hardware if possible, then the highest recommender score. Embedding-only models are skipped.
+func pickInstalledModel(task string) (RecommendedModel, bool) {
+	hardwareKnown := detectedHardware.RAM_GB > 0
+	var best RecommendedModel
+	bestFits, found := false, false
+	for _, model := range ModelDatabase.List() {
+		if !model.Installed || !hasTask(model, task) || hasTask(model, "embedding") {
+			continue
+		}
+		if result, ok := benchmarkFor(model.Name); ok {
+			model.Score += throughputBonus(result)
+		}
+		fits := hardwareKnown && detectedHardware.VRAM_GB >= model.HardwareReq.MinVRAM_GB && detectedHardware.RAM_GB >= model.HardwareReq.MinRAM_GB
+		if !found || fits && !bestFits || fits == bestFits && model.Score > best.Score {
+			best, bestFits, found = model, fits, true
+		}
+	}
+	return best, found
+}
+
+func hasTask(model RecommendedModel, task string) bool {
+	for _, t := range model.Tasks {
+		if t == task {
+			return true
+		}
+	}
+	return false
+}
+
+// routeAutoModel picks the model for a request with model "auto". When no installed model
+// suits the request's category, the best chat model is used.
+func routeAutoModel(ctx context.Context, client *http.Client, clientReq ClientRequest) (AutoRoute, error) {
+	category, reason, classifier := classifyRequest(ctx, client, clientReq)
+	model, ok := pickInstalledModel(category)
+	if !ok && category != "chat" {
+		reason += fmt.Sprintf("; no installed %s model, using a chat model", category)
+		model, ok = pickInstalledModel("chat")
+	}
+	if !ok {
+		return AutoRoute{}, errors.New("model \"auto\": no installed model is known yet")
+	}
+	return AutoRoute{
+		Time:       time.Now().UTC(),
+		RequestID:  requestIDFrom(ctx),
+		Model:      model.Name,
+		Category:   category,
+		Reason:     reason,
+		Classifier: classifier,
+	}, nil
+}
+
+// AutoRouteLog keeps the recent routing decisions.
+type AutoRouteLog struct {
+	mu     sync.Mutex
+	routes []AutoRoute
+}
+
+var autoRoutes = &AutoRouteLog{}
+
+func (l *AutoRouteLog) Record(route AutoRoute) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.routes = append(l.routes, route)
+	if len(l.routes) > maxAutoRoutes {
+		l.routes = l.routes[len(l.routes)-maxAutoRoutes:]
+	}
+	if err := appendJSONLine(autoRoutesFile, route); err != nil {
+		log.Printf("Could not record auto route: %v", err)
+	}
+}
+
+// List returns recorded decisions, newest first, optionally only those of one request or model.
+func (l *AutoRouteLog) List(requestID, model string) []AutoRoute {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := []AutoRoute{}
+	for i := len(l.routes) - 1; i >= 0; i-- {
+		route := l.routes[i]
+		if (requestID == "" || route.RequestID == requestID) && (model == "" || route.Model == model) {
+			list = append(list, route)
+		}
+	}
+	return list
+}
+
+// withAutoRoute records the decision, tells the client the model in X-Auto-Model and keeps the
+// decision for the "route" event at the start of the stream.
+func withAutoRoute(w http.ResponseWriter, r *http.Request, route AutoRoute) *http.Request {
+	autoRoutes.Record(route)
+	log.Printf("Auto model: %s (%s: %s, by %s) for request %s", route.Model, route.Category, route.Reason, route.Classifier, route.RequestID)
+	w.Header().Set("X-Auto-Model", route.Model)
+	return r.WithContext(context.WithValue(r.Context(), autoRouteKey, route))
+}
+
+// autoRouteEvents starts a stream's preamble with the "route" event of an auto-routed request.
+func autoRouteEvents(ctx context.Context) []streamEvent {
+	route, ok := ctx.Value(autoRouteKey).(AutoRoute)
+	if !ok {
+		return nil
+	}
+	return []streamEvent{{"route", route}}
+}
+
+// handleAdminAutoRoutes lists routing decisions: GET /api/admin/auto-routes?request_id=...&model=...
+func handleAdminAutoRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(autoRoutes.List(r.URL.Query().Get("request_id"), r.URL.Query().Get("model")))
+}
+
+// --- Embeddings ---
+
+const (
+	// Most texts one /api/embeddings request may embed
+	maxEmbeddingInputs = 1000
+	embeddingCacheFile = "embeddings.jsonl"
+)
+
+// EmbeddingsRequest is the body of POST /api/embeddings. Input is one text or a list of them.
+type EmbeddingsRequest struct {
+	Model     string                 `json:"model"`
+	Input     json.RawMessage        `json:"input"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive json.RawMessage        `json:"keep_alive,omitempty"`
+}
+
+// EmbeddingsResponse has one embedding per input, in order. Cached counts those that came
+// from the cache.
+type EmbeddingsResponse struct {
+	Model      string      `json:"model"`
+	Embeddings [][]float64 `json:"embeddings"`
+	Cached     int         `json:"cached"`
+}
+
+type ollamaEmbedPayload struct {
+	Model     string                 `json:"model"`
+	Input     []string               `json:"input"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive json.RawMessage        `json:"keep_alive,omitempty"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings [][]float64 `json:"embeddings"`
+}
+
+// embeddingCacheEntry is one line of the cache file.
+type embeddingCacheEntry struct {
+	Key       string    `json:"key"`
+	Embedding []float64 `json:"embedding"`
+}
+
+// EmbeddingCache keeps embeddings by model, options and content hash, so the same document
+// chunks aren't embedded again. The file in the data directory is append-only and compacted
+// at startup.
+type EmbeddingCache struct {
+	mu      sync.Mutex
+	limit   int
+	entries map[string][]float64
+	order   []string // Oldest first
+}
+
+var embeddingCache *EmbeddingCache
+
+func NewEmbeddingCache(limit int) *EmbeddingCache {
+	ec := &EmbeddingCache{limit: limit, entries: make(map[string][]float64)}
+	if limit <= 0 || config.DataDir == "" {
+		return ec
+	}
+	f, err := os.Open(filepath.Join(config.DataDir, embeddingCacheFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("⚠️ WARNING: Could not load embedding cache: %v", err)
+		}
+		return ec
+	}
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry embeddingCacheEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			ec.add(entry.Key, entry.Embedding)
+			lines++
+		}
+	}
+	f.Close()
+	if lines > len(ec.order) {
+		ec.compact()
+	}
+	return ec
+}
+
+func embeddingKey(model string, options map[string]interface{}, text string) string {
+	opts, _ := json.Marshal(options) // Map keys are sorted, so equal options hash the same
+	sum := sha256.Sum256([]byte(model + "\x00" + string(opts) + "\x00" + text))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ec *EmbeddingCache) Get(key string) ([]float64, bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	embedding, ok := ec.entries[key]
+	return embedding, ok
+}
+
+func (ec *EmbeddingCache) Put(key string, embedding []float64) {
+	if ec.limit <= 0 {
+		return
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if _, ok := ec.entries[key]; ok {
+		return
+	}
+	ec.add(key, embedding)
+	if err := appendJSONLine(embeddingCacheFile, embeddingCacheEntry{key, embedding}); err != nil {
+		log.Printf("Could not save embedding: %v", err)
+	}
+}
+
+// add stores an embedding, dropping the oldest beyond the limit. Callers hold ec.mu.
+func (ec *EmbeddingCache) add(key string, embedding []float64) {
+	if _, ok := ec.entries[key]; !ok {
+		ec.order = append(ec.order, key)
+	}
+	ec.entries[key] = embedding
+	for len(ec.order) > ec.limit {
+		delete(ec.entries, ec.order[0])
+		ec.order = ec.order[1:]
+	}
+}
+
+// compact rewrites the cache file with only the entries still kept.
+func (ec *EmbeddingCache) compact() {
+	target := filepath.Join(config.DataDir, embeddingCacheFile)
+	var buf bytes.Buffer
+	for _, key := range ec.order {
+		line, _ := json.Marshal(embeddingCacheEntry{key, ec.entries[key]})
+		buf.Write(append(line, '\n'))
+	}
+	if err := os.WriteFile(target+".tmp", buf.Bytes(), 0600); err != nil {
+		log.Printf("Could not compact embedding cache: %v", err)
+		return
+	}
+	if err := os.Rename(target+".tmp", target); err != nil {
+		log.Printf("Could not compact embedding cache: %v", err)
+	}
+}
+
+// parseEmbeddingInput accepts a single text or a list of texts.
+func parseEmbeddingInput(raw json.RawMessage) ([]string, error) {
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []string{one}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, errors.New("input must be a string or a list of strings")
+	}
+	if len(list) == 0 || len(list) > maxEmbeddingInputs {
+		return nil, fmt.Errorf("input must have between 1 and %d texts", maxEmbeddingInputs)
+	}
+	return list, nil
+}
+
+// handleEmbeddings embeds texts with Ollama's /api/embed, answering from the cache where it
+// can: POST /api/embeddings {"model", "input"}
+func handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req EmbeddingsRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "Invalid embeddings payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	texts, err := parseEmbeddingInput(req.Input)
+	if err == nil && (!modelNamePattern.MatchString(req.Model) || len(req.Model) > 200) {
+		err = fmt.Errorf("invalid model name %q", req.Model)
+	}
+	if err == nil {
+		err = validateOptions(req.Options)
+	}
+	if err == nil && len(req.KeepAlive) > 0 {
+		err = validateKeepAlive(req.KeepAlive)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := EmbeddingsResponse{Model: req.Model, Embeddings: make([][]float64, len(texts))}
+	keys := make([]string, len(texts))
+	var missing []string
+	positions := make(map[string][]int) // Texts to embed, and where their embeddings go
+	for i, text := range texts {
+		keys[i] = embeddingKey(req.Model, req.Options, text)
+		if embedding, ok := embeddingCache.Get(keys[i]); ok {
+			resp.Embeddings[i] = embedding
+			resp.Cached++
+			continue
+		}
+		if _, ok := positions[keys[i]]; !ok {
+			missing = append(missing, text)
+		}
+		positions[keys[i]] = append(positions[keys[i]], i)
+	}
+
+	if len(missing) > 0 {
+		embeddings, status, err := ollamaEmbed(r.Context(), ollamaEmbedPayload{
+			Model:     req.Model,
+			Input:     missing,
+			Options:   req.Options,
+			KeepAlive: keepAliveFor(ClientRequest{Model: req.Model, KeepAlive: req.KeepAlive}),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		for i, text := range missing {
+			key := embeddingKey(req.Model, req.Options, text)
+			embeddingCache.Put(key, embeddings[i])
+			for _, pos := range positions[key] {
+				resp.Embeddings[pos] = embeddings[i]
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ollamaEmbed asks the model's backend for embeddings. On failure it also returns the status
+// to answer with.
+func ollamaEmbed(ctx context.Context, payload ollamaEmbedPayload) ([][]float64, int, error) {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, routes.Resolve(payload.Model)+ollamaEmbedAPI, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newOllamaClient(300 * time.Second).Do(req)
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("Ollama Connection Error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, http.StatusNotFound, fmt.Errorf("Model %s is not installed", payload.Model)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, http.StatusBadGateway, fmt.Errorf("Ollama API Error: %s", msg)
+	}
+
+	var result ollamaEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("invalid /api/embed response: %w", err)
+	}
+	if len(result.Embeddings) != len(payload.Input) {
+		return nil, http.StatusBadGateway, fmt.Errorf("Ollama returned %d embeddings for %d texts", len(result.Embeddings), len(payload.Input))
+	}
+	return result.Embeddings, http.StatusOK, nil
+}
+
+// --- Kiosk Mode ---
+
+// kioskPaths are all the public listener serves in kiosk mode; "/" is the kiosk page.
+var kioskPaths = map[string]bool{
+	"/":                  true,
+	"/index.html":        true,
+	"/static/kiosk.js":   true,
+	"/static/styles.css": true,
+	"/api/kiosk":         true,
+	"/api/kiosk/chat":    true,
+}
+
+// kioskMiddleware hides everything but the kiosk page and its API.
+func kioskMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !kioskPaths[assets.Original(r.URL.Path)] {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/" || r.URL.Path == "/index.html" {
+			servePage(w, "kiosk.html")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimiter allows each key a number of requests per sliding window.
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	recent map[string][]time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{limit: limit, window: window, recent: make(map[string][]time.Time)}
+}
+
+// Allow records a request by key if it is within the limit. Otherwise it returns how long
+// until the next one will be.
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	times := rl.prune(key, now)
+	if len(times) >= rl.limit {
+		return false, times[0].Add(rl.window).Sub(now)
+	}
+	rl.recent[key] = append(times, now)
+
+	// Forget visitors who have gone quiet, so the map doesn't grow without bound
+	if len(rl.recent) > 1000 {
+		for k := range rl.recent {
+			if len(rl.prune(k, now)) == 0 {
+				delete(rl.recent, k)
+			}
+		}
+	}
+	return true, 0
+}
+
+// Limit returns how many requests a key may make per window.
+func (rl *RateLimiter) Limit() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.limit
+}
+
+// SetLimit changes the limit; requests already made count against the new one.
+func (rl *RateLimiter) SetLimit(limit int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limit = limit
+}
+
+// prune drops a key's requests that have left the window. Callers hold rl.mu.
+func (rl *RateLimiter) prune(key string, now time.Time) []time.Time {
+	times := rl.recent[key]
+	for len(times) > 0 && now.Sub(times[0]) >= rl.window {
+		times = times[1:]
+	}
+	rl.recent[key] = times
+	return times
+}
+
+var kioskLimiter *RateLimiter
+
+// handleKiosk describes the kiosk to its page: GET /api/kiosk
+func handleKiosk(w http.ResponseWriter, r *http.Request) {
+	if !config.Kiosk.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"title":               config.Kiosk.Title,
+		"model":               config.Kiosk.Model,
+		"showcase":            config.Kiosk.Showcase,
+		"max_prompt_chars":    config.Kiosk.MaxPromptChars,
+		"requests_per_minute": kioskLimiter.Limit(),
+	})
+}
+
+// handleKioskChat answers a visitor with the kiosk's model and system prompt; only the
+// conversation comes from the visitor: POST /api/kiosk/chat {"messages": [...]}
+func handleKioskChat(w http.ResponseWriter, r *http.Request) {
+	if !config.Kiosk.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Messages []Message `json:"messages"`
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, "Invalid kiosk payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, err := kioskMessages(body.Messages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ok, wait := kioskLimiter.Allow(clientIP(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Please wait a moment before asking again", http.StatusTooManyRequests)
+		return
+	}
+
+	clientReq := ClientRequest{
+		ActionType: "chat",
+		Model:      config.Kiosk.Model,
+		Messages:   messages,
+		Options:    map[string]interface{}{"num_predict": float64(config.Kiosk.MaxTokens)},
+	}
+	if err := validateClientRequest(clientReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r = withGuardrail(w, r, clientReq)
+	// Commands such as /model would let visitors pick another model; "/..." is just text here
+	r = r.WithContext(context.WithValue(r.Context(), noCommandsKey, true))
+	callChatAPI(w, r, clientReq, newOllamaClient(300*time.Second))
+}
+
+// kioskMessages keeps the visitor's latest messages, checked against the kiosk's limits,
+// behind the kiosk's system prompt.
+func kioskMessages(messages []Message) ([]Message, error) {
+	if len(messages) == 0 || messages[len(messages)-1].Role != "user" {
+		return nil, errors.New("the last message must be from the user")
+	}
+	if len(messages) > config.Kiosk.MaxHistory+1 {
+		messages = messages[len(messages)-config.Kiosk.MaxHistory-1:]
+	}
+	out := []Message{}
+	if config.Kiosk.System != "" {
+		out = append(out, Message{Role: "system", Content: config.Kiosk.System})
+	}
+	for _, m := range messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			return nil, fmt.Errorf("invalid role %q", m.Role)
+		}
+		if m.Role == "user" && utf8.RuneCountInString(m.Content) > config.Kiosk.MaxPromptChars {
+			return nil, fmt.Errorf("messages may be at most %d characters", config.Kiosk.MaxPromptChars)
+		}
+		out = append(out, Message{Role: m.Role, Content: m.Content})
+	}
+	return out, nil
+}
+
+// --- Conversation Quality ---
+
+const (
+	qualityFile = "quality.json"
+	// Sampled answers waiting to be judged; more are dropped until the next run
+	maxQualityPending = 200
+	// Longest question or answer shown to the judge
+	maxQualityJudgeChars = 4000
+)
+
+// QualitySample is a question and the answer a model gave, kept in memory until judged.
+type QualitySample struct {
+	Model    string
+	Question string
+	answer   strings.Builder
+	done     bool
+}
+
+// Add collects the answer from an NDJSON line of the response.
+func (qs *QualitySample) Add(line string) {
+	if qs == nil {
+		return
+	}
+	var chunk OllamaResponseChunk
+	if json.Unmarshal([]byte(line), &chunk) != nil {
+		return
+	}
+	qs.answer.WriteString(chunk.Response)
+	if chunk.Message != nil {
+		qs.answer.WriteString(chunk.Message.Content)
+	}
+	if chunk.Done {
+		qs.done = true
+		if chunk.Model != "" {
+			qs.Model = chunk.Model
+		}
+	}
+}
+
+// QualityScore is the judge's verdict on one answer, from 1 to 5.
+type QualityScore struct {
+	Helpfulness  int    `json:"helpfulness"`
+	Groundedness int    `json:"groundedness"`
+	Reason       string `json:"reason"`
+}
+
+// QualityRecord totals the scores of one model's answers on one (UTC) day.
+type QualityRecord struct {
+	Day          string `json:"day"`
+	Model        string `json:"model"`
+	Samples      int    `json:"samples"`
+	Helpfulness  int    `json:"helpfulness"` // Sums; divide by Samples
+	Groundedness int    `json:"groundedness"`
+}
+
+// QualityAverage is a model's average scores over a period.
+type QualityAverage struct {
+	Samples      int     `json:"samples"`
+	Helpfulness  float64 `json:"helpfulness"`
+	Groundedness float64 `json:"groundedness"`
+}
+
+// ModelQuality is one row of GET /api/usage/quality: a model's averages and their daily trend.
+type ModelQuality struct {
+	Model string `json:"model"`
+	QualityAverage
+	Days []DayQuality `json:"days"`
+}
+
+type DayQuality struct {
+	Day string `json:"day"`
+	QualityAverage
+}
+
+func (rec QualityRecord) average() QualityAverage {
+	if rec.Samples == 0 {
+		return QualityAverage{}
+	}
+	return QualityAverage{
+		Samples:      rec.Samples,
+		Helpfulness:  math.Round(float64(rec.Helpfulness)/float64(rec.Samples)*100) / 100,
+		Groundedness: math.Round(float64(rec.Groundedness)/float64(rec.Samples)*100) / 100,
+	}
+}
+
+// QualityStore holds the sampled answers waiting to be judged and the daily scores, which are
+// persisted in the data directory. Only the scores are saved, not the conversations.
+type QualityStore struct {
+	mu      sync.Mutex
+	pending []*QualitySample
+	records map[string]*QualityRecord
+}
+
+var quality *QualityStore
+
+func NewQualityStore() *QualityStore {
+	qs := &QualityStore{records: make(map[string]*QualityRecord)}
+	var saved []*QualityRecord
+	if err := loadJSONFile(qualityFile, &saved); err != nil {
+		log.Printf("⚠️ WARNING: Could not load quality scores: %v", err)
+	}
+	for _, rec := range saved {
+		qs.records[rec.Day+"|"+rec.Model] = rec
+	}
+	return qs
+}
+
+// Sample starts collecting a generate or chat answer for judging, if quality scoring is on,
+// the request isn't private and the answer is picked. Otherwise it returns nil, which ignores Add.
+func (qs *QualityStore) Sample(ctx context.Context, payload interface{}) *QualitySample {
+	if !config.Quality.Enabled || isPrivate(ctx) || rand.Float64() >= config.Quality.SampleRate {
+		return nil
+	}
+	switch p := payload.(type) {
+	case OllamaGenerateRequestPayload:
+		return &QualitySample{Model: p.Model, Question: p.Prompt}
+	case OllamaChatRequestPayload:
+		return &QualitySample{Model: p.Model, Question: lastUserMessage(p.Messages)}
+	}
+	return nil
+}
+
+// Keep queues a complete sample for the next run of the judge.
+func (qs *QualityStore) Keep(sample *QualitySample) {
+	if sample == nil || !sample.done || strings.TrimSpace(sample.Question) == "" {
+		return
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if len(qs.pending) < maxQualityPending {
+		qs.pending = append(qs.pending, sample)
+	}
+}
+
+// take removes and returns the samples waiting to be judged.
+func (qs *QualityStore) take() []*QualitySample {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	pending := qs.pending
+	qs.pending = nil
+	return pending
+}
+
+func (qs *QualityStore) Record(model string, score QualityScore) {
+	day := time.Now().UTC().Format("2006-01-02")
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	rec, ok := qs.records[day+"|"+model]
+	if !ok {
+		rec = &QualityRecord{Day: day, Model: model}
+		qs.records[day+"|"+model] = rec
+	}
+	rec.Samples++
+	rec.Helpfulness += score.Helpfulness
+	rec.Groundedness += score.Groundedness
+
+	list := make([]*QualityRecord, 0, len(qs.records))
+	for _, r := range qs.records {
+		list = append(list, r)
+	}
+	if err := saveJSONFile(qualityFile, list); err != nil {
+		log.Printf("Could not save quality scores: %v", err)
+	}
+}
+
+// Trends returns each model's averages over the last `days` days, with one entry per day.
+func (qs *QualityStore) Trends(days int) []ModelQuality {
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format("2006-01-02")
+
+	qs.mu.Lock()
+	totals := make(map[string]*QualityRecord)
+	byModel := make(map[string][]DayQuality)
+	for _, rec := range qs.records {
+		if rec.Day < since {
+			continue
+		}
+		total, ok := totals[rec.Model]
+		if !ok {
+			total = &QualityRecord{Model: rec.Model}
+			totals[rec.Model] = total
+		}
+		total.Samples += rec.Samples
+		total.Helpfulness += rec.Helpfulness
+		total.Groundedness += rec.Groundedness
+		byModel[rec.Model] = append(byModel[rec.Model], DayQuality{Day: rec.Day, QualityAverage: rec.average()})
+	}
+	qs.mu.Unlock()
+
+	list := make([]ModelQuality, 0, len(totals))
+	for model, total := range totals {
+		trend := byModel[model]
+		sort.Slice(trend, func(i, j int) bool { return trend[i].Day < trend[j].Day })
+		list = append(list, ModelQuality{Model: model, QualityAverage: total.average(), Days: trend})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Model < list[j].Model })
+	return list
+}
+
+// runQualityJob judges the sampled answers every interval.
+func runQualityJob(interval time.Duration) {
+	for range time.Tick(interval) {
+		judgeQualitySamples(context.Background())
+	}
+}
+
+// judgeQualitySamples scores every waiting sample with the judge model. Samples the judge
+// fails on are dropped.
+func judgeQualitySamples(ctx context.Context) {
+	samples := quality.take()
+	if len(samples) == 0 {
+		return
+	}
+	client := newOllamaClient(300 * time.Second)
+	judged := 0
+	for _, sample := range samples {
+		score, err := judgeQuality(ctx, client, sample)
+		if err != nil {
+			log.Printf("Quality judge %s failed on an answer by %s: %v", config.Quality.JudgeModel, sample.Model, err)
+			continue
+		}
+		quality.Record(sample.Model, score)
+		judged++
+	}
+	log.Printf("Quality judge %s scored %d of %d sampled answers", config.Quality.JudgeModel, judged, len(samples))
+}
+
+// judgeQuality asks the judge model to rate an answer's helpfulness and groundedness.
+func judgeQuality(ctx context.Context, client *http.Client, sample *QualitySample) (QualityScore, error) {
+	prompt := fmt.Sprintf("Rate an AI assistant's answer to a user's request, each from 1 (poor) to 5 (excellent):\n"+
+		"- helpfulness: does it address what was asked, completely and clearly?\n"+
+		"- groundedness: does it stick to facts and to what the request provides, without made-up claims?\n\n"+
+		"Request:\n%s\n\nAnswer:\n%s\n\n"+
+		"Reply with only JSON: {\"helpfulness\": <1-5>, \"groundedness\": <1-5>, \"reason\": \"<one sentence>\"}",
+		truncateRunes(sample.Question, maxQualityJudgeChars), truncateRunes(sample.answer.String(), maxQualityJudgeChars))
+	chunk, err := ollamaGenerateOnce(ctx, client, routes.Resolve(config.Quality.JudgeModel), OllamaGenerateRequestPayload{
+		Model:   config.Quality.JudgeModel,
+		Prompt:  prompt,
+		Format:  json.RawMessage(`"json"`),
+		Options: map[string]interface{}{"temperature": 0},
+	})
+	if err != nil {
+		return QualityScore{}, err
+	}
+	var score QualityScore
+	if err := json.Unmarshal([]byte(chunk.Response), &score); err != nil {
+		return QualityScore{}, fmt.Errorf("unreadable verdict %q: %v", chunk.Response, err)
+	}
+	if score.Helpfulness < 1 || score.Helpfulness > 5 || score.Groundedness < 1 || score.Groundedness > 5 {
+		return QualityScore{}, fmt.Errorf("scores out of range in %q", chunk.Response)
+	}
+	return score, nil
+}
+
+// handleQuality reports per-model quality trends: GET /api/usage/quality?days=30
+func handleQuality(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days < 1 {
+		days = 30
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":     config.Quality.Enabled,
+		"judge_model": config.Quality.JudgeModel,
+		"days":        days,
+		"models":      quality.Trends(days),
+	})
+}
+
+// --- Image Downscaling ---
+
+// hasImages reports whether a request carries images, on the prompt or on any message.
+func hasImages(req ClientRequest) bool {
+	if len(req.Images) > 0 {
+		return true
+	}
+	for _, m := range req.Messages {
+		if len(m.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Images are decoded whole before they are scaled down, so their size is capped: a PNG that
+// compresses well fits far more pixels into a request than memory can hold once decoded.
+const maxImagePixels = 40 * 1000 * 1000
+
+// downscaleRequestImages scales down every image of a request, including those attached to
+// earlier messages of a chat, which clients send again with the history.
+func downscaleRequestImages(req *ClientRequest) error {
+	if config.MaxImageDimension == 0 || !hasImages(*req) {
+		return nil
+	}
+	var err error
+	for i, img := range req.Images {
+		if req.Images[i], err = downscaleImage(img, config.MaxImageDimension); err != nil {
+			return err
+		}
+	}
+	for _, m := range req.Messages {
+		for i, img := range m.Images {
+			if m.Images[i], err = downscaleImage(img, config.MaxImageDimension); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// downscaleImage shrinks a base64-encoded image so that neither side exceeds maxSide pixels.
+// JPEGs stay JPEGs and everything else becomes a PNG. Images that are small enough, or in a
+// format Go can't decode (e.g. WebP), are returned unchanged. Images with more than
+// maxImagePixels pixels are refused without being decoded.
+func downscaleImage(b64 string, maxSide int) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return b64, nil
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (cfg.Width <= maxSide && cfg.Height <= maxSide) {
+		return b64, nil
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return "", fmt.Errorf("image of %dx%d pixels is too large; at most %d megapixels are accepted", cfg.Width, cfg.Height, maxImagePixels/1000000)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return b64, nil
+	}
+
+	longest := cfg.Width
+	if cfg.Height > longest {
+		longest = cfg.Height
+	}
+	scale := float64(maxSide) / float64(longest)
+	width := int(math.Max(1, math.Round(float64(cfg.Width)*scale)))
+	height := int(math.Max(1, math.Round(float64(cfg.Height)*scale)))
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, resizeImage(src, width, height), &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, resizeImage(src, width, height))
+	}
+	if err != nil {
+		return b64, nil
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// resizeImage scales src down to width x height, averaging the source pixels that fall on
+// each target pixel (a box filter), which keeps text in screenshots readable.
+func resizeImage(src image.Image, width, height int) *image.RGBA64 {
+	bounds := src.Bounds()
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// --- Context Files ---
+
+const (
+	maxContextFiles      = 20        // Files per chat request
+	maxArchiveEntries    = 2000      // Entries an archive may have, including folders
+	maxContextFileBytes  = 256 << 10 // Larger files are left out
+	maxContextFilesBytes = 1 << 20   // All files of a request together
+	maxArchiveReadBytes  = 16 << 20  // Bytes read from an archive, which keeps zip bombs small
+)
+
+// ContextFile is a file sent with a chat for the model to read. A text file goes in Content.
+// An archive (.zip, .tar, .tar.gz) goes base64-encoded in Data, and Include picks the entries
+// or folders to read from it (all of them when empty); an entry can be narrowed to some of its
+// lines as "path:10-40". Like images, files aren't stored: a client sends them with every
+// request of the chat.
+type ContextFile struct {
+	Name        string   `json:"name"`
+	Content     string   `json:"content,omitempty"`
+	Data        string   `json:"data,omitempty"`
+	Include     []string `json:"include,omitempty"`
+	Lines       string   `json:"lines,omitempty"`        // For text files: "10-40", "10-" or "10"
+	LineNumbers bool     `json:"line_numbers,omitempty"` // Number the lines of code files
+	Filter      string   `json:"filter,omitempty"`       // For CSV and Excel files: also send the rows where "column=value"
+}
+
+// contextEntry is a text file put into a chat's context.
+type contextEntry struct {
+	Path        string
+	Archive     string // The archive it came from, if any
+	Content     string
+	FirstLine   int // Line number of the first line of Content
+	LastLine    int // Set when only some lines were included
+	LineNumbers bool
+	Summary     bool // Content is a profile of a table, not the file itself
+}
+
+// codeLanguages maps the extensions (and names) of source files to the language tag of their
+// fenced code block.
+var codeLanguages = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".mjs": "javascript", ".jsx": "jsx",
+	".ts": "typescript", ".tsx": "tsx", ".rs": "rust", ".java": "java", ".kt": "kotlin",
+	".scala": "scala", ".c": "c", ".h": "c", ".cc": "cpp", ".cpp": "cpp", ".hpp": "cpp",
+	".cs": "csharp", ".rb": "ruby", ".php": "php", ".swift": "swift", ".lua": "lua",
+	".sh": "bash", ".bash": "bash", ".zsh": "bash", ".ps1": "powershell", ".sql": "sql",
+	".html": "html", ".css": "css", ".scss": "scss", ".vue": "vue", ".json": "json",
+	".yaml": "yaml", ".yml": "yaml", ".toml": "toml", ".xml": "xml", ".proto": "protobuf",
+	".tf": "hcl", ".dart": "dart", ".ex": "elixir", ".exs": "elixir", ".hs": "haskell",
+	"dockerfile": "dockerfile", "makefile": "makefile",
+}
+
+// codeLanguage returns the fence language of a source file, or "" for other files.
+func codeLanguage(name string) string {
+	base := strings.ToLower(path.Base(name))
+	if lang, ok := codeLanguages[base]; ok {
+		return lang
+	}
+	return codeLanguages[path.Ext(base)]
+}
+
+// parseLineRange reads "10-40", "10-" (to the end) or "10"; last is 0 for the end of the file.
+func parseLineRange(s string) (first, last int, err error) {
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	if first, err = strconv.Atoi(from); err != nil || first < 1 {
+		return 0, 0, fmt.Errorf("lines must look like 10-40, 10- or 10, got %q", s)
+	}
+	if to == "" {
+		return first, 0, nil
+	}
+	if last, err = strconv.Atoi(to); err != nil || last < first {
+		return 0, 0, fmt.Errorf("lines must look like 10-40, 10- or 10, got %q", s)
+	}
+	return first, last, nil
+}
+
+// withLineRange narrows an entry to a range of its lines.
+func withLineRange(e contextEntry, lines string) (contextEntry, error) {
+	first, last, err := parseLineRange(lines)
+	if err != nil {
+		return e, err
+	}
+	all := strings.Split(strings.TrimRight(e.Content, "\n"), "\n")
+	if first > len(all) {
+		return e, fmt.Errorf("%s has only %d lines", e.Path, len(all))
+	}
+	if last == 0 || last > len(all) {
+		last = len(all)
+	}
+	e.Content = strings.Join(all[first-1:last], "\n")
+	e.FirstLine, e.LastLine = first, last
+	return e, nil
+}
+
+// formatContextEntry writes a file for the model: source code as a fenced block tagged with
+// its language under a path header, other text between START/END FILE markers.
+func formatContextEntry(sb *strings.Builder, e contextEntry) {
+	name := e.Path
+	if e.Archive != "" {
+		name += " (from " + e.Archive + ")"
+	}
+	content := strings.TrimRight(e.Content, "\n")
+	lang := codeLanguage(e.Path)
+	if e.Summary {
+		name += " (summary of the table)"
+		lang = ""
+	}
+	if lang == "" {
+		if e.LastLine > 0 {
+			name += fmt.Sprintf(", lines %d-%d", e.FirstLine, e.LastLine)
+		}
+		fmt.Fprintf(sb, "\n--- START FILE: %s ---\n%s\n--- END FILE: %s ---\n", name, content, name)
+		return
+	}
+
+	if e.LastLine > 0 {
+		name += fmt.Sprintf(", lines %d-%d", e.FirstLine, e.LastLine)
+	}
+	if e.LineNumbers {
+		lines := strings.Split(content, "\n")
+		width := len(strconv.Itoa(e.FirstLine + len(lines) - 1))
+		for i, line := range lines {
+			lines[i] = fmt.Sprintf("%*d | %s", width, e.FirstLine+i, line)
+		}
+		content = strings.Join(lines, "\n")
+	}
+	// The fence must be longer than any run of backticks in the file
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(sb, "\nFile: %s\n%s%s\n%s\n%s\n", name, fence, lang, content, fence)
+}
+
+func validateContextFiles(files []ContextFile) error {
+	if len(files) > maxContextFiles {
+		return fmt.Errorf("at most %d files are allowed", maxContextFiles)
+	}
+	for i, f := range files {
+		switch {
+		case strings.TrimSpace(f.Name) == "":
+			return fmt.Errorf("file %d: name is required", i)
+		case f.Data != "" && f.Content != "":
+			return fmt.Errorf("file %d: send either content or data, not both", i)
+		case isAudioFile(f.Name) && config.Whisper.URL == "":
+			return fmt.Errorf("file %d: audio files need a Whisper server, which isn't configured", i)
+		case isAudioFile(f.Name) && f.Data == "":
+			return fmt.Errorf("file %d: send audio files base64-encoded in data", i)
+		case isAudioFile(f.Name) && base64.StdEncoding.DecodedLen(len(f.Data)) > maxAudioBytes:
+			return fmt.Errorf("file %d exceeds %d MB", i, maxAudioBytes>>20)
+		case f.Data != "" && archiveKind(f.Name) == "" && tabularKind(f.Name) != "xlsx" && !isAudioFile(f.Name):
+			return fmt.Errorf("file %d: data is only accepted for .zip, .tar, .tar.gz, .xlsx and audio files", i)
+		case len(f.Include) > 0 && (f.Data == "" || archiveKind(f.Name) == ""):
+			return fmt.Errorf("file %d: include is only for archives", i)
+		case tabularKind(f.Name) == "xlsx" && f.Data == "":
+			return fmt.Errorf("file %d: send .xlsx files base64-encoded in data", i)
+		case f.Filter != "" && tabularKind(f.Name) == "":
+			return fmt.Errorf("file %d: filter is only for CSV, TSV and Excel files", i)
+		case len(f.Content) > contextFileLimit(f.Name, f.Lines):
+			return fmt.Errorf("file %d exceeds %d KB", i, contextFileLimit(f.Name, f.Lines)>>10)
+		case f.Data != "" && f.Lines != "":
+			return fmt.Errorf(`file %d: for archive entries, give the lines in include, like "src/main.go:10-40"`, i)
+		}
+		if f.Lines != "" {
+			if _, _, err := parseLineRange(f.Lines); err != nil {
+				return fmt.Errorf("file %d: %v", i, err)
+			}
+		}
+		if f.Filter != "" {
+			if _, _, err := parseRowFilter(f.Filter); err != nil {
+				return fmt.Errorf("file %d: %v", i, err)
+			}
+		}
+		if f.Data != "" {
+			if _, err := base64.StdEncoding.DecodeString(f.Data); err != nil {
+				return fmt.Errorf("file %d: data is not valid base64", i)
+			}
+		}
+	}
+	return nil
+}
+
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// addContextFiles puts the request's files in a system message ahead of the latest user
+// message, the way web search results are added, and returns a "files" event listing what
+// the model got and what was left out.
+func addContextFiles(req *OllamaChatRequestPayload, files []ContextFile) (streamEvent, error) {
+	last := len(req.Messages) - 1
+	if last < 0 || req.Messages[last].Role != "user" {
+		return streamEvent{}, errors.New("files need a user message to go with")
+	}
+	entries, skipped, err := contextEntries(files)
+	if err != nil {
+		return streamEvent{}, err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("The user attached these files. Use them to answer the next message.\n")
+	included := make([]string, 0, len(entries))
+	for _, e := range entries {
+		formatContextEntry(&sb, e)
+		name := e.Path
+		if e.Archive != "" {
+			name += " (from " + e.Archive + ")"
+		}
+		included = append(included, name)
+	}
+
+	messages := make([]Message, 0, len(req.Messages)+1)
+	messages = append(messages, req.Messages[:last]...)
+	messages = append(messages, Message{Role: "system", Content: sb.String()}, req.Messages[last])
+	req.Messages = messages
+
+	return streamEvent{"files", map[string]interface{}{"included": included, "skipped": skipped}}, nil
+}
+
+// contextEntries reads the text files of a request, extracting archives. Archive entries that
+// are binary or too large are skipped rather than failing the request.
+func contextEntries(files []ContextFile) (entries []contextEntry, skipped []string, err error) {
+	total := 0
+	for _, f := range files {
+		data, _ := base64.StdEncoding.DecodeString(f.Data)
+		if archiveKind(f.Name) == "" {
+			e := contextEntry{Path: f.Name, Content: f.Content, FirstLine: 1, LineNumbers: f.LineNumbers}
+			switch {
+			case f.Lines != "":
+				e, err = withLineRange(e, f.Lines)
+			case tabularKind(f.Name) == "xlsx":
+				var rows [][]string
+				if rows, err = readXLSX(data); err == nil {
+					err = summarizeTableEntry(&e, rows, f.Filter)
+				}
+			case tabularKind(f.Name) != "":
+				var rows [][]string
+				if rows, err = readDelimited(f.Content, tabularKind(f.Name)); err == nil {
+					err = summarizeTableEntry(&e, rows, f.Filter)
+				}
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", f.Name, err)
+			}
+			entries = append(entries, e)
+			total += len(e.Content)
+			continue
+		}
+		extracted, tooBig, err := extractArchive(f.Name, data, f.Include)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		for _, p := range tooBig {
+			skipped = append(skipped, p+" (from "+f.Name+")")
+		}
+		for _, e := range extracted {
+			e.Archive = f.Name
+			e.LineNumbers = f.LineNumbers
+			if kind := tabularKind(e.Path); (kind == "csv" || kind == "tsv") && e.LastLine == 0 {
+				rows, err := readDelimited(e.Content, kind)
+				if err == nil {
+					err = summarizeTableEntry(&e, rows, "")
+				}
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: %s: %v", f.Name, e.Path, err)
+				}
+			}
+			entries = append(entries, e)
+			total += len(e.Content)
+		}
+	}
+	if total > maxContextFilesBytes {
+		return nil, nil, fmt.Errorf("files exceed %d KB in total; include fewer of them", maxContextFilesBytes>>10)
+	}
+	return entries, skipped, nil
+}
+
+// archiveFile is an entry of a zip or tar archive.
+type archiveFile struct {
+	Name string
+	Dir  bool
+	Open func() (io.Reader, error)
+}
+
+// extractArchive reads the text entries of an archive that include selects. Entry names that
+// point outside the archive (absolute, or with "..") fail the whole archive; links and other
+// special entries are ignored. Nothing is written to disk.
+func extractArchive(name string, data []byte, include []string) (entries []contextEntry, skipped []string, err error) {
+	var files []archiveFile
+	switch archiveKind(name) {
+	case "zip":
+		files, err = zipFiles(data)
+	default:
+		files, err = tarFiles(data, archiveKind(name) == "tar.gz")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	matched := make([]bool, len(include))
+	read := 0
+	for _, f := range files {
+		if f.Dir {
+			continue
+		}
+		entryPath, ok := safeArchivePath(f.Name)
+		if !ok {
+			return nil, nil, fmt.Errorf("entry %q points outside the archive", f.Name)
+		}
+		selected, lines := archiveIncludes(include, entryPath, matched)
+		if !selected {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", entryPath, err)
+		}
+		limit := contextFileLimit(entryPath, lines)
+		content, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", entryPath, err)
+		}
+		if read += len(content); read > maxArchiveReadBytes {
+			return nil, nil, fmt.Errorf("archive expands to more than %d MB", maxArchiveReadBytes>>20)
+		}
+		if len(content) > limit || !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+			skipped = append(skipped, entryPath)
+			continue
+		}
+		entry := contextEntry{Path: entryPath, Content: string(content), FirstLine: 1}
+		if lines != "" {
+			if entry, err = withLineRange(entry, lines); err != nil {
+				return nil, nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	for i, ok := range matched {
+		if !ok {
+			return nil, nil, fmt.Errorf("nothing in the archive matches %q", include[i])
+		}
+	}
+	return entries, skipped, nil
+}
+
+func zipFiles(data []byte) ([]archiveFile, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not a valid zip archive: %v", err)
+	}
+	if len(zr.File) > maxArchiveEntries {
+		return nil, fmt.Errorf("archive has more than %d entries", maxArchiveEntries)
+	}
+	files := make([]archiveFile, 0, len(zr.File))
+	for _, zf := range zr.File {
+		zf := zf
+		if !zf.Mode().IsRegular() && !zf.FileInfo().IsDir() {
+			continue
+		}
+		files = append(files, archiveFile{Name: zf.Name, Dir: zf.FileInfo().IsDir(), Open: func() (io.Reader, error) {
+			return zf.Open()
+		}})
+	}
+	return files, nil
+}
+
+// tarFiles lists a tar archive. A tar can only be read front to back, so each regular file's
+// content is kept (up to the per-file limit) while listing.
+func tarFiles(data []byte, gzipped bool) ([]archiveFile, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("not a valid gzip file: %v", err)
+		}
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	var files []archiveFile
+	read := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("not a valid tar archive: %v", err)
+		}
+		if len(files) == maxArchiveEntries {
+			return nil, fmt.Errorf("archive has more than %d entries", maxArchiveEntries)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			files = append(files, archiveFile{Name: hdr.Name, Dir: true})
+		case tar.TypeReg:
+			content, err := io.ReadAll(io.LimitReader(tr, int64(contextFileLimit(hdr.Name, ""))+1))
+			if err != nil {
+				return nil, fmt.Errorf("not a valid tar archive: %v", err)
+			}
+			if read += len(content); read > maxArchiveReadBytes {
+				return nil, fmt.Errorf("archive expands to more than %d MB", maxArchiveReadBytes>>20)
+			}
+			files = append(files, archiveFile{Name: hdr.Name, Open: func() (io.Reader, error) {
+				return bytes.NewReader(content), nil
+			}})
+		}
+	}
+}
+
+// safeArchivePath cleans an entry name and rejects names that escape the archive's root.
+func safeArchivePath(name string) (string, bool) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if clean == "." || clean == ".." || path.IsAbs(clean) || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return clean, true
+}
+
+// archiveIncludes reports whether an entry is one of include's files or inside one of its
+// folders, marking the include items that matched, and returns the line range ("10-40") an
+// item gave for the file. An empty include selects everything.
+func archiveIncludes(include []string, entryPath string, matched []bool) (selected bool, lines string) {
+	if len(include) == 0 {
+		return true, ""
+	}
+	for i, inc := range include {
+		inc, rng := splitIncludeLines(inc)
+		inc = strings.Trim(path.Clean("/"+inc), "/")
+		if entryPath == inc {
+			matched[i] = true
+			selected, lines = true, rng
+		} else if inc == "" || strings.HasPrefix(entryPath, inc+"/") {
+			matched[i] = true
+			selected = true
+		}
+	}
+	return selected, lines
+}
+
+// splitIncludeLines splits "src/main.go:10-40" into the path and the line range.
+func splitIncludeLines(inc string) (string, string) {
+	if i := strings.LastIndex(inc, ":"); i >= 0 {
+		if _, _, err := parseLineRange(inc[i+1:]); err == nil {
+			return inc[:i], inc[i+1:]
+		}
+	}
+	return inc, ""
+}
+
+// --- Tabular Files ---
+
+const (
+	maxTabularFileBytes = 20 << 20  // CSV and Excel files are summarized, so they may be larger than other files
+	maxXLSXPartBytes    = 100 << 20 // Uncompressed size of the parts of an Excel file that are read
+	maxXLSXColumns      = 16384     // Excel's own limit, column XFD
+	maxXLSXCells        = 2000000   // Cells of a worksheet, counting the empty ones between filled cells
+	tabularSampleRows   = 5
+	maxFilteredRows     = 100
+	maxDistinctValues   = 1000 // Distinct values counted per column
+)
+
+// tabularKind returns "csv", "tsv" or "xlsx" for files that are summarized, "" for others.
+func tabularKind(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".csv":
+		return "csv"
+	case ".tsv":
+		return "tsv"
+	case ".xlsx":
+		return "xlsx"
+	}
+	return ""
+}
+
+// contextFileLimit is the largest file of this name accepted as context. Tables are summarized
+// unless only some of their lines are asked for.
+func contextFileLimit(name, lines string) int {
+	if tabularKind(name) != "" && lines == "" {
+		return maxTabularFileBytes
+	}
+	return maxContextFileBytes
+}
+
+func readDelimited(content, kind string) ([][]string, error) {
+	r := csv.NewReader(strings.NewReader(content))
+	if kind == "tsv" {
+		r.Comma = '\t'
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("not a valid %s file: %v", strings.ToUpper(kind), err)
+	}
+	return rows, nil
+}
+
+// readXLSX reads the first worksheet of an Excel workbook. Formulas count with their cached
+// value, and dates stay the serial numbers Excel stores.
+func readXLSX(data []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not a valid .xlsx file: %v", err)
+	}
+	parts := make(map[string]*zip.File)
+	var sheets []string
+	for _, f := range zr.File {
+		parts[f.Name] = f
+		if strings.HasPrefix(f.Name, "xl/worksheets/sheet") && strings.HasSuffix(f.Name, ".xml") {
+			sheets = append(sheets, f.Name)
+		}
+	}
+	if len(sheets) == 0 {
+		return nil, errors.New("the workbook has no worksheets")
+	}
+	// sheet1.xml comes before sheet10.xml
+	sort.Slice(sheets, func(i, j int) bool {
+		if len(sheets[i]) != len(sheets[j]) {
+			return len(sheets[i]) < len(sheets[j])
+		}
+		return sheets[i] < sheets[j]
+	})
+
+	var shared struct {
+		Items []struct {
+			Text string `xml:"t"`
+			Runs []struct {
+				Text string `xml:"t"`
+			} `xml:"r"`
+		} `xml:"si"`
+	}
+	if f := parts["xl/sharedStrings.xml"]; f != nil {
+		if err := decodeXLSXPart(f, &shared); err != nil {
+			return nil, err
+		}
+	}
+	strs := make([]string, len(shared.Items))
+	for i, item := range shared.Items {
+		strs[i] = item.Text
+		for _, run := range item.Runs {
+			strs[i] += run.Text
+		}
+	}
+
+	// The worksheet is read cell by cell, so one that is too large is refused before it is all
+	// in memory
+	f := parts[sheets[0]]
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Name, err)
+	}
+	defer rc.Close()
+	decoder := xml.NewDecoder(io.LimitReader(rc, maxXLSXPartBytes))
+	var rows [][]string
+	var row []string
+	cells, index := 0, 0
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "row":
+				if len(rows) >= maxXLSXCells {
+					return nil, fmt.Errorf("the worksheet has more than %d cells", maxXLSXCells)
+				}
+				row, index = []string{}, 0
+			case "c":
+				var c struct {
+					Ref    string `xml:"r,attr"`
+					Type   string `xml:"t,attr"`
+					Value  string `xml:"v"`
+					Inline string `xml:"is>t"`
+				}
+				if err := decoder.DecodeElement(&c, &t); err != nil {
+					return nil, fmt.Errorf("%s: %v", f.Name, err)
+				}
+				if row == nil {
+					continue // Not in a row
+				}
+				col, err := xlsxColumn(c.Ref)
+				if err != nil {
+					return nil, err
+				}
+				if col < 0 {
+					col = index
+				}
+				index++
+				if len(row) <= col {
+					if cells += col + 1 - len(row); cells > maxXLSXCells {
+						return nil, fmt.Errorf("the worksheet has more than %d cells", maxXLSXCells)
+					}
+				}
+				for len(row) <= col {
+					row = append(row, "")
+				}
+				switch c.Type {
+				case "s":
+					if n, err := strconv.Atoi(c.Value); err == nil && n >= 0 && n < len(strs) {
+						row[col] = strs[n]
+					}
+				case "inlineStr":
+					row[col] = c.Inline
+				case "b":
+					row[col] = map[string]string{"0": "FALSE", "1": "TRUE"}[c.Value]
+				default:
+					row[col] = c.Value
+				}
+			}
+		case xml.EndElement:
+			if t.Name.Local == "row" && row != nil {
+				rows = append(rows, row)
+				row = nil
+			}
+		}
+	}
+	return rows, nil
+}
+
+func decodeXLSXPart(f *zip.File, v interface{}) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Name, err)
+	}
+	defer rc.Close()
+	if err := xml.NewDecoder(io.LimitReader(rc, maxXLSXPartBytes)).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", f.Name, err)
+	}
+	return nil
+}
+
+// xlsxColumn turns the letters of a cell reference ("AB12") into a column index (27), or -1
+// without letters. Columns past Excel's last one, XFD, are refused.
+func xlsxColumn(ref string) (int, error) {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		if col = col*26 + int(r-'A'+1); col > maxXLSXColumns {
+			return 0, fmt.Errorf("cell %.20s is past column XFD", ref)
+		}
+	}
+	return col - 1, nil
+}
+
+// parseRowFilter splits a "column=value" filter.
+func parseRowFilter(filter string) (column, value string, err error) {
+	i := strings.Index(filter, "=")
+	if i <= 0 {
+		return "", "", fmt.Errorf(`filter must look like "column=value", got %q`, filter)
+	}
+	return strings.TrimSpace(filter[:i]), strings.TrimSpace(filter[i+1:]), nil
+}
+
+// columnProfile collects what the summary says about a column.
+type columnProfile struct {
+	name     string
+	values   int
+	kinds    map[string]int // Values per detected type
+	min, max float64
+	sum      float64
+	numbers  int
+	distinct map[string]bool
+	examples []string
+}
+
+func (cp *columnProfile) add(v string) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return
+	}
+	cp.values++
+	kind := valueKind(v)
+	cp.kinds[kind]++
+	if kind == "integer" || kind == "number" {
+		f, _ := strconv.ParseFloat(v, 64)
+		if cp.numbers == 0 || f < cp.min {
+			cp.min = f
+		}
+		if cp.numbers == 0 || f > cp.max {
+			cp.max = f
+		}
+		cp.sum += f
+		cp.numbers++
+	}
+	if len(cp.distinct) < maxDistinctValues {
+		if !cp.distinct[v] && len(cp.examples) < 3 {
+			cp.examples = append(cp.examples, truncateRunes(v, 40))
+		}
+		cp.distinct[v] = true
+	}
+}
+
+// columnType is the type all of a column's values share: integer, number, boolean, date or text.
+func (cp *columnProfile) columnType() string {
+	switch {
+	case cp.values == 0:
+		return "empty"
+	case cp.kinds["integer"] == cp.values:
+		return "integer"
+	case cp.kinds["integer"]+cp.kinds["number"] == cp.values:
+		return "number"
+	case cp.kinds["boolean"] == cp.values:
+		return "boolean"
+	case cp.kinds["date"] == cp.values:
+		return "date"
+	}
+	return "text"
+}
+
+var tableDateLayouts = []string{"2006-01-02", "2006-01-02 15:04:05", time.RFC3339, "02.01.2006", "01/02/2006"}
+
+func valueKind(v string) string {
+	if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return "integer"
+	}
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return "number"
+	}
+	switch strings.ToLower(v) {
+	case "true", "false", "yes", "no":
+		return "boolean"
+	}
+	for _, layout := range tableDateLayouts {
+		if _, err := time.Parse(layout, v); err == nil {
+			return "date"
+		}
+	}
+	return "text"
+}
+
+// summarizeTableEntry replaces a table with a profile: its size, each column's type and
+// statistics, its first rows and, with a filter, the rows that match it. The first row is
+// taken as the header.
+func summarizeTableEntry(e *contextEntry, rows [][]string, filter string) error {
+	if len(rows) == 0 {
+		return errors.New("the table is empty")
+	}
+	header, body := rows[0], rows[1:]
+	profiles := make([]*columnProfile, len(header))
+	for i, name := range header {
+		if strings.TrimSpace(name) == "" {
+			name = fmt.Sprintf("column %d", i+1)
+		}
+		profiles[i] = &columnProfile{name: strings.TrimSpace(name), kinds: make(map[string]int), distinct: make(map[string]bool)}
+	}
+	for _, row := range body {
+		for i, v := range row {
+			if i < len(profiles) {
+				profiles[i].add(v)
+			}
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Table with %d rows (not counting the header) and %d columns.\n\nColumns:\n", len(body), len(header))
+	for _, cp := range profiles {
+		distinct := strconv.Itoa(len(cp.distinct))
+		if len(cp.distinct) >= maxDistinctValues {
+			distinct += "+"
+		}
+		fmt.Fprintf(&sb, "- %s (%s): %d values, %s distinct", cp.name, cp.columnType(), cp.values, distinct)
+		if t := cp.columnType(); (t == "integer" || t == "number") && cp.numbers > 0 {
+			fmt.Fprintf(&sb, ", min %s, max %s, mean %s", formatStat(cp.min), formatStat(cp.max), formatStat(cp.sum/float64(cp.numbers)))
+		} else if len(cp.examples) > 0 {
+			fmt.Fprintf(&sb, ", e.g. %s", strings.Join(cp.examples, "; "))
+		}
+		sb.WriteString("\n")
+	}
+
+	sample := body
+	if len(sample) > tabularSampleRows {
+		sample = sample[:tabularSampleRows]
+	}
+	fmt.Fprintf(&sb, "\nFirst %d rows:\n", len(sample))
+	writeTableRows(&sb, header, sample)
+
+	if filter != "" {
+		column, value, _ := parseRowFilter(filter)
+		col := -1
+		for i, cp := range profiles {
+			if strings.EqualFold(cp.name, column) {
+				col = i
+			}
+		}
+		if col < 0 {
+			return fmt.Errorf("filter: there is no column %q", column)
+		}
+		var matches [][]string
+		for _, row := range body {
+			if col < len(row) && strings.EqualFold(strings.TrimSpace(row[col]), value) {
+				matches = append(matches, row)
+			}
+		}
+		shown := matches
+		if len(shown) > maxFilteredRows {
+			shown = shown[:maxFilteredRows]
+		}
+		fmt.Fprintf(&sb, "\nRows where %s = %s (%d of %d shown):\n", profiles[col].name, value, len(shown), len(matches))
+		writeTableRows(&sb, header, shown)
+	}
+
+	e.Content = sb.String()
+	e.Summary = true
+	return nil
+}
+
+func formatStat(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
+
+func writeTableRows(sb *strings.Builder, header []string, rows [][]string) {
+	w := csv.NewWriter(sb)
+	w.Write(header)
+	w.WriteAll(rows)
+}
+
+// --- Audio Transcription ---
+
+const (
+	maxAudioBytes   = 20 << 20 // About 27 MB base64-encoded, which fits in maxRequestBytes
+	transcriptsFile = "transcripts.json"
+)
+
+var audioExtensions = map[string]bool{
+	".mp3": true, ".wav": true, ".m4a": true, ".aac": true, ".ogg": true, ".oga": true,
+	".opus": true, ".flac": true, ".webm": true,
+}
+
+func isAudioFile(name string) bool {
+	return audioExtensions[strings.ToLower(path.Ext(name))]
+}
+
+// Transcript is the text of an audio file, kept by the file's SHA-256 so a chat that sends a
+// recording with every message has it transcribed only once.
+type Transcript struct {
+	SHA256    string    `json:"sha256"`
+	Name      string    `json:"name"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TranscriptStore holds the transcripts made so far, saved to transcripts.json.
+type TranscriptStore struct {
+	mu          sync.Mutex
+	transcripts map[string]Transcript
+}
+
+var transcripts = NewTranscriptStore()
+
+func NewTranscriptStore() *TranscriptStore {
+	ts := &TranscriptStore{transcripts: make(map[string]Transcript)}
+	var saved []Transcript
+	if err := loadJSONFile(transcriptsFile, &saved); err != nil {
+		log.Printf("⚠️ WARNING: Could not load transcripts: %v", err)
+	}
+	for _, t := range saved {
+		ts.transcripts[t.SHA256] = t
+	}
+	return ts
+}
+
+func (ts *TranscriptStore) Get(sha string) (Transcript, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.transcripts[sha]
+	return t, ok
+}
+
+func (ts *TranscriptStore) Len() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.transcripts)
+}
+
+func (ts *TranscriptStore) Put(t Transcript) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.transcripts[t.SHA256] = t
+	list := make([]Transcript, 0, len(ts.transcripts))
+	for _, entry := range ts.transcripts {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	if err := saveJSONFile(transcriptsFile, list); err != nil {
+		log.Printf("Could not save transcripts: %v", err)
+	}
+}
+
+// transcribeAudioFiles replaces a request's audio files with their transcripts, which then go
+// into the chat like text files, and returns the transcripts by file name. Recordings not
+// transcribed before are sent to the Whisper server. Transcripts of private requests aren't kept.
+func transcribeAudioFiles(ctx context.Context, files []ContextFile) ([]ContextFile, map[string]string, error) {
+	out := make([]ContextFile, 0, len(files))
+	texts := make(map[string]string)
+	for _, f := range files {
+		if !isAudioFile(f.Name) {
+			out = append(out, f)
+			continue
+		}
+		data, _ := base64.StdEncoding.DecodeString(f.Data)
+		sum := sha256.Sum256(data)
+		t, ok := transcripts.Get(hex.EncodeToString(sum[:]))
+		if !ok {
+			text, err := transcribeAudio(ctx, f.Name, data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: transcription failed: %v", f.Name, err)
+			}
+			t = Transcript{SHA256: hex.EncodeToString(sum[:]), Name: f.Name, Text: text, CreatedAt: time.Now().UTC()}
+			if !isPrivate(ctx) {
+				transcripts.Put(t)
+			}
+			log.Printf("Transcribed %s: %d characters (request %s)", f.Name, len(text), requestIDFrom(ctx))
+		}
+		texts[f.Name] = t.Text
+		out = append(out, ContextFile{Name: f.Name + " (transcript)", Content: t.Text})
+	}
+	return out, texts, nil
+}
+
+// transcribeAudio sends a recording to the Whisper server. whisper.cpp and OpenAI-compatible
+// servers both take it as the multipart field "file" and answer {"text": ...}.
+func transcribeAudio(ctx context.Context, name string, data []byte) (string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", path.Base(name))
+	if err != nil {
+		return "", err
+	}
+	part.Write(data)
+	mw.WriteField("response_format", "json")
+	if config.Whisper.Model != "" {
+		mw.WriteField("model", config.Whisper.Model)
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.Whisper.URL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	client := &http.Client{Timeout: time.Duration(config.Whisper.TimeoutSeconds) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("whisper server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("unreadable whisper response: %v", err)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// --- Admin Access ---
+
+// isAdmin reports whether a request carries the admin token. Without a configured token, only
+// requests from this machine (loopback or a Unix socket) are admin, and over loopback only if
+// addressed to a loopback name. A request relayed by a proxy that isn't trusted is not, since
+// the proxy may be forwarding it from anywhere.
+func isAdmin(r *http.Request) bool {
+	if config.AdminToken == "" {
+		host := clientIP(r)
+		if host == remoteHost(r) && r.Header.Get("X-Forwarded-For") != "" {
+			return false
+		}
+		if host == "local" {
+			return true
+		}
+		// A page in a browser on this machine may reach LAIM under a rebound DNS name
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback() && isLoopbackHost(r.Host)
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// isLoopbackHost reports whether a Host header names this machine: localhost, a name under
+// .localhost or a loopback address. Browsers don't look these up in DNS, so they can't be rebound.
+func isLoopbackHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireAdmin refuses requests without the admin token.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="laim admin"`)
+			http.Error(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// DataFile is one file in the data directory.
+type DataFile struct {
+	Name     string    `json:"name"`
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified"`
+}
+
+// AdminStats is an overview of the instance for its admin.
+type AdminStats struct {
+	DataDir          string             `json:"data_dir"`
+	DataFiles        []DataFile         `json:"data_files"`
+	DataBytes        int64              `json:"data_bytes"`
+	TokensToday      map[string]int     `json:"tokens_today"` // By client
+	TokenQuotas      []TokenQuotaStatus `json:"token_quotas,omitempty"`
+	PendingDeletions int                `json:"pending_deletions"`
+	Prompts          int                `json:"prompts"`
+	Transcripts      int                `json:"transcripts"`
+}
+
+// handleAdminStats shows what LAIM stores and today's usage: GET /api/admin/stats
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := AdminStats{
+		DataDir:          config.DataDir,
+		DataFiles:        []DataFile{},
+		TokensToday:      usage.TokensToday(),
+		TokenQuotas:      tokenQuotaReport(),
+		PendingDeletions: len(pendingDeletions.List()),
+		Prompts:          len(prompts.List()),
+		Transcripts:      transcripts.Len(),
+	}
+	if config.DataDir != "" {
+		entries, err := os.ReadDir(config.DataDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "Could not read the data directory: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			stats.DataFiles = append(stats.DataFiles, DataFile{Name: entry.Name(), Bytes: info.Size(), Modified: info.ModTime().UTC()})
+			stats.DataBytes += info.Size()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// --- Upstream Errors ---
+
+// Codes for the Ollama failures LAIM recognises; anything else is upstream_error.
+const (
+	codeModelNotFound     = "model_not_found"
+	codeOutOfMemory       = "out_of_memory"
+	codeContextExceeded   = "context_exceeded"
+	codeOllamaUnreachable = "ollama_unreachable"
+	codeUpstreamError     = "upstream_error"
+	codeQuotaExceeded     = "quota_exceeded" // Not from Ollama: the client's daily token budget is used up
+)
+
+// UpstreamError is an Ollama failure translated into a stable code and a hint on how to recover.
+// It's sent as {"error", "code", "hint"}, both as a response body and as a stream error event.
+type UpstreamError struct {
+	Message string `json:"error"`
+	Code    string `json:"code"`
+	Hint    string `json:"hint,omitempty"`
+	Status  int    `json:"-"`
+}
+
+func (e *UpstreamError) Error() string { return e.Message }
+
+// classifyUpstream maps a connection error, or an Ollama status and error message, to an UpstreamError.
+// model is the model the request was for and only used to word the hint.
+func classifyUpstream(model string, status int, message string, connErr error) *UpstreamError {
+	if connErr != nil {
+		return &UpstreamError{
+			Message: "Ollama is not reachable: " + connErr.Error(),
+			Code:    codeOllamaUnreachable,
+			Hint:    "Start Ollama with `ollama serve`, or point ollama_url (or OLLAMA_URL) at the running server.",
+			Status:  http.StatusBadGateway,
+		}
+	}
+
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "out of memory") || strings.Contains(lower, "more system memory") ||
+		strings.Contains(lower, "insufficient memory") || strings.Contains(lower, "cudamalloc failed"):
+		return &UpstreamError{
+			Message: message,
+			Code:    codeOutOfMemory,
+			Hint:    "Unload other models, pick a smaller model or quantization, or lower num_ctx.",
+			Status:  http.StatusServiceUnavailable,
+		}
+	case strings.Contains(lower, "context") && (strings.Contains(lower, "exceed") || strings.Contains(lower, "too long")):
+		return &UpstreamError{
+			Message: message,
+			Code:    codeContextExceeded,
+			Hint:    "Shorten the conversation or the attached files, or raise num_ctx if the model supports a longer context.",
+			Status:  http.StatusRequestEntityTooLarge,
+		}
+	case status == http.StatusNotFound || strings.Contains(lower, "not found") || strings.Contains(lower, "file does not exist"):
+		return &UpstreamError{Message: message, Code: codeModelNotFound, Hint: modelNotFoundHint(model), Status: http.StatusNotFound}
+	}
+
+	if status < http.StatusBadRequest {
+		status = http.StatusBadGateway
+	}
+	return &UpstreamError{Message: "Ollama API Error: " + message, Code: codeUpstreamError, Status: status}
+}
+
+// upstreamMessage extracts the message from an Ollama error body ({"error": "..."}), or returns the body as is.
+func upstreamMessage(body []byte) string {
+	var parsed struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) == nil && parsed.Error != "" {
+		return parsed.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// upstreamFailure reads a non-200 Ollama response and classifies it.
+func upstreamFailure(model string, resp *http.Response) *UpstreamError {
+	body, _ := io.ReadAll(resp.Body)
+	return classifyUpstream(model, resp.StatusCode, upstreamMessage(body), nil)
+}
+
+func modelNotFoundHint(model string) string {
+	if model == "" {
+		return "Pull the model from the Models panel or with `ollama pull <model>`."
+	}
+	return fmt.Sprintf("Pull it from the Models panel or with `ollama pull %s`.", model)
+}
+
+// asUpstreamError returns err as an UpstreamError, classifying its message if it isn't one yet.
+// Errors classified without knowing the model get its name into their hint.
+func asUpstreamError(model string, err error) *UpstreamError {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		if upstream.Code == codeModelNotFound && model != "" {
+			named := *upstream
+			named.Hint = modelNotFoundHint(model)
+			return &named
+		}
+		return upstream
+	}
+	return classifyUpstream(model, 0, err.Error(), nil)
+}
+
+func writeUpstreamError(w http.ResponseWriter, e *UpstreamError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// --- CORS ---
+
+// CORSRule allows cross-origin requests from the origins it lists. An origin is matched
+// exactly ("https://app.example.com"), by subdomain wildcard ("https://*.home.lan", which
+// doesn't match home.lan itself), as "*" for any origin, or by a regular expression
+// prefixed with "~" ("~^https://[a-z]+\.home\.lan(:\d+)?$").
+type CORSRule struct {
+	Origins          []string `json:"origins"`
+	AllowCredentials bool     `json:"allow_credentials"` // Let the browser send cookies and HTTP auth
+	AllowHeaders     []string `json:"allow_headers"`     // Request headers allowed; default corsDefaultHeaders
+	ExposeHeaders    []string `json:"expose_headers"`    // Response headers scripts may read; default X-Request-ID
+	MaxAgeSeconds    int      `json:"max_age_seconds"`   // How long browsers may cache a preflight; default 600
+}
+
+var (
+	corsDefaultHeaders = []string{"Content-Type", "Authorization", "Last-Event-ID"}
+	corsDefaultExpose  = []string{"X-Request-ID"}
+)
+
+const corsMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// corsPolicy is a CORSRule with its origin patterns compiled.
+type corsPolicy struct {
+	rule      CORSRule
+	anyOrigin bool
+	exact     map[string]bool
+	suffixes  []string // "https://.home.lan" for "https://*.home.lan"
+	patterns  []*regexp.Regexp
+}
+
+func validateCORSRules(rules []CORSRule) error {
+	_, err := compileCORSRules(rules)
+	return err
+}
+
+func compileCORSRules(rules []CORSRule) ([]corsPolicy, error) {
+	policies := make([]corsPolicy, 0, len(rules))
+	for i, rule := range rules {
+		if len(rule.Origins) == 0 {
+			return nil, fmt.Errorf("rule %d: origins are required", i)
+		}
+		if rule.MaxAgeSeconds < 0 {
+			return nil, fmt.Errorf("rule %d: max_age_seconds must not be negative", i)
+		}
+		p := corsPolicy{rule: rule, exact: make(map[string]bool)}
+		for _, origin := range rule.Origins {
+			switch {
+			case origin == "*":
+				// Any site could then act with the visitor's credentials
+				if rule.AllowCredentials {
+					return nil, fmt.Errorf("rule %d: origin \"*\" can't allow credentials; list the origins instead", i)
+				}
+				p.anyOrigin = true
+			case strings.HasPrefix(origin, "~"):
+				re, err := regexp.Compile(origin[1:])
+				if err != nil {
+					return nil, fmt.Errorf("rule %d: bad origin pattern %q: %v", i, origin, err)
+				}
+				p.patterns = append(p.patterns, re)
+			case strings.Contains(origin, "*"):
+				scheme, host, ok := strings.Cut(origin, "://*.")
+				if !ok || strings.Contains(host, "*") || (scheme != "http" && scheme != "https") {
+					return nil, fmt.Errorf("rule %d: origin %q: a wildcard must be the first label, as in https://*.example.com", i, origin)
+				}
+				p.suffixes = append(p.suffixes, strings.ToLower(scheme+"://."+host))
+			default:
+				u, err := url.Parse(origin)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+					return nil, fmt.Errorf("rule %d: origin %q must be a scheme and host, as in https://app.example.com", i, origin)
+				}
+				p.exact[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+			}
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// Matches reports whether the rule allows origin, as sent by the browser ("https://host[:port]").
+func (p corsPolicy) Matches(origin string) bool {
+	lower := strings.ToLower(origin)
+	if p.anyOrigin || p.exact[lower] {
+		return true
+	}
+	for _, suffix := range p.suffixes {
+		// "https://.home.lan" matches "https://nas.home.lan" and "https://nas.home.lan:8443"
+		scheme, host, _ := strings.Cut(suffix, "://")
+		originScheme, originHost, ok := strings.Cut(lower, "://")
+		if !ok || originScheme != scheme {
+			continue
+		}
+		if h, _, err := net.SplitHostPort(originHost); err == nil {
+			originHost = h
+		}
+		if strings.HasSuffix(originHost, host) && len(originHost) > len(host) {
+			return true
+		}
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware answers preflight requests and adds CORS headers for origins a rule allows.
+// Other origins get no CORS headers, so browsers keep blocking them.
+func corsMiddleware(rules []CORSRule, next http.Handler) http.Handler {
+	policies, _ := compileCORSRules(rules) // Validated when the config was loaded
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		var policy *corsPolicy
+		for i := range policies {
+			if policies[i].Matches(origin) {
+				policy = &policies[i]
+				break
+			}
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if policy == nil {
+			if preflight {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rule := policy.rule
+		if policy.anyOrigin && !rule.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if rule.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		expose := rule.ExposeHeaders
+		if expose == nil {
+			expose = corsDefaultExpose
+		}
+		if len(expose) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+		}
+		if !preflight {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		headers := rule.AllowHeaders
+		if headers == nil {
+			headers = corsDefaultHeaders
+		}
+		maxAge := rule.MaxAgeSeconds
+		if maxAge == 0 {
+			maxAge = 600
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// crossSiteMiddleware refuses state-changing requests that a page on another site sent through
+// a visitor's browser, since they would act with the visitor's access: admin, for a browser on
+// the LAIM host itself. Such a request carries an Origin that is neither LAIM's own host nor
+// allowed by a CORS rule, or is marked cross-site by the browser. JSON APIs also need a JSON
+// Content-Type, which a page can't send to another site without a preflight.
+func crossSiteMiddleware(rules []CORSRule, next http.Handler) http.Handler {
+	policies, _ := compileCORSRules(rules) // Validated when the config was loaded
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !sameSiteRequest(r, policies) {
+			http.Error(w, "Cross-site request refused", http.StatusForbidden)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") && r.ContentLength != 0 && !jsonContent(r) {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// jsonContent reports whether a request body is JSON or JSON lines. Batch jobs may also be
+// uploaded as a file, which still needs a same-site origin.
+func jsonContent(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/jsonl":
+		return true
+	case "multipart/form-data":
+		return r.URL.Path == "/api/batch"
+	}
+	return false
+}
+
+// sameSiteRequest reports whether a request came from LAIM's own pages, from an origin a CORS
+// rule allows, or from outside a browser. Behind a trusted proxy, the host it forwards counts.
+func sameSiteRequest(r *http.Request, policies []corsPolicy) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return r.Header.Get("Sec-Fetch-Site") != "cross-site"
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host != "" {
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" && isTrustedProxy(remoteHost(r)) && strings.EqualFold(u.Host, forwarded) {
+			return true
+		}
+	}
+	for i := range policies {
+		if policies[i].Matches(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// --- Static Assets ---
+
+// Hashed assets never change under their name, so browsers may keep them for a year
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// AssetSet gives every embedded asset a name containing a hash of its content
+// ("/static/app.js" becomes "/static/app.3f2a9c1b7e04.js") and renders the pages with
+// those names. A new build changes the names of the assets that changed, so browsers
+// fetch them at once instead of using a stale copy.
+type AssetSet struct {
+	hashed   map[string]string // "/static/app.js" -> its hashed path
+	original map[string]string // hashed path -> "/static/app.js"
+	pages    map[string][]byte // HTML pages with the hashed paths filled in, by file name
+}
+
+var assets = NewAssetSet(staticFiles)
+
+func NewAssetSet(files embed.FS) *AssetSet {
+	a := &AssetSet{hashed: make(map[string]string), original: make(map[string]string), pages: make(map[string][]byte)}
+	entries, _ := files.ReadDir("static")
+	var htmlPages []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if path.Ext(name) == ".html" {
+			htmlPages = append(htmlPages, name)
+			continue
+		}
+		content, _ := files.ReadFile("static/" + name)
+		sum := sha256.Sum256(content)
+		ext := path.Ext(name)
+		hashed := "/static/" + strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:6]) + ext
+		a.hashed["/static/"+name] = hashed
+		a.original[hashed] = "/static/" + name
+	}
+
+	// Only quoted references are replaced, so "/static/app.js" doesn't also hit "/static/app.json"
+	var pairs []string
+	for name, hashed := range a.hashed {
+		pairs = append(pairs, `"`+name+`"`, `"`+hashed+`"`)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	for _, name := range htmlPages {
+		content, _ := files.ReadFile("static/" + name)
+		a.pages[name] = []byte(replacer.Replace(string(content)))
+	}
+	return a
+}
+
+// Hashed returns the hashed path of an asset, or the path itself if it isn't one.
+func (a *AssetSet) Hashed(p string) string {
+	if hashed, ok := a.hashed[p]; ok {
+		return hashed
+	}
+	return p
+}
+
+// Original returns the path an asset is embedded under, for hashed and plain paths alike.
+func (a *AssetSet) Original(p string) string {
+	if original, ok := a.original[p]; ok {
+		return original
+	}
+	return p
+}
+
+// servePage writes an HTML page. Pages are always revalidated, so a new build's asset
+// names reach the browser with the next load.
+func servePage(w http.ResponseWriter, name string) {
+	content, ok := assets.pages[name]
+	if config.UIDir != "" {
+		// Pages from the UI directory refer to the assets by their plain names, which are
+		// revalidated on every load
+		var err error
+		content, err = os.ReadFile(filepath.Join(config.UIDir, name))
+		ok = err == nil
+	}
+	if !ok {
+		http.Error(w, "Could not load UI", http.StatusInternalServerError)
+		log.Printf("Error reading %s: not found", name)
+		return
+	}
+	if config.BasePath != "" {
+		content = bytes.ReplaceAll(content, []byte(`"/static/`), []byte(`"`+config.BasePath+`/static/`))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(content)
+}
+
+var staticServer = http.FileServer(http.FS(staticFiles))
+
+// handleStatic serves embedded assets. Hashed names are cached for good; the plain names
+// still work, for bookmarks and scripts, but are revalidated every time.
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	if config.UIDir != "" {
+		w.Header().Set("Cache-Control", "no-cache")
+		http.StripPrefix("/static", http.FileServer(http.Dir(config.UIDir))).ServeHTTP(w, r)
+		return
+	}
+	if original, ok := assets.original[r.URL.Path]; ok {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+		r = r.Clone(r.Context())
+		r.URL.Path = original
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	staticServer.ServeHTTP(w, r)
+}
+
+// --- UI Preferences ---
+
+const preferencesFile = "preferences.json"
+
+var (
+	uiThemes = map[string]bool{"light": true, "dark": true, "system": true}
+	uiPanels = map[string]bool{"generate": true, "chat": true, "model-management": true}
+)
+
+// Preferences are a client's UI settings. They're kept per client (IP address, or "local"
+// over a Unix socket), so they follow a person to every browser on the same machine.
+type Preferences struct {
+	Theme        string `json:"theme"`         // light, dark or system
+	FontSize     int    `json:"font_size"`     // Base font size in pixels, 12 to 24
+	DefaultPanel string `json:"default_panel"` // generate, chat or model-management
+	SendOnEnter  bool   `json:"send_on_enter"` // Enter sends a chat message; Shift+Enter adds a line
+}
+
+var defaultPreferences = Preferences{Theme: "system", FontSize: 16, DefaultPanel: "generate"}
+
+func (p Preferences) Validate() error {
+	switch {
+	case !uiThemes[p.Theme]:
+		return errors.New("theme must be light, dark or system")
+	case p.FontSize < 12 || p.FontSize > 24:
+		return errors.New("font_size must be between 12 and 24")
+	case !uiPanels[p.DefaultPanel]:
+		return errors.New("default_panel must be generate, chat or model-management")
+	}
+	return nil
+}
+
+// PreferenceStore holds every client's preferences, saved to preferences.json.
+type PreferenceStore struct {
+	mu      sync.Mutex
+	clients map[string]Preferences
+}
+
+var preferences = NewPreferenceStore()
+
+func NewPreferenceStore() *PreferenceStore {
+	ps := &PreferenceStore{clients: make(map[string]Preferences)}
+	if err := loadJSONFile(preferencesFile, &ps.clients); err != nil {
+		log.Printf("⚠️ WARNING: Could not load UI preferences: %v", err)
+	}
+	return ps
+}
+
+// Get returns a client's preferences, or the defaults if it hasn't saved any.
+func (ps *PreferenceStore) Get(client string) Preferences {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if p, ok := ps.clients[client]; ok {
+		return p
+	}
+	return defaultPreferences
+}
+
+func (ps *PreferenceStore) Put(client string, p Preferences) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.clients[client] = p
+	if err := saveJSONFile(preferencesFile, ps.clients); err != nil {
+		log.Printf("Could not save UI preferences: %v", err)
+	}
+}
+
+// handlePreferences returns (GET) or replaces (PUT) the calling client's UI preferences.
+func handlePreferences(w http.ResponseWriter, r *http.Request) {
+	client := clientFrom(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		p := defaultPreferences
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&p); err != nil {
+			http.Error(w, "Invalid preferences: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.Validate(); err != nil {
+			http.Error(w, "Invalid preferences: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		preferences.Put(client, p)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences.Get(client))
+}
+
+// --- Reverse Proxies ---
+
+// trustedProxies are the parsed trusted_proxies; a nil IPNet stands for Unix socket connections.
+var trustedProxies []*net.IPNet
+
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		if entry == "unix" {
+			nets = append(nets, nil)
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address, a CIDR range or \"unix\"", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address, a CIDR range or \"unix\"", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy reports whether host (an IP address, or "local") is a trusted proxy.
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	for _, n := range trustedProxies {
+		if (n == nil && host == "local") || (n != nil && ip != nil && n.Contains(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedMiddleware takes the scheme from X-Forwarded-Proto for requests from trusted
+// proxies, so logs and reports show the URL the client used.
+func forwardedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTrustedProxy(remoteHost(r)) {
+			if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+				r.URL.Scheme, r.URL.Host = proto, r.Host
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// basePathMiddleware serves next under prefix ("/laim"): "/laim/api/models" reaches it as
+// "/api/models", "/laim" is redirected to "/laim/" and everything else is not found. The UI
+// uses relative URLs, so it works under any prefix.
+func basePathMiddleware(prefix string, next http.Handler) http.Handler {
+	stripped := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == prefix:
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, prefix+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// --- Basic HTML UI ---
+
+// The basic UI sends whole conversations back with every message; this keeps them bounded
+const (
+	basicMaxMessages    = 40
+	basicMaxPromptChars = 16000
+)
+
+var basicTemplate = htmltemplate.Must(htmltemplate.ParseFS(staticFiles, "static/basic.html"))
+
+// basicPageTemplate returns the page template, read again on every request when the UI is
+// served from a directory.
+func basicPageTemplate() (*htmltemplate.Template, error) {
+	if config.UIDir == "" {
+		return basicTemplate, nil
+	}
+	return htmltemplate.ParseFiles(filepath.Join(config.UIDir, "basic.html"))
+}
+
+// BasicPage is what static/basic.html renders.
+type BasicPage struct {
+	Models   []string
+	Model    string
+	Messages []Message
+	History  string // Messages as JSON, carried in a hidden form field
+	Error    string
+	Hint     string
+}
+
+// handleBasic serves a plain HTML chat at /basic for screen readers, text browsers and devices
+// without JavaScript. The conversation travels in the form, so the server keeps nothing, and
+// each answer is sent as a whole page once it's complete.
+func handleBasic(w http.ResponseWriter, r *http.Request) {
+	page := BasicPage{Models: basicModels(r.Context())}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+		page.Model = r.PostFormValue("model")
+		if err := basicChat(w, r, &page); err != nil {
+			page.Error = err.Error()
+			var upstream *UpstreamError
+			if errors.As(err, &upstream) {
+				page.Hint = upstream.Hint
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if page.Model == "" && len(page.Models) > 0 {
+		page.Model = page.Models[0]
+	}
+	if len(page.Messages) > 0 {
+		history, _ := json.Marshal(page.Messages)
+		page.History = string(history)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	tmpl, err := basicPageTemplate()
+	if err != nil {
+		http.Error(w, "Could not load UI", http.StatusInternalServerError)
+		log.Printf("Error reading basic.html: %v", err)
+		return
+	}
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Printf("Could not render the basic UI: %v", err)
+	}
+}
+
+// basicChat sends the form's conversation plus its new prompt to the model and adds the answer.
+// On an error, page keeps the conversation as it was, so the prompt can be sent again.
+func basicChat(w http.ResponseWriter, r *http.Request, page *BasicPage) error {
+	if history := r.PostFormValue("history"); history != "" {
+		if err := json.Unmarshal([]byte(history), &page.Messages); err != nil {
+			return errors.New("The conversation sent with the form is damaged; please start a new one")
+		}
+	}
+	for _, m := range page.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			return errors.New("The conversation sent with the form is damaged; please start a new one")
+		}
+	}
+	prompt := strings.TrimSpace(r.PostFormValue("prompt"))
+	switch {
+	case !modelNamePattern.MatchString(page.Model):
+		return errors.New("Choose a model")
+	case prompt == "":
+		return errors.New("Enter a prompt")
+	case utf8.RuneCountInString(prompt) > basicMaxPromptChars:
+		return fmt.Errorf("The prompt is longer than %d characters", basicMaxPromptChars)
+	case len(page.Messages) >= basicMaxMessages:
+		return errors.New("This conversation is as long as the basic UI allows; please start a new one")
+	}
+
+	if status, usedUp := tokenQuotaUsedUp(clientFrom(r.Context())); usedUp {
+		return fmt.Errorf("Daily token quota of %d tokens used up; it resets at %s", status.Limit, status.ResetsAt.Format(time.RFC3339))
+	}
+
+	messages := append(append([]Message{}, page.Messages...), Message{Role: "user", Content: prompt})
+	clientReq := ClientRequest{ActionType: "chat", Model: page.Model, Messages: messages}
+	r = withGuardrail(w, r, clientReq)
+	backend := routes.Resolve(page.Model)
+	release, err := generationQueue.Acquire(r.Context(), backend, func(int) {})
+	if err != nil {
+		return fmt.Errorf("Server busy: %v", err)
+	}
+	defer release()
+
+	payload := OllamaChatRequestPayload{
+		Model:     page.Model,
+		Messages:  guardrailMessages(r.Context(), messages),
+		Options:   map[string]interface{}{"num_ctx": config.DefaultNumCtx},
+		KeepAlive: keepAliveFor(clientReq),
+	}
+	var answer Message
+	err = ollamaStream(r.Context(), newOllamaClient(300*time.Second), backend+ollamaChatAPI, payload, func(chunk OllamaResponseChunk) {
+		if chunk.Message != nil {
+			answer.Content += chunk.Message.Content
+		}
+	})
+	if err != nil {
+		return asUpstreamError(page.Model, err)
+	}
+	page.Messages = append(messages, Message{Role: "assistant", Content: answer.Content})
+	return nil
+}
+
+// basicModels lists the installed models on every backend, by name.
+func basicModels(ctx context.Context) []string {
+	client := newOllamaClient(10 * time.Second)
+	seen := make(map[string]bool)
+	var names []string
+	for _, backend := range routes.Backends() {
+		models, err := fetchInstalledModels(ctx, client, backend)
+		if err != nil {
+			continue
+		}
+		for _, m := range models {
+			if !seen[m.Name] {
+				seen[m.Name] = true
+				names = append(names, m.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// --- Subcommands ---
+
+// subcommands are what the binary can do besides serving, e.g. "laim recommend -task coding".
+var subcommands = map[string]struct {
+	summary string
+	run     func(args []string) int // Returns the exit code
+}{
+	"serve":     {"Run the web UI and API server (the default)", runServe},
+	"recommend": {"Print the models that suit this machine", runRecommend},
+	"chat":      {"Chat with a model in the terminal", runChat},
+}
+
+func main() {
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command == "help" {
+		printUsage(os.Stdout)
+		return
+	}
+	sub, ok := subcommands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "laim: unknown command %q\n\n", command)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	os.Exit(sub.run(args))
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Usage: laim [command] [flags]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, subcommands[name].summary)
+	}
+	fmt.Fprintln(w, "\nRun \"laim <command> -h\" for a command's flags. Settings come from CONFIG_FILE and the environment.")
+}
+
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("laim serve", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "laim serve: unexpected argument %q\n", fs.Arg(0))
+		return 2
+	}
+	serve()
+	return 0
+}
+
+// recommendFlags are the recommend flags; each sets the /api/recommendations query parameter
+// of the same name, with "-" for "_".
+var recommendFlags = []struct{ name, usage string }{
+	{"task", "Only models for this task, e.g. coding or chat"},
+	{"vram", "VRAM in GB, instead of the detected amount"},
+	{"ram", "RAM in GB, instead of the detected amount"},
+	{"gpus", "Each GPU's VRAM in GB, e.g. 24,24"},
+	{"profile", "Hardware profile: gpu, unified or cpu"},
+	{"max_download_gb", "Largest download to suggest, in GB"},
+	{"quantization", "Quantization to size models at, e.g. Q4_K_M"},
+	{"license", "Only these licenses, comma separated"},
+	{"min_context", "Smallest context window, in tokens"},
+	{"required_context", "Context the models must fit in memory, in tokens"},
+	{"multilingual", "Only multilingual models (true or false)"},
+	{"sort", "fit, score, name, size, vram or updated"},
+	{"limit", "How many models to print"},
+}
+
+// runRecommend prints recommendations for this machine without starting the server.
+func runRecommend(args []string) int {
+	fs := flag.NewFlagSet("laim recommend", flag.ContinueOnError)
+	values := make(map[string]*string)
+	for _, f := range recommendFlags {
+		values[f.name] = fs.String(strings.ReplaceAll(f.name, "_", "-"), "", f.usage)
+	}
+	asJSON := fs.Bool("json", false, "Print the full response as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	query := url.Values{"limit": {"10"}}
+	for name, v := range values {
+		if *v != "" {
+			query.Set(name, *v)
+		}
+	}
+
+	config = loadConfig()
+	routes = NewRouteTable(config.DefaultBackend, config.Routes)
+	detectedHardware = detectHardware()
+	modelMetadata = NewMetadataCache()
+	loadBenchmarks()
+	fetchAndMergeModels()
+
+	response, _, err := recommendationResponse(context.Background(), query)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "laim recommend: %v\n", err)
+		return 2
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(response)
+		return 0
+	}
+	printRecommendations(os.Stdout, response)
+	return 0
+}
+
+func printRecommendations(w io.Writer, response map[string]interface{}) {
+	hw := response["current_hardware"].(map[string]interface{})
+	fmt.Fprintf(w, "Hardware: %s VRAM, %s RAM, %s profile\n\n", hw["vram"], hw["ram"], hw["profile"])
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tFIT\tVRAM\tRAM\tINSTALL")
+	for _, m := range response["recommendations"].([]RecommendedModel) {
+		install := "installed"
+		if !m.Installed {
+			install = m.PullCommand
+			if m.DownloadGB > 0 {
+				install = fmt.Sprintf("%s (%.1f GB)", m.PullCommand, m.DownloadGB)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d GB\t%d GB\t%s\n", m.Name, m.Fit, m.HardwareReq.MinVRAM_GB, m.HardwareReq.MinRAM_GB, install)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d of %d models shown.\n", len(response["recommendations"].([]RecommendedModel)), response["total"])
+}
+
+// --- Terminal Chat ---
+
+// cliChatsDir holds the chats of "laim chat" in the data directory, one <id>.json each.
+const cliChatsDir = "chats"
+
+// CLIChat is a conversation held in the terminal, saved after every turn so that
+// "laim chat -continue <id>" can pick it up again.
+type CLIChat struct {
+	ID        string        `json:"id"`
+	Model     string        `json:"model"`
+	Messages  []Message     `json:"messages"`
+	Files     []ContextFile `json:"files,omitempty"` // Attached with /file; sent with every turn, like the UI's files
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+var cliChatIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+func loadCLIChat(id string) (CLIChat, error) {
+	var chat CLIChat
+	if !cliChatIDPattern.MatchString(id) {
+		return chat, fmt.Errorf("invalid chat ID %q", id)
+	}
+	if err := loadJSONFile(filepath.Join(cliChatsDir, id+".json"), &chat); err != nil {
+		return chat, err
+	}
+	if chat.ID == "" {
+		return chat, fmt.Errorf("no chat %s in %s", id, filepath.Join(config.DataDir, cliChatsDir))
+	}
+	return chat, nil
+}
+
+func saveCLIChat(chat *CLIChat) error {
+	if config.DataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(config.DataDir, cliChatsDir), 0700); err != nil {
+		return err
+	}
+	chat.UpdatedAt = time.Now().UTC()
+	return saveJSONFile(filepath.Join(cliChatsDir, chat.ID+".json"), chat)
+}
+
+// Archives, Excel workbooks and recordings are sent base64-encoded, everything else as text,
+// as the UI does; images go with the next message instead.
+var (
+	cliBinaryFilePattern = regexp.MustCompile(`(?i)\.(zip|tar|tar\.gz|tgz|xlsx|mp3|wav|m4a|aac|ogg|oga|opus|flac|webm)$`)
+	cliImageFilePattern  = regexp.MustCompile(`(?i)\.(png|jpe?g|gif|webp)$`)
+)
+
+// chatSession sends the turns of a terminal chat to a LAIM server and prints the answers.
+type chatSession struct {
+	server string // e.g. "http://localhost:8080"
+	client *http.Client
+	chat   CLIChat
+	images []string // Attached with /file, sent with the next message
+	out    io.Writer
+	errOut io.Writer
+}
+
+// attach reads a file for /file.
+func (s *chatSession) attach(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(name)
+	switch {
+	case cliImageFilePattern.MatchString(base):
+		s.images = append(s.images, base64.StdEncoding.EncodeToString(data))
+		fmt.Fprintf(s.out, "Attached %s to your next message.\n", base)
+		return nil
+	case cliBinaryFilePattern.MatchString(base):
+		s.chat.Files = append(s.chat.Files, ContextFile{Name: base, Data: base64.StdEncoding.EncodeToString(data)})
+	case !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0:
+		return fmt.Errorf("%s is not a text file", base)
+	default:
+		s.chat.Files = append(s.chat.Files, ContextFile{Name: base, Content: string(data)})
+	}
+	fmt.Fprintf(s.out, "Attached %s; the model reads it with every message.\n", base)
+	return nil
+}
+
+// get fetches one of the server's JSON endpoints into v.
+func (s *chatSession) get(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.server+endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return chatResponseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// models lists the models the server has.
+func (s *chatSession) models(ctx context.Context) ([]string, error) {
+	var tags OllamaTagsResponse
+	if err := s.get(ctx, "/api/models", &tags); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(tags.Models))
+	for _, m := range tags.Models {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// chatResponseError turns a failed response into an error carrying LAIM's hint, if it gave one.
+func chatResponseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var e UpstreamError
+	if json.Unmarshal(body, &e) == nil && e.Message != "" {
+		if e.Hint != "" {
+			return fmt.Errorf("%s\n%s", e.Message, e.Hint)
+		}
+		return errors.New(e.Message)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// send sends one line to the model and streams the answer to out. Lines starting with "/" that
+// the terminal doesn't handle itself are slash commands; the server runs them.
+func (s *chatSession) send(ctx context.Context, text string) error {
+	userMessage := Message{Role: "user", Content: text, Images: s.images}
+	payload, err := json.Marshal(ClientRequest{
+		ActionType: "chat",
+		Model:      s.chat.Model,
+		Messages:   append(append([]Message{}, s.chat.Messages...), userMessage),
+		Files:      s.chat.Files,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.server+"/api/ollama-action", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return chatResponseError(resp)
+	}
+	s.images = nil
+
+	var answer strings.Builder
+	commandRan, failed := false, false
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line struct {
+			Event   string          `json:"event"`
+			Data    json.RawMessage `json:"data"`
+			Message *Message        `json:"message"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &line) != nil {
+			continue
+		}
+		switch line.Event {
+		case "":
+			if line.Message != nil && line.Message.Content != "" {
+				answer.WriteString(line.Message.Content)
+				fmt.Fprint(s.out, line.Message.Content)
+			}
+		case "command":
+			var result CommandResult
+			json.Unmarshal(line.Data, &result)
+			commandRan = true
+			if result.Model != "" {
+				s.chat.Model = result.Model
+			}
+			if result.ClearContext {
+				s.chat.Messages = nil
+			}
+			if result.Message != "" {
+				fmt.Fprintln(s.out, result.Message)
+			}
+		case "error":
+			var e UpstreamError
+			json.Unmarshal(line.Data, &e)
+			failed = true
+			fmt.Fprintf(s.errOut, "\nError: %s\n", e.Message)
+			if e.Hint != "" {
+				fmt.Fprintln(s.errOut, e.Hint)
+			}
+		case "queue":
+			var q struct {
+				Position int `json:"queue_position"`
+			}
+			if json.Unmarshal(line.Data, &q) == nil && q.Position > 0 {
+				fmt.Fprintf(s.errOut, "Waiting for a free slot (position %d)...\n", q.Position)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	if answer.Len() > 0 {
+		fmt.Fprintln(s.out)
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(s.errOut, "(stopped)")
+	}
+
+	// A command that didn't ask the model anything isn't part of the conversation
+	if failed || (commandRan && answer.Len() == 0) || (answer.Len() == 0 && ctx.Err() != nil) {
+		return nil
+	}
+	s.chat.Messages = append(s.chat.Messages, userMessage, Message{Role: "assistant", Content: answer.String()})
+	return saveCLIChat(&s.chat)
+}
+
+// cliChatCommands are the commands the terminal handles itself; the server runs the others.
+var cliChatCommands = []struct{ usage, description string }{
+	{"/file <path>", "Attach a file: text and archives are read with every message, images go with the next one"},
+	{"/models", "List the models"},
+	{"/new", "Start a new chat"},
+	{"/quit", "Leave (Ctrl-D works too); Ctrl-C stops an answer"},
+}
+
+// repl reads lines from in until it ends or /quit. Each line is a turn unless the terminal
+// handles it itself.
+func (s *chatSession) repl(ctx context.Context, in io.Reader, interrupted func(context.Context) (context.Context, context.CancelFunc)) {
+	fmt.Fprintf(s.out, "Chat %s with %s. Type /quit to leave, /file <path> to attach a file.\n", s.chat.ID, s.chat.Model)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		fmt.Fprint(s.out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		command, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			command, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch command {
+		case "":
+			continue
+		case "/quit", "/exit":
+			return
+		case "/file":
+			if arg == "" {
+				fmt.Fprintln(s.errOut, "Usage: /file <path>")
+			} else if err := s.attach(arg); err != nil {
+				fmt.Fprintf(s.errOut, "Error: %v\n", err)
+			}
+			continue
+		case "/models":
+			names, err := s.models(ctx)
+			if err != nil {
+				fmt.Fprintf(s.errOut, "Error: %v\n", err)
+			}
+			for _, name := range names {
+				fmt.Fprintln(s.out, name)
+			}
+			continue
+		case "/new":
+			s.chat = CLIChat{ID: newRequestID(), Model: s.chat.Model}
+			s.images = nil
+			fmt.Fprintf(s.out, "Chat %s with %s.\n", s.chat.ID, s.chat.Model)
+			continue
+		case "/help":
+			var commands []SlashCommand
+			if err := s.get(ctx, "/api/commands", &commands); err != nil {
+				fmt.Fprintf(s.errOut, "Error: %v\n", err)
+			}
+			tw := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+			for _, c := range cliChatCommands {
+				fmt.Fprintf(tw, "%s\t%s\n", c.usage, c.description)
+			}
+			for _, c := range commands {
+				fmt.Fprintf(tw, "%s\t%s\n", c.Usage, c.Description)
+			}
+			tw.Flush()
+			continue
+		}
+		turnCtx, stop := interrupted(ctx)
+		err := s.send(turnCtx, line)
+		stop()
+		if err != nil {
+			fmt.Fprintf(s.errOut, "Error: %v\n", err)
+		}
+	}
+}
+
+// pickModel asks which model to chat with.
+func (s *chatSession) pickModel(ctx context.Context, in *bufio.Reader) error {
+	names, err := s.models(ctx)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return errors.New("the server has no models; pull one first")
+	}
+	for i, name := range names {
+		fmt.Fprintf(s.out, "%3d  %s\n", i+1, name)
+	}
+	for {
+		fmt.Fprint(s.out, "Model: ")
+		line, err := in.ReadString('\n')
+		answer := strings.TrimSpace(line)
+		if n, convErr := strconv.Atoi(answer); convErr == nil && n >= 1 && n <= len(names) {
+			s.chat.Model = names[n-1]
+			return nil
+		}
+		for _, name := range names {
+			if answer == name || answer+":latest" == name {
+				s.chat.Model = name
+				return nil
+			}
+		}
+		if err != nil {
+			return errors.New("no model picked")
+		}
+		fmt.Fprintf(s.errOut, "Pick a number from 1 to %d or type a name.\n", len(names))
+	}
+}
+
+func runChat(args []string) int {
+	fs := flag.NewFlagSet("laim chat", flag.ContinueOnError)
+	defaultServer := os.Getenv("LAIM_URL")
+	if defaultServer == "" {
+		defaultServer = "http://localhost:8080"
+	}
+	server := fs.String("server", defaultServer, "The LAIM server to talk to (LAIM_URL)")
+	model := fs.String("model", "", "The model to chat with; without it, pick one from a list")
+	continueID := fs.String("continue", "", "Continue the chat with this ID")
+	list := fs.Bool("list", false, "List the saved chats and exit")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "laim chat: unexpected argument %q\n", fs.Arg(0))
+		return 2
+	}
+	config = loadConfig()
+
+	if *list {
+		if err := listCLIChats(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "laim chat: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	s := &chatSession{
+		server: strings.TrimRight(*server, "/"),
+		client: &http.Client{},
+		chat:   CLIChat{ID: newRequestID()},
+		out:    os.Stdout,
+		errOut: os.Stderr,
+	}
+	if *continueID != "" {
+		chat, err := loadCLIChat(*continueID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "laim chat: %v\n", err)
+			return 1
+		}
+		s.chat = chat
+		for _, m := range chat.Messages {
+			if m.Role == "user" {
+				fmt.Fprintf(s.out, "> %s\n", m.Content)
+			} else {
+				fmt.Fprintf(s.out, "%s\n", m.Content)
+			}
+		}
+	}
+	if *model != "" {
+		s.chat.Model = *model
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	if s.chat.Model == "" {
+		if err := s.pickModel(context.Background(), in); err != nil {
+			fmt.Fprintf(os.Stderr, "laim chat: %v\n", err)
+			return 1
+		}
+	}
+	if config.DataDir == "" {
+		fmt.Fprintln(s.errOut, "No data directory; this chat won't be saved.")
+	}
+	// Ctrl-C stops the answer being written; between answers it quits as usual
+	s.repl(context.Background(), in, func(ctx context.Context) (context.Context, context.CancelFunc) {
+		return signal.NotifyContext(ctx, os.Interrupt)
+	})
+	if len(s.chat.Messages) > 0 && config.DataDir != "" {
+		fmt.Fprintf(s.out, "Continue with: laim chat -continue %s\n", s.chat.ID)
+	}
+	return 0
+}
+
+// listCLIChats prints the saved chats, newest first.
+func listCLIChats(w io.Writer) error {
+	if config.DataDir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Join(config.DataDir, cliChatsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var chats []CLIChat
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if chat, err := loadCLIChat(id); err == nil {
+			chats = append(chats, chat)
+		}
+	}
+	sort.Slice(chats, func(i, j int) bool { return chats[i].UpdatedAt.After(chats[j].UpdatedAt) })
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMODEL\tMESSAGES\tUPDATED\tFIRST MESSAGE")
+	for _, chat := range chats {
+		first := ""
+		if len(chat.Messages) > 0 {
+			first = truncateRunes(strings.Join(strings.Fields(chat.Messages[0].Content), " "), 50)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", chat.ID, chat.Model, len(chat.Messages), chat.UpdatedAt.Local().Format("2006-01-02 15:04"), first)
+	}
+	return tw.Flush()
+}
+
+// --- Inbound Hooks ---
+
+// HookConfig is an inbound webhook at POST /api/hooks/{id}, a model step for automation tools
+// such as n8n and Node-RED. The JSON posted to it is put into Template and sent to Model.
+type HookConfig struct {
+	ID         string                 `json:"id"`
+	Model      string                 `json:"model"`
+	Template   string                 `json:"template"`              // The prompt; {{payload.field}} and {{query.name}} are filled in
+	System     string                 `json:"system,omitempty"`      // System prompt, filled in the same way
+	Options    map[string]interface{} `json:"options,omitempty"`     // Ollama options, e.g. temperature
+	Format     json.RawMessage        `json:"format,omitempty"`      // "json" or a JSON schema; the answer is then also returned parsed, as "data"
+	Token      string                 `json:"token,omitempty"`       // When set, callers must send "Authorization: Bearer <token>"
+	ForwardURL string                 `json:"forward_url,omitempty"` // POST the result here instead of returning it
+}
+
+// HookResult is what a hook answers with, or forwards.
+type HookResult struct {
+	Hook      string          `json:"hook"`
+	RequestID string          `json:"request_id"`
+	Model     string          `json:"model"`
+	Response  string          `json:"response,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Error     *UpstreamError  `json:"error,omitempty"` // Only in forwarded results; returned results fail with the error's status
+}
+
+const hookForwardTimeout = 30 * time.Second // Also for batch job webhooks
+
+var (
+	hookIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	// hookFieldPattern is {{payload}}, {{payload.a.b}}, {{payload.items.0}} or {{query.name}}
+	hookFieldPattern = regexp.MustCompile(`\{\{\s*((?:payload|query)(?:\.[A-Za-z0-9_-]+)*)\s*\}\}`)
+)
+
+func validateHooks(hooks []HookConfig) error {
+	seen := make(map[string]bool)
+	for _, h := range hooks {
+		if !hookIDPattern.MatchString(h.ID) {
+			return fmt.Errorf("hook id %q must be letters, digits, - and _", h.ID)
+		}
+		if seen[h.ID] {
+			return fmt.Errorf("hook %s is defined twice", h.ID)
+		}
+		seen[h.ID] = true
+		if !modelNamePattern.MatchString(h.Model) || strings.TrimSpace(h.Template) == "" {
+			return fmt.Errorf("hook %s needs a model and a template", h.ID)
+		}
+		if h.ForwardURL != "" {
+			if u, err := url.Parse(h.ForwardURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("hook %s: forward_url must be an http(s) URL", h.ID)
+			}
+		}
+	}
+	return nil
+}
+
+func findHook(id string) (HookConfig, bool) {
+	for _, h := range config.Hooks {
+		if h.ID == id {
+			return h, true
+		}
+	}
+	return HookConfig{}, false
+}
+
+// renderHookTemplate fills in the fields of the posted JSON and the query string. A field
+// that isn't there becomes empty, since automation payloads often leave fields out. Strings
+// are put in as they are, anything else as JSON.
+func renderHookTemplate(text string, payload interface{}, query url.Values) string {
+	text = hookFieldPattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := strings.Split(hookFieldPattern.FindStringSubmatch(m)[1], ".")
+		if parts[0] == "query" {
+			if len(parts) != 2 {
+				return ""
+			}
+			return query.Get(parts[1])
+		}
+		v := payload
+		for _, key := range parts[1:] {
+			switch node := v.(type) {
+			case map[string]interface{}:
+				v = node[key]
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(node) {
+					return ""
+				}
+				v = node[i]
+			default:
+				return ""
+			}
+		}
+		switch v := v.(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		default:
+			data, _ := json.MarshalIndent(v, "", "  ")
+			return string(data)
+		}
+	})
+	return text
+}
+
+// handleHook runs a hook: POST /api/hooks/{id} with any JSON body.
+func handleHook(w http.ResponseWriter, r *http.Request) {
+	hook, ok := findHook(strings.TrimPrefix(r.URL.Path, "/api/hooks/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if hook.Token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(hook.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="laim hook"`)
+			http.Error(w, "Hook token required", http.StatusUnauthorized)
+			return
+		}
+	}
+	r, ok = withTokenQuota(w, r)
+	if !ok {
+		return
+	}
+
+	var payload interface{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	var messages []Message
+	if hook.System != "" {
+		messages = append(messages, Message{Role: "system", Content: expandBuiltinVariables(renderHookTemplate(hook.System, payload, query), hook.Model)})
+	}
+	messages = append(messages, Message{Role: "user", Content: expandBuiltinVariables(renderHookTemplate(hook.Template, payload, query), hook.Model)})
+
+	clientReq := ClientRequest{ActionType: "chat", Model: hook.Model, Messages: messages, Options: hook.Options, Format: hook.Format}
+	r = withGuardrail(w, r, clientReq)
+	req := OllamaChatRequestPayload{
+		Model:     hook.Model,
+		Messages:  guardrailMessages(r.Context(), messages),
+		Format:    hook.Format,
+		Options:   hook.Options,
+		KeepAlive: keepAliveFor(clientReq),
+	}
+	result := HookResult{Hook: hook.ID, RequestID: requestIDFrom(r.Context()), Model: hook.Model}
+
+	if hook.ForwardURL == "" {
+		if err := runHook(r.Context(), &req, &result); err != nil {
+			var upstream *UpstreamError
+			if !errors.As(err, &upstream) {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			writeUpstreamError(w, asUpstreamError(hook.Model, err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	// The caller doesn't wait; the answer goes to forward_url once it is written
+	ctx := context.WithValue(context.Background(), clientKey, clientFrom(r.Context()))
+	go func() {
+		if err := runHook(ctx, &req, &result); err != nil {
+			result.Error = asUpstreamError(hook.Model, err)
+		}
+		// forward_url comes from the config file, so it may well be on the local network
+		if err := postWebhook(http.DefaultClient, hook.ForwardURL, result.RequestID, result); err != nil {
+			log.Printf("Hook %s: could not forward request %s to %s: %v", hook.ID, result.RequestID, hook.ForwardURL, err)
+		}
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"hook": hook.ID, "request_id": result.RequestID, "status": "accepted"})
+}
+
+// runHook asks the hook's model, waiting for a generation slot like any other request.
+func runHook(ctx context.Context, req *OllamaChatRequestPayload, result *HookResult) error {
+	release, err := generationQueue.Acquire(ctx, routes.Resolve(req.Model), func(int) {})
+	if err != nil {
+		return fmt.Errorf("Server busy: %v", err)
+	}
+	defer release()
+
+	answer, _, err := askChat(ctx, req)
+	if err != nil {
+		return err
+	}
+	result.Response = answer
+	if len(req.Format) > 0 && json.Valid([]byte(answer)) {
+		result.Data = json.RawMessage(answer)
+	}
+	return nil
+}
+
+// askChat sends a chat to the model without streaming it to anyone; ollamaStream counts the
+// tokens towards the context's client. The caller holds a generation slot.
+func askChat(ctx context.Context, req *OllamaChatRequestPayload) (string, OllamaResponseChunk, error) {
+	fitToContext(req)
+	var answer strings.Builder
+	var last OllamaResponseChunk
+	err := ollamaStream(ctx, newOllamaClient(300*time.Second), routes.Resolve(req.Model)+ollamaChatAPI, *req, func(chunk OllamaResponseChunk) {
+		if chunk.Done {
+			last = chunk
+		}
+		if chunk.Message != nil {
+			answer.WriteString(chunk.Message.Content)
+		}
+	})
+	return answer.String(), last, err
+}
+
+// postWebhook POSTs v as JSON to target, for hooks that forward their results and batch jobs
+// that report when they finish.
+func postWebhook(client *http.Client, target, requestID string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookForwardTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if requestID != "" {
+		req.Header.Set("X-Request-ID", requestID)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", target, resp.Status)
+	}
+	return nil
+}
+
+// --- Batch Jobs ---
+
+const (
+	batchesFile        = "batches.json"
+	batchResultsDir    = "batches" // In the data directory, one <id>.jsonl of results per job
+	maxBatchItems      = 10000
+	maxBatchJobs       = 100                // Jobs kept; starting another removes the oldest finished one
+	maxClientBatchJobs = 5                  // Jobs one client may have running at once
+	batchJobTTL        = 7 * 24 * time.Hour // Finished jobs are removed after this long
+)
+
+// batchWebhookClient calls the webhook_url of batch jobs. Any client may set one, so like
+// web_fetch it only reaches public addresses.
+var batchWebhookClient = &http.Client{Transport: &http.Transport{DialContext: publicOnlyDialer}}
+
+// BatchItem is one prompt of a batch job. In a request it may also be just the prompt, as a string.
+type BatchItem struct {
+	ID     string `json:"id,omitempty"` // The caller's own ID, returned with the result
+	Prompt string `json:"prompt"`
+	Model  string `json:"model,omitempty"`  // Overrides the job's model
+	System string `json:"system,omitempty"` // Overrides the job's system prompt
+}
+
+func (item *BatchItem) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*item = BatchItem{}
+		return json.Unmarshal(data, &item.Prompt)
+	}
+	type plain BatchItem
+	return json.Unmarshal(data, (*plain)(item))
+}
+
+// BatchRequest starts a batch job.
+type BatchRequest struct {
+	Model       string                 `json:"model"`
+	System      string                 `json:"system,omitempty"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+	Format      json.RawMessage        `json:"format,omitempty"`      // "json" or a JSON schema; answers are then also returned parsed, as "data"
+	Concurrency int                    `json:"concurrency,omitempty"` // Prompts run at once; default 1, at most max_concurrent_generations
+	WebhookURL  string                 `json:"webhook_url,omitempty"` // Gets the job's status once it has finished
+	Prompts     []BatchItem            `json:"prompts"`
+}
+
+// BatchJob is the status of a batch job.
+type BatchJob struct {
+	ID          string     `json:"id"`
+	Client      string     `json:"client"` // Who started the job; only they and admins see it
+	Status      string     `json:"status"` // "running", "completed", "cancelled", "quota_exceeded", or "interrupted" when LAIM stopped first
+	Model       string     `json:"model"`
+	Total       int        `json:"total"`
+	Completed   int        `json:"completed"` // Including the failed ones
+	Failed      int        `json:"failed"`
+	Concurrency int        `json:"concurrency"`
+	WebhookURL  string     `json:"webhook_url,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// BatchResult is the answer to one prompt of a batch job.
+type BatchResult struct {
+	Index        int             `json:"index"` // Position of the prompt in the request
+	ID           string          `json:"id,omitempty"`
+	Model        string          `json:"model"`
+	Response     string          `json:"response,omitempty"`
+	Data         json.RawMessage `json:"data,omitempty"`
+	Error        *UpstreamError  `json:"error,omitempty"`
+	PromptTokens int             `json:"prompt_tokens,omitempty"`
+	EvalTokens   int             `json:"eval_tokens,omitempty"`
+	DurationMs   int64           `json:"duration_ms"`
+}
+
+type batchJob struct {
+	status  BatchJob
+	results []BatchResult // In the order they finished
+	cancel  context.CancelFunc
+}
+
+// BatchStore runs batch jobs in the background and keeps their results: the jobs in
+// batches.json, the results of each in batches/<id>.jsonl as they come in.
+type BatchStore struct {
+	mu   sync.Mutex
+	jobs map[string]*batchJob
+}
+
+var batches *BatchStore
+
+func NewBatchStore() *BatchStore {
+	bs := &BatchStore{jobs: make(map[string]*batchJob)}
+	var saved []BatchJob
+	if err := loadJSONFile(batchesFile, &saved); err != nil {
+		log.Printf("⚠️ WARNING: Could not load batch jobs: %v", err)
+	}
+	for _, status := range saved {
+		job := &batchJob{status: status}
+		results, err := loadBatchResults(status.ID)
+		if err != nil {
+			log.Printf("⚠️ WARNING: Could not load the results of batch job %s: %v", status.ID, err)
+		}
+		job.results = results
+		job.status.Completed, job.status.Failed = len(results), 0
+		for _, r := range results {
+			if r.Error != nil {
+				job.status.Failed++
+			}
+		}
+		if job.status.Status == "running" {
+			job.status.Status = "interrupted"
+		}
+		bs.jobs[status.ID] = job
+	}
+	bs.evict(0)
+	return bs
+}
+
+func loadBatchResults(id string) ([]BatchResult, error) {
+	if config.DataDir == "" {
+		return nil, nil
+	}
+	f, err := os.Open(filepath.Join(config.DataDir, batchResultsDir, id+".jsonl"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var results []BatchResult
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r BatchResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return results, err
+		}
+		results = append(results, r)
+	}
+	return results, scanner.Err()
+}
+
+// save writes the jobs to batches.json; the caller holds bs.mu.
+func (bs *BatchStore) save() {
+	list := make([]BatchJob, 0, len(bs.jobs))
+	for _, job := range bs.jobs {
+		list = append(list, job.status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	if err := saveJSONFile(batchesFile, list); err != nil {
+		log.Printf("Could not save batch jobs: %v", err)
+	}
+}
+
+var errTooManyBatchJobs = fmt.Errorf("%d batch jobs are running; wait for one to finish or cancel one", maxBatchJobs)
+var errTooManyClientBatchJobs = fmt.Errorf("you have %d batch jobs running; wait for one to finish or cancel one", maxClientBatchJobs)
+
+// Start runs req in the background. ctx carries the client and guardrail the prompts run under.
+func (bs *BatchStore) Start(ctx context.Context, req BatchRequest) (BatchJob, error) {
+	bs.mu.Lock()
+	running := 0
+	for _, job := range bs.jobs {
+		if job.status.Client == clientFrom(ctx) && job.status.Status == "running" {
+			running++
+		}
+	}
+	if running >= maxClientBatchJobs {
+		bs.mu.Unlock()
+		return BatchJob{}, errTooManyClientBatchJobs
+	}
+	if !bs.evict(1) {
+		bs.mu.Unlock()
+		return BatchJob{}, errTooManyBatchJobs
+	}
+	bs.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	job := &batchJob{
+		status: BatchJob{
+			ID:          newRequestID(),
+			Client:      clientFrom(ctx),
+			Status:      "running",
+			Model:       req.Model,
+			Total:       len(req.Prompts),
+			Concurrency: req.Concurrency,
+			WebhookURL:  req.WebhookURL,
+			CreatedAt:   time.Now().UTC(),
+		},
+		cancel: cancel,
+	}
+	if config.DataDir != "" {
+		if err := os.MkdirAll(filepath.Join(config.DataDir, batchResultsDir), 0700); err != nil {
+			log.Printf("Could not create %s: %v", batchResultsDir, err)
+		}
+	}
+	bs.mu.Lock()
+	bs.jobs[job.status.ID] = job
+	bs.save()
+	status := job.status
+	bs.mu.Unlock()
+
+	go bs.run(ctx, job, req)
+	return status, nil
+}
+
+// evict removes the finished jobs older than batchJobTTL, then the oldest finished jobs until
+// room more jobs fit under maxBatchJobs. It reports whether they do; the caller holds bs.mu.
+func (bs *BatchStore) evict(room int) bool {
+	var finished []*batchJob
+	for id, job := range bs.jobs {
+		if job.status.Status == "running" {
+			continue
+		}
+		if time.Since(job.finishedAt()) > batchJobTTL {
+			bs.remove(id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].finishedAt().Before(finished[j].finishedAt()) })
+	for len(bs.jobs)+room > maxBatchJobs && len(finished) > 0 {
+		bs.remove(finished[0].status.ID)
+		finished = finished[1:]
+	}
+	bs.save()
+	return len(bs.jobs)+room <= maxBatchJobs
+}
+
+// finishedAt is when the job finished, or for an interrupted one, when it started.
+func (job *batchJob) finishedAt() time.Time {
+	if job.status.FinishedAt != nil {
+		return *job.status.FinishedAt
+	}
+	return job.status.CreatedAt
+}
+
+// remove forgets a job and deletes its results; the caller holds bs.mu.
+func (bs *BatchStore) remove(id string) {
+	if job := bs.jobs[id]; job != nil && job.cancel != nil {
+		job.cancel()
+	}
+	delete(bs.jobs, id)
+	if config.DataDir != "" {
+		os.Remove(filepath.Join(config.DataDir, batchResultsDir, id+".jsonl"))
+	}
+}
+
+func (bs *BatchStore) run(ctx context.Context, job *batchJob, req BatchRequest) {
+	items := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < req.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				result := runBatchItem(ctx, req, i)
+				if ctx.Err() != nil {
+					return
+				}
+				bs.record(job, result)
+				if result.Error != nil && result.Error.Code == codeQuotaExceeded {
+					bs.halt(job, "quota_exceeded")
+				}
+			}
+		}()
+	}
+feed:
+	for i := range req.Prompts {
+		select {
+		case items <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(items)
+	wg.Wait()
+
+	bs.mu.Lock()
+	if bs.jobs[job.status.ID] != job { // Deleted
+		bs.mu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	job.status.FinishedAt = &now
+	if job.status.Status == "running" {
+		job.status.Status = "completed"
+	}
+	bs.save()
+	status := job.status
+	bs.mu.Unlock()
+	job.cancel()
+
+	if status.WebhookURL != "" {
+		if err := postWebhook(batchWebhookClient, status.WebhookURL, "", status); err != nil {
+			log.Printf("Batch job %s: could not call its webhook %s: %v", status.ID, status.WebhookURL, err)
+		}
+	}
+}
+
+func (bs *BatchStore) record(job *batchJob, result BatchResult) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.jobs[job.status.ID] != job {
+		return
+	}
+	job.results = append(job.results, result)
+	job.status.Completed++
+	if result.Error != nil {
+		job.status.Failed++
+	}
+	if err := appendJSONLine(filepath.Join(batchResultsDir, job.status.ID+".jsonl"), result); err != nil {
+		log.Printf("Could not save a result of batch job %s: %v", job.status.ID, err)
+	}
+}
+
+// runBatchItem answers one prompt. It waits for a generation slot behind every interactive
+// request and never takes a place in their queue, so a batch can't crowd out interactive users.
+func runBatchItem(ctx context.Context, req BatchRequest, i int) BatchResult {
+	item := req.Prompts[i]
+	model, system := req.Model, req.System
+	if item.Model != "" {
+		model = item.Model
+	}
+	if item.System != "" {
+		system = item.System
+	}
+	result := BatchResult{Index: i, ID: item.ID, Model: model}
+	started := time.Now()
+	if status, usedUp := tokenQuotaUsedUp(clientFrom(ctx)); usedUp {
+		result.Error = &UpstreamError{
+			Message: fmt.Sprintf("Daily token quota of %d tokens used up; it resets at %s", status.Limit, status.ResetsAt.Format(time.RFC3339)),
+			Code:    codeQuotaExceeded,
+			Hint:    "The rest of the batch was not run.",
+			Status:  http.StatusTooManyRequests,
+		}
+		return result
+	}
+
+	release, err := generationQueue.AcquireBackground(ctx, routes.Resolve(model))
+	if err != nil {
+		result.Error = asUpstreamError(model, err)
+		return result
+	}
+	defer release()
+
+	var messages []Message
+	if system != "" {
+		messages = append(messages, Message{Role: "system", Content: system})
+	}
+	messages = append(messages, Message{Role: "user", Content: item.Prompt})
+	chatReq := OllamaChatRequestPayload{
+		Model:     model,
+		Messages:  guardrailMessages(ctx, messages),
+		Format:    req.Format,
+		Options:   req.Options,
+		KeepAlive: keepAliveFor(ClientRequest{ActionType: "chat", Model: model}),
+	}
+	answer, last, err := askChat(ctx, &chatReq)
+	result.DurationMs = time.Since(started).Milliseconds()
+	if err != nil {
+		result.Error = asUpstreamError(model, err)
+		return result
+	}
+	result.Response, result.PromptTokens, result.EvalTokens = answer, last.PromptEvalCount, last.EvalCount
+	if len(req.Format) > 0 && json.Valid([]byte(answer)) {
+		result.Data = json.RawMessage(answer)
+	}
+	return result
+}
+
+func (bs *BatchStore) Get(id string) (BatchJob, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	job, ok := bs.jobs[id]
+	if !ok {
+		return BatchJob{}, false
+	}
+	return job.status, true
+}
+
+// List returns the jobs of client, or with client "" everyone's, newest first.
+func (bs *BatchStore) List(client string) []BatchJob {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	list := make([]BatchJob, 0, len(bs.jobs))
+	for _, job := range bs.jobs {
+		if client == "" || job.status.Client == client {
+			list = append(list, job.status)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Results returns a job's results so far, in the order of its prompts.
+func (bs *BatchStore) Results(id string) ([]BatchResult, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	job, ok := bs.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	results := append([]BatchResult(nil), job.results...)
+	sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+	return results, true
+}
+
+// Cancel stops a running job; the prompts answered so far are kept.
+func (bs *BatchStore) Cancel(id string) (BatchJob, bool) {
+	bs.mu.Lock()
+	job, ok := bs.jobs[id]
+	bs.mu.Unlock()
+	if !ok {
+		return BatchJob{}, false
+	}
+	return bs.halt(job, "cancelled"), true
+}
+
+// halt stops a running job, giving it status instead of "completed".
+func (bs *BatchStore) halt(job *batchJob, status string) BatchJob {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if job.status.Status == "running" {
+		job.status.Status = status
+		job.cancel()
+	}
+	return job.status
+}
+
+// Delete cancels a job if it is still running and removes it with its results.
+func (bs *BatchStore) Delete(id string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if _, ok := bs.jobs[id]; !ok {
+		return false
+	}
+	bs.remove(id)
+	bs.save()
+	return true
+}
+
+// handleBatch serves the batch jobs: POST /api/batch starts one, GET /api/batch lists them,
+// GET and DELETE /api/batch/{id} read and remove one, POST /api/batch/{id}/cancel stops it and
+// GET /api/batch/{id}/results returns its results as JSON lines. Clients only see their own
+// jobs; admins see everyone's.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	client := clientFrom(r.Context())
+	if isAdmin(r) {
+		client = ""
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/batch"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodPost:
+			startBatch(w, r)
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(batches.List(client))
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, action := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		id, action = rest[:i], rest[i+1:]
+	}
+	status, ok := batches.Get(id)
+	if !ok || (client != "" && status.Client != client) {
+		http.Error(w, "Batch job not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case action == "" && r.Method == http.MethodDelete:
+		batches.Delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "cancel" && r.Method == http.MethodPost:
+		status, _ = batches.Cancel(id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case action == "results" && r.Method == http.MethodGet:
+		results, _ := batches.Results(id)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, result := range results {
+			encoder.Encode(result)
+		}
+	case action == "" || action == "cancel" || action == "results":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// startBatch reads a batch request: JSON, or JSON lines of prompts (as the body or an uploaded
+// "file") with the other fields as query parameters.
+func startBatch(w http.ResponseWriter, r *http.Request) {
+	var req BatchRequest
+	contentType := r.Header.Get("Content-Type")
+	body := http.MaxBytesReader(w, r.Body, maxRequestBytes)
+	switch {
+	case strings.HasPrefix(contentType, "multipart/form-data"), strings.Contains(contentType, "ndjson"), strings.Contains(contentType, "jsonl"):
+		var lines io.Reader = body
+		if strings.HasPrefix(contentType, "multipart/form-data") {
+			r.Body = body
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, "Upload the prompts as a JSON lines \"file\": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			lines = file
+		}
+		query := r.URL.Query()
+		req.Model, req.System, req.WebhookURL = query.Get("model"), query.Get("system"), query.Get("webhook_url")
+		if format := query.Get("format"); format != "" {
+			req.Format, _ = json.Marshal(format)
+		}
+		if c := query.Get("concurrency"); c != "" {
+			n, err := strconv.Atoi(c)
+			if err != nil {
+				http.Error(w, "Invalid concurrency", http.StatusBadRequest)
+				return
+			}
+			req.Concurrency = n
+		}
+		scanner := bufio.NewScanner(lines)
+		scanner.Buffer(make([]byte, 64*1024), maxRequestBytes)
+		for n := 1; scanner.Scan(); n++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var item BatchItem
+			if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid prompt on line %d: %v", n, err), http.StatusBadRequest)
+				return
+			}
+			req.Prompts = append(req.Prompts, item)
+		}
+		if err := scanner.Err(); err != nil {
+			http.Error(w, "Could not read the prompts: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		decoder := json.NewDecoder(body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := validateBatchRequest(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r, ok := withTokenQuota(w, r)
+	if !ok {
+		return
+	}
+	// The prompts run under the client and guardrail of the request that started them
+	r = withGuardrail(w, r, ClientRequest{ActionType: "batch", Model: req.Model})
+	ctx := context.WithValue(context.Background(), clientKey, clientFrom(r.Context()))
+	if text, _ := r.Context().Value(guardrailKey).(string); text != "" {
+		ctx = context.WithValue(ctx, guardrailKey, text)
+	}
+	status, err := batches.Start(ctx, req)
+	if errors.Is(err, errTooManyClientBatchJobs) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "batch/"+status.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+func validateBatchRequest(req *BatchRequest) error {
+	if len(req.Prompts) == 0 || len(req.Prompts) > maxBatchItems {
+		return fmt.Errorf("a batch needs between 1 and %d prompts", maxBatchItems)
+	}
+	// Each prompt must pass as the chat it becomes
+	for i, item := range req.Prompts {
+		model, system := req.Model, req.System
+		if item.Model != "" {
+			model = item.Model
+		}
+		if item.System != "" {
+			system = item.System
+		}
+		if model == "" {
+			return fmt.Errorf("prompt %d: needs a model, for the job or the prompt", i)
+		}
+		if strings.TrimSpace(item.Prompt) == "" {
+			return fmt.Errorf("prompt %d is empty", i)
+		}
+		if len(system) > maxSystemPromptBytes {
+			return fmt.Errorf("prompt %d: system prompt exceeds %d bytes", i, maxSystemPromptBytes)
+		}
+		if model == autoModel {
+			return fmt.Errorf("prompt %d: model %q is not supported for batches", i, autoModel)
+		}
+		messages := []Message{{Role: "user", Content: item.Prompt}}
+		if system != "" {
+			messages = append([]Message{{Role: "system", Content: system}}, messages...)
+		}
+		if err := validateClientRequest(ClientRequest{ActionType: "chat", Model: model, Messages: messages, Options: req.Options, Format: req.Format}); err != nil {
+			return fmt.Errorf("prompt %d: %v", i, err)
+		}
+	}
+	if req.Concurrency < 0 {
+		return errors.New("concurrency must not be negative")
+	}
+	if req.Concurrency == 0 {
+		req.Concurrency = 1
+	}
+	if req.Concurrency > config.MaxConcurrentGenerations {
+		req.Concurrency = config.MaxConcurrentGenerations
+	}
+	if req.WebhookURL != "" {
+		u, err := url.Parse(req.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("webhook_url must be an http(s) URL")
+		}
+		if !isPublicHost(u.Hostname()) {
+			return errors.New("webhook_url must be a public address, not localhost or the local network")
+		}
+	}
+	return nil
+}
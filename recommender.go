@@ -0,0 +1,2004 @@
+package main
+
+// The LLM recommender suggests installed and well-known models that fit this machine's
+// hardware. It runs inside the LAIM server under /api/recommendations and shares its
+// routing table, data directory and pull handling.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const huggingFaceBaseURL = "https://huggingface.co"
+const huggingFaceModelsAPI = huggingFaceBaseURL + "/api/models"
+
+// --- Hugging Face API Structures ---
+
+// HuggingFaceModel is the structure for a single item in the /api/models search results
+type HuggingFaceModel struct {
+	ModelId     string   `json:"modelId"`
+	PipelineTag string   `json:"pipeline_tag"` // e.g., "text-generation", "image-classification"
+	Tags        []string `json:"tags"`         // Detailed tags like "gemma", "2b", "text", "pytorch"
+}
+
+// --- Recommender Data Structures ---
+
+// HardwareSpecs defines the minimum required hardware for a model.
+type HardwareSpecs struct {
+	MinVRAM_GB int `json:"min_vram_gb"`
+	MinRAM_GB  int `json:"min_ram_gb"`
+}
+
+// RecommendedModel includes model info, tasks, and its hardware requirements.
+type RecommendedModel struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Tasks       []string      `json:"tasks"`
+	HardwareReq HardwareSpecs `json:"hardware_req"`
+	Score       int           `json:"score"`
+
+	// Set when HardwareReq is estimated from the model's size rather than the defaults
+	ParameterSize string          `json:"parameter_size,omitempty"`
+	Quantization  string          `json:"quantization,omitempty"`
+	Variants      []QuantEstimate `json:"variants,omitempty"` // What other quantizations of the model would need
+	SizeGB        float64         `json:"size_gb,omitempty"`  // Download size of the listed quantization
+
+	// Known from the catalog, the description or Hugging Face; empty when nobody says
+	ContextLength int    `json:"context_length,omitempty"` // Tokens; for installed models, from /api/show
+	License       string `json:"license,omitempty"`        // e.g. "apache-2.0", "llama3.2"
+	Multilingual  bool   `json:"multilingual,omitempty"`
+
+	KVCacheBytesPerToken int64 `json:"kv_cache_bytes_per_token,omitempty"` // Installed models only
+
+	Benchmark *BenchmarkResult `json:"benchmark,omitempty"` // Measured on this machine, if benchmarked
+	Installed bool             `json:"installed"`           // False for well-known models that can be pulled
+	// For models that aren't installed: what pulling one downloads, and how to pull it from a shell
+	DownloadGB  float64 `json:"download_gb,omitempty"`
+	PullCommand string  `json:"pull_command,omitempty"`
+	Updated     string  `json:"updated,omitempty"` // When the library last updated the model (YYYY-MM-DD)
+
+	// How well the model suits a recommendation request, out of 100, and what that is made of
+	Fit         int    `json:"fit,omitempty"`
+	Explanation string `json:"explanation,omitempty"`
+}
+
+// ModelDatabase holds all known models and their properties. Refreshes replace its contents
+// while handlers read it.
+var ModelDatabase = NewModelStore()
+
+// ModelStore is the recommender's model database, safe for concurrent use.
+type ModelStore struct {
+	mu          sync.RWMutex
+	models      map[string]RecommendedModel
+	refreshedAt time.Time
+
+	refreshMu sync.Mutex // One refresh at a time
+}
+
+func NewModelStore() *ModelStore {
+	return &ModelStore{models: make(map[string]RecommendedModel)}
+}
+
+func (ms *ModelStore) Get(name string) (RecommendedModel, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	model, ok := ms.models[name]
+	return model, ok
+}
+
+// List returns every model, sorted by name.
+func (ms *ModelStore) List() []RecommendedModel {
+	ms.mu.RLock()
+	list := make([]RecommendedModel, 0, len(ms.models))
+	for _, model := range ms.models {
+		list = append(list, model)
+	}
+	ms.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (ms *ModelStore) Replace(models map[string]RecommendedModel) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.models = models
+	ms.refreshedAt = time.Now().UTC()
+	recommendationCache.Clear()
+}
+
+func (ms *ModelStore) RefreshedAt() time.Time {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.refreshedAt
+}
+
+// ModelMetadata is what Hugging Face said about a model, kept so lookups survive restarts.
+type ModelMetadata struct {
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	Tasks        []string  `json:"tasks"`
+	License      string    `json:"license,omitempty"`
+	Multilingual bool      `json:"multilingual,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+const modelMetadataFile = "model_metadata.json"
+
+// MetadataCache holds enrichment results in the data directory until they are older than
+// the configured TTL.
+type MetadataCache struct {
+	mu      sync.Mutex
+	entries map[string]ModelMetadata
+}
+
+var modelMetadata *MetadataCache
+
+func NewMetadataCache() *MetadataCache {
+	mc := &MetadataCache{entries: make(map[string]ModelMetadata)}
+	var saved []ModelMetadata
+	if err := loadJSONFile(modelMetadataFile, &saved); err != nil {
+		log.Printf("⚠️ WARNING: Could not load model metadata: %v", err)
+	}
+	for _, m := range saved {
+		mc.entries[m.Name] = m
+	}
+	return mc
+}
+
+// Get returns a model's metadata unless it has expired.
+func (mc *MetadataCache) Get(name string) (ModelMetadata, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	m, ok := mc.entries[name]
+	ttl := time.Duration(config.RecommenderMetadataTTLHours) * time.Hour
+	return m, ok && time.Since(m.FetchedAt) < ttl
+}
+
+func (mc *MetadataCache) Put(m ModelMetadata) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.entries[m.Name] = m
+	list := make([]ModelMetadata, 0, len(mc.entries))
+	for _, entry := range mc.entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	if err := saveJSONFile(modelMetadataFile, list); err != nil {
+		log.Printf("Could not save model metadata: %v", err)
+	}
+}
+
+// placeholderMetadata describes models neither the catalog nor Hugging Face knows.
+var placeholderMetadata = RecommendedModel{
+	Description: "Assigned generic tasks and default hardware requirements (8 GB VRAM / 16 GB RAM).",
+	Tasks:       []string{"chat", "generate", "general"},
+	HardwareReq: HardwareSpecs{MinVRAM_GB: 8, MinRAM_GB: 16},
+	Score:       6,
+}
+
+// --- Ollama Library Catalog ---
+
+// CatalogModel is one model in the Ollama library.
+type CatalogModel struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Capabilities []string `json:"capabilities,omitempty"` // "tools", "vision", "embedding", "thinking"
+	Sizes        []string `json:"sizes,omitempty"`        // Parameter-size tags, e.g. "8b"
+	Pulls        string   `json:"pulls,omitempty"`        // As the library shows it, e.g. "1.2M"
+	Updated      string   `json:"updated,omitempty"`      // YYYY-MM-DD, worked out from "Updated 2 weeks ago"
+}
+
+// ModelCatalog is the list of models that can be pulled, most popular first.
+type ModelCatalog struct {
+	Models    []CatalogModel `json:"models"`
+	FetchedAt time.Time      `json:"fetched_at"`
+	Source    string         `json:"source"` // "library", "cache" or "builtin"
+}
+
+const (
+	modelCatalogFile = "model_catalog.json"
+	catalogMaxAge    = 24 * time.Hour
+	catalogPopular   = 10 // The most popular models score one point higher
+)
+
+// builtinCatalog is used when the library can't be reached and nothing is cached.
+var builtinCatalog = []CatalogModel{
+	{Name: "llama3.1", Description: "Llama 3.1 is a new state-of-the-art model from Meta available in 8B, 70B and 405B parameter sizes.", Capabilities: []string{"tools"}, Sizes: []string{"8b", "70b"}, Updated: "2024-07-23"},
+	{Name: "deepseek-r1", Description: "DeepSeek-R1 is a family of open reasoning models with performance approaching that of leading models.", Capabilities: []string{"tools", "thinking"}, Sizes: []string{"1.5b", "7b", "8b", "14b", "32b", "70b"}, Updated: "2025-05-29"},
+	{Name: "llama3.2", Description: "Meta's Llama 3.2 goes small with 1B and 3B models.", Capabilities: []string{"tools"}, Sizes: []string{"1b", "3b"}, Updated: "2024-09-25"},
+	{Name: "nomic-embed-text", Description: "A high-performing open embedding model with a large token context window.", Capabilities: []string{"embedding"}, Updated: "2024-02-15"},
+	{Name: "mistral", Description: "The 7B model released by Mistral AI, updated to version 0.3.", Capabilities: []string{"tools"}, Sizes: []string{"7b"}, Updated: "2024-07-22"},
+	{Name: "qwen2.5", Description: "Qwen2.5 models are pretrained on Alibaba's latest large-scale dataset, supporting up to 128K tokens.", Capabilities: []string{"tools"}, Sizes: []string{"0.5b", "1.5b", "3b", "7b", "14b", "32b", "72b"}, Updated: "2024-09-19"},
+	{Name: "qwen2.5-coder", Description: "The latest series of Code-Specific Qwen models, with significant improvements in code generation, code reasoning, and code fixing.", Capabilities: []string{"tools"}, Sizes: []string{"0.5b", "1.5b", "3b", "7b", "14b", "32b"}, Updated: "2024-11-12"},
+	{Name: "gemma2", Description: "Google Gemma 2 is a high-performing and efficient model available in three sizes: 2B, 9B, and 27B.", Sizes: []string{"2b", "9b", "27b"}, Updated: "2024-07-31"},
+	{Name: "llava", Description: "LLaVA is a novel end-to-end trained large multimodal model that combines a vision encoder and Vicuna for general-purpose visual and language understanding.", Capabilities: []string{"vision"}, Sizes: []string{"7b", "13b", "34b"}, Updated: "2024-02-01"},
+	{Name: "phi3", Description: "Phi-3 is a family of lightweight 3B (Mini) and 14B (Medium) state-of-the-art open models by Microsoft.", Sizes: []string{"3.8b", "14b"}, Updated: "2024-06-01"},
+	{Name: "codellama", Description: "A large language model that can use text prompts to generate and discuss code.", Sizes: []string{"7b", "13b", "34b", "70b"}, Updated: "2024-01-29"},
+	{Name: "tinyllama", Description: "The TinyLlama project is an open endeavor to train a compact 1.1B Llama model on 3 trillion tokens.", Sizes: []string{"1.1b"}, Updated: "2024-01-04"},
+	{Name: "gemma", Description: "Gemma is a family of lightweight, state-of-the-art open models built by Google DeepMind.", Sizes: []string{"2b", "7b"}, Updated: "2024-04-06"},
+}
+
+// CatalogStore holds the catalog most recently fetched from the Ollama library.
+type CatalogStore struct {
+	mu      sync.RWMutex
+	catalog ModelCatalog
+}
+
+var modelCatalog = &CatalogStore{}
+
+func (cs *CatalogStore) Get() ModelCatalog {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.catalog
+}
+
+func (cs *CatalogStore) set(catalog ModelCatalog) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.catalog = catalog
+}
+
+// Refresh fetches the library again once the catalog is a day old. When the library can't be
+// reached, the last catalog saved in the data directory is used, or else the built-in list.
+func (cs *CatalogStore) Refresh(client *http.Client) ModelCatalog {
+	current := cs.Get()
+	if len(current.Models) == 0 {
+		var saved ModelCatalog
+		if err := loadJSONFile(modelCatalogFile, &saved); err != nil {
+			log.Printf("⚠️ WARNING: Could not load the model catalog: %v", err)
+		}
+		if len(saved.Models) > 0 {
+			saved.Source = "cache"
+			current = saved
+		}
+	}
+
+	stale := current.Source == "" || current.Source == "builtin" || time.Since(current.FetchedAt) > catalogMaxAge
+	if config.ModelCatalogURL != "" && stale {
+		models, err := fetchCatalog(client, config.ModelCatalogURL)
+		if err != nil {
+			log.Printf("⚠️ WARNING: Could not fetch the model catalog: %v", err)
+		} else {
+			current = ModelCatalog{Models: models, FetchedAt: time.Now().UTC(), Source: "library"}
+			if err := saveJSONFile(modelCatalogFile, current); err != nil {
+				log.Printf("Could not save the model catalog: %v", err)
+			}
+		}
+	}
+
+	if len(current.Models) == 0 {
+		current = ModelCatalog{Models: builtinCatalog, Source: "builtin"}
+	}
+	cs.set(current)
+	return current
+}
+
+// Lookup finds the catalog entry for a model name, with or without its tag.
+func (c ModelCatalog) Lookup(name string) (CatalogModel, bool) {
+	base := strings.SplitN(name, ":", 2)[0]
+	for _, m := range c.Models {
+		if m.Name == base {
+			return m, true
+		}
+	}
+	return CatalogModel{}, false
+}
+
+var (
+	libraryEntryPattern       = regexp.MustCompile(`href="/library/([\w.\-]+)"`)
+	libraryDescriptionPattern = regexp.MustCompile(`(?s)<p[^>]*>(.*?)</p>`)
+	libraryCapabilityPattern  = regexp.MustCompile(`x-test-capability[^>]*>\s*([^<]+?)\s*<`)
+	librarySizePattern        = regexp.MustCompile(`x-test-size[^>]*>\s*([^<]+?)\s*<`)
+	libraryPullsPattern       = regexp.MustCompile(`x-test-pull-count[^>]*>\s*([^<]+?)\s*<`)
+	libraryUpdatedPattern     = regexp.MustCompile(`x-test-updated[^>]*>\s*([^<]+?)\s*<`)
+	relativeTimePattern       = regexp.MustCompile(`(?i)(\d+|an?)\s+(minute|hour|day|week|month|year)s?\s+ago`)
+	htmlTagPattern            = regexp.MustCompile(`<[^>]+>`)
+)
+
+// fetchCatalog reads the library's model list. The URL may also serve a catalog as JSON, e.g.
+// a mirror on a network without internet access.
+func fetchCatalog(client *http.Client, url string) ([]CatalogModel, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var models []CatalogModel
+	if strings.Contains(resp.Header.Get("Content-Type"), "application/json") {
+		var catalog ModelCatalog
+		if err := json.Unmarshal(body, &catalog); err != nil {
+			return nil, fmt.Errorf("invalid catalog: %w", err)
+		}
+		models = catalog.Models
+	} else {
+		models = parseLibraryPage(string(body))
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("no models found at %s", url)
+	}
+	return models, nil
+}
+
+// parseLibraryPage extracts the models listed on an ollama.com library or search page, in the
+// page's order.
+func parseLibraryPage(page string) []CatalogModel {
+	now := time.Now().UTC()
+	matches := libraryEntryPattern.FindAllStringSubmatchIndex(page, -1)
+	seen := make(map[string]bool)
+	var models []CatalogModel
+	for i, m := range matches {
+		name := page[m[2]:m[3]]
+		end := len(page)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		entry := page[m[1]:end]
+		model := CatalogModel{Name: name}
+		if d := libraryDescriptionPattern.FindStringSubmatch(entry); d != nil {
+			model.Description = strings.TrimSpace(html.UnescapeString(htmlTagPattern.ReplaceAllString(d[1], "")))
+		}
+		for _, c := range libraryCapabilityPattern.FindAllStringSubmatch(entry, -1) {
+			model.Capabilities = append(model.Capabilities, strings.ToLower(c[1]))
+		}
+		for _, size := range librarySizePattern.FindAllStringSubmatch(entry, -1) {
+			model.Sizes = append(model.Sizes, strings.ToLower(size[1]))
+		}
+		if p := libraryPullsPattern.FindStringSubmatch(entry); p != nil {
+			model.Pulls = p[1]
+		}
+		if u := libraryUpdatedPattern.FindStringSubmatch(entry); u != nil {
+			model.Updated = parseRelativeDate(u[1], now)
+		}
+		models = append(models, model)
+	}
+	return models
+}
+
+var longContextPattern = regexp.MustCompile(`(?i)\b(1[0-9]{2}|[2-9][0-9]{2})K\b|long context|large (token )?context`)
+
+// contextLengthPattern finds a context window in a description, e.g. "up to 128K tokens".
+var contextLengthPattern = regexp.MustCompile(`(?i)\b(\d{1,4})K[- ](?:tokens?|context)`)
+
+var multilingualPattern = regexp.MustCompile(`(?i)multilingual|multiple languages|\b\d{2,3}\+? languages`)
+
+// catalogLicenses are the licenses of well-known model families. The library list doesn't
+// show licenses, so other catalog models have none unless Hugging Face names one.
+var catalogLicenses = map[string]string{
+	"llama2":           "llama2",
+	"codellama":        "llama2",
+	"llama3":           "llama3",
+	"llama3.1":         "llama3.1",
+	"llama3.2":         "llama3.2",
+	"llama3.3":         "llama3.3",
+	"deepseek-r1":      "mit",
+	"mistral":          "apache-2.0",
+	"mixtral":          "apache-2.0",
+	"qwen3":            "apache-2.0",
+	"gemma":            "gemma",
+	"gemma2":           "gemma",
+	"gemma3":           "gemma",
+	"phi3":             "mit",
+	"phi4":             "mit",
+	"tinyllama":        "apache-2.0",
+	"nomic-embed-text": "apache-2.0",
+}
+
+// descriptionContext reads a context window from a description, in tokens, or 0.
+func descriptionContext(description string) int {
+	m := contextLengthPattern.FindStringSubmatch(description)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n * 1024
+}
+
+// parseRelativeDate turns the library's "3 weeks ago" into the date it refers to. It returns
+// "" for text it doesn't understand.
+func parseRelativeDate(text string, now time.Time) string {
+	if strings.Contains(strings.ToLower(text), "yesterday") {
+		return now.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	m := relativeTimePattern.FindStringSubmatch(text)
+	if m == nil {
+		return ""
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		n = 1 // "a week ago", "an hour ago"
+	}
+	switch strings.ToLower(m[2]) {
+	case "day":
+		now = now.AddDate(0, 0, -n)
+	case "week":
+		now = now.AddDate(0, 0, -7*n)
+	case "month":
+		now = now.AddDate(0, -n, 0)
+	case "year":
+		now = now.AddDate(-n, 0, 0)
+	}
+	return now.Format("2006-01-02")
+}
+
+// catalogTasks derives a model's tasks from its library capabilities and description.
+func catalogTasks(m CatalogModel) []string {
+	for _, c := range m.Capabilities {
+		if c == "embedding" {
+			return []string{"embedding"}
+		}
+	}
+	tasks := []string{"chat", "generate", "general"}
+	if strings.Contains(m.Name, "code") || strings.Contains(strings.ToLower(m.Description), " code") {
+		tasks = append(tasks, "code")
+	}
+	if longContextPattern.MatchString(m.Description) {
+		tasks = append(tasks, "long-context")
+	}
+	for _, c := range m.Capabilities {
+		switch c {
+		case "vision":
+			tasks = append(tasks, "vision")
+		case "tools":
+			tasks = append(tasks, "tools")
+		case "thinking":
+			tasks = append(tasks, "reasoning")
+		}
+	}
+	return tasks
+}
+
+// catalogScore rates a model by its size, with a point for being among the most popular.
+func catalogScore(billions float64, rank int) int {
+	score := 5
+	switch {
+	case billions >= 30:
+		score = 10
+	case billions >= 12:
+		score = 9
+	case billions >= 6:
+		score = 8
+	case billions >= 2.5:
+		score = 7
+	case billions >= 1.5:
+		score = 6
+	}
+	if rank < catalogPopular && score < 10 {
+		score++
+	}
+	return score
+}
+
+// catalogModel describes a catalog entry, or one of its sizes, as a recommendation.
+func catalogModel(m CatalogModel, rank int, tag OllamaModel) RecommendedModel {
+	billions := parseParameterSize(tag.Details.ParameterSize)
+	if billions == 0 {
+		billions = parseParameterSize(tag.Name)
+	}
+	model := placeholderMetadata
+	model.Name = tag.Name
+	model.Description = m.Description
+	model.Tasks = catalogTasks(m)
+	model.Updated = m.Updated
+	model.ContextLength = descriptionContext(m.Description)
+	model.License = catalogLicenses[m.Name]
+	model.Multilingual = multilingualPattern.MatchString(m.Description)
+	if billions > 0 {
+		model.Score = catalogScore(billions, rank)
+	}
+	return applyEstimates(model, tag)
+}
+
+// installedKey identifies a model by its name without the tag and its rounded size, so a
+// pulled "mistral" isn't recommended again as "mistral:7b".
+func installedKey(name string, billions float64) string {
+	return strings.SplitN(name, ":", 2)[0] + "|" + strconv.Itoa(int(math.Round(billions)))
+}
+
+// handleCatalog lists the models that can be pulled: GET /api/recommendations/catalog
+func handleCatalog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	catalog := modelCatalog.Get()
+	if len(catalog.Models) == 0 {
+		catalog = ModelCatalog{Models: builtinCatalog, Source: "builtin"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(catalog)
+}
+
+// --- Hugging Face Enrichment Logic (Omitted for brevity, assumed unchanged) ---
+
+// enrichModelFromHuggingFace attempts to fetch metadata for an unknown model from Hugging Face.
+// Returns an updated description, tasks list, license and languages, and whether Hugging Face
+// knew the model.
+func enrichModelFromHuggingFace(ollamaModelName string, placeholder RecommendedModel) (ModelMetadata, bool) {
+	// 1. Clean the model name for a better search (e.g., 'deepseek-r1:14b' -> 'deepseek-r1')
+	parts := strings.Split(ollamaModelName, ":")
+	searchQuery := parts[0]
+
+	// 2. Build the search URL. We search for the base model name and limit to 1 result.
+	searchURL := fmt.Sprintf("%s?search=%s&limit=1", huggingFaceModelsAPI, searchQuery)
+
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Get(searchURL)
+	if err != nil {
+		log.Printf("HF search failed for %s: %v", ollamaModelName, err)
+		return missingMetadata(ollamaModelName, placeholder), false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("HF search API returned non-200 status %d for %s", resp.StatusCode, ollamaModelName)
+		return missingMetadata(ollamaModelName, placeholder), false
+	}
+
+	var results []HuggingFaceModel
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		log.Printf("Failed to decode HF response for %s: %v", ollamaModelName, err)
+		return missingMetadata(ollamaModelName, placeholder), false
+	}
+
+	if len(results) == 0 {
+		log.Printf("HF search found no results for %s", searchQuery)
+		return missingMetadata(ollamaModelName, placeholder), false
+	}
+
+	hfModel := results[0]
+
+	// 3. Extract PipelineTag and Tags to form a better description and task list
+	newTasks := placeholder.Tasks
+
+	// Use the pipeline tag if available, as it's the most reliable task indicator
+	if hfModel.PipelineTag != "" {
+		newTasks = []string{strings.Replace(hfModel.PipelineTag, "-", " ", -1)} // "text-generation" -> "text generation"
+	} else if len(hfModel.Tags) > 0 {
+		// Fallback to tags if no pipeline tag, filtering for common relevant tags
+		newTasks = []string{}
+		for _, tag := range hfModel.Tags {
+			if strings.Contains(tag, "llama") || strings.Contains(tag, "mistral") || strings.Contains(tag, "code") || strings.Contains(tag, "chat") {
+				newTasks = append(newTasks, tag)
+			}
+		}
+		if len(newTasks) == 0 {
+			newTasks = placeholder.Tasks
+		}
+	}
+
+	// 4. Construct the enriched description
+
+	// Create a clean, comma-separated list of tasks for the description
+	taskString := strings.Join(newTasks, ", ")
+
+	hfDescription := fmt.Sprintf(
+		"Model '%s' is installed on Ollama. Found potential match on Hugging Face as '%s'. Primary tasks identified: %s. Hardware estimates remain at default (8 GB VRAM / 16 GB RAM).",
+		ollamaModelName, hfModel.ModelId, taskString)
+
+	log.Printf("   -> HF Enrichment successful for %s. Pipeline Tag: %s, Tasks: %v", ollamaModelName, hfModel.PipelineTag, newTasks)
+	meta := ModelMetadata{Name: ollamaModelName, Description: hfDescription, Tasks: newTasks}
+	languages := 0
+	for _, tag := range hfModel.Tags {
+		switch {
+		case strings.HasPrefix(tag, "license:"):
+			meta.License = strings.TrimPrefix(tag, "license:")
+		case tag == "multilingual":
+			meta.Multilingual = true
+		case languageTagPattern.MatchString(tag):
+			languages++
+		}
+	}
+	if languages > 1 {
+		meta.Multilingual = true
+	}
+	return meta, true
+}
+
+// languageTagPattern matches Hugging Face's language tags, e.g. "en" or "de".
+var languageTagPattern = regexp.MustCompile(`^[a-z]{2}$`)
+
+// missingMetadata is what a model Hugging Face couldn't tell us about is described as.
+func missingMetadata(name string, placeholder RecommendedModel) ModelMetadata {
+	return ModelMetadata{
+		Name:        name,
+		Description: fmt.Sprintf("Model '%s' is installed on Ollama, but specific metadata is missing. %s", name, placeholder.Description),
+		Tasks:       placeholder.Tasks,
+	}
+}
+
+// enrichedMetadata returns the cached Hugging Face metadata for a model, looking it up when
+// there is none or it has expired. Failed lookups aren't cached, so they are retried.
+func enrichedMetadata(name string, placeholder RecommendedModel) ModelMetadata {
+	if m, ok := modelMetadata.Get(name); ok {
+		return m
+	}
+	m, ok := enrichModelFromHuggingFace(name, placeholder)
+	if ok {
+		m.FetchedAt = time.Now().UTC()
+		modelMetadata.Put(m)
+	}
+	return m
+}
+
+// --- Ollama Fetch and Merge Logic ---
+
+// fetchAndMergeModels rebuilds ModelDatabase from the models installed on every backend,
+// described by the Ollama library catalog or Hugging Face. The catalog's models that aren't
+// installed are listed too, so they can be recommended and pulled. It returns the number of
+// models.
+func fetchAndMergeModels() int {
+	ModelDatabase.refreshMu.Lock()
+	defer ModelDatabase.refreshMu.Unlock()
+
+	client := newOllamaClient(5 * time.Second)
+	catalog := modelCatalog.Refresh(newOllamaClient(15 * time.Second))
+	models := make(map[string]RecommendedModel)
+	installed := make(map[string]bool)
+
+	for _, backend := range routes.Backends() {
+		tags, err := fetchInstalledModels(context.Background(), client, backend)
+		if err != nil {
+			log.Printf("⚠️ WARNING: Recommender could not list the models on %s: %v", backend, err)
+			continue
+		}
+
+		for _, ollamaModel := range tags {
+			modelName := strings.TrimSuffix(ollamaModel.Name, ":latest") // Cleanup tag if present
+			if _, ok := models[modelName]; ok {
+				continue // Installed on several backends
+			}
+			ollamaModel.Name = modelName
+
+			var model RecommendedModel
+			if entry, ok := catalog.Lookup(modelName); ok {
+				// Case 1: Model found in the catalog (e.g., 'llama3.2:3b')
+				model = catalogModel(entry, catalogRank(catalog, entry.Name), ollamaModel)
+			} else {
+				// Case 2: Model found on Ollama but not in the catalog (e.g., a custom import); its
+				// description and tasks come from Hugging Face
+				meta := enrichedMetadata(modelName, placeholderMetadata)
+				model = placeholderMetadata
+				model.Name = modelName
+				model.Description = meta.Description
+				model.Tasks = meta.Tasks
+				model.License = meta.License
+				model.Multilingual = meta.Multilingual
+				model = applyEstimates(model, ollamaModel)
+			}
+			model.Installed = true
+			if details, err := fetchModelDetails(context.Background(), client, modelName); err == nil {
+				if details.ContextLength > 0 {
+					model.ContextLength = details.ContextLength
+				}
+				model.KVCacheBytesPerToken = details.KVCacheBytesPerToken
+			}
+			models[modelName] = model
+
+			billions := parseParameterSize(ollamaModel.Details.ParameterSize)
+			if billions == 0 {
+				billions = parseParameterSize(modelName)
+			}
+			installed[installedKey(modelName, billions)] = true
+		}
+	}
+
+	for rank, entry := range catalog.Models {
+		if len(entry.Sizes) == 0 {
+			if _, ok := models[entry.Name]; !ok {
+				models[entry.Name] = catalogModel(entry, rank, OllamaModel{Name: entry.Name})
+			}
+			continue
+		}
+		for _, size := range entry.Sizes {
+			name := entry.Name + ":" + size
+			if _, ok := models[name]; ok || installed[installedKey(name, parseParameterSize(size))] {
+				continue
+			}
+			tag := OllamaModel{Name: name, Details: OllamaModelDetails{ParameterSize: strings.ToUpper(size), QuantizationLevel: "Q4_K_M"}}
+			models[name] = catalogModel(entry, rank, tag)
+		}
+	}
+
+	ModelDatabase.Replace(models)
+	return len(models)
+}
+
+// catalogRank is a model's position in the catalog, which lists the most popular first.
+func catalogRank(catalog ModelCatalog, name string) int {
+	for i, m := range catalog.Models {
+		if m.Name == name {
+			return i
+		}
+	}
+	return len(catalog.Models)
+}
+
+// refreshModelsPeriodically keeps ModelDatabase current as models are pulled and deleted.
+func refreshModelsPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		n := fetchAndMergeModels()
+		log.Printf("Recommender refreshed: %d models", n)
+	}
+}
+
+// handleRecommendationRefresh rebuilds the model database now: POST /api/recommendations/refresh
+// Only admins may, since a rebuild queries every backend and looks models up on Hugging Face.
+func handleRecommendationRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Only admins may refresh the model list on this server; send the admin token", http.StatusForbidden)
+		return
+	}
+	n := fetchAndMergeModels()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"models": n, "refreshed_at": ModelDatabase.RefreshedAt()})
+}
+
+// --- Quantization-Aware Estimates ---
+
+// bitsPerWeight is the average storage per parameter of common GGUF quantizations.
+var bitsPerWeight = map[string]float64{
+	"Q2_K":   3.35,
+	"Q3_K_S": 3.5,
+	"Q3_K_M": 3.9,
+	"Q3_K_L": 4.3,
+	"Q4_0":   4.55,
+	"Q4_1":   5.0,
+	"Q4_K_S": 4.6,
+	"Q4_K_M": 4.85,
+	"Q5_0":   5.5,
+	"Q5_1":   6.0,
+	"Q5_K_S": 5.55,
+	"Q5_K_M": 5.7,
+	"Q6_K":   6.6,
+	"Q8_0":   8.5,
+	"F16":    16,
+	"BF16":   16,
+	"F32":    32,
+}
+
+// The quantizations every estimate lists as alternatives; Ollama's default tags are Q4_K_M
+var commonQuantizations = []string{"Q4_K_M", "Q8_0", "F16"}
+
+// Memory on top of the weights: the KV cache for a default-sized context and compute buffers
+const (
+	vramOverheadFactor = 1.2
+	vramOverheadGB     = 0.5
+	ramHeadroomGB      = 2 // For the OS and Ollama itself when layers are offloaded to the CPU
+)
+
+// QuantEstimate is the hardware a model needs at one quantization.
+type QuantEstimate struct {
+	Quantization string  `json:"quantization"`
+	SizeGB       float64 `json:"size_gb"`
+	MinVRAM_GB   int     `json:"min_vram_gb"`
+	MinRAM_GB    int     `json:"min_ram_gb"`
+}
+
+var parameterSizePattern = regexp.MustCompile(`(?i)(\d+(?:\.\d+)?)\s*([bm])\b`)
+
+// parseParameterSize reads "7.2B", "137M" or a tag like "13b-chat" as billions of parameters.
+func parseParameterSize(s string) float64 {
+	m := parameterSizePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	if strings.EqualFold(m[2], "m") {
+		n /= 1000
+	}
+	return n
+}
+
+// estimateForSize turns the size of a model's weights into hardware requirements.
+func estimateForSize(quantization string, sizeBytes float64) QuantEstimate {
+	sizeGB := sizeBytes / (1 << 30)
+	vram := int(math.Ceil(sizeGB*vramOverheadFactor + vramOverheadGB))
+	return QuantEstimate{
+		Quantization: quantization,
+		SizeGB:       math.Round(sizeGB*10) / 10,
+		MinVRAM_GB:   vram,
+		MinRAM_GB:    vram + ramHeadroomGB,
+	}
+}
+
+// estimateForParameters estimates a quantization of a model that isn't installed.
+func estimateForParameters(quantization string, billions float64) (QuantEstimate, bool) {
+	bits, ok := bitsPerWeight[strings.ToUpper(quantization)]
+	if !ok || billions <= 0 {
+		return QuantEstimate{}, false
+	}
+	return estimateForSize(strings.ToUpper(quantization), billions*1e9*bits/8), true
+}
+
+// applyEstimates replaces a model's static hardware requirements with ones computed from the
+// installed tag's actual size, and lists what the common quantizations would need. Models
+// Ollama reports nothing useful for keep their static requirements.
+func applyEstimates(model RecommendedModel, tag OllamaModel) RecommendedModel {
+	billions := parseParameterSize(tag.Details.ParameterSize)
+	if billions == 0 {
+		billions = parseParameterSize(tag.Name)
+	}
+	quant := strings.ToUpper(tag.Details.QuantizationLevel)
+
+	switch {
+	case tag.Size > 0:
+		installed := estimateForSize(quant, float64(tag.Size))
+		model.HardwareReq = HardwareSpecs{MinVRAM_GB: installed.MinVRAM_GB, MinRAM_GB: installed.MinRAM_GB}
+		model.SizeGB = installed.SizeGB
+	case billions > 0:
+		if installed, ok := estimateForParameters(quant, billions); ok {
+			model.HardwareReq = HardwareSpecs{MinVRAM_GB: installed.MinVRAM_GB, MinRAM_GB: installed.MinRAM_GB}
+			model.SizeGB = installed.SizeGB
+		}
+	}
+	model.ParameterSize = tag.Details.ParameterSize
+	model.Quantization = quant
+
+	model.Variants = nil
+	for _, q := range commonQuantizations {
+		if estimate, ok := estimateForParameters(q, billions); ok {
+			model.Variants = append(model.Variants, estimate)
+		}
+	}
+	return model
+}
+
+// --- Utility: Extract Unique Tasks ---
+
+// getUniqueTasks compiles a sorted list of all unique tasks from the current model database.
+func getUniqueTasks() []string {
+	taskSet := make(map[string]bool)
+	// Iterate over the map values (RecommendedModel structs)
+	for _, model := range ModelDatabase.List() {
+		for _, task := range model.Tasks {
+			taskSet[task] = true
+		}
+	}
+
+	var tasks []string
+	for task := range taskSet {
+		tasks = append(tasks, task)
+	}
+
+	sort.Strings(tasks)
+	return tasks
+}
+
+// --- Hardware Detection ---
+
+// DetectedGPU is one graphics card found on this machine.
+type DetectedGPU struct {
+	Name    string `json:"name"`
+	Vendor  string `json:"vendor"` // "nvidia", "amd" or "apple"
+	VRAM_GB int    `json:"vram_gb"`
+}
+
+// DetectedHardware is the hardware profile recommendations default to.
+type DetectedHardware struct {
+	RAM_GB  int           `json:"ram_gb"`
+	VRAM_GB int           `json:"vram_gb"` // Total over all GPUs; Ollama splits models across them
+	GPUs    []DetectedGPU `json:"gpus"`
+	Profile string        `json:"profile"` // "gpu", "unified" or "cpu"; empty if nothing was detected
+}
+
+// detectedHardware is filled in once at startup.
+var detectedHardware DetectedHardware
+
+// How long a single detection tool may take before it is given up on
+const hardwareProbeTimeout = 5 * time.Second
+
+// detectHardware reads total RAM from the OS and asks nvidia-smi, rocm-smi or (on macOS)
+// system_profiler for GPU memory. Anything that can't be detected is left at zero.
+func detectHardware() DetectedHardware {
+	hw := DetectedHardware{RAM_GB: bytesToGB(detectRAMBytes()), GPUs: []DetectedGPU{}}
+
+	hw.GPUs = append(hw.GPUs, detectNvidiaGPUs()...)
+	hw.GPUs = append(hw.GPUs, detectAMDGPUs()...)
+	hw.GPUs = append(hw.GPUs, detectAppleGPUs(hw.RAM_GB)...)
+	for _, gpu := range hw.GPUs {
+		hw.VRAM_GB += gpu.VRAM_GB
+	}
+	switch {
+	case len(hw.GPUs) > 0 && hw.GPUs[0].Vendor == "apple":
+		hw.Profile = profileUnified
+	case len(hw.GPUs) > 0:
+		hw.Profile = profileGPU
+	case hw.RAM_GB > 0:
+		hw.Profile = profileCPU
+	}
+	return hw
+}
+
+func bytesToGB(n uint64) int {
+	return int((n + (1<<30)/2) >> 30) // Rounded, so 15.6 GiB of usable RAM counts as 16
+}
+
+// runProbe runs a detection tool, returning its output or "" if it isn't installed or fails.
+func runProbe(name string, args ...string) string {
+	if _, err := exec.LookPath(name); err != nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hardwareProbeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		log.Printf("Hardware probe %s failed: %v", name, err)
+		return ""
+	}
+	return string(out)
+}
+
+func detectRAMBytes() uint64 {
+	switch runtime.GOOS {
+	case "linux":
+		data, err := os.ReadFile("/proc/meminfo")
+		if err != nil {
+			return 0
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "MemTotal:" {
+				kb, _ := strconv.ParseUint(fields[1], 10, 64)
+				return kb * 1024
+			}
+		}
+	case "darwin":
+		n, _ := strconv.ParseUint(strings.TrimSpace(runProbe("sysctl", "-n", "hw.memsize")), 10, 64)
+		return n
+	case "windows":
+		out := runProbe("powershell", "-NoProfile", "-Command", "(Get-CimInstance Win32_ComputerSystem).TotalPhysicalMemory")
+		n, _ := strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+		return n
+	}
+	return 0
+}
+
+// detectNvidiaGPUs parses nvidia-smi's CSV output ("name, memory.total in MiB").
+func detectNvidiaGPUs() []DetectedGPU {
+	var gpus []DetectedGPU
+	out := runProbe("nvidia-smi", "--query-gpu=name,memory.total", "--format=csv,noheader,nounits")
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			continue
+		}
+		mib, err := strconv.ParseUint(strings.TrimSpace(fields[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		gpus = append(gpus, DetectedGPU{Name: strings.TrimSpace(fields[0]), Vendor: "nvidia", VRAM_GB: bytesToGB(mib << 20)})
+	}
+	return gpus
+}
+
+// detectAMDGPUs reads rocm-smi's JSON report, which is keyed by card ("card0", ...).
+func detectAMDGPUs() []DetectedGPU {
+	out := runProbe("rocm-smi", "--showmeminfo", "vram", "--showproductname", "--json")
+	if out == "" {
+		return nil
+	}
+	var cards map[string]map[string]string
+	if err := json.Unmarshal([]byte(out), &cards); err != nil {
+		log.Printf("Could not parse rocm-smi output: %v", err)
+		return nil
+	}
+
+	var names []string
+	for card := range cards {
+		names = append(names, card)
+	}
+	sort.Strings(names)
+
+	var gpus []DetectedGPU
+	for _, card := range names {
+		info := cards[card]
+		total, err := strconv.ParseUint(info["VRAM Total Memory (B)"], 10, 64)
+		if err != nil {
+			continue
+		}
+		name := info["Card series"]
+		if name == "" {
+			name = card
+		}
+		gpus = append(gpus, DetectedGPU{Name: name, Vendor: "amd", VRAM_GB: bytesToGB(total)})
+	}
+	return gpus
+}
+
+// detectAppleGPUs covers Apple Silicon, where the GPU shares system memory. Metal lets it use
+// about three quarters of that, which is what Ollama can load models into.
+func detectAppleGPUs(ramGB int) []DetectedGPU {
+	if runtime.GOOS != "darwin" || runtime.GOARCH != "arm64" {
+		return nil
+	}
+	name := strings.TrimSpace(runProbe("sysctl", "-n", "machdep.cpu.brand_string"))
+	if name == "" {
+		name = "Apple Silicon"
+	}
+	return []DetectedGPU{{Name: name + " (unified memory)", Vendor: "apple", VRAM_GB: ramGB * 3 / 4}}
+}
+
+// handleHardware serves GET /api/recommendations/hardware, the profile detected at startup.
+func handleHardware(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detectedHardware)
+}
+
+// --- Benchmarks ---
+
+// The standardized prompt every model is benchmarked with, and how many tokens it may write
+const benchmarkPrompt = "Explain how a CPU cache works, in about 150 words."
+const benchmarkNumPredict = 128
+
+// How often /api/ps is polled for memory use while a benchmark runs
+const benchmarkPollInterval = 250 * time.Millisecond
+
+// BenchmarkResult is what a model measured on this machine.
+type BenchmarkResult struct {
+	Model           string    `json:"model"`
+	TokensPerSecond float64   `json:"tokens_per_second"`
+	LoadSeconds     float64   `json:"load_seconds"`   // Cold load, since the model is unloaded first
+	PeakMemoryGB    float64   `json:"peak_memory_gb"` // Largest size /api/ps reported while it ran
+	PeakVRAMGB      float64   `json:"peak_vram_gb"`   // The part of that in GPU memory
+	RanAt           time.Time `json:"ran_at"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// The latest result per model, kept in the data directory
+const benchmarkFile = "benchmarks.json"
+
+var (
+	benchmarksMu sync.Mutex
+	benchmarks   = make(map[string]BenchmarkResult)
+)
+
+func loadBenchmarks() {
+	var saved []BenchmarkResult
+	if err := loadJSONFile(benchmarkFile, &saved); err != nil {
+		log.Printf("⚠️ WARNING: Could not load benchmarks: %v", err)
+	}
+	benchmarksMu.Lock()
+	defer benchmarksMu.Unlock()
+	benchmarks = make(map[string]BenchmarkResult)
+	for _, result := range saved {
+		benchmarks[result.Model] = result
+	}
+}
+
+// saveBenchmark records a result and rewrites the benchmark file.
+func saveBenchmark(result BenchmarkResult) {
+	benchmarksMu.Lock()
+	defer benchmarksMu.Unlock()
+	benchmarks[result.Model] = result
+	recommendationCache.Clear()
+	if err := saveJSONFile(benchmarkFile, benchmarkList()); err != nil {
+		log.Printf("Could not save benchmarks: %v", err)
+	}
+}
+
+// benchmarkList returns every result sorted by model. The caller holds benchmarksMu.
+func benchmarkList() []BenchmarkResult {
+	list := make([]BenchmarkResult, 0, len(benchmarks))
+	for _, r := range benchmarks {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Model < list[j].Model })
+	return list
+}
+
+// benchmarkFor returns the latest successful result for a model.
+func benchmarkFor(name string) (BenchmarkResult, bool) {
+	benchmarksMu.Lock()
+	defer benchmarksMu.Unlock()
+	result, ok := benchmarks[name]
+	if !ok {
+		result, ok = benchmarks[name+":latest"]
+	}
+	return result, ok && result.Error == ""
+}
+
+// throughputBonus adjusts a model's score by how fast it actually runs here: models too
+// slow to use comfortably drop, fast ones rise.
+func throughputBonus(result BenchmarkResult) int {
+	switch {
+	case result.TokensPerSecond >= 30:
+		return 2
+	case result.TokensPerSecond >= 15:
+		return 1
+	case result.TokensPerSecond >= 5:
+		return 0
+	}
+	return -2
+}
+
+// benchmarkModel unloads the model, then generates from the standard prompt on the backend
+// the model routes to while polling /api/ps for its memory use. It is unloaded again afterwards.
+// The run holds a generation queue slot, so it waits its turn like any other generation.
+func benchmarkModel(ctx context.Context, name string) BenchmarkResult {
+	result := BenchmarkResult{Model: name, RanAt: time.Now().UTC()}
+	backend := routes.Resolve(name)
+	release, err := generationQueue.Acquire(ctx, backend, func(int) {})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer release()
+	client := newOllamaClient(10 * time.Minute)
+	unload := json.RawMessage("0")
+
+	if err := ollamaStream(ctx, client, backend+ollamaGenerateAPI, OllamaUnloadPayload{Model: name}, func(OllamaResponseChunk) {}); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	peak := make(chan [2]int64, 1)
+	go func() {
+		var size, vram int64
+		ticker := time.NewTicker(benchmarkPollInterval)
+		defer ticker.Stop()
+		for {
+			running, _ := fetchRunningModels(pollCtx, client, backend)
+			for _, m := range running {
+				if m.Name == name || m.Name == name+":latest" {
+					if m.Size > size {
+						size = m.Size
+					}
+					if m.SizeVRAM > vram {
+						vram = m.SizeVRAM
+					}
+				}
+			}
+			select {
+			case <-pollCtx.Done():
+				peak <- [2]int64{size, vram}
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	final, err := ollamaGenerateOnce(ctx, client, backend, OllamaGenerateRequestPayload{
+		Model:     name,
+		Prompt:    benchmarkPrompt,
+		KeepAlive: unload,
+		Options:   map[string]interface{}{"num_predict": benchmarkNumPredict, "temperature": 0},
+	})
+	stopPolling()
+	memory := <-peak
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if final.EvalDuration > 0 {
+		result.TokensPerSecond = math.Round(float64(final.EvalCount)/(float64(final.EvalDuration)/1e9)*10) / 10
+	}
+	result.LoadSeconds = math.Round(float64(final.LoadDuration)/1e7) / 100
+	result.PeakMemoryGB = math.Round(float64(memory[0])/(1<<30)*10) / 10
+	result.PeakVRAMGB = math.Round(float64(memory[1])/(1<<30)*10) / 10
+	return result
+}
+
+// handleBenchmark lists the stored results (GET) or benchmarks models one at a time (POST).
+// A POST body of {"models": [...]} limits the run; by default every installed model is measured.
+// Only admins may run benchmarks, since each one unloads and reloads a model.
+func handleBenchmark(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		benchmarksMu.Lock()
+		list := benchmarkList()
+		benchmarksMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		if !isAdmin(r) {
+			http.Error(w, "Only admins may run benchmarks on this server; send the admin token", http.StatusForbidden)
+			return
+		}
+		var body struct {
+			Models []string `json:"models"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid benchmark request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, name := range body.Models {
+			if !modelNamePattern.MatchString(name) || len(name) > 200 {
+				http.Error(w, fmt.Sprintf("invalid model name %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+		models := body.Models
+		if len(models) == 0 {
+			for _, model := range ModelDatabase.List() {
+				if model.Installed {
+					models = append(models, model.Name)
+				}
+			}
+		}
+
+		results := make([]BenchmarkResult, 0, len(models))
+		for _, name := range models {
+			if r.Context().Err() != nil {
+				return
+			}
+			log.Printf("Benchmarking %s...", name)
+			result := benchmarkModel(r.Context(), name)
+			if result.Error != "" {
+				log.Printf("   -> %s failed: %s", name, result.Error)
+			} else {
+				log.Printf("   -> %s: %.1f tokens/s, loaded in %.2fs, %.1f GB", name, result.TokensPerSecond, result.LoadSeconds, result.PeakMemoryGB)
+			}
+			saveBenchmark(result)
+			results = append(results, result)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRecommendationPull installs a recommended model: POST /api/recommendations/pull?model=...
+// It is the pull action, so progress streams the same way and joins a pull already running.
+func handleRecommendationPull(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Only admins may pull models on this server; send the admin token", http.StatusForbidden)
+		return
+	}
+	clientReq := ClientRequest{ActionType: "pull", Model: r.URL.Query().Get("model")}
+	if err := validateClientRequest(clientReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	callModelPullAPI(w, r, clientReq, newOllamaClient(300*time.Second))
+}
+
+// startRecommender detects the hardware and loads saved state, then builds the model database
+// in the background, so Hugging Face lookups don't hold up the server's start.
+func startRecommender() {
+	detectedHardware = detectHardware()
+	log.Printf("Detected hardware: %d GB RAM, %d GB VRAM across %d GPU(s), %s profile", detectedHardware.RAM_GB, detectedHardware.VRAM_GB, len(detectedHardware.GPUs), detectedHardware.Profile)
+	modelMetadata = NewMetadataCache()
+	loadBenchmarks()
+
+	go func() {
+		log.Printf("⭐ Recommender model database: %d models", fetchAndMergeModels())
+		if config.RecommenderRefreshMinutes > 0 {
+			refreshModelsPeriodically(time.Duration(config.RecommenderRefreshMinutes) * time.Minute)
+		}
+	}()
+}
+
+// --- Hardware/Recommendation Logic ---
+
+// CurrentHardwareSpecs is the hardware a recommendation is for. Its profile decides how models
+// are fitted to it (see placeModel).
+type CurrentHardwareSpecs struct {
+	VRAM_GB int
+	RAM_GB  int
+	Profile string // profileGPU when empty
+	GPUs    []int  // VRAM of each GPU in GB, when known; a model is split across them
+}
+
+// Hardware profiles
+const (
+	profileGPU     = "gpu"     // Dedicated GPUs with their own VRAM
+	profileUnified = "unified" // Apple Silicon: the GPU uses part of system RAM
+	profileCPU     = "cpu"     // No usable GPU
+)
+
+const (
+	// Layers that don't fit in VRAM run on the CPU. Below this share on the GPU, that is too
+	// slow to recommend.
+	minGPUShare = 0.5
+	// Every GPU past the first keeps its own compute buffers
+	perGPUOverheadGB = 1
+	// Effective memory bandwidth of a desktop CPU, for the layers it runs
+	assumedCPUBandwidthGBs = 50
+)
+
+// Placement is how a model would be loaded on some hardware.
+type Placement struct {
+	GPUShare float64 // Share of the layers on the GPU(s): 1 entirely, 0 on the CPU only
+	SpareGB  int     // Memory left once it is loaded: VRAM, or RAM on the CPU profile
+	TotalGB  int     // The memory SpareGB is out of
+	GPUCount int     // GPUs the model is split across
+}
+
+// placeModel fits a model to the hardware's profile:
+//   - gpu: the model goes into VRAM, split across the GPUs, each of which but the first needs
+//     its own buffers. A model too big for VRAM still fits if at least half its layers do and
+//     RAM holds the whole model; the rest of its layers run on the CPU.
+//   - unified: GPU and CPU share RAM, so only the share the GPU may use counts.
+//   - cpu: the model runs from RAM.
+//
+// It returns false if the model doesn't fit.
+func placeModel(model RecommendedModel, hw CurrentHardwareSpecs) (Placement, bool) {
+	req := model.HardwareReq
+	switch hw.Profile {
+	case profileCPU:
+		return Placement{SpareGB: hw.RAM_GB - req.MinRAM_GB, TotalGB: hw.RAM_GB}, req.MinRAM_GB <= hw.RAM_GB
+	case profileUnified:
+		return Placement{GPUShare: 1, SpareGB: hw.VRAM_GB - req.MinVRAM_GB, TotalGB: hw.VRAM_GB, GPUCount: 1}, req.MinVRAM_GB <= hw.VRAM_GB
+	}
+
+	if hw.RAM_GB < req.MinRAM_GB || hw.VRAM_GB <= 0 {
+		return Placement{}, false
+	}
+	usable, gpus := hw.VRAM_GB, 1
+	if len(hw.GPUs) > 1 && req.MinVRAM_GB > largestGPU(hw.GPUs) {
+		gpus = len(hw.GPUs)
+		usable -= (gpus - 1) * perGPUOverheadGB
+	}
+	if req.MinVRAM_GB <= usable {
+		return Placement{GPUShare: 1, SpareGB: usable - req.MinVRAM_GB, TotalGB: hw.VRAM_GB, GPUCount: gpus}, true
+	}
+	share := float64(usable) / float64(req.MinVRAM_GB)
+	return Placement{GPUShare: share, TotalGB: hw.VRAM_GB, GPUCount: gpus}, share >= minGPUShare
+}
+
+func largestGPU(gpus []int) int {
+	largest := 0
+	for _, gb := range gpus {
+		if gb > largest {
+			largest = gb
+		}
+	}
+	return largest
+}
+
+// recommendModels returns the models that fit the hardware and do the task, best fit first.
+func recommendModels(currentHardware CurrentHardwareSpecs, task string, filter RecommendationFilter) []RecommendedModel {
+	results := []RecommendedModel{}
+	task = strings.ToLower(task)
+	now := time.Now()
+
+	for _, model := range ModelDatabase.List() {
+		model, ok := filter.Apply(model)
+		if !ok {
+			continue
+		}
+		if _, fits := placeModel(model, currentHardware); !fits {
+			continue
+		}
+		if result, ok := benchmarkFor(model.Name); ok {
+			model.Benchmark = &result
+		}
+		fit, ok := scoreFit(model, currentHardware, task, now)
+		if !ok {
+			continue
+		}
+		model.Fit, model.Explanation = fit.Score(), fit.Explain()
+		results = append(results, model)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Fit != results[j].Fit {
+			return results[i].Fit > results[j].Fit
+		}
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// RecommendationFilter holds the constraints a recommendation request adds to the hardware
+// and task. Models that aren't known to meet a constraint are left out.
+type RecommendationFilter struct {
+	MaxDownloadGB float64  // Installed models download nothing and always pass
+	Quantization  string   // Models that aren't installed are offered at this quantization
+	Licenses      []string // Any of these
+	MinContext    int      // Tokens
+	Multilingual  bool
+
+	// RequiredContext is the context the model must handle, in tokens. Besides the context
+	// window, the memory its KV cache takes is added to the hardware requirements where known.
+	RequiredContext int
+}
+
+// parseRecommendationFilter reads ?max_download_gb=&quantization=&license=&min_context=&multilingual=
+// and ?required_context=.
+func parseRecommendationFilter(query url.Values) (RecommendationFilter, error) {
+	var f RecommendationFilter
+	if v := query.Get("max_download_gb"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 {
+			return f, fmt.Errorf("max_download_gb must be a positive number")
+		}
+		f.MaxDownloadGB = n
+	}
+	if v := query.Get("quantization"); v != "" {
+		f.Quantization = strings.ToUpper(v)
+		if _, ok := bitsPerWeight[f.Quantization]; !ok {
+			return f, fmt.Errorf("unknown quantization %q", v)
+		}
+	}
+	for _, license := range strings.Split(query.Get("license"), ",") {
+		if license = strings.ToLower(strings.TrimSpace(license)); license != "" {
+			f.Licenses = append(f.Licenses, license)
+		}
+	}
+	if v := query.Get("min_context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return f, fmt.Errorf("min_context must be a positive number of tokens")
+		}
+		f.MinContext = n
+	}
+	if v := query.Get("required_context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return f, fmt.Errorf("required_context must be a positive number of tokens")
+		}
+		f.RequiredContext = n
+	}
+	if v := query.Get("multilingual"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("multilingual must be true or false")
+		}
+		f.Multilingual = b
+	}
+	return f, nil
+}
+
+// Apply returns the model as it meets the constraints, switched to the requested quantization
+// if it isn't installed, or false if it doesn't meet them.
+func (f RecommendationFilter) Apply(model RecommendedModel) (RecommendedModel, bool) {
+	if f.Quantization != "" && model.Quantization != f.Quantization {
+		if model.Installed {
+			return model, false
+		}
+		billions := parseParameterSize(model.ParameterSize)
+		if billions == 0 {
+			billions = parseParameterSize(model.Name)
+		}
+		estimate, ok := estimateForParameters(f.Quantization, billions)
+		if !ok {
+			return model, false
+		}
+		model.Quantization = estimate.Quantization
+		model.SizeGB = estimate.SizeGB
+		model.HardwareReq = HardwareSpecs{MinVRAM_GB: estimate.MinVRAM_GB, MinRAM_GB: estimate.MinRAM_GB}
+	}
+	if f.MaxDownloadGB > 0 && !model.Installed && (model.SizeGB == 0 || model.SizeGB > f.MaxDownloadGB) {
+		return model, false
+	}
+	if len(f.Licenses) > 0 {
+		licensed := false
+		for _, license := range f.Licenses {
+			licensed = licensed || license == strings.ToLower(model.License)
+		}
+		if !licensed {
+			return model, false
+		}
+	}
+	if f.MinContext > 0 && model.ContextLength < f.MinContext {
+		return model, false
+	}
+	if f.Multilingual && !model.Multilingual {
+		return model, false
+	}
+	if f.RequiredContext > 0 {
+		if model.ContextLength < f.RequiredContext {
+			return model, false
+		}
+		if model.KVCacheBytesPerToken > 0 {
+			extra := int(math.Ceil(float64(model.KVCacheBytesPerToken) * float64(f.RequiredContext) / (1 << 30)))
+			model.HardwareReq.MinVRAM_GB += extra
+			model.HardwareReq.MinRAM_GB += extra
+		}
+	}
+	return model, true
+}
+
+// --- Fit Scoring ---
+
+// How much each part of the fit counts, out of 100
+const (
+	fitQualityWeight  = 30
+	fitTaskWeight     = 25
+	fitHeadroomWeight = 20
+	fitSpeedWeight    = 15
+	fitRecencyWeight  = 10
+)
+
+const (
+	// A model leaving this share of VRAM free gets full marks for headroom
+	comfortableHeadroom = 0.3
+	// Generation speed that gets full marks; reading speed is about 10 tokens/s
+	comfortableTokensPerSecond = 30
+	// Effective memory bandwidth of a mid-range GPU, for estimating the speed of unbenchmarked
+	// models: generating a token reads all the weights once
+	assumedBandwidthGBs = 200
+)
+
+// genericTasks are what most models do; the other tasks mark a specialist.
+var genericTasks = map[string]bool{"chat": true, "generate": true, "general": true, "tools": true, "summarization": true, "experiment": true, "advanced": true}
+
+// Fit is a model's rating for one request: each part from 0 to 1, with a note on what it is based on.
+type Fit struct {
+	Quality, Task, Headroom, Speed, Recency float64
+	notes                                   []string
+}
+
+// Score weighs the parts into a rating out of 100.
+func (f Fit) Score() int {
+	return int(math.Round(f.Quality*fitQualityWeight + f.Task*fitTaskWeight + f.Headroom*fitHeadroomWeight +
+		f.Speed*fitSpeedWeight + f.Recency*fitRecencyWeight))
+}
+
+func (f Fit) Explain() string {
+	return strings.Join(f.notes, ", ")
+}
+
+func (f *Fit) note(format string, args ...interface{}) {
+	f.notes = append(f.notes, fmt.Sprintf(format, args...))
+}
+
+// scoreFit rates how well a model suits the hardware and task. It returns false if the model
+// doesn't do the task at all.
+func scoreFit(model RecommendedModel, hw CurrentHardwareSpecs, task string, now time.Time) (Fit, bool) {
+	var f Fit
+
+	f.Quality = math.Max(0, math.Min(float64(model.Score)/10, 1))
+	f.note("quality %d/10", model.Score)
+
+	if !f.scoreTask(model, task) {
+		return f, false
+	}
+	p, _ := placeModel(model, hw)
+	f.scoreHeadroom(p, hw)
+	f.scoreSpeed(model, p)
+	f.scoreRecency(model, now)
+	return f, true
+}
+
+// scoreTask rates how well the model's tasks match the requested one. A specialist in the task
+// rates highest; every other specialty lowers the rating a little, and a partial match ("chat"
+// for "chatbot") rates half. Without a task, every model matches fully.
+func (f *Fit) scoreTask(model RecommendedModel, task string) bool {
+	if task == "" {
+		f.Task = 1
+		return true
+	}
+	var others []string
+	exact := false
+	for _, t := range model.Tasks {
+		switch {
+		case t == task:
+			exact = true
+		case !genericTasks[t]:
+			others = append(others, t)
+		}
+	}
+	if exact {
+		f.Task = math.Max(1-0.1*float64(len(others)), 0.6)
+		if len(others) == 0 {
+			f.note("made for %s", task)
+		} else {
+			f.note("does %s, but specializes in %s", task, strings.Join(others, "/"))
+		}
+		return true
+	}
+	for _, t := range model.Tasks {
+		if strings.Contains(t, task) {
+			f.Task = 0.5
+			f.note("partly matches %s (%s)", task, t)
+			return true
+		}
+	}
+	return false
+}
+
+// scoreHeadroom rates the memory left free once the model is loaded, room for longer contexts
+// and other models: VRAM, or RAM on the CPU profile.
+func (f *Fit) scoreHeadroom(p Placement, hw CurrentHardwareSpecs) {
+	if p.TotalGB <= 0 {
+		return
+	}
+	memory := "VRAM"
+	if hw.Profile == profileCPU {
+		memory = "RAM"
+	}
+	f.Headroom = math.Max(0, math.Min(float64(p.SpareGB)/float64(p.TotalGB)/comfortableHeadroom, 1))
+	switch {
+	case p.GPUShare > 0 && p.GPUShare < 1:
+		f.note("%.0f%% of layers on the GPU, the rest on the CPU", p.GPUShare*100)
+	case p.SpareGB == 0:
+		f.note("just fits in %s", memory)
+	default:
+		f.note("%d GB %s to spare", p.SpareGB, memory)
+	}
+	if p.GPUCount > 1 {
+		f.note("split across %d GPUs", p.GPUCount)
+	}
+}
+
+// scoreSpeed rates the measured generation speed, or else one estimated from the model's size
+// and where its layers run.
+func (f *Fit) scoreSpeed(model RecommendedModel, p Placement) {
+	if model.Benchmark != nil {
+		f.Speed = math.Min(model.Benchmark.TokensPerSecond/comfortableTokensPerSecond, 1)
+		f.note("%.0f tokens/s measured", model.Benchmark.TokensPerSecond)
+		return
+	}
+	weightsGB := (float64(model.HardwareReq.MinVRAM_GB) - vramOverheadGB) / vramOverheadFactor
+	if weightsGB <= 0 {
+		f.Speed = 0.5
+		return
+	}
+	// Generating a token reads the GPU's layers and the CPU's layers in turn
+	seconds := weightsGB*p.GPUShare/assumedBandwidthGBs + weightsGB*(1-p.GPUShare)/assumedCPUBandwidthGBs
+	tokensPerSecond := 1 / seconds
+	f.Speed = math.Min(tokensPerSecond/comfortableTokensPerSecond, 1)
+	f.note("~%.0f tokens/s estimated", tokensPerSecond)
+}
+
+// scoreRecency rates how recently the model was updated: full marks within six months, none
+// after three years. Models of unknown age rate in the middle.
+func (f *Fit) scoreRecency(model RecommendedModel, now time.Time) {
+	updated, err := time.Parse("2006-01-02", model.Updated)
+	if err != nil {
+		f.Recency = 0.5
+		return
+	}
+	months := now.Sub(updated).Hours() / 24 / 30
+	f.Recency = math.Max(0, math.Min(1, 1-(months-6)/30))
+	f.note("updated %s", model.Updated)
+}
+
+// --- Recommendation Cache ---
+
+// At most this many recommendation sets are cached; the oldest go first
+const maxCachedRecommendations = 256
+
+// RecommendationCache keeps computed recommendation sets by hardware, task and filters, so
+// repeated and paged requests don't rescore every model. Refreshing the model database or
+// saving a benchmark clears it.
+type RecommendationCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedRecommendations
+	order   []string // Oldest first
+}
+
+type cachedRecommendations struct {
+	models  []RecommendedModel
+	expires time.Time
+}
+
+var recommendationCache = NewRecommendationCache()
+
+func NewRecommendationCache() *RecommendationCache {
+	return &RecommendationCache{entries: make(map[string]cachedRecommendations)}
+}
+
+func recommendationKey(hw CurrentHardwareSpecs, task string, filter RecommendationFilter) string {
+	return fmt.Sprintf("%+v|%s|%+v", hw, strings.ToLower(task), filter)
+}
+
+func (rc *RecommendationCache) Get(key string) ([]RecommendedModel, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	entry, ok := rc.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.models, true
+}
+
+func (rc *RecommendationCache) Put(key string, models []RecommendedModel, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, exists := rc.entries[key]; !exists {
+		rc.order = append(rc.order, key)
+	}
+	rc.entries[key] = cachedRecommendations{models: models, expires: time.Now().Add(ttl)}
+	for len(rc.order) > maxCachedRecommendations {
+		delete(rc.entries, rc.order[0])
+		rc.order = rc.order[1:]
+	}
+}
+
+func (rc *RecommendationCache) Clear() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries = make(map[string]cachedRecommendations)
+	rc.order = nil
+}
+
+// cachedRecommendModels is recommendModels through the cache. It reports whether the result
+// came from the cache. The result is shared, so callers must not change it.
+func cachedRecommendModels(hw CurrentHardwareSpecs, task string, filter RecommendationFilter) ([]RecommendedModel, bool) {
+	key := recommendationKey(hw, task, filter)
+	if models, ok := recommendationCache.Get(key); ok {
+		return models, true
+	}
+	models := recommendModels(hw, task, filter)
+	recommendationCache.Put(key, models, time.Duration(config.RecommendationCacheSeconds)*time.Second)
+	return models, false
+}
+
+// recommendationSorts order recommendations for ?sort=. Ties keep the order by fit.
+var recommendationSorts = map[string]func(a, b RecommendedModel) bool{
+	"fit":     func(a, b RecommendedModel) bool { return a.Fit > b.Fit },
+	"score":   func(a, b RecommendedModel) bool { return a.Score > b.Score },
+	"name":    func(a, b RecommendedModel) bool { return a.Name < b.Name },
+	"size":    func(a, b RecommendedModel) bool { return a.SizeGB < b.SizeGB },
+	"vram":    func(a, b RecommendedModel) bool { return a.HardwareReq.MinVRAM_GB < b.HardwareReq.MinVRAM_GB },
+	"updated": func(a, b RecommendedModel) bool { return a.Updated > b.Updated },
+}
+
+// --- API Handler ---
+
+// handleRecommendations serves GET /api/recommendations?task=&vram=&ram=, plus the constraints
+// RecommendationFilter reads and the paging RecommendationPage reads, along with every task
+// models can be filtered by.
+func handleRecommendations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	responsePayload, cached, err := recommendationResponse(r.Context(), r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cached {
+		w.Header().Set("X-Cache", "hit")
+	} else {
+		w.Header().Set("X-Cache", "miss")
+	}
+
+	if err := json.NewEncoder(w).Encode(responsePayload); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// recommendationResponse answers a recommendation query (task, hardware overrides, filters and
+// paging, as in GET /api/recommendations) and says whether it came from the cache.
+func recommendationResponse(ctx context.Context, query url.Values) (map[string]interface{}, bool, error) {
+	task := query.Get("task")
+
+	currentHardware, vramSource, ramSource, err := requestedHardware(query)
+	if err != nil {
+		return nil, false, err
+	}
+
+	filter, err := parseRecommendationFilter(query)
+	if err != nil {
+		return nil, false, err
+	}
+
+	page, err := parseRecommendationPage(query)
+	if err != nil {
+		return nil, false, err
+	}
+
+	all, cached := cachedRecommendModels(currentHardware, task, filter)
+	recommendations := all
+	if page.Sort != "fit" {
+		recommendations = append([]RecommendedModel(nil), all...)
+		less := recommendationSorts[page.Sort]
+		sort.SliceStable(recommendations, func(i, j int) bool { return less(recommendations[i], recommendations[j]) })
+	}
+	if page.Offset > len(recommendations) {
+		page.Offset = len(recommendations)
+	}
+	recommendations = recommendations[page.Offset:]
+	if page.Limit > 0 && page.Limit < len(recommendations) {
+		recommendations = recommendations[:page.Limit]
+	}
+	recommendations = markInstalled(ctx, recommendations)
+
+	return map[string]interface{}{
+		"current_hardware": map[string]interface{}{
+			"vram":    fmt.Sprintf("%d GB (%s)", currentHardware.VRAM_GB, vramSource),
+			"ram":     fmt.Sprintf("%d GB (%s)", currentHardware.RAM_GB, ramSource),
+			"profile": currentHardware.Profile,
+			"gpus":    currentHardware.GPUs,
+		},
+		"recommendations": recommendations,
+		"total":           len(all),
+		"offset":          page.Offset,
+		"limit":           page.Limit,
+		"sort":            page.Sort,
+		"tasks":           getUniqueTasks(),
+		"refreshed_at":    ModelDatabase.RefreshedAt(),
+	}, cached, nil
+}
+
+// installedNow lists the models the backends have right now, by name and by installedKey. It
+// returns false if no backend answered.
+func installedNow(ctx context.Context) (map[string]bool, bool) {
+	client := newOllamaClient(2 * time.Second)
+	installed := make(map[string]bool)
+	answered := false
+	for _, backend := range routes.Backends() {
+		tags, err := fetchInstalledModels(ctx, client, backend)
+		if err != nil {
+			continue
+		}
+		answered = true
+		for _, tag := range tags {
+			name := strings.TrimSuffix(tag.Name, ":latest")
+			billions := parseParameterSize(tag.Details.ParameterSize)
+			if billions == 0 {
+				billions = parseParameterSize(name)
+			}
+			installed[name] = true
+			installed[installedKey(name, billions)] = true
+		}
+	}
+	return installed, answered
+}
+
+// markInstalled copies the recommendations with Installed as the backends have it now, since
+// models may have been pulled or deleted since the model database was built. Models that
+// aren't installed get their download size and pull command. If no backend answers, the
+// database's view stands.
+func markInstalled(ctx context.Context, models []RecommendedModel) []RecommendedModel {
+	installed, answered := installedNow(ctx)
+	marked := make([]RecommendedModel, len(models))
+	for i, m := range models {
+		if answered {
+			billions := parseParameterSize(m.ParameterSize)
+			if billions == 0 {
+				billions = parseParameterSize(m.Name)
+			}
+			m.Installed = installed[m.Name] || installed[installedKey(m.Name, billions)]
+		}
+		m.DownloadGB, m.PullCommand = 0, ""
+		if !m.Installed {
+			m.DownloadGB = m.SizeGB
+			m.PullCommand = "ollama pull " + m.Name
+		}
+		marked[i] = m
+	}
+	return marked
+}
+
+// RecommendationPage selects which recommendations a response lists.
+type RecommendationPage struct {
+	Sort   string // A key of recommendationSorts
+	Offset int
+	Limit  int // 0: all of them
+}
+
+// parseRecommendationPage reads ?sort=, ?offset= and ?limit=. ?top=N is the same as ?limit=N.
+func parseRecommendationPage(query url.Values) (RecommendationPage, error) {
+	page := RecommendationPage{Sort: "fit"}
+	if v := query.Get("sort"); v != "" {
+		if _, ok := recommendationSorts[v]; !ok {
+			return page, fmt.Errorf("sort must be fit, score, name, size, vram or updated")
+		}
+		page.Sort = v
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return page, fmt.Errorf("offset must be zero or more")
+		}
+		page.Offset = n
+	}
+	for _, name := range []string{"top", "limit"} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return page, fmt.Errorf("%s must be a positive number", name)
+			}
+			page.Limit = n
+		}
+	}
+	return page, nil
+}
+
+// requestedHardware is the detected hardware with the request's overrides: ?vram= and ?ram= in
+// GB, ?gpus= as each GPU's VRAM ("24,24"), and ?profile= (gpu, unified or cpu). Overriding
+// the VRAM means dedicated GPUs unless a profile says otherwise.
+func requestedHardware(query url.Values) (hw CurrentHardwareSpecs, vramSource, ramSource string, err error) {
+	vram, vramSource := hardwareValue(query.Get("vram"), detectedHardware.VRAM_GB, 8)
+	ram, ramSource := hardwareValue(query.Get("ram"), detectedHardware.RAM_GB, 16)
+	hw = CurrentHardwareSpecs{VRAM_GB: vram, RAM_GB: ram, Profile: detectedHardware.Profile}
+
+	if vramSource == "Detected" {
+		for _, gpu := range detectedHardware.GPUs {
+			hw.GPUs = append(hw.GPUs, gpu.VRAM_GB)
+		}
+	} else {
+		hw.Profile = profileGPU
+	}
+	if v := query.Get("gpus"); v != "" {
+		hw.GPUs, hw.VRAM_GB, vramSource = nil, 0, "Manual Input"
+		for _, field := range strings.Split(v, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || n < 1 {
+				return hw, "", "", fmt.Errorf("gpus must list each GPU's VRAM in GB, like 24,24")
+			}
+			hw.GPUs = append(hw.GPUs, n)
+			hw.VRAM_GB += n
+		}
+		hw.Profile = profileGPU
+	}
+	switch p := query.Get("profile"); p {
+	case "":
+	case profileGPU, profileUnified, profileCPU:
+		hw.Profile = p
+	default:
+		return hw, "", "", fmt.Errorf("profile must be gpu, unified or cpu")
+	}
+
+	switch hw.Profile {
+	case "":
+		hw.Profile = profileGPU
+	case profileCPU:
+		hw.VRAM_GB, hw.GPUs, vramSource = 0, nil, "CPU only"
+	case profileUnified:
+		hw.GPUs = nil
+		if vramSource != "Manual Input" {
+			// Metal lets the GPU use about three quarters of the memory
+			hw.VRAM_GB, vramSource = ram*3/4, "unified memory"
+		}
+	}
+	return hw, vramSource, ramSource, nil
+}
+
+// hardwareValue picks a hardware amount in GB: the query override, else the detected amount,
+// else a fallback. It also says which one it used.
+func hardwareValue(override string, detected, fallback int) (int, string) {
+	if n, err := strconv.Atoi(override); err == nil && n >= 0 {
+		return n, "Manual Input"
+	}
+	if detected > 0 {
+		return detected, "Detected"
+	}
+	return fallback, "Default"
+}
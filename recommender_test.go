@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecommendationsMergeInstalledAndKnownModels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"models":[{"name":"mistral:latest","size":4109865159,
+			"details":{"family":"llama","parameter_size":"7.2B","quantization_level":"Q4_K_M"}}]}`)
+	}))
+	defer upstream.Close()
+	setupTestServer(t, upstream.URL)
+	fetchAndMergeModels()
+
+	mistral, _ := ModelDatabase.Get("mistral")
+	if !mistral.Installed || mistral.Quantization != "Q4_K_M" || mistral.HardwareReq.MinVRAM_GB != 6 || len(mistral.Variants) != 3 {
+		t.Errorf("installed model = %+v", mistral)
+	}
+	if gemma, ok := ModelDatabase.Get("gemma:2b"); !ok || gemma.Installed {
+		t.Errorf("well-known model missing or marked installed: %+v", gemma)
+	}
+
+	saveBenchmark(BenchmarkResult{Model: "gemma:2b", TokensPerSecond: 40})
+	rec := httptest.NewRecorder()
+	handleRecommendations(rec, httptest.NewRequest(http.MethodGet, "/api/recommendations?vram=8&ram=16&task=chat", nil))
+	var resp struct {
+		Recommendations []RecommendedModel `json:"recommendations"`
+		Tasks           []string           `json:"tasks"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Recommendations) < 2 || len(resp.Tasks) == 0 {
+		t.Fatalf("recommendations = %+v", resp)
+	}
+	for i, m := range resp.Recommendations {
+		if m.Name == "" {
+			t.Errorf("placeholder metadata recommended as a model")
+		}
+		if m.Name == "gemma:2b" && (m.Benchmark == nil || !strings.Contains(m.Explanation, "40 tokens/s measured")) {
+			t.Errorf("benchmarked model = %+v", m)
+		}
+		if m.Fit == 0 || m.Explanation == "" {
+			t.Errorf("%s has no fit score or explanation", m.Name)
+		}
+		if i > 0 && m.Fit > resp.Recommendations[i-1].Fit {
+			t.Errorf("recommendations not sorted by fit: %+v", resp.Recommendations)
+		}
+	}
+}
+
+func TestRecommendationPullUsesPullHandler(t *testing.T) {
+	var pulled map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&pulled)
+		fmt.Fprintln(w, `{"status":"success"}`)
+	}))
+	defer upstream.Close()
+	setupTestServer(t, upstream.URL)
+
+	pull := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:8080"+target, nil)
+		req.RemoteAddr = "127.0.0.1:50000"
+		rec := httptest.NewRecorder()
+		handleRecommendationPull(rec, req)
+		return rec
+	}
+	rec := pull("/api/recommendations/pull?model=gemma:2b")
+	if pulled["name"] != "gemma:2b" || !strings.Contains(rec.Body.String(), `"status":"success"`) {
+		t.Errorf("pulled %v, stream %q", pulled, rec.Body.String())
+	}
+
+	rec = pull("/api/recommendations/pull?model=bad%20name")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid model name: status %d", rec.Code)
+	}
+}
+
+func TestBenchmarksNeedAdminAndAQueueSlot(t *testing.T) {
+	var generations int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case ollamaGenerateAPI:
+			atomic.AddInt32(&generations, 1)
+			fmt.Fprintln(w, `{"done":true,"eval_count":100,"eval_duration":2000000000}`)
+		default:
+			fmt.Fprint(w, `{"models":[]}`)
+		}
+	}))
+	defer upstream.Close()
+	setupTestServer(t, upstream.URL)
+	generationQueue = NewGenerationQueue(1, 0)
+
+	benchmark := func(remoteAddr string) (int, []BenchmarkResult) {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/api/recommendations/benchmark", strings.NewReader(`{"models":["mistral"]}`))
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handleBenchmark(rec, req)
+		var results []BenchmarkResult
+		json.NewDecoder(rec.Body).Decode(&results)
+		return rec.Code, results
+	}
+
+	if code, _ := benchmark("192.0.2.1:1234"); code != http.StatusForbidden || atomic.LoadInt32(&generations) != 0 {
+		t.Errorf("benchmark from another machine: status %d, %d generations", code, generations)
+	}
+
+	release, err := generationQueue.Acquire(context.Background(), upstream.URL, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, results := benchmark("127.0.0.1:50000"); len(results) != 1 || !strings.Contains(results[0].Error, "queue is full") || atomic.LoadInt32(&generations) != 0 {
+		t.Errorf("benchmark with the queue full: %+v, %d generations", results, generations)
+	}
+	release()
+
+	if _, results := benchmark("127.0.0.1:50000"); len(results) != 1 || results[0].TokensPerSecond != 50 {
+		t.Errorf("benchmark: %+v", results)
+	}
+}
+
+func TestRecommenderMetadataPersistsUntilExpired(t *testing.T) {
+	setupTestServer(t, "http://127.0.0.1:0")
+	config.DataDir = t.TempDir()
+	config.RecommenderMetadataTTLHours = 24
+
+	modelMetadata = NewMetadataCache()
+	modelMetadata.Put(ModelMetadata{Name: "phi3:mini", Description: "Small model", Tasks: []string{"chat"}, FetchedAt: time.Now()})
+	modelMetadata.Put(ModelMetadata{Name: "old:1b", Description: "Stale", FetchedAt: time.Now().Add(-25 * time.Hour)})
+
+	reloaded := NewMetadataCache()
+	if m, ok := reloaded.Get("phi3:mini"); !ok || m.Description != "Small model" {
+		t.Errorf("phi3:mini after restart = %+v, %v", m, ok)
+	}
+	if _, ok := reloaded.Get("old:1b"); ok {
+		t.Error("expired metadata was used")
+	}
+}
+
+func TestRecommendationRefreshRebuildsDatabase(t *testing.T) {
+	installed := `{"models":[]}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, installed)
+	}))
+	defer upstream.Close()
+	setupTestServer(t, upstream.URL)
+	fetchAndMergeModels()
+	if m, _ := ModelDatabase.Get("mistral"); m.Installed {
+		t.Fatal("mistral installed before the pull")
+	}
+
+	installed = `{"models":[{"name":"mistral:latest"}]}`
+	refresh := func(method, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:8080/api/recommendations/refresh", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handleRecommendationRefresh(rec, req)
+		return rec
+	}
+	rec := refresh(http.MethodPost, "192.0.2.1:1234")
+	if m, _ := ModelDatabase.Get("mistral"); m.Installed || rec.Code != http.StatusForbidden {
+		t.Errorf("refresh from another machine: status %d, mistral = %+v", rec.Code, m)
+	}
+	rec = refresh(http.MethodPost, "127.0.0.1:50000")
+	if m, _ := ModelDatabase.Get("mistral"); !m.Installed || rec.Code != http.StatusOK {
+		t.Errorf("after refresh: status %d, mistral = %+v", rec.Code, m)
+	}
+	if ModelDatabase.RefreshedAt().IsZero() {
+		t.Error("refresh time not recorded")
+	}
+
+	if rec = refresh(http.MethodGet, "127.0.0.1:50000"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET refresh: status %d", rec.Code)
+	}
+}
+
+const libraryPage = `<ul>
+<li><a href="/library/qwen3" class="group w-full">
+  <div x-test-model-title title="qwen3"><h2>qwen3</h2>
+  <p class="max-w-lg break-words">Qwen3 is the latest generation of large language models &amp; more.</p></div>
+  <span x-test-capability class="text-indigo-600">tools</span>
+  <span x-test-capability class="text-indigo-600">thinking</span>
+  <span x-test-size class="text-blue-600">4b</span>
+  <span x-test-size class="text-blue-600">8b</span>
+  <span x-test-pull-count>4.1M</span>
+  <span x-test-updated>2 weeks ago</span>
+</a></li>
+<li><a href="/library/mistral" class="group w-full">
+  <p class="max-w-lg">The 7B model released by Mistral AI.</p>
+  <span x-test-size class="text-blue-600">7b</span>
+</a></li>
+</ul>`
+
+func TestModelCatalogFromOllamaLibrary(t *testing.T) {
+	online := true
+	library := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !online {
+			http.Error(w, "offline", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, libraryPage)
+	}))
+	defer library.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"models":[{"name":"qwen3:8b","details":{"parameter_size":"8.2B","quantization_level":"Q4_K_M"}}]}`)
+	}))
+	defer upstream.Close()
+	setupTestServer(t, upstream.URL)
+	config.DataDir = t.TempDir()
+	config.ModelCatalogURL = library.URL
+	fetchAndMergeModels()
+
+	catalog := modelCatalog.Get()
+	if catalog.Source != "library" || len(catalog.Models) != 2 {
+		t.Fatalf("catalog = %+v", catalog)
+	}
+	qwen := catalog.Models[0]
+	if qwen.Name != "qwen3" || qwen.Description != "Qwen3 is the latest generation of large language models & more." ||
+		strings.Join(qwen.Capabilities, ",") != "tools,thinking" || strings.Join(qwen.Sizes, ",") != "4b,8b" || qwen.Pulls != "4.1M" ||
+		qwen.Updated != time.Now().UTC().AddDate(0, 0, -14).Format("2006-01-02") {
+		t.Errorf("parsed %+v", qwen)
+	}
+	if m, ok := ModelDatabase.Get("qwen3:8b"); !ok || !m.Installed || !strings.Contains(strings.Join(m.Tasks, ","), "reasoning") {
+		t.Errorf("installed qwen3:8b = %+v", m)
+	}
+	if m, ok := ModelDatabase.Get("qwen3:4b"); !ok || m.Installed || m.HardwareReq.MinVRAM_GB == 0 {
+		t.Errorf("catalog qwen3:4b = %+v", m)
+	}
+	if _, ok := ModelDatabase.Get("gemma:2b"); ok {
+		t.Error("built-in catalog used although the library answered")
+	}
+
+	// Offline after a restart: the saved catalog is used
+	online = false
+	modelCatalog = &CatalogStore{}
+	if catalog := modelCatalog.Refresh(http.DefaultClient); catalog.Source != "cache" || len(catalog.Models) != 2 {
+		t.Errorf("offline catalog = %+v", catalog)
+	}
+
+	// Offline with nothing saved: the built-in list
+	config.DataDir = ""
+	modelCatalog = &CatalogStore{}
+	if catalog := modelCatalog.Refresh(http.DefaultClient); catalog.Source != "builtin" || len(catalog.Models) == 0 {
+		t.Errorf("fallback catalog = %+v", catalog)
+	}
+}
+
+func TestRecommendationFitScoring(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	hw := CurrentHardwareSpecs{VRAM_GB: 24, RAM_GB: 64}
+	coder := RecommendedModel{Name: "coder", Score: 8, Tasks: []string{"chat", "code"}, HardwareReq: HardwareSpecs{MinVRAM_GB: 6, MinRAM_GB: 8}, Updated: "2024-11-01"}
+	generalist := RecommendedModel{Name: "generalist", Score: 8, Tasks: []string{"chat", "code", "vision", "reasoning"}, HardwareReq: HardwareSpecs{MinVRAM_GB: 6, MinRAM_GB: 8}, Updated: "2024-11-01"}
+	huge := RecommendedModel{Name: "huge", Score: 8, Tasks: []string{"chat", "code"}, HardwareReq: HardwareSpecs{MinVRAM_GB: 23, MinRAM_GB: 32}, Updated: "2024-11-01"}
+	old := coder
+	old.Updated = "2021-01-01"
+
+	score := func(m RecommendedModel) int {
+		fit, ok := scoreFit(m, hw, "code", now)
+		if !ok {
+			t.Fatalf("%s doesn't match code", m.Name)
+		}
+		return fit.Score()
+	}
+	if score(coder) <= score(generalist) {
+		t.Error("specialist doesn't rank above a model with other specialties")
+	}
+	if score(coder) <= score(huge) {
+		t.Error("model with headroom doesn't rank above one that just fits")
+	}
+	if score(coder) <= score(old) {
+		t.Error("recent model doesn't rank above an old one")
+	}
+	slow := coder
+	slow.Benchmark = &BenchmarkResult{TokensPerSecond: 3}
+	if score(coder) <= score(slow) {
+		t.Error("model measured as slow doesn't drop")
+	}
+	if _, ok := scoreFit(coder, hw, "vision", now); ok {
+		t.Error("model matched a task it doesn't do")
+	}
+	fit, _ := scoreFit(huge, hw, "code", now)
+	if explanation := fit.Explain(); !strings.Contains(explanation, "1 GB VRAM to spare") || !strings.Contains(explanation, "made for code") {
+		t.Errorf("explanation = %q", explanation)
+	}
+}
+
+func TestRecommendationsTop(t *testing.T) {
+	setupTestServer(t, "http://127.0.0.1:0")
+	fetchAndMergeModels()
+
+	rec := httptest.NewRecorder()
+	handleRecommendations(rec, httptest.NewRequest(http.MethodGet, "/api/recommendations?vram=48&ram=128&top=3", nil))
+	var resp struct {
+		Recommendations []RecommendedModel `json:"recommendations"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Recommendations) != 3 {
+		t.Errorf("top=3 returned %d recommendations", len(resp.Recommendations))
+	}
+
+	rec = httptest.NewRecorder()
+	handleRecommendations(rec, httptest.NewRequest(http.MethodGet, "/api/recommendations?top=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("top=0: status %d", rec.Code)
+	}
+}
+
+func TestRecommendationFilters(t *testing.T) {
+	setupTestServer(t, "http://127.0.0.1:0")
+	fetchAndMergeModels()
+
+	recommend := func(query string) map[string]RecommendedModel {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleRecommendations(rec, httptest.NewRequest(http.MethodGet, "/api/recommendations?vram=48&ram=128&"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", query, rec.Code, rec.Body)
+		}
+		var resp struct {
+			Recommendations []RecommendedModel `json:"recommendations"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		models := make(map[string]RecommendedModel)
+		for _, m := range resp.Recommendations {
+			models[m.Name] = m
+		}
+		return models
+	}
+
+	models := recommend("quantization=q8_0&max_download_gb=3")
+	if gemma, ok := models["gemma:2b"]; !ok || gemma.Quantization != "Q8_0" || gemma.SizeGB != 2 {
+		t.Errorf("gemma:2b at Q8_0 = %+v", gemma)
+	}
+	for name, m := range models {
+		if m.Quantization != "Q8_0" || m.SizeGB > 3 {
+			t.Errorf("%s doesn't meet the filter: %+v", name, m)
+		}
+	}
+
+	models = recommend("license=apache-2.0,mit")
+	if _, ok := models["mistral:7b"]; !ok {
+		t.Error("mistral:7b left out of apache-2.0 models")
+	}
+	if _, ok := models["gemma:2b"]; ok {
+		t.Error("gemma:2b listed under apache-2.0 or mit")
+	}
+
+	models = recommend("min_context=100000")
+	if qwen, ok := models["qwen2.5:7b"]; !ok || qwen.ContextLength != 128*1024 {
+		t.Errorf("qwen2.5:7b with 128K context = %+v", qwen)
+	}
+	if _, ok := models["mistral:7b"]; ok {
+		t.Error("model of unknown context length passed min_context")
+	}
+
+	for _, query := range []string{"quantization=q9", "max_download_gb=-1", "min_context=lots", "multilingual=maybe"} {
+		rec := httptest.NewRecorder()
+		handleRecommendations(rec, httptest.NewRequest(http.MethodGet, "/api/recommendations?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, rec.Code)
+		}
+	}
+}
+
+func TestRecommendationsForARequiredContext(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/show" {
+			fmt.Fprint(w, `{"details":{"family":"llama"},"model_info":{"general.architecture":"llama","llama.context_length":32768,
+				"llama.block_count":32,"llama.attention.head_count":32,"llama.attention.head_count_kv":8,"llama.embedding_length":4096}}`)
+			return
+		}
+		fmt.Fprint(w, `{"models":[{"name":"mistral:latest","size":4109865159,
+			"details":{"family":"llama","parameter_size":"7.2B","quantization_level":"Q4_K_M"}}]}`)
+	}))
+	defer upstream.Close()
+	setupTestServer(t, upstream.URL)
+	fetchAndMergeModels()
+
+	mistral, _ := ModelDatabase.Get("mistral")
+	if mistral.ContextLength != 32768 || mistral.KVCacheBytesPerToken != 32*8*256*2 {
+		t.Fatalf("mistral = %+v", mistral)
+	}
+
+	recommend := func(context int) map[string]RecommendedModel {
+		rec := httptest.NewRecorder()
+		handleRecommendations(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/recommendations?vram=12&ram=32&required_context=%d", context), nil))
+		var resp struct {
+			Recommendations []RecommendedModel `json:"recommendations"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		models := make(map[string]RecommendedModel)
+		for _, m := range resp.Recommendations {
+			models[m.Name] = m
+		}
+		return models
+	}
+	// 32K tokens of KV cache take 4 GB on top of the 6 GB the model needs
+	got := recommend(32768)
+	if got["mistral"].HardwareReq.MinVRAM_GB != 10 {
+		t.Errorf("required_context=32768: mistral = %+v", got["mistral"])
+	}
+	if _, ok := got["gemma:2b"]; ok {
+		t.Error("model of unknown context length recommended")
+	}
+	if got["qwen2.5:7b"].ContextLength != 128*1024 {
+		t.Errorf("catalog model with a 128K window left out: %+v", got)
+	}
+	if _, ok := recommend(65536)["mistral"]; ok {
+		t.Error("required_context=65536 recommends a 32K model")
+	}
+}
+
+func TestHardwareProfilesPlaceModels(t *testing.T) {
+	big := RecommendedModel{Name: "big", Score: 8, HardwareReq: HardwareSpecs{MinVRAM_GB: 30, MinRAM_GB: 32}}
+	hardware := func(query string) CurrentHardwareSpecs {
+		t.Helper()
+		q, _ := url.ParseQuery(query)
+		hw, _, _, err := requestedHardware(q)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return hw
+	}
+
+	twoGPUs := hardware("gpus=24,24&ram=64")
+	if p, ok := placeModel(big, twoGPUs); !ok || p.GPUShare != 1 || p.GPUCount != 2 || p.SpareGB != 17 {
+		t.Errorf("two 24 GB GPUs: %+v, %v", p, ok)
+	}
+	oneGPU := hardware("vram=24&ram=64")
+	p, ok := placeModel(big, oneGPU)
+	if !ok || p.GPUShare != 0.8 {
+		t.Errorf("one 24 GB GPU should run 80%% of the layers: %+v, %v", p, ok)
+	}
+	if _, ok := placeModel(big, hardware("vram=12&ram=64")); ok {
+		t.Error("model with most of its layers on the CPU recommended")
+	}
+	mac := hardware("profile=unified&ram=64")
+	if mac.VRAM_GB != 48 {
+		t.Errorf("unified memory with 64 GB RAM: %+v", mac)
+	}
+	if _, ok := placeModel(big, mac); !ok {
+		t.Error("model doesn't fit in 48 GB of unified memory")
+	}
+	cpu := hardware("profile=cpu&ram=32")
+	if p, ok := placeModel(big, cpu); !ok || p.GPUShare != 0 || cpu.VRAM_GB != 0 {
+		t.Errorf("CPU only with 32 GB RAM: %+v, %v", p, ok)
+	}
+
+	now := time.Now()
+	full, _ := scoreFit(big, twoGPUs, "", now)
+	offloaded, _ := scoreFit(big, oneGPU, "", now)
+	if offloaded.Speed >= full.Speed || !strings.Contains(offloaded.Explain(), "80% of layers on the GPU") || !strings.Contains(full.Explain(), "split across 2 GPUs") {
+		t.Errorf("offloaded: %q, on two GPUs: %q", offloaded.Explain(), full.Explain())
+	}
+
+	for _, query := range []string{"profile=tpu", "gpus=24,lots"} {
+		q, _ := url.ParseQuery(query)
+		if _, _, _, err := requestedHardware(q); err == nil {
+			t.Errorf("%s accepted", query)
+		}
+	}
+}
+
+func TestRecommendationsAreCachedAndPaged(t *testing.T) {
+	setupTestServer(t, "http://127.0.0.1:0")
+	config.RecommendationCacheSeconds = 60
+	fetchAndMergeModels()
+
+	type response struct {
+		Recommendations []RecommendedModel `json:"recommendations"`
+		Total           int                `json:"total"`
+	}
+	get := func(query string) (response, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleRecommendations(rec, httptest.NewRequest(http.MethodGet, "/api/recommendations?vram=48&ram=128&"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", query, rec.Code)
+		}
+		var resp response
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp, rec.Header().Get("X-Cache")
+	}
+
+	all, cache := get("")
+	if cache != "miss" || all.Total < 10 || len(all.Recommendations) != all.Total {
+		t.Fatalf("first request: cache %q, %d of %d", cache, len(all.Recommendations), all.Total)
+	}
+	page, cache := get("offset=2&limit=3")
+	if cache != "hit" || page.Total != all.Total || len(page.Recommendations) != 3 || page.Recommendations[0].Name != all.Recommendations[2].Name {
+		t.Errorf("second page: cache %q, %+v", cache, page)
+	}
+	byName, _ := get("sort=name")
+	for i := 1; i < len(byName.Recommendations); i++ {
+		if byName.Recommendations[i-1].Name > byName.Recommendations[i].Name {
+			t.Fatalf("sort=name: %s before %s", byName.Recommendations[i-1].Name, byName.Recommendations[i].Name)
+		}
+	}
+	if again, _ := get(""); again.Recommendations[0].Name != all.Recommendations[0].Name {
+		t.Error("sorting changed the cached order")
+	}
+	if past, _ := get("offset=1000"); len(past.Recommendations) != 0 {
+		t.Errorf("offset past the end: %d recommendations", len(past.Recommendations))
+	}
+
+	saveBenchmark(BenchmarkResult{Model: "gemma:2b", TokensPerSecond: 40})
+	if _, cache := get(""); cache != "miss" {
+		t.Error("cache not cleared by a new benchmark")
+	}
+
+	for _, query := range []string{"sort=popularity", "offset=-1", "limit=0"} {
+		rec := httptest.NewRecorder()
+		handleRecommendations(rec, httptest.NewRequest(http.MethodGet, "/api/recommendations?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, rec.Code)
+		}
+	}
+}
+
+func TestRecommendationsShowWhatIsInstalledNow(t *testing.T) {
+	var mu sync.Mutex
+	tags := `{"models":[{"name":"mistral:latest","size":4109865159,"details":{"parameter_size":"7.2B","quantization_level":"Q4_K_M"}}]}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, tags)
+	}))
+	defer upstream.Close()
+	setupTestServer(t, upstream.URL)
+	fetchAndMergeModels()
+
+	// Since the database was built, gemma:2b was pulled and mistral deleted
+	mu.Lock()
+	tags = `{"models":[{"name":"gemma:2b","size":1678447520,"details":{"parameter_size":"3B","quantization_level":"Q4_0"}}]}`
+	mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	handleRecommendations(rec, httptest.NewRequest(http.MethodGet, "/api/recommendations?vram=48&ram=128", nil))
+	var resp struct {
+		Recommendations []RecommendedModel `json:"recommendations"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	models := make(map[string]RecommendedModel)
+	for _, m := range resp.Recommendations {
+		models[m.Name] = m
+	}
+	if gemma := models["gemma:2b"]; !gemma.Installed || gemma.PullCommand != "" || gemma.DownloadGB != 0 {
+		t.Errorf("pulled model = %+v", gemma)
+	}
+	if mistral := models["mistral"]; mistral.Installed || mistral.PullCommand != "ollama pull mistral" || mistral.DownloadGB != 3.8 {
+		t.Errorf("deleted model = %+v", mistral)
+	}
+	if db, _ := ModelDatabase.Get("mistral"); !db.Installed {
+		t.Error("request changed the model database")
+	}
+}
+
+func TestRecommendCommandPrintsATable(t *testing.T) {
+	setupTestServer(t, "http://127.0.0.1:0")
+	fetchAndMergeModels()
+
+	response, _, err := recommendationResponse(context.Background(), url.Values{"vram": {"48"}, "ram": {"128"}, "limit": {"2"}, "sort": {"name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	printRecommendations(&out, response)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	models := response["recommendations"].([]RecommendedModel)
+	if len(lines) != 7 || !strings.HasPrefix(lines[0], "Hardware: 48 GB (Manual Input) VRAM, 128 GB (Manual Input) RAM") ||
+		!strings.HasPrefix(lines[2], "MODEL") || !strings.HasPrefix(lines[3], models[0].Name+" ") || !strings.Contains(lines[3], models[0].PullCommand) ||
+		lines[6] != fmt.Sprintf("2 of %d models shown.", response["total"]) {
+		t.Errorf("table:\n%s", out.String())
+	}
+
+	if _, _, err := recommendationResponse(context.Background(), url.Values{"profile": {"tpu"}}); err == nil {
+		t.Error("accepted an unknown profile")
+	}
+}
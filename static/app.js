@@ -21,24 +21,91 @@ const elements = {
     chatSection: document.getElementById('chat-section'),
     modelMgmtSection: document.getElementById('model-management-section'),
     settingsContainer: document.getElementById('advanced-settings-container'),
-    modelSelectContainer: document.getElementById('common-model-select-container')
+    modelSelectContainer: document.getElementById('common-model-select-container'),
+    promptSelectContainer: document.getElementById('prompt-select-container'),
+    promptSelect: document.getElementById('prompt-select'),
+    promptVariables: document.getElementById('prompt-variables')
 };
 
 let currentReader = null;
+let currentRequestId = null;
 let chatMessages = [];
 
 // --- Dark Mode ---
-if (localStorage.getItem('darkMode') === 'true') {
-    document.body.classList.add('dark-mode');
-    document.body.classList.remove('light-mode');
-    elements.darkModeToggle.textContent = '☀️ Light Mode';
-}
-elements.darkModeToggle.addEventListener('click', () => {
-    document.body.classList.toggle('dark-mode');
-    document.body.classList.toggle('light-mode');
-    const isDark = document.body.classList.contains('dark-mode');
+function setDarkMode(isDark) {
+    document.body.classList.toggle('dark-mode', isDark);
+    document.body.classList.toggle('light-mode', !isDark);
     elements.darkModeToggle.textContent = isDark ? '☀️ Light Mode' : '🌙 Dark Mode';
     localStorage.setItem('darkMode', isDark);
+}
+// The last theme used here applies until the saved preferences arrive, so the page doesn't flash
+if (localStorage.getItem('darkMode') === 'true') setDarkMode(true);
+elements.darkModeToggle.addEventListener('click', () => {
+    preferences.theme = document.body.classList.contains('dark-mode') ? 'light' : 'dark';
+    applyPreferences();
+    savePreferences();
+});
+
+// --- Preferences (kept on the server, per client) ---
+const systemDark = window.matchMedia('(prefers-color-scheme: dark)');
+let preferences = { theme: 'system', font_size: 16, default_panel: 'generate', send_on_enter: false };
+
+function applyPreferences() {
+    setDarkMode(preferences.theme === 'dark' || (preferences.theme === 'system' && systemDark.matches));
+    document.documentElement.style.fontSize = `${preferences.font_size}px`;
+    document.getElementById('pref-theme').value = preferences.theme;
+    document.getElementById('pref-font-size').value = preferences.font_size;
+    document.getElementById('pref-default-panel').value = preferences.default_panel;
+    document.getElementById('pref-send-on-enter').checked = preferences.send_on_enter;
+}
+
+async function savePreferences() {
+    try {
+        const res = await fetch('api/preferences', {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(preferences)
+        });
+        if (!res.ok) throw new Error(await res.text());
+        preferences = await res.json();
+    } catch (e) {
+        console.error('Could not save preferences', e);
+    }
+}
+
+async function loadPreferences() {
+    try {
+        const res = await fetch('api/preferences');
+        if (!res.ok) return;
+        preferences = await res.json();
+        applyPreferences();
+        elements.apiTypeSelect.value = preferences.default_panel;
+        elements.apiTypeSelect.dispatchEvent(new Event('change'));
+    } catch (e) {
+        console.error('Could not load preferences', e);
+    }
+}
+
+systemDark.addEventListener('change', () => { if (preferences.theme === 'system') applyPreferences(); });
+document.getElementById('pref-theme').addEventListener('change', (e) => {
+    preferences.theme = e.target.value;
+    applyPreferences();
+    savePreferences();
+});
+document.getElementById('pref-font-size').addEventListener('change', (e) => {
+    const size = parseInt(e.target.value, 10);
+    if (size < 12 || size > 24) return applyPreferences();
+    preferences.font_size = size;
+    applyPreferences();
+    savePreferences();
+});
+document.getElementById('pref-default-panel').addEventListener('change', (e) => {
+    preferences.default_panel = e.target.value;
+    savePreferences();
+});
+document.getElementById('pref-send-on-enter').addEventListener('change', (e) => {
+    preferences.send_on_enter = e.target.checked;
+    savePreferences();
 });
 
 // --- Tabs / Navigation ---
@@ -53,10 +120,12 @@ elements.apiTypeSelect.addEventListener('change', (e) => {
         elements.modelMgmtSection.classList.remove('hidden');
         elements.settingsContainer.classList.add('hidden');
         elements.modelSelectContainer.classList.add('hidden');
+        elements.promptSelectContainer.classList.add('hidden');
         elements.unifiedResponseOutput.classList.add('hidden');
     } else {
         elements.settingsContainer.classList.remove('hidden');
         elements.modelSelectContainer.classList.remove('hidden');
+        elements.promptSelectContainer.classList.remove('hidden');
         elements.unifiedResponseOutput.classList.remove('hidden');
         if(val === 'generate') elements.generateSection.classList.remove('hidden');
         if(val === 'chat') elements.chatSection.classList.remove('hidden');
@@ -64,16 +133,25 @@ elements.apiTypeSelect.addEventListener('change', (e) => {
 });
 
 // --- API Interaction Helper ---
-async function streamResponse(endpoint, payload, onChunk, onDone) {
+// Ollama failures arrive as {"error", "code", "hint"}; show the hint under the message
+function upstreamError(body) {
+    return new Error(body.hint ? `${body.error}\n${body.hint}` : body.error);
+}
+
+async function responseError(res) {
+    const text = await res.text();
     try {
-        const response = await fetch(endpoint, {
-            method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify(payload)
-        });
+        const body = JSON.parse(text);
+        if (body.error) return upstreamError(body);
+    } catch (e) { /* plain text error */ }
+    return new Error(text);
+}
 
-        if (!response.ok) throw new Error(await response.text());
+async function streamResponse(endpoint, payload, onChunk, onDone) {
+    let lastEventId = '';
+    let queued = false;
 
+    const readEvents = async (response) => {
         const reader = response.body.getReader();
         currentReader = reader;
         const decoder = new TextDecoder();
@@ -87,19 +165,79 @@ async function streamResponse(endpoint, payload, onChunk, onDone) {
             buffer = lines.pop();
 
             for (const line of lines) {
+                if (line.startsWith('id: ')) {
+                    lastEventId = line.slice(4);
+                    continue;
+                }
                 if (line.startsWith('data: ')) {
                     const data = line.slice(6);
                     if (data === '[DONE]') break;
+                    let chunk;
                     try {
-                        onChunk(JSON.parse(data));
-                    } catch (e) { console.error('Parse error', e); }
+                        chunk = JSON.parse(data);
+                    } catch (e) { console.error('Parse error', e); continue; }
+
+                    // Server-side events: queue position while waiting, errors after the stream started
+                    if (chunk.queue_position) {
+                        elements.loadingIndicator.textContent = `Queued (position ${chunk.queue_position})...`;
+                        queued = true;
+                        continue;
+                    }
+                    if (chunk.error) throw upstreamError(chunk);
+                    if (chunk.task && chunk.temperature !== undefined) {
+                        elements.loadingIndicator.textContent = `Generating (${chunk.task}, temperature ${chunk.temperature})...`;
+                        continue;
+                    }
+                    if (chunk.resets_at && chunk.limit) {
+                        elements.loadingIndicator.textContent = chunk.exceeded
+                            ? `Today's token quota is used up (${chunk.used} of ${chunk.limit} tokens)...`
+                            : `Generating (${chunk.percent}% of today's token quota used)...`;
+                        continue;
+                    }
+                    if (chunk.category && chunk.classifier) {
+                        elements.loadingIndicator.textContent = `Generating with ${chunk.model} (${chunk.category})...`;
+                        continue;
+                    }
+                    if (chunk.candidate) {
+                        elements.loadingIndicator.textContent = `Candidate ${chunk.candidate} written...`;
+                    }
+
+                    if (queued) {
+                        elements.loadingIndicator.textContent = 'Generating...';
+                        queued = false;
+                    }
+                    onChunk(chunk);
                 }
             }
         }
+    };
+
+    try {
+        const response = await fetch(endpoint, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(payload)
+        });
+
+        if (!response.ok) throw await responseError(response);
+        currentRequestId = response.headers.get('X-Request-ID');
+
+        try {
+            await readEvents(response);
+        } catch (err) {
+            // The connection dropped (e.g. the device slept): pick the generation up where it stopped
+            if (!(err instanceof TypeError) || !lastEventId) throw err;
+            const resumed = await fetch(`api/streams/${encodeURIComponent(currentRequestId)}`, {
+                headers: { 'Last-Event-ID': lastEventId }
+            });
+            if (!resumed.ok) throw await responseError(resumed);
+            await readEvents(resumed);
+        }
     } catch (err) {
         if (err.name !== 'AbortError') alert("Error: " + err.message);
     } finally {
         currentReader = null;
+        currentRequestId = null;
         onDone();
     }
 }
@@ -107,18 +245,27 @@ async function streamResponse(endpoint, payload, onChunk, onDone) {
 // --- Logic: Generate ---
 elements.generateButton.addEventListener('click', async () => {
     const prompt = elements.promptInput.value.trim();
-    if (!prompt) return alert('Enter a prompt');
+    const longform = document.getElementById('longform-checkbox').checked;
+    const images = longform ? [] : await readBase64(document.getElementById('prompt-images').files);
+    if (!prompt && !images.length) return alert('Enter a prompt');
     
     toggleLoading(true, elements.generateButton, elements.stopGenerateButton);
     elements.responseOutput.textContent = '';
     let fullText = '';
 
-    await streamResponse('/api/ollama-action', {
-        actionType: 'generate',
+    await streamResponse('api/ollama-action', {
+        actionType: longform ? 'longform' : 'generate',
         model: elements.modelSelect.value,
         prompt: prompt,
-        options: getSettings()
+        ...(images.length ? { images } : {}),
+        options: getSettings(),
+        ...getGenerationFields(),
+        ...(longform ? {} : getPromptFields())
     }, (chunk) => {
+        // Long document mode announces each section before writing it
+        if (chunk.index && chunk.total) {
+            elements.loadingIndicator.textContent = `Writing section ${chunk.index}/${chunk.total}: ${chunk.title}...`;
+        }
         if (chunk.response) {
             fullText += chunk.response;
             elements.responseOutput.innerHTML = marked.parse(fullText);
@@ -127,48 +274,220 @@ elements.generateButton.addEventListener('click', async () => {
 });
 
 // --- Logic: Chat ---
+elements.chatInput.addEventListener('keydown', (e) => {
+    if (preferences.send_on_enter && e.key === 'Enter' && !e.shiftKey && !e.isComposing) {
+        e.preventDefault();
+        elements.sendChatButton.click();
+    }
+});
+
 elements.sendChatButton.addEventListener('click', async () => {
     const text = elements.chatInput.value.trim();
-    if (!text) return;
+    const imageInput = document.getElementById('chat-images');
+    const images = await readBase64(imageInput.files);
+    if (!text && !images.length) return;
+    if (images.length && getRoundTable()) return alert('Images cannot be sent to the round table');
+    const userMessage = {role: 'user', content: text, ...(images.length ? {images} : {})};
 
     // UI Update
-    addMessage('user', text);
+    addMessage('user', text, images);
     elements.chatInput.value = '';
+    imageInput.value = '';
     toggleLoading(true, elements.sendChatButton, elements.stopChatButton);
 
-    // Build History
-    const msgs = chatMessages.map(m => ({role: m.role, content: m.content}));
-    msgs.push({ role: 'user', content: text });
+    // Build History; round-table replies keep the name of the participant who wrote them, and
+    // images stay with the message they were attached to so the model sees them on later turns
+    const msgs = chatMessages.map(m => ({role: m.role, content: m.content, ...(m.name ? {name: m.name} : {}), ...(m.images ? {images: m.images} : {})}));
+    msgs.push(userMessage);
     
     // Check for System Prompt
     const sysPrompt = document.getElementById('system-prompt-input').value.trim();
     if(sysPrompt && msgs.length === 1) msgs.unshift({ role: 'system', content: sysPrompt });
 
     let botResponse = '';
-    const botMsgDiv = addMessage('assistant', '...'); // Placeholder
+    let sources = [];
+    let commandRan = false;
+    let variants = [];
+    let botMsgDiv = addMessage('assistant', '...'); // Placeholder
+    const webSearch = document.getElementById('web-search-checkbox').checked;
+    const privateChat = document.getElementById('private-checkbox').checked;
+
+    // Round table: each participant's turn becomes its own message
+    const roundTable = getRoundTable();
+    let speaker = null;
+    const turns = [];
 
-    await streamResponse('/api/ollama-action', {
+    const payload = roundTable ? {
+        actionType: 'roundtable',
+        model: elements.modelSelect.value,
+        messages: msgs,
+        ...(privateChat ? { private: true } : {}),
+        ...roundTable
+    } : {
         actionType: 'chat',
         model: elements.modelSelect.value,
-        messages: msgs
-    }, (chunk) => {
+        messages: msgs,
+        ...(webSearch ? { enable_web_search: true } : {}),
+        ...(privateChat ? { private: true } : {}),
+        ...(chatFiles.length ? { files: chatFileFields() } : {}),
+        ...getGenerationFields(),
+        ...getPromptFields()
+    };
+
+    await streamResponse('api/ollama-action', payload, (chunk) => {
+        if (chunk.participant) {
+            if (speaker) {
+                turns.push({role: 'assistant', name: speaker, content: botResponse});
+                botMsgDiv = addMessage('assistant', '...');
+            }
+            speaker = chunk.participant;
+            botResponse = '';
+            elements.loadingIndicator.textContent = `${speaker} (${chunk.model}) is answering, round ${chunk.round}...`;
+            return;
+        }
+        // Slash commands (/model, /clear-context, ...) report what they changed
+        if (chunk.command) {
+            commandRan = true;
+            if (chunk.model) {
+                if (![...elements.modelSelect.options].some(o => o.value === chunk.model)) {
+                    elements.modelSelect.add(new Option(chunk.model, chunk.model));
+                }
+                elements.modelSelect.value = chunk.model;
+            }
+            if (chunk.clear_context) chatMessages = [];
+            if (chunk.message) botMsgDiv.textContent = chunk.message;
+            return;
+        }
+        // Best-of-N: every candidate is kept as a variant of the reply
+        if (chunk.candidate) {
+            if (!chunk.error) variants[chunk.candidate - 1] = chunk.content;
+            return;
+        }
+        // Which attached files the model got
+        if (chunk.included) {
+            renderChatFiles(chunk.skipped);
+            return;
+        }
+        // What the attached recordings say
+        if (chunk.transcripts) {
+            renderTranscripts(chunk.transcripts);
+            return;
+        }
+        // Web search results the answer cites as [1], [2], ...
+        if (chunk.sources) {
+            sources = chunk.sources;
+            return;
+        }
+        // Context usage event, sent before the reply streams
+        if (chunk.num_ctx) {
+            let usage = `Context: ~${chunk.prompt_tokens} / ${chunk.num_ctx} tokens`;
+            if (chunk.summarized_messages) usage += `, ${chunk.summarized_messages} older messages summarized`;
+            if (chunk.trimmed_messages) usage += ` (${chunk.trimmed_messages} oldest messages not sent)`;
+            document.getElementById('context-usage').textContent = usage;
+            return;
+        }
         if (chunk.message && chunk.message.content) {
             botResponse += chunk.message.content;
-            botMsgDiv.innerHTML = marked.parse(botResponse);
+            botMsgDiv.innerHTML = marked.parse((speaker ? `**${speaker}:** ` : '') + botResponse + formatSources(sources));
             // Auto scroll
             elements.chatHistoryOutput.scrollTop = elements.chatHistoryOutput.scrollHeight;
         }
     }, () => {
-        chatMessages.push({role: 'user', content: text});
-        chatMessages.push({role: 'assistant', content: botResponse});
+        // A command that didn't ask the model anything isn't part of the conversation
+        if (speaker) {
+            turns.push({role: 'assistant', name: speaker, content: botResponse});
+            chatMessages.push(userMessage, ...turns);
+        } else if (!commandRan || botResponse) {
+            chatMessages.push(userMessage);
+            const reply = {role: 'assistant', content: botResponse};
+            variants = variants.filter(v => v !== undefined);
+            if (variants.length > 1) {
+                reply.variants = variants;
+                reply.selected = Math.max(0, variants.indexOf(botResponse));
+                addVariantSwitcher(botMsgDiv, reply, sources);
+            }
+            chatMessages.push(reply);
+        }
         toggleLoading(false, elements.sendChatButton, elements.stopChatButton);
     });
 });
 
+// ◀ n/N ▶ below a best-of-N reply; the variant shown is the one sent as history from then on
+function addVariantSwitcher(div, reply, sources) {
+    const bar = document.createElement('div');
+    bar.className = 'flex gap-2 items-center text-sm';
+    const label = document.createElement('span');
+    const show = (i) => {
+        reply.selected = (i + reply.variants.length) % reply.variants.length;
+        reply.content = reply.variants[reply.selected];
+        div.innerHTML = marked.parse(reply.content + formatSources(sources));
+        label.textContent = `${reply.selected + 1}/${reply.variants.length}`;
+        div.appendChild(bar);
+    };
+    [['◀', -1], ['▶', 1]].forEach(([text, step]) => {
+        const btn = document.createElement('button');
+        btn.className = 'btn btn-sm btn-secondary';
+        btn.textContent = text;
+        btn.addEventListener('click', () => show(reply.selected + step));
+        bar.appendChild(btn);
+    });
+    bar.insertBefore(label, bar.lastChild);
+    show(reply.selected);
+}
+
+// --- Logic: Round Table ---
+function addParticipant() {
+    const row = document.createElement('div');
+    row.className = 'flex gap-2 items-center mt-1 roundtable-participant';
+    const model = document.createElement('select');
+    model.className = 'form-control';
+    [...elements.modelSelect.options].forEach(o => model.add(new Option(o.text, o.value)));
+    model.value = elements.modelSelect.value;
+    const name = document.createElement('input');
+    name.className = 'form-control';
+    name.placeholder = 'Name (optional)';
+    const persona = document.createElement('input');
+    persona.className = 'form-control';
+    persona.placeholder = 'Persona, e.g. "You are a cautious security reviewer."';
+    const remove = document.createElement('button');
+    remove.className = 'btn btn-sm btn-secondary';
+    remove.textContent = '✕';
+    remove.addEventListener('click', () => row.remove());
+    row.append(model, name, persona, remove);
+    document.getElementById('roundtable-participants').appendChild(row);
+}
+
+document.getElementById('add-participant-button').addEventListener('click', addParticipant);
+
+// The roundtable fields, or null when the round table isn't in use
+function getRoundTable() {
+    if (!document.getElementById('roundtable-checkbox').checked) return null;
+    const participants = [...document.querySelectorAll('.roundtable-participant')].map(row => {
+        const [model, name, persona] = row.querySelectorAll('select, input');
+        return {
+            model: model.value,
+            ...(name.value.trim() ? { name: name.value.trim() } : {}),
+            ...(persona.value.trim() ? { persona: persona.value.trim() } : {})
+        };
+    });
+    if (participants.length < 2) return null;
+    const { keep_alive } = getGenerationFields(); // The other generation settings don't apply to a round table
+    return {
+        participants,
+        rounds: parseInt(document.getElementById('roundtable-rounds').value) || 1,
+        ...(keep_alive !== undefined ? { keep_alive } : {})
+    };
+}
+
+function formatSources(sources) {
+    if (!sources.length) return '';
+    return '\n\n---\n' + sources.map((s, i) => `${i + 1}. [${s.title}](${s.url})`).join('\n');
+}
+
 // --- Logic: Model Management ---
 async function loadModels() {
     try {
-        const res = await fetch('/api/models');
+        const res = await fetch('api/models');
         const data = await res.json();
         elements.modelSelect.innerHTML = '';
         elements.modelActionSelect.innerHTML = '';
@@ -181,22 +500,257 @@ async function loadModels() {
                 elements.modelActionSelect.add(opt2);
             });
         }
+        // Let the server pick an installed model for each message
+        elements.modelSelect.add(new Option('auto (best model per message)', 'auto'));
+        const defaultModel = res.headers.get('X-Default-Model');
+        if (defaultModel && [...elements.modelSelect.options].some(o => o.value === defaultModel)) {
+            elements.modelSelect.value = defaultModel;
+        }
     } catch(e) { console.error("Could not load models", e); }
 }
 
 document.getElementById('refresh-models-button').addEventListener('click', loadModels);
 
+document.getElementById('model-details-button').addEventListener('click', async () => {
+    const name = elements.modelActionSelect.value;
+    if (!name) return;
+    elements.modelActionOutput.textContent = `Loading details for ${name}...`;
+    try {
+        const res = await fetch(`api/models/${encodeURIComponent(name).replace(/%2F/g, '/')}`);
+        if (!res.ok) throw await responseError(res);
+        const d = await res.json();
+        elements.modelActionOutput.textContent = [
+            `${d.name} (${d.family}, ${d.format})`,
+            `Parameters: ${d.parameter_size}${d.parameter_count ? ` (${d.parameter_count.toLocaleString()})` : ''}`,
+            `Quantization: ${d.quantization_level}`,
+            `Context length: ${d.context_length ? d.context_length.toLocaleString() + ' tokens' : 'unknown'}`,
+            d.capabilities ? `Capabilities: ${d.capabilities.join(', ')}` : '',
+            d.parameters ? `\nParameters:\n${d.parameters}` : '',
+            `\nTemplate:\n${d.template}`
+        ].filter(Boolean).join('\n');
+    } catch(e) {
+        elements.modelActionOutput.textContent = "Error: " + e.message;
+    }
+});
+
+// --- Logic: Loaded Models ---
+function formatBytes(n) {
+    return n >= 1 << 30 ? `${(n / (1 << 30)).toFixed(1)} GB` : `${Math.round(n / (1 << 20))} MB`;
+}
+
+async function loadRunningModels() {
+    const container = document.getElementById('running-models');
+    try {
+        const res = await fetch('api/ps');
+        const data = await res.json();
+        container.innerHTML = '';
+
+        const host = data.host || {};
+        const memory = [];
+        if (host.total_bytes) memory.push(`RAM: ${formatBytes(host.total_bytes - host.available_bytes)} / ${formatBytes(host.total_bytes)} used`);
+        (host.gpus || []).forEach(g => memory.push(`${g.name}: ${formatBytes(g.used_bytes)} / ${formatBytes(g.total_bytes)} used`));
+        if (memory.length) {
+            const line = document.createElement('div');
+            line.textContent = memory.join(' · ');
+            container.appendChild(line);
+        }
+
+        if (!data.models.length) {
+            container.appendChild(document.createTextNode('No models loaded.'));
+            return;
+        }
+        data.models.forEach(m => {
+            const row = document.createElement('div');
+            row.className = 'flex gap-2 items-center mt-1';
+            const minutes = Math.max(0, Math.round((new Date(m.expires_at) - Date.now()) / 60000));
+            const label = document.createElement('span');
+            label.textContent = `${m.name} — ${formatBytes(m.size)} (${formatBytes(m.size_vram)} VRAM), unloads in ${minutes} min`;
+            const unload = document.createElement('button');
+            unload.className = 'btn btn-sm btn-secondary';
+            unload.textContent = 'Unload';
+            unload.addEventListener('click', async () => {
+                const res = await fetch('api/ollama-action', {
+                    method: 'POST',
+                    headers: adminHeaders({'Content-Type': 'application/json'}),
+                    body: JSON.stringify({ actionType: 'unload', model: m.name })
+                });
+                if (!res.ok) return alert(await res.text());
+                loadRunningModels();
+            });
+            row.append(label, unload);
+            container.appendChild(row);
+        });
+    } catch(e) {
+        container.textContent = "Could not load running models: " + e.message;
+    }
+}
+
+document.getElementById('refresh-running-button').addEventListener('click', loadRunningModels);
+
+// --- Logic: Recommendations ---
+async function showDetectedHardware() {
+    const el = document.getElementById('detected-hardware');
+    try {
+        const hw = await (await fetch('api/recommendations/hardware')).json();
+        const gpus = hw.gpus.length ? hw.gpus.map(g => `${g.name} (${g.vram_gb} GB)`).join(', ') : 'no GPU found';
+        el.textContent = `Detected: ${hw.ram_gb} GB RAM, ${gpus}${hw.profile ? ` (${hw.profile} profile)` : ''}.`;
+    } catch(e) {
+        el.textContent = 'Hardware detection unavailable.';
+    }
+}
+
+async function loadRecommendations() {
+    const container = document.getElementById('recommendations');
+    const taskSelect = document.getElementById('recommend-task-select');
+    const params = new URLSearchParams();
+    const vram = document.getElementById('recommend-vram-input').value;
+    const ram = document.getElementById('recommend-ram-input').value;
+    if (vram) params.append('vram', vram);
+    if (ram) params.append('ram', ram);
+    const profile = document.getElementById('recommend-profile-select').value;
+    if (profile) params.append('profile', profile);
+    if (taskSelect.value) params.append('task', taskSelect.value);
+    try {
+        const data = await (await fetch(`api/recommendations?${params}`)).json();
+        if (taskSelect.options.length === 1) data.tasks.forEach(t => taskSelect.add(new Option(t, t)));
+
+        container.innerHTML = '';
+        const summary = document.createElement('div');
+        const hw = data.current_hardware;
+        const gpus = hw.gpus && hw.gpus.length > 1 ? ` on ${hw.gpus.length} GPUs` : '';
+        summary.textContent = hw.profile === 'cpu'
+            ? `For ${hw.ram} RAM, CPU only:`
+            : `For ${hw.vram} VRAM${gpus} and ${hw.ram} RAM (${hw.profile === 'unified' ? 'unified memory' : 'dedicated GPU'}):`;
+        container.appendChild(summary);
+        if (!data.recommendations.length) {
+            container.appendChild(document.createTextNode('No models fit.'));
+            return;
+        }
+        data.recommendations.forEach(m => {
+            const row = document.createElement('div');
+            row.className = 'flex gap-2 items-center mt-1';
+            const label = document.createElement('span');
+            const quant = m.quantization ? ` ${m.quantization} (${m.parameter_size})` : '';
+            label.textContent = `${m.fit}/100 ${m.name}${quant} — needs ${m.hardware_req.min_vram_gb} GB VRAM / ${m.hardware_req.min_ram_gb} GB RAM. ${m.description}`;
+            label.title = m.explanation;
+            row.appendChild(label);
+            if (!m.installed) {
+                const pull = document.createElement('button');
+                pull.className = 'btn btn-sm btn-success';
+                pull.textContent = m.download_gb ? `Install (${m.download_gb} GB)` : 'Install';
+                pull.title = m.pull_command;
+                pull.addEventListener('click', () => {
+                    elements.modelActionOutput.textContent = `Starting pull of ${m.name}...`;
+                    followProgress(fetch(`api/recommendations/pull?model=${encodeURIComponent(m.name)}`, { method: 'POST', headers: adminHeaders() }), 'pull');
+                });
+                row.appendChild(pull);
+            } else {
+                const use = document.createElement('button');
+                use.className = 'btn btn-sm btn-primary';
+                use.textContent = 'Use now';
+                use.addEventListener('click', () => {
+                    if (![...elements.modelSelect.options].some(o => o.value === m.name)) {
+                        elements.modelSelect.add(new Option(m.name, m.name));
+                    }
+                    elements.modelSelect.value = m.name;
+                });
+                row.appendChild(use);
+            }
+            container.appendChild(row);
+        });
+    } catch(e) {
+        container.textContent = "Could not load recommendations: " + e.message;
+    }
+}
+
+document.getElementById('recommend-button').addEventListener('click', loadRecommendations);
+
+// Runs a standard prompt on every installed model, one after another; this takes a while
+document.getElementById('benchmark-button').addEventListener('click', async (e) => {
+    e.target.disabled = true;
+    elements.modelActionOutput.textContent = 'Benchmarking installed models, one at a time...';
+    try {
+        const res = await fetch('api/recommendations/benchmark', { method: 'POST', headers: adminHeaders() });
+        if (!res.ok) throw new Error(await res.text());
+        const results = await res.json();
+        elements.modelActionOutput.textContent = results.map(r => r.error
+            ? `${r.model}: failed (${r.error})`
+            : `${r.model}: ${r.tokens_per_second} tok/s, loaded in ${r.load_seconds}s, ${r.peak_memory_gb} GB`).join('\n');
+        loadRecommendations();
+    } catch(err) {
+        elements.modelActionOutput.textContent = "Benchmark failed: " + err.message;
+    } finally {
+        e.target.disabled = false;
+    }
+});
+
+// --- Logic: Prompt Library ---
+let promptLibrary = {};
+
+async function loadPrompts() {
+    try {
+        const res = await fetch('api/prompts');
+        const list = await res.json();
+        promptLibrary = {};
+        elements.promptSelect.innerHTML = '<option value="">None</option>';
+        list.forEach(p => {
+            promptLibrary[p.id] = p;
+            elements.promptSelect.add(new Option(`${p.name} (${p.kind === 'system' ? 'persona' : 'template'})`, p.id));
+        });
+    } catch(e) { console.error("Could not load prompts", e); }
+}
+
+// One input per template variable; {{input}} is filled from the prompt/message itself
+elements.promptSelect.addEventListener('change', () => {
+    elements.promptVariables.innerHTML = '';
+    const p = promptLibrary[elements.promptSelect.value];
+    if (!p) return;
+    p.variables.filter(v => v !== 'input').forEach(v => {
+        const input = document.createElement('input');
+        input.type = 'text';
+        input.className = 'form-control mt-2';
+        input.placeholder = v;
+        input.dataset.variable = v;
+        elements.promptVariables.appendChild(input);
+    });
+});
+
+function getPromptFields() {
+    const promptId = elements.promptSelect.value;
+    if (!promptId) return {};
+    const variables = {};
+    elements.promptVariables.querySelectorAll('input').forEach(i => variables[i.dataset.variable] = i.value);
+    return { promptId, variables };
+}
+
 // --- Utilities ---
-function addMessage(role, text) {
+function addMessage(role, text, images = []) {
     const div = document.createElement('div');
     div.className = `chat-message ${role}`;
     div.innerHTML = role === 'user' ? text : marked.parse(text);
+    images.forEach(data => {
+        const img = document.createElement('img');
+        img.src = 'data:image;base64,' + data;
+        img.className = 'chat-image';
+        div.appendChild(img);
+    });
     elements.chatHistoryOutput.appendChild(div);
     return div;
 }
 
+// Reads files as base64 without the data: prefix, as Ollama and LAIM expect
+function readBase64(files) {
+    return Promise.all([...files].map(file => new Promise((resolve, reject) => {
+        const reader = new FileReader();
+        reader.onload = () => resolve(reader.result.split(',')[1]);
+        reader.onerror = () => reject(reader.error);
+        reader.readAsDataURL(file);
+    })));
+}
+
 function toggleLoading(isLoading, startBtn, stopBtn) {
     elements.loadingIndicator.style.display = isLoading ? 'block' : 'none';
+    elements.loadingIndicator.textContent = 'Generating...';
     if(isLoading) {
         startBtn.classList.add('hidden');
         stopBtn.classList.remove('hidden');
@@ -216,6 +770,19 @@ function getSettings() {
     };
 }
 
+// keep_alive, auto_temperature and best-of-N candidates for generate and chat
+function getGenerationFields() {
+    const value = document.getElementById('keep-alive-select').value;
+    const extra = value ? { keep_alive: JSON.parse(value) } : {};
+    if (document.getElementById('auto-temperature-checkbox').checked) extra.auto_temperature = true;
+    const candidates = document.getElementById('candidates-select').value;
+    if (candidates) {
+        extra.candidates = parseInt(candidates);
+        if (document.getElementById('judge-checkbox').checked) extra.pick = 'judge';
+    }
+    return extra;
+}
+
 // Sliders UI
 ['temperature', 'top-p', 'max-tokens'].forEach(id => {
     const slider = document.getElementById(`${id}-slider`);
@@ -226,18 +793,28 @@ function getSettings() {
 // Stop Buttons
 [elements.stopGenerateButton, elements.stopChatButton].forEach(btn => {
     btn.addEventListener('click', () => {
+        // Generations outlive dropped connections so they can be resumed; stop this one for good
+        if(currentRequestId) fetch(`api/streams/${encodeURIComponent(currentRequestId)}`, { method: 'DELETE' }).catch(() => {});
         if(currentReader) currentReader.cancel();
     });
 });
 
 // Init
-document.addEventListener('DOMContentLoaded', loadModels);
+document.addEventListener('DOMContentLoaded', () => {
+    loadPreferences();
+    loadModels();
+    loadPrompts();
+    resumePulls();
+    loadRunningModels();
+    showDetectedHardware();
+    loadRecommendations();
+});
 
 // Export Chat
 document.getElementById('export-chat-button').addEventListener('click', () => {
     if(chatMessages.length === 0) return alert("Empty chat");
     let md = `# Chat Export - ${new Date().toLocaleString()}\n\n`;
-    chatMessages.forEach(m => md += `### ${m.role.toUpperCase()}\n${m.content}\n\n`);
+    chatMessages.forEach(m => md += `### ${(m.name || m.role).toUpperCase()}\n${m.content}\n\n`);
     
     const blob = new Blob([md], {type: 'text/markdown'});
     const a = document.createElement('a');
@@ -250,30 +827,112 @@ document.getElementById('export-chat-button').addEventListener('click', () => {
 document.getElementById('clear-chat-button').addEventListener('click', () => {
     if(confirm("Clear history?")) {
         chatMessages = [];
+        chatFiles = [];
+        renderChatFiles();
         elements.chatHistoryOutput.innerHTML = '';
     }
 });
 
-// Hardcoded available models for the "Pull" dropdown
-const commonModels = ["llama2", "mistral", "codellama", "dolphin-phi", "neural-chat", "starling-lm", "orca-mini"];
+// Files attached to the chat are sent with every message until the chat is cleared
+let chatFiles = [];
+// Archives, Excel workbooks and recordings are sent base64-encoded, everything else as text
+const binaryFilePattern = /\.(zip|tar|tar\.gz|tgz|xlsx|mp3|wav|m4a|aac|ogg|oga|opus|flac|webm)$/i;
+
+document.getElementById('chat-files').addEventListener('change', async (e) => {
+    for (const file of e.target.files) {
+        chatFiles.push(binaryFilePattern.test(file.name)
+            ? {name: file.name, data: (await readBase64([file]))[0]}
+            : {name: file.name, content: await file.text()});
+    }
+    e.target.value = '';
+    renderChatFiles();
+});
+
+function chatFileFields() {
+    const include = document.getElementById('chat-files-include').value.split(',').map(s => s.trim()).filter(Boolean);
+    const lineNumbers = document.getElementById('chat-files-line-numbers').checked;
+    return chatFiles.map(f => ({...f, ...(f.data && !/\.xlsx$/i.test(f.name) && include.length ? {include} : {}), ...(lineNumbers ? {line_numbers: true} : {})}));
+}
+
+function renderChatFiles(skipped = []) {
+    const list = document.getElementById('chat-files-list');
+    list.textContent = chatFiles.length ? '📎 ' + chatFiles.map(f => f.name).join(', ') : '';
+    if (skipped && skipped.length) list.textContent += ` (left out, binary or too large: ${skipped.join(', ')})`;
+}
+
+function renderTranscripts(transcripts) {
+    const list = document.getElementById('chat-files-list');
+    for (const [name, text] of Object.entries(transcripts)) {
+        const details = document.createElement('details');
+        const summary = document.createElement('summary');
+        summary.textContent = `🎙️ Transcript of ${name}`;
+        details.append(summary, text);
+        list.appendChild(details);
+    }
+}
+
+// The "Pull" dropdown lists the Ollama library's models, most popular first
 const availSelect = document.getElementById('available-model-select');
-commonModels.forEach(m => availSelect.add(new Option(m, m)));
+const availDescription = document.getElementById('available-model-description');
+let catalogModels = [];
+
+async function loadCatalog() {
+    try {
+        const res = await fetch('api/recommendations/catalog');
+        if (!res.ok) throw await responseError(res);
+        catalogModels = (await res.json()).models || [];
+    } catch (e) {
+        console.error("Could not load the model catalog:", e);
+        return;
+    }
+    availSelect.innerHTML = '';
+    catalogModels.forEach(m => {
+        (m.sizes && m.sizes.length ? m.sizes.map(size => `${m.name}:${size}`) : [m.name])
+            .forEach(name => availSelect.add(new Option(name, name)));
+    });
+    showCatalogDescription();
+}
 
-document.getElementById('pull-available-model-button').addEventListener('click', () => performModelAction('pull', availSelect.value));
-document.getElementById('pull-manual-model-button').addEventListener('click', () => performModelAction('pull', document.getElementById('model-action-input').value));
+function showCatalogDescription() {
+    const entry = catalogModels.find(m => m.name === availSelect.value.split(':')[0]);
+    availDescription.textContent = entry ? entry.description + (entry.pulls ? ` (${entry.pulls} pulls)` : '') : '';
+    availDescription.classList.toggle('hidden', !availDescription.textContent);
+}
+
+availSelect.addEventListener('change', showCatalogDescription);
+loadCatalog();
+
+document.getElementById('pull-available-model-button').addEventListener('click', () => pullModel(availSelect.value));
+document.getElementById('pull-manual-model-button').addEventListener('click', () => pullModel(document.getElementById('model-action-input').value));
+
+function pullModel(name) {
+    if (!name) return alert("No model name specified");
+    streamProgress({ actionType: 'pull', model: name });
+}
 document.getElementById('delete-model-button').addEventListener('click', () => performModelAction('delete', document.getElementById('model-action-input').value || elements.modelActionSelect.value));
 
+// The admin token is only kept in the page, never stored
+function adminHeaders(headers = {}) {
+    const token = document.getElementById('admin-token-input').value;
+    return token ? {...headers, 'Authorization': `Bearer ${token}`} : headers;
+}
+
 async function performModelAction(type, name) {
     if(!name) return alert("No model name specified");
     if(type === 'delete' && !confirm(`Delete ${name}?`)) return;
 
     elements.modelActionOutput.textContent = `Processing ${type} for ${name}...`;
     try {
-        const res = await fetch('/api/ollama-action', {
+        const res = await fetch('api/ollama-action', {
             method: 'POST',
-            headers: {'Content-Type': 'application/json'},
+            headers: adminHeaders({'Content-Type': 'application/json'}),
             body: JSON.stringify({ actionType: type, model: name })
         });
+        // Deletions are staged first and can be undone until they run
+        if (res.status === 202) {
+            showUndo(await res.json());
+            return;
+        }
         const txt = await res.text();
         elements.modelActionOutput.textContent = txt;
         loadModels(); // Refresh list after action
@@ -281,3 +940,92 @@ async function performModelAction(type, name) {
         elements.modelActionOutput.textContent = "Error: " + e.message;
     }
 }
+
+// --- Logic: Create / Copy / Push ---
+// Streams progress lines ({status, total, completed}) of a long-running model operation
+async function streamProgress(payload) {
+    elements.modelActionOutput.textContent = `Starting ${payload.actionType}...`;
+    await followProgress(fetch('api/ollama-action', {
+        method: 'POST',
+        headers: adminHeaders({'Content-Type': 'application/json'}),
+        body: JSON.stringify(payload)
+    }), payload.actionType);
+}
+
+async function followProgress(request, label) {
+    try {
+        const res = await request;
+        if (!res.ok) throw await responseError(res);
+        if (!(res.headers.get('Content-Type') || '').includes('text/event-stream')) {
+            elements.modelActionOutput.textContent = `${label} done.`;
+            loadModels();
+            return;
+        }
+
+        const reader = res.body.getReader();
+        const decoder = new TextDecoder();
+        let buffer = '';
+        while (true) {
+            const { done, value } = await reader.read();
+            if (done) break;
+            buffer += decoder.decode(value, { stream: true });
+            const lines = buffer.split('\n');
+            buffer = lines.pop();
+            for (const line of lines) {
+                if (!line.startsWith('data: ')) continue;
+                const p = JSON.parse(line.slice(6));
+                if (p.error) throw upstreamError(p);
+                const pct = p.total ? ` ${Math.round(100 * (p.completed || 0) / p.total)}%` : '';
+                elements.modelActionOutput.textContent = `${p.model ? p.model + ': ' : ''}${p.status}${pct}`;
+            }
+        }
+        loadModels();
+    } catch(e) {
+        elements.modelActionOutput.textContent = "Error: " + e.message;
+    }
+}
+
+// Pulls keep running on the server across page reloads; pick up where we left off
+async function resumePulls() {
+    try {
+        const res = await fetch('api/pull/status');
+        const running = (await res.json()).filter(p => !p.done);
+        running.forEach(p => followProgress(fetch(`api/pull/status?model=${encodeURIComponent(p.model)}`), 'pull'));
+    } catch(e) { console.error("Could not check running pulls", e); }
+}
+
+document.getElementById('create-variant-button').addEventListener('click', () => {
+    const name = document.getElementById('variant-name-input').value.trim();
+    if (!name) return alert("Enter a name for the new model");
+    streamProgress({
+        actionType: 'create',
+        model: name,
+        from: elements.modelActionSelect.value,
+        system: document.getElementById('variant-system-input').value.trim(),
+        options: getSettings()
+    });
+});
+
+document.getElementById('copy-model-button').addEventListener('click', () => {
+    const name = document.getElementById('variant-name-input').value.trim();
+    if (!name) return alert("Enter a name for the copy");
+    streamProgress({ actionType: 'copy', model: elements.modelActionSelect.value, destination: name });
+});
+
+document.getElementById('push-model-button').addEventListener('click', () => {
+    streamProgress({ actionType: 'push', model: elements.modelActionSelect.value });
+});
+
+function showUndo(op) {
+    const seconds = Math.max(0, Math.round((new Date(op.expires_at) - Date.now()) / 1000));
+    elements.modelActionOutput.textContent = `Scheduled: ${op.description} in ${seconds}s. `;
+    const undo = document.createElement('button');
+    undo.className = 'btn btn-secondary';
+    undo.textContent = 'Undo';
+    undo.addEventListener('click', async () => {
+        const res = await fetch(`api/undo/${op.undo_token}`, { method: 'POST', headers: adminHeaders() });
+        elements.modelActionOutput.textContent = res.ok ? `Undone: ${op.description}` : await res.text();
+    });
+    elements.modelActionOutput.appendChild(undo);
+    setTimeout(loadModels, seconds * 1000 + 1000); // Refresh once the deletion has run
+}
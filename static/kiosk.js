@@ -0,0 +1,95 @@
+// Kiosk page: example chats and a prompt box for the kiosk's model. Replies are shown as
+// plain text, since visitors are anonymous.
+const chat = document.getElementById('kiosk-chat');
+const input = document.getElementById('kiosk-input');
+const sendButton = document.getElementById('kiosk-send');
+const status = document.getElementById('kiosk-status');
+let history = [];
+
+function addMessage(container, role, text) {
+    const div = document.createElement('div');
+    div.className = `chat-message ${role}`;
+    div.textContent = text;
+    container.appendChild(div);
+    return div;
+}
+
+async function loadKiosk() {
+    const kiosk = await (await fetch('api/kiosk')).json();
+    document.title = kiosk.title;
+    document.getElementById('kiosk-title').textContent = kiosk.title;
+    document.getElementById('kiosk-model').textContent = `Running ${kiosk.model} on this machine`;
+    input.maxLength = kiosk.max_prompt_chars;
+
+    const showcase = document.getElementById('kiosk-showcase');
+    (kiosk.showcase || []).forEach(example => {
+        const details = document.createElement('details');
+        const summary = document.createElement('summary');
+        summary.textContent = example.title;
+        details.appendChild(summary);
+        example.messages.filter(m => m.role !== 'system').forEach(m => addMessage(details, m.role, m.content));
+        showcase.appendChild(details);
+    });
+}
+
+async function ask() {
+    const text = input.value.trim();
+    if (!text) return;
+    input.value = '';
+    addMessage(chat, 'user', text);
+    const reply = addMessage(chat, 'assistant', '...');
+    sendButton.disabled = true;
+    status.textContent = 'Thinking...';
+
+    let answer = '';
+    try {
+        const res = await fetch('api/kiosk/chat', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({messages: [...history, {role: 'user', content: text}]})
+        });
+        if (!res.ok) throw new Error(await res.text());
+
+        const reader = res.body.getReader();
+        const decoder = new TextDecoder();
+        let buffer = '';
+        while (true) {
+            const { done, value } = await reader.read();
+            if (done) break;
+            buffer += decoder.decode(value, { stream: true });
+            const lines = buffer.split('\n');
+            buffer = lines.pop();
+            for (const line of lines) {
+                if (!line.startsWith('data: ') || line === 'data: [DONE]') continue;
+                const chunk = JSON.parse(line.slice(6));
+                if (chunk.error) throw new Error(chunk.error);
+                if (chunk.message && chunk.message.content) {
+                    answer += chunk.message.content;
+                    reply.textContent = answer;
+                }
+            }
+        }
+        history.push({role: 'user', content: text}, {role: 'assistant', content: answer});
+        status.textContent = '';
+    } catch (e) {
+        reply.remove();
+        status.textContent = e.message;
+    } finally {
+        sendButton.disabled = false;
+    }
+}
+
+sendButton.addEventListener('click', ask);
+input.addEventListener('keydown', e => {
+    if (e.key === 'Enter' && !e.shiftKey) {
+        e.preventDefault();
+        ask();
+    }
+});
+document.getElementById('kiosk-reset').addEventListener('click', () => {
+    history = [];
+    chat.innerHTML = '';
+    status.textContent = '';
+});
+
+loadKiosk();